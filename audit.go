@@ -0,0 +1,126 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// The verification results an AuditEntry can have.
+const (
+	AuditVerified   = "verified"
+	AuditRejected   = "rejected"
+	AuditUnverified = "unverified"
+	AuditFailed     = "failed"
+)
+
+// AuditEntry is one line of the audit log: what happened to one script.
+type AuditEntry struct {
+	Time   time.Time `json:"time"`
+	Source string    `json:"source"`
+	Author string    `json:"author,omitempty"`
+
+	// Signer is the fingerprint of the author's key the signature was
+	// checked against.
+	Signer string `json:"signer,omitempty"`
+
+	// Result is AuditVerified or AuditRejected once the signature has been
+	// checked, AuditUnverified with -no-verify, and AuditFailed when
+	// pipethis stopped before it got that far.
+	Result string `json:"result"`
+
+	// Reason is why pipethis stopped, if it did.
+	Reason string `json:"reason,omitempty"`
+
+	// Executed is set once the script has been handed to its interpreter
+	// (or hook, or STDOUT), even if it failed from there.
+	Executed bool `json:"executed"`
+}
+
+// AuditLog is an append-only file of AuditEntry records, one JSON object per
+// line.
+type AuditLog struct {
+	file *os.File
+}
+
+// OpenAuditLog opens the audit log at filename for appending, and creates it
+// (readable only by its owner) if it isn't there yet.
+func OpenAuditLog(filename string) (*AuditLog, error) {
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't open the audit log: %w", err)
+	}
+
+	return &AuditLog{file: file}, nil
+}
+
+// Record appends entry to the log, dated now if it isn't dated already, and
+// makes sure it's on disk before returning.
+func (a *AuditLog) Record(entry AuditEntry) error {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	// one write per line, so lines from pipethis runs sharing the log don't
+	// get mixed up
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("Couldn't write to the audit log: %w", err)
+	}
+
+	return a.file.Sync()
+}
+
+// Close closes the log file.
+func (a *AuditLog) Close() error {
+	return a.file.Close()
+}
+
+// auditResult is AuditVerified if the signature checked out, AuditRejected
+// otherwise.
+func auditResult(verified bool) string {
+	if verified {
+		return AuditVerified
+	}
+
+	return AuditRejected
+}
+
+// finish records entry when main is done with it, and has to be deferred with
+// the result of recover() as panicked. A panic means pipethis stopped early:
+// the entry is marked AuditFailed if there isn't a result yet, the panic is
+// the Reason, and the panic carries on once the entry is written. Entries
+// with nothing decided and no panic (like -print-key) aren't recorded.
+func (a *AuditLog) finish(entry *AuditEntry, panicked interface{}) {
+	if panicked != nil {
+		if entry.Result == "" {
+			entry.Result = AuditFailed
+		}
+		entry.Reason = fmt.Sprint(panicked)
+	}
+
+	if a != nil && entry.Result != "" {
+		if err := a.Record(*entry); err != nil {
+			log.Println(err)
+		}
+	}
+
+	if panicked != nil {
+		panic(panicked)
+	}
+}
@@ -0,0 +1,51 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/ellotheth/pipethis/lookup"
+	"golang.org/x/crypto/openpgp"
+)
+
+// confirm shows who signed the script and what's going to run it, and asks
+// prompter whether to go ahead. Anything short of a yes, including an error
+// from prompter, stops.
+func confirm(prompter lookup.Prompter, signer *openpgp.Entity, interpreter string) bool {
+	msg := fmt.Sprintf("Signed by %s\n", lookup.FormatFingerprint(fmt.Sprintf("%X", signer.PrimaryKey.Fingerprint)))
+	msg += fmt.Sprintf("          %s\n", primaryIdentity(signer))
+	msg += fmt.Sprintf("Run it with %s? (y/N) ", interpreter)
+
+	ok, err := prompter.Confirm(msg)
+
+	return err == nil && ok
+}
+
+// primaryIdentity is the identity key marks as primary, or the first one
+// alphabetically if it doesn't mark any.
+func primaryIdentity(key *openpgp.Entity) string {
+	names := []string{}
+	for name, identity := range key.Identities {
+		if identity.SelfSignature != nil && identity.SelfSignature.IsPrimaryId != nil && *identity.SelfSignature.IsPrimaryId {
+			return name
+		}
+		names = append(names, name)
+	}
+
+	if len(names) == 0 {
+		return "(no identity)"
+	}
+
+	sort.Strings(names)
+
+	return names[0]
+}
@@ -0,0 +1,167 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package lookup
+
+import (
+	"context"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+// DefaultCacheTTL is how long CachingService trusts a cached key before it
+// fetches a fresh copy.
+const DefaultCacheTTL = 7 * 24 * time.Hour
+
+// CachingService implements the KeyService interface by wrapping another
+// KeyService, and saving the keys it fetches as armored files so they don't
+// have to be fetched again.
+type CachingService struct {
+	service KeyService
+	dir     string
+	ttl     time.Duration
+}
+
+// NewCachingService wraps service with a key cache in dir. If dir is empty,
+// DefaultCacheDir() is used; if ttl is zero, DefaultCacheTTL is used.
+func NewCachingService(service KeyService, dir string, ttl time.Duration) *CachingService {
+	if dir == "" {
+		dir = DefaultCacheDir()
+	}
+	if ttl == 0 {
+		ttl = DefaultCacheTTL
+	}
+
+	return &CachingService{service: service, dir: dir, ttl: ttl}
+}
+
+// DefaultCacheDir is $XDG_CACHE_HOME/pipethis, or ~/.cache/pipethis if
+// XDG_CACHE_HOME isn't set.
+func DefaultCacheDir() string {
+	if cache := os.Getenv("XDG_CACHE_HOME"); cache != "" {
+		return path.Join(cache, "pipethis")
+	}
+
+	// without a home directory, it's relative to wherever we are
+	home, _ := homeDir()
+
+	return path.Join(home, ".cache", "pipethis")
+}
+
+// filename is where the key for fingerprint is cached. Anything that isn't a
+// full hex fingerprint doesn't get cached: a weird fingerprint can't send us
+// wandering around the filesystem, and a key id (which more than one key can
+// have) can't turn up somebody else's key.
+func (c CachingService) filename(fingerprint string) string {
+	fingerprint = NormalizeFingerprint(fingerprint)
+	if decoded, err := hex.DecodeString(fingerprint); err != nil || len(decoded) != 20 {
+		return ""
+	}
+
+	return path.Join(c.dir, fingerprint+".asc")
+}
+
+func (c CachingService) load(filename string) (openpgp.EntityList, error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	if time.Since(info.ModTime()) > c.ttl {
+		return nil, os.ErrNotExist
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return openpgp.ReadArmoredKeyRing(file)
+}
+
+func (c CachingService) save(filename string, ring openpgp.EntityList) error {
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		return err
+	}
+
+	// write someplace temporary first, so a half-written key never shows up
+	// in the cache
+	file, err := ioutil.TempFile(c.dir, "pipethis-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	writer, err := armor.Encode(file, openpgp.PublicKeyType, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range ring {
+		if err := key.Serialize(writer); err != nil {
+			return err
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), filename)
+}
+
+// Matches passes query straight through to the wrapped service.
+func (c CachingService) Matches(ctx context.Context, query string) ([]User, error) {
+	return c.service.Matches(ctx, query)
+}
+
+// FullKey gets the key for user whole from the wrapped service. Only what Key
+// hands out is cached, so it's never used here.
+func (c CachingService) FullKey(ctx context.Context, user User) (openpgp.EntityList, error) {
+	return FullKey(ctx, c.service, user)
+}
+
+// Key returns the cached key for user if there is one, it's not older than
+// the TTL, and it really is the key for user's fingerprint. Otherwise it gets
+// the key from the wrapped service and caches it, as long as that one's the
+// key for the fingerprint. Only full fingerprints are cached. Failing to cache
+// the key doesn't make Key fail.
+func (c CachingService) Key(ctx context.Context, user User) (openpgp.EntityList, error) {
+	filename := c.filename(user.Fingerprint)
+	if filename == "" {
+		return c.service.Key(ctx, user)
+	}
+
+	if ring, err := c.load(filename); err == nil && len(ring) > 0 {
+		if ring, err := fetchedKey(ring, user.Fingerprint); err == nil {
+			return ring, nil
+		}
+	}
+
+	ring, err := c.service.Key(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := fetchedKey(ring, user.Fingerprint); err == nil {
+		c.save(filename, ring)
+	}
+
+	return ring, nil
+}
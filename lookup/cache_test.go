@@ -0,0 +1,171 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package lookup
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/crypto/openpgp"
+)
+
+type CacheTest struct {
+	dir string
+	suite.Suite
+}
+
+func (s *CacheTest) SetupTest() {
+	dir, err := ioutil.TempDir("", "pipethis-test-")
+	s.Require().NoError(err)
+	s.dir = dir
+}
+
+func (s *CacheTest) TearDownTest() {
+	os.RemoveAll(s.dir)
+}
+
+func (s *CacheTest) TestDefaultCacheDir() {
+	xdg, home := os.Getenv("XDG_CACHE_HOME"), os.Getenv("HOME")
+	defer os.Setenv("XDG_CACHE_HOME", xdg)
+	defer os.Setenv("HOME", home)
+
+	os.Setenv("HOME", "/home/foo")
+	os.Setenv("XDG_CACHE_HOME", "")
+	s.Equal("/home/foo/.cache/pipethis", DefaultCacheDir())
+
+	os.Setenv("XDG_CACHE_HOME", "/var/cache")
+	s.Equal("/var/cache/pipethis", DefaultCacheDir())
+
+	// without HOME, the current user's home directory is used
+	os.Setenv("XDG_CACHE_HOME", "")
+	os.Setenv("HOME", "")
+	current := currentUser
+	defer func() { currentUser = current }()
+	currentUser = func() (*user.User, error) { return &user.User{HomeDir: "/home/bar"}, nil }
+	s.Equal("/home/bar/.cache/pipethis", DefaultCacheDir())
+}
+
+func (s *CacheTest) TestKeyCachesOnMiss() {
+	wrapped := &fakeService{ring: readTestRing(s.T(), "testdata/pubring.gpg")}
+	cache := NewCachingService(wrapped, s.dir, time.Hour)
+
+	ring, err := cache.Key(context.Background(), User{Fingerprint: fixtureFingerprint})
+	s.NoError(err)
+	s.Len(ring, 1)
+	s.Equal(1, wrapped.keys)
+
+	info, err := os.Stat(path.Join(s.dir, fixtureFingerprint+".asc"))
+	s.NoError(err)
+	s.Equal(os.FileMode(0600), info.Mode().Perm())
+
+	// the second time comes straight from the cache
+	ring, err = cache.Key(context.Background(), User{Fingerprint: fixtureFingerprint})
+	s.NoError(err)
+	s.Len(ring, 1)
+	s.Equal(fixtureKeyID, ring[0].PrimaryKey.KeyIdString())
+	s.Equal(1, wrapped.keys)
+}
+
+func (s *CacheTest) TestKeyRefreshesStaleKeys() {
+	wrapped := &fakeService{ring: readTestRing(s.T(), "testdata/pubring.gpg")}
+	cache := NewCachingService(wrapped, s.dir, time.Hour)
+
+	cache.Key(context.Background(), User{Fingerprint: fixtureFingerprint})
+
+	stale := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(path.Join(s.dir, fixtureFingerprint+".asc"), stale, stale)
+
+	_, err := cache.Key(context.Background(), User{Fingerprint: fixtureFingerprint})
+	s.NoError(err)
+	s.Equal(2, wrapped.keys)
+}
+
+func (s *CacheTest) TestKeySkipsCacheForWeirdFingerprints() {
+	wrapped := &fakeService{ring: readTestRing(s.T(), "testdata/pubring.gpg")}
+	cache := NewCachingService(wrapped, s.dir, time.Hour)
+
+	cache.Key(context.Background(), User{Fingerprint: "../../etc/passwd"})
+
+	files, _ := ioutil.ReadDir(s.dir)
+	s.Empty(files)
+	s.Equal(1, wrapped.keys)
+}
+
+func (s *CacheTest) TestKeyOnlyCachesFullFingerprints() {
+	wrapped := &fakeService{ring: readTestRing(s.T(), "testdata/pubring.gpg")}
+	cache := NewCachingService(wrapped, s.dir, time.Hour)
+
+	for _, id := range []string{fixtureKeyID, fixtureKeyID[8:]} {
+		_, err := cache.Key(context.Background(), User{Fingerprint: id})
+		s.NoError(err, id)
+	}
+
+	files, _ := ioutil.ReadDir(s.dir)
+	s.Empty(files)
+	s.Equal(2, wrapped.keys)
+}
+
+func (s *CacheTest) TestKeyChecksTheFingerprintOnEveryHit() {
+	wrapped := &fakeService{ring: readTestRing(s.T(), "testdata/pubring.gpg")}
+	cache := NewCachingService(wrapped, s.dir, time.Hour)
+
+	_, err := cache.Key(context.Background(), User{Fingerprint: fixtureFingerprint})
+	s.Require().NoError(err)
+
+	// somebody else's key, left where the fixture's should be
+	other := newTestEntity(s.T(), "Other", "other@example.com")
+	s.Require().NoError(cache.save(path.Join(s.dir, fixtureFingerprint+".asc"), openpgp.EntityList{other}))
+
+	ring, err := cache.Key(context.Background(), User{Fingerprint: fixtureFingerprint})
+	s.NoError(err)
+	s.Require().Len(ring, 1)
+	s.Equal(fixtureKeyID, ring[0].PrimaryKey.KeyIdString())
+	s.Equal(2, wrapped.keys)
+
+	// and a wrapped service that sends back the wrong key doesn't get it
+	// cached
+	os.Remove(path.Join(s.dir, fixtureFingerprint+".asc"))
+	wrapped.ring = openpgp.EntityList{other}
+	cache.Key(context.Background(), User{Fingerprint: fixtureFingerprint})
+
+	files, _ := ioutil.ReadDir(s.dir)
+	s.Empty(files)
+}
+
+func (s *CacheTest) TestKeyPassesErrorsThrough() {
+	wrapped := &fakeService{err: errors.New("broken")}
+	cache := NewCachingService(wrapped, s.dir, time.Hour)
+
+	_, err := cache.Key(context.Background(), User{Fingerprint: fixtureFingerprint})
+	s.Error(err)
+
+	files, _ := ioutil.ReadDir(s.dir)
+	s.Empty(files)
+}
+
+func (s *CacheTest) TestMatchesPassesThrough() {
+	wrapped := &fakeService{users: []User{User{Fingerprint: "AAAA"}}}
+
+	users, err := NewCachingService(wrapped, s.dir, time.Hour).Matches(context.Background(), "foo")
+	s.NoError(err)
+	s.Equal(wrapped.users, users)
+	s.Equal(1, wrapped.matches)
+}
+
+func TestCacheTest(t *testing.T) {
+	suite.Run(t, new(CacheTest))
+}
@@ -0,0 +1,135 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package lookup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// CascadeService implements the KeyService interface by trying a list of
+// other KeyServices in order, e.g. the local keyring first, then a keyserver,
+// then Keybase.
+type CascadeService struct {
+	services []KeyService
+	merge    bool
+}
+
+// NewCascadeService creates a CascadeService that tries services in the order
+// they're given. If merge is true, Matches asks every service (all at once)
+// instead of stopping at the first one that finds something.
+func NewCascadeService(merge bool, services ...KeyService) *CascadeService {
+	return &CascadeService{services: services, merge: merge}
+}
+
+// NewWKDCascadeService creates a CascadeService for authors given as email
+// addresses: it asks the Web Key Directory on the address's own domain first,
+// since the domain owner controls it, and falls back to the VKS keyserver at
+// server (DefaultVKSServer if server is empty). Queries that aren't email
+// addresses go straight to the keyserver. The options are passed along to
+// both services.
+func NewWKDCascadeService(server string, options ...RemoteOption) *CascadeService {
+	return NewCascadeService(false, emailOnlyService{NewWKDService(options...)}, NewVKSService(server, options...))
+}
+
+// errSkipped means a service in a cascade didn't try the query at all, so
+// there's nothing to report.
+var errSkipped = errors.New("Skipped")
+
+// emailOnlyService only passes queries along to its KeyService if they're email
+// addresses. Everything else is skipped.
+type emailOnlyService struct {
+	KeyService
+}
+
+func (e emailOnlyService) Matches(ctx context.Context, query string) ([]User, error) {
+	if _, err := wkdURLs(bareAddress(query)); err != nil {
+		return nil, errSkipped
+	}
+
+	return e.KeyService.Matches(ctx, query)
+}
+
+// cascadeError combines the errors from every service that failed.
+func cascadeError(errs []string) error {
+	if len(errs) == 0 {
+		return errors.New("No key services to try")
+	}
+
+	return fmt.Errorf("All services failed: %s", strings.Join(errs, "; "))
+}
+
+// Matches returns the matches from the first service that finds any, or (if
+// the CascadeService is merging) the matches from every service that finds
+// any, with duplicate fingerprints merged. If no service finds a match, Matches
+// returns an error with all the services' errors.
+func (c CascadeService) Matches(ctx context.Context, query string) ([]User, error) {
+	if c.merge {
+		users, err := ParallelMatches(ctx, query, c.services...)
+		if len(users) > 0 {
+			return users, nil
+		}
+		return nil, err
+	}
+
+	errs := []string{}
+
+	for _, service := range c.services {
+		matches, err := service.Matches(ctx, query)
+		if err == nil && len(matches) == 0 {
+			err = ErrNoMatches
+		}
+		if errors.Is(err, errSkipped) {
+			continue
+		}
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+
+		return mergeUsers(matches), nil
+	}
+
+	return nil, cascadeError(errs)
+}
+
+// Key returns the key for user from the first service that has it. If no
+// service has it, Key returns an error with all the services' errors.
+func (c CascadeService) Key(ctx context.Context, user User) (openpgp.EntityList, error) {
+	return c.key(ctx, user, KeyService.Key)
+}
+
+// FullKey works like Key, but gets the key whole from each service.
+func (c CascadeService) FullKey(ctx context.Context, user User) (openpgp.EntityList, error) {
+	return c.key(ctx, user, func(service KeyService, ctx context.Context, user User) (openpgp.EntityList, error) {
+		return FullKey(ctx, service, user)
+	})
+}
+
+// key does the work for Key and FullKey, getting the key from each service
+// with get.
+func (c CascadeService) key(ctx context.Context, user User, get func(KeyService, context.Context, User) (openpgp.EntityList, error)) (openpgp.EntityList, error) {
+	errs := []string{}
+
+	for _, service := range c.services {
+		ring, err := get(service, ctx, user)
+		if err == nil {
+			return ring, nil
+		}
+
+		errs = append(errs, err.Error())
+	}
+
+	return nil, cascadeError(errs)
+}
@@ -0,0 +1,218 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package lookup
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/crypto/openpgp"
+)
+
+// fakeService is a KeyService with canned answers.
+type fakeService struct {
+	users   []User
+	ring    openpgp.EntityList
+	err     error
+	matches int
+	keys    int
+}
+
+func (f *fakeService) Matches(ctx context.Context, query string) ([]User, error) {
+	f.matches++
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	return f.users, nil
+}
+
+func (f *fakeService) Key(ctx context.Context, user User) (openpgp.EntityList, error) {
+	f.keys++
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	return f.ring, nil
+}
+
+type CascadeTest struct {
+	suite.Suite
+}
+
+func (s *CascadeTest) TestMatchesStopsAtFirstSuccess() {
+	first := &fakeService{err: errors.New("first")}
+	second := &fakeService{users: []User{User{Fingerprint: "AAAA"}}}
+	third := &fakeService{users: []User{User{Fingerprint: "BBBB"}}}
+
+	users, err := NewCascadeService(false, first, second, third).Matches(context.Background(), "foo")
+
+	s.NoError(err)
+	s.Equal([]User{User{Fingerprint: "AAAA"}}, users)
+	s.Equal(1, first.matches)
+	s.Equal(1, second.matches)
+	s.Equal(0, third.matches)
+}
+
+func (s *CascadeTest) TestMatchesSkipsEmptyResults() {
+	first := &fakeService{users: []User{}}
+	second := &fakeService{users: []User{User{Fingerprint: "AAAA"}}}
+
+	users, err := NewCascadeService(false, first, second).Matches(context.Background(), "foo")
+
+	s.NoError(err)
+	s.Len(users, 1)
+}
+
+func (s *CascadeTest) TestMatchesMergesWithoutDuplicates() {
+	first := &fakeService{users: []User{User{Fingerprint: "AAAA"}, User{Fingerprint: "BBBB"}}}
+	second := &fakeService{err: errors.New("second")}
+	third := &fakeService{users: []User{User{Fingerprint: "aa aa"}, User{Fingerprint: "CCCC"}}}
+
+	users, err := NewCascadeService(true, first, second, third).Matches(context.Background(), "foo")
+
+	s.NoError(err)
+	s.Equal([]User{User{Fingerprint: "AAAA"}, User{Fingerprint: "BBBB"}, User{Fingerprint: "CCCC"}}, users)
+	s.Equal(1, third.matches)
+}
+
+func (s *CascadeTest) TestMatchesAggregatesErrors() {
+	first := &fakeService{err: errors.New("first broke")}
+	second := &fakeService{err: errors.New("second broke")}
+
+	for _, merge := range []bool{true, false} {
+		_, err := NewCascadeService(merge, first, second).Matches(context.Background(), "foo")
+
+		s.Error(err)
+		s.Contains(err.Error(), "All services failed")
+		s.Contains(err.Error(), "first broke")
+		s.Contains(err.Error(), "second broke")
+	}
+}
+
+func (s *CascadeTest) TestMatchesFailsWithoutServices() {
+	_, err := NewCascadeService(false).Matches(context.Background(), "foo")
+	s.Error(err)
+}
+
+func (s *CascadeTest) TestKeyStopsAtFirstSuccess() {
+	ring := openpgp.EntityList{&openpgp.Entity{}}
+	first := &fakeService{err: errors.New("first")}
+	second := &fakeService{ring: ring}
+	third := &fakeService{ring: openpgp.EntityList{}}
+
+	actual, err := NewCascadeService(false, first, second, third).Key(context.Background(), User{})
+
+	s.NoError(err)
+	s.Equal(ring, actual)
+	s.Equal(0, third.keys)
+}
+
+func (s *CascadeTest) TestKeyAggregatesErrors() {
+	first := &fakeService{err: errors.New("first broke")}
+	second := &fakeService{err: errors.New("second broke")}
+
+	_, err := NewCascadeService(false, first, second).Key(context.Background(), User{})
+
+	s.Error(err)
+	s.Contains(err.Error(), "first broke")
+	s.Contains(err.Error(), "second broke")
+}
+
+// wkdCascade creates the WKD to VKS cascade against one fake server that has
+// no Web Key Directory, but does have the fixture key on its keyserver. The
+// paths it's asked for are saved in requests.
+func (s *CascadeTest) wkdCascade(requests *[]string) (*CascadeService, *httptest.Server) {
+	armored := armorTestRing(s.T(), readTestRing(s.T(), "testdata/pubring.gpg")...)
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requests = append(*requests, r.URL.Path)
+
+		switch r.URL.Path {
+		case "/vks/v1/by-email/test@example.com",
+			"/vks/v1/by-fingerprint/" + fixtureFingerprint:
+			w.Write(armored)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+
+	// every host (the author's domain too) goes to the fake server
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial("tcp", server.Listener.Addr().String())
+		},
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+
+	return NewWKDCascadeService(server.URL, WithHTTPClient(client), WithRetries(0)), server
+}
+
+func (s *CascadeTest) TestWKDCascadeFallsBackToKeyserver() {
+	requests := []string{}
+	service, server := s.wkdCascade(&requests)
+	defer server.Close()
+
+	users, err := service.Matches(context.Background(), "test@example.com")
+	s.NoError(err)
+	s.Len(users, 1)
+	s.Equal(fixtureFingerprint, users[0].Fingerprint)
+
+	// both WKD methods first, then the keyserver
+	s.Len(requests, 3)
+	s.Contains(requests[0], "/.well-known/openpgpkey/example.com/hu/")
+	s.Contains(requests[1], "/.well-known/openpgpkey/hu/")
+	s.Equal("/vks/v1/by-email/test@example.com", requests[2])
+
+	ring, err := service.Key(context.Background(), users[0])
+	s.NoError(err)
+	s.Len(ring, 1)
+}
+
+func (s *CascadeTest) TestWKDCascadeTakesANameAndAddress() {
+	requests := []string{}
+	service, server := s.wkdCascade(&requests)
+	defer server.Close()
+
+	users, err := service.Matches(context.Background(), "Test User <test@example.com>")
+	s.Require().NoError(err)
+	s.Len(users, 1)
+	s.Equal(fixtureFingerprint, users[0].Fingerprint)
+
+	// the keyserver gets the bare address, like WKD does
+	s.Require().Len(requests, 3)
+	s.Equal("/vks/v1/by-email/test@example.com", requests[2])
+}
+
+func (s *CascadeTest) TestWKDCascadeSkipsWKDForOtherQueries() {
+	requests := []string{}
+	service, server := s.wkdCascade(&requests)
+	defer server.Close()
+
+	users, err := service.Matches(context.Background(), fixtureFingerprint)
+	s.NoError(err)
+	s.Len(users, 1)
+	s.Equal([]string{"/vks/v1/by-fingerprint/" + fixtureFingerprint}, requests)
+
+	// when nothing's found, the skipped service isn't part of the error
+	_, err = service.Matches(context.Background(), "0123456789ABCDEF")
+	s.Error(err)
+	s.NotContains(err.Error(), "Invalid email")
+}
+
+func TestCascadeTest(t *testing.T) {
+	suite.Run(t, new(CascadeTest))
+}
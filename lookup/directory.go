@@ -0,0 +1,174 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package lookup
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// DirectoryService implements the KeyService interface for a directory of
+// key files (*.asc for armored keys, *.gpg for binary ones), for trusted keys
+// that are vendored or copied around by hand instead of kept in a GnuPG
+// keyring. Keys are matched exactly the way LocalPGPService matches them.
+type DirectoryService struct {
+	dir  string
+	ring openpgp.EntityList
+
+	// MatchMode decides how Matches compares the query to each key, like
+	// LocalPGPService.MatchMode.
+	MatchMode MatchMode
+
+	// ShowExpired makes Matches include expired keys, like
+	// LocalPGPService.ShowExpired.
+	ShowExpired bool
+
+	// MaxMatches is the most keys Matches returns, like
+	// LocalPGPService.MaxMatches.
+	MaxMatches int
+
+	// Capability is what a key has to be able to do for Matches to offer
+	// it, like LocalPGPService.Capability.
+	Capability Capability
+
+	// Logger, if it's set, hears about the key files being loaded or
+	// skipped.
+	Logger Logger
+
+	// now is the clock expiry is checked against. It's only replaced in
+	// tests.
+	now func() time.Time
+}
+
+// NewDirectoryService creates a DirectoryService for the key files in dir, if
+// it's a directory; otherwise it bails.
+func NewDirectoryService(dir string) (*DirectoryService, error) {
+	dir = expandPath(dir)
+
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, errors.New(dir + " is not a directory")
+	}
+
+	return &DirectoryService{dir: dir}, nil
+}
+
+// isKeyFile is true for the file names DirectoryService loads.
+func isKeyFile(name string) bool {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".asc", ".gpg":
+		return true
+	}
+
+	return false
+}
+
+// Ring loads the keys from every key file in the directory, with repeated
+// keys dropped, so DirectoryService can use them later. Key files that can't
+// be read are skipped (and logged); anything else in the directory is
+// ignored. If it's already been loaded, Ring returns the existing version.
+func (d *DirectoryService) Ring() (openpgp.EntityList, error) {
+	if d.ring != nil {
+		return d.ring, nil
+	}
+
+	files, err := ioutil.ReadDir(d.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	ring := openpgp.EntityList{}
+	for _, info := range files {
+		if info.IsDir() || !isKeyFile(info.Name()) {
+			continue
+		}
+
+		keys, err := d.load(path.Join(d.dir, info.Name()))
+		if err != nil {
+			logf(d.Logger, "skipping %s: %v", info.Name(), err)
+			continue
+		}
+		logf(d.Logger, "loaded %d keys from %s", len(keys), info.Name())
+
+		ring = append(ring, keys...)
+	}
+	d.ring = uniqueKeys(ring)
+
+	return d.ring, nil
+}
+
+// load reads the keys in one key file.
+func (d *DirectoryService) load(filename string) (openpgp.EntityList, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return readRing(bufio.NewReader(file), openpgp.ReadKeyRing)
+}
+
+func (d *DirectoryService) clock() time.Time {
+	if d.now == nil {
+		return time.Now()
+	}
+
+	return d.now()
+}
+
+// Matches finds all the keys that have a fingerprint, name, or email address
+// that match query, the same way LocalPGPService.Matches does. If no matches
+// are found, Matches returns an error.
+func (d *DirectoryService) Matches(ctx context.Context, query string) ([]User, error) {
+	ring, err := d.Ring()
+	if err != nil {
+		return nil, err
+	}
+
+	users, err := matchRing(ctx, ring, query, d.MatchMode, d.Capability, d.ShowExpired, d.clock())
+	if err != nil {
+		return nil, err
+	}
+
+	return limitMatches(users, d.MaxMatches)
+}
+
+// List is every key in the directory, the same way LocalPGPService.List does.
+func (d *DirectoryService) List(ctx context.Context) ([]User, error) {
+	ring, err := d.Ring()
+	if err != nil {
+		return nil, err
+	}
+
+	return listRing(ctx, ring, d.clock())
+}
+
+// Key gets the key for a user's fingerprint, the same way LocalPGPService.Key
+// does. If the fingerprint is invalid, the key has expired, or there's no
+// single key that matches, Key returns an error.
+func (d *DirectoryService) Key(ctx context.Context, user User) (openpgp.EntityList, error) {
+	ring, err := d.Ring()
+	if err != nil {
+		return nil, err
+	}
+
+	return keyFromRing(ring, user, d.clock())
+}
@@ -0,0 +1,74 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package lookup
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type DirectoryTest struct {
+	suite.Suite
+}
+
+func (s *DirectoryTest) TestRingLoadsKeyFiles() {
+	var buf bytes.Buffer
+	dir, err := NewDirectoryService("testdata/keydir")
+	s.Require().NoError(err)
+	dir.Logger = log.New(&buf, "", 0)
+
+	ring, err := dir.Ring()
+	s.NoError(err)
+	s.Len(ring, 2)
+
+	// the broken key file is skipped, and the README isn't even tried
+	s.Contains(buf.String(), "skipping broken.asc: ")
+	s.Contains(buf.String(), "loaded 1 keys from live.asc")
+	s.Contains(buf.String(), "loaded 1 keys from test.gpg")
+	s.NotContains(buf.String(), "README")
+}
+
+func (s *DirectoryTest) TestMatchesAndKeyUseEveryFile() {
+	dir, err := NewDirectoryService("testdata/keydir")
+	s.Require().NoError(err)
+
+	users, err := dir.Matches(context.Background(), "test@example.com")
+	s.NoError(err)
+	s.Len(users, 1)
+	s.Equal(fixtureFingerprint, users[0].Fingerprint)
+
+	users, err = dir.Matches(context.Background(), "live@example.com")
+	s.NoError(err)
+	s.Len(users, 1)
+
+	ring, err := dir.Key(context.Background(), users[0])
+	s.NoError(err)
+	s.Len(ring, 1)
+
+	_, err = dir.Matches(context.Background(), "nobody@example.com")
+	s.Error(err)
+}
+
+func (s *DirectoryTest) TestNewDirectoryServiceNeedsADirectory() {
+	_, err := NewDirectoryService("testdata/not-a-real-dir")
+	s.True(os.IsNotExist(err))
+
+	_, err = NewDirectoryService("testdata/pubring.gpg")
+	s.EqualError(err, "testdata/pubring.gpg is not a directory")
+}
+
+func TestDirectoryTest(t *testing.T) {
+	suite.Run(t, new(DirectoryTest))
+}
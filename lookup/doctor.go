@@ -0,0 +1,191 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package lookup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// doctorQuery is what Diagnose looks up to see if a keyserver is there. It's
+// a fingerprint nobody has, so the answer is always "no matches" from a
+// keyserver that's working.
+const doctorQuery = "0000000000000000000000000000000000000000"
+
+// Diagnosis is what Diagnose found out about the local keyring and the
+// keyservers.
+type Diagnosis struct {
+	// RingPath is the keyring that was checked.
+	RingPath string
+
+	// RingErr is why the keyring can't be used, or nil if it can. It
+	// matches ErrRingMissing, ErrRingEmpty, or ErrRingUnreadable (with
+	// errors.Is) if the keyring couldn't be opened, and it's the parse
+	// error otherwise.
+	RingErr error
+
+	// Keys is how many keys were in the keyring.
+	Keys int
+
+	// Revoked and Expired are how many of the Keys are revoked, or have
+	// expired. They'll never match an author.
+	Revoked int
+	Expired int
+
+	// Keyservers are the keyservers that were checked, in order.
+	Keyservers []KeyserverStatus
+
+	// Advice says what to do about each problem that was found.
+	Advice []string
+}
+
+// KeyserverStatus is whether one keyserver answered.
+type KeyserverStatus struct {
+	Keyserver string
+	Err       error
+}
+
+// Reachable is true when the keyserver answered, even if it didn't have
+// anything to say.
+func (k KeyserverStatus) Reachable() bool {
+	var urlErr *url.Error
+	return k.Err == nil || !(errors.As(k.Err, &urlErr) || errors.Is(k.Err, ErrOffline) || errors.Is(k.Err, context.DeadlineExceeded))
+}
+
+// OK is true when Diagnose didn't find any problems.
+func (d Diagnosis) OK() bool {
+	return len(d.Advice) == 0
+}
+
+// String lists everything Diagnose found, one thing per line.
+func (d Diagnosis) String() string {
+	lines := []string{"Keyring: " + d.RingPath}
+	if d.RingErr != nil {
+		lines = append(lines, "  "+d.RingErr.Error())
+	} else {
+		line := fmt.Sprintf("  %d keys", d.Keys)
+		if d.Revoked > 0 {
+			line += fmt.Sprintf(", %d revoked", d.Revoked)
+		}
+		if d.Expired > 0 {
+			line += fmt.Sprintf(", %d expired", d.Expired)
+		}
+		lines = append(lines, line)
+	}
+
+	for _, status := range d.Keyservers {
+		if status.Reachable() {
+			lines = append(lines, "Keyserver "+status.Keyserver+": reachable")
+		} else {
+			lines = append(lines, "Keyserver "+status.Keyserver+": "+status.Err.Error())
+		}
+	}
+
+	for _, advice := range d.Advice {
+		lines = append(lines, "- "+advice)
+	}
+
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// Diagnose checks that the local keyring at ringpath (or the one in the GnuPG
+// home directory, if ringpath is empty) is there and has keys in it, and that
+// each of the keyservers answers, and says what to do about anything that's
+// wrong. The keyservers are described the same way as for NewRemoteService,
+// and the options are passed along to them.
+func Diagnose(ctx context.Context, ringpath string, keyservers []string, options ...RemoteOption) Diagnosis {
+	ringfile, err := newPublicRingFile()
+	if ringpath != "" {
+		ringfile, err = publicRingFile(expandPath(ringpath)), nil
+	}
+
+	diagnosis := Diagnosis{RingPath: string(ringfile)}
+	if err != nil {
+		diagnosis.RingErr = err
+		diagnosis.advise("There's no home directory to find a keyring in. Set HOME, or set GNUPGHOME to the directory with your pubring.gpg or pubring.kbx.")
+	} else {
+		diagnosis.checkRing(ctx, ringfile)
+	}
+
+	for _, keyserver := range keyservers {
+		diagnosis.checkKeyserver(ctx, keyserver, options...)
+	}
+
+	return diagnosis
+}
+
+// checkRing loads ringfile the way LocalPGPService does, and counts the keys,
+// and the ones that can't be used.
+func (d *Diagnosis) checkRing(ctx context.Context, ringfile publicRingFile) {
+	local, err := newLocalPGPService(ringfile)
+	var users []User
+	if err == nil {
+		users, err = local.List(ctx)
+		d.Keys = len(users)
+	}
+	d.RingErr = err
+
+	unusable := 0
+	for _, user := range users {
+		if user.Revoked {
+			d.Revoked++
+		}
+		if user.Expired {
+			d.Expired++
+		}
+		if user.Revoked || user.Expired {
+			unusable++
+		}
+	}
+
+	switch {
+	case errors.Is(err, ErrRingMissing):
+		d.advise("There's no keyring at %s. Set GNUPGHOME to the directory with your pubring.gpg or pubring.kbx, or import a key with gpg --import.", ringfile)
+	case errors.Is(err, ErrRingUnreadable):
+		d.advise("The keyring at %s can't be read. Check its permissions.", ringfile)
+	case errors.Is(err, ErrRingEmpty) || (err == nil && d.Keys == 0):
+		d.advise("The keyring at %s doesn't have any keys. Import the script author's key with gpg --import.", ringfile)
+	case err != nil:
+		d.advise("The keyring at %s can't be parsed. It has to be a GnuPG keyring (pubring.gpg) or keybox (pubring.kbx).", ringfile)
+	case unusable == d.Keys:
+		d.advise("Every key in the keyring at %s is revoked or expired. Import the script author's current key with gpg --import.", ringfile)
+	}
+}
+
+// checkKeyserver looks up a key nobody has on keyserver, to see if it
+// answers.
+func (d *Diagnosis) checkKeyserver(ctx context.Context, keyserver string, options ...RemoteOption) {
+	status := KeyserverStatus{Keyserver: keyserver}
+	defer func() { d.Keyservers = append(d.Keyservers, status) }()
+
+	service, err := NewRemoteService(keyserver, options...)
+	if err != nil {
+		status.Err = err
+		if !errors.Is(err, ErrOffline) {
+			d.advise("%s isn't a keyserver pipethis knows: %v", keyserver, err)
+		}
+		return
+	}
+
+	_, status.Err = service.Matches(ctx, doctorQuery)
+	switch {
+	case !status.Reachable():
+		d.advise("Can't reach keyserver %s. Check your network connection and proxy settings, or use -lookup-with local.", keyserver)
+	case errors.Is(status.Err, ErrRateLimited):
+		d.advise("Keyserver %s is rate limiting requests. Wait a while before trying again, or use another keyserver.", keyserver)
+	}
+}
+
+func (d *Diagnosis) advise(format string, v ...interface{}) {
+	d.Advice = append(d.Advice, fmt.Sprintf(format, v...))
+}
@@ -0,0 +1,153 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package lookup
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/user"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type DoctorTest struct {
+	suite.Suite
+}
+
+func (s *DoctorTest) TestDiagnoseCountsKeysInGoodRing() {
+	diagnosis := Diagnose(context.Background(), "testdata/usage.gpg", nil)
+
+	s.Equal("testdata/usage.gpg", diagnosis.RingPath)
+	s.NoError(diagnosis.RingErr)
+	s.Equal(2, diagnosis.Keys)
+	s.True(diagnosis.OK())
+	s.Empty(diagnosis.Advice)
+	s.Equal("Keyring: testdata/usage.gpg\n  2 keys\n", diagnosis.String())
+}
+
+func (s *DoctorTest) TestDiagnoseCountsUnusableKeys() {
+	diagnosis := Diagnose(context.Background(), "testdata/revoked.gpg", nil)
+
+	s.Equal(2, diagnosis.Keys)
+	s.Equal(1, diagnosis.Revoked)
+	s.True(diagnosis.OK())
+	s.Equal("Keyring: testdata/revoked.gpg\n  2 keys, 1 revoked\n", diagnosis.String())
+}
+
+func (s *DoctorTest) TestDiagnoseUsesGnupgHome() {
+	os.Setenv("GNUPGHOME", "testdata/secrethome")
+	defer os.Unsetenv("GNUPGHOME")
+
+	diagnosis := Diagnose(context.Background(), "", nil)
+
+	s.Equal("testdata/secrethome/pubring.gpg", diagnosis.RingPath)
+	s.NoError(diagnosis.RingErr)
+	s.True(diagnosis.OK())
+}
+
+func (s *DoctorTest) TestDiagnoseReportsMissingHome() {
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	defer os.Setenv("GNUPGHOME", os.Getenv("GNUPGHOME"))
+	defer func() { currentUser = user.Current }()
+
+	os.Setenv("HOME", "")
+	os.Setenv("GNUPGHOME", "")
+	currentUser = func() (*user.User, error) { return nil, errors.New("No such user") }
+
+	diagnosis := Diagnose(context.Background(), "", nil)
+
+	s.True(errors.Is(diagnosis.RingErr, ErrNoHome))
+	s.Equal([]string{"There's no home directory to find a keyring in. Set HOME, or set GNUPGHOME to the directory with your pubring.gpg or pubring.kbx."}, diagnosis.Advice)
+}
+
+func (s *DoctorTest) TestDiagnoseReportsMissingRing() {
+	diagnosis := Diagnose(context.Background(), "testdata/nope/pubring.gpg", nil)
+
+	s.True(errors.Is(diagnosis.RingErr, ErrRingMissing))
+	s.Zero(diagnosis.Keys)
+	s.False(diagnosis.OK())
+	s.Equal([]string{"There's no keyring at testdata/nope/pubring.gpg. Set GNUPGHOME to the directory with your pubring.gpg or pubring.kbx, or import a key with gpg --import."}, diagnosis.Advice)
+	s.Contains(diagnosis.String(), "Keyring not found")
+}
+
+func (s *DoctorTest) TestDiagnoseReportsEmptyRing() {
+	dir, err := ioutil.TempDir("", "pipethis-test-")
+	s.Require().NoError(err)
+	defer os.RemoveAll(dir)
+
+	ringpath := path.Join(dir, "pubring.gpg")
+	s.Require().NoError(ioutil.WriteFile(ringpath, nil, 0600))
+
+	diagnosis := Diagnose(context.Background(), ringpath, nil)
+
+	s.True(errors.Is(diagnosis.RingErr, ErrRingEmpty))
+	s.Zero(diagnosis.Keys)
+	s.Equal([]string{"The keyring at " + ringpath + " doesn't have any keys. Import the script author's key with gpg --import."}, diagnosis.Advice)
+}
+
+func (s *DoctorTest) TestDiagnoseReportsUnparseableRing() {
+	diagnosis := Diagnose(context.Background(), "testdata/keydir/README", nil)
+
+	s.Error(diagnosis.RingErr)
+	s.Equal([]string{"The keyring at testdata/keydir/README can't be parsed. It has to be a GnuPG keyring (pubring.gpg) or keybox (pubring.kbx)."}, diagnosis.Advice)
+}
+
+func (s *DoctorTest) TestDiagnoseChecksKeyservers() {
+	up := httptest.NewServer(http.NotFoundHandler())
+	defer up.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	diagnosis := Diagnose(context.Background(), "testdata/pubring.gpg", []string{up.URL, down.URL, "gopher://nope"})
+
+	s.Require().Len(diagnosis.Keyservers, 3)
+	s.True(diagnosis.Keyservers[0].Reachable())
+	s.False(diagnosis.Keyservers[1].Reachable())
+	s.Equal([]string{
+		"Can't reach keyserver " + down.URL + ". Check your network connection and proxy settings, or use -lookup-with local.",
+		"gopher://nope isn't a keyserver pipethis knows: Unrecognized keyserver: gopher://nope",
+	}, diagnosis.Advice)
+	s.Contains(diagnosis.String(), "Keyserver "+up.URL+": reachable\n")
+}
+
+func (s *DoctorTest) TestDiagnoseReportsRateLimits() {
+	limited := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer limited.Close()
+
+	diagnosis := Diagnose(context.Background(), "testdata/pubring.gpg", []string{limited.URL})
+
+	s.Require().Len(diagnosis.Keyservers, 1)
+	s.True(diagnosis.Keyservers[0].Reachable())
+	s.Equal([]string{
+		"Keyserver " + limited.URL + " is rate limiting requests. Wait a while before trying again, or use another keyserver.",
+	}, diagnosis.Advice)
+}
+
+func (s *DoctorTest) TestDiagnoseSkipsKeyserversOffline() {
+	diagnosis := Diagnose(context.Background(), "testdata/pubring.gpg", []string{"vks"}, WithOffline())
+
+	s.Require().Len(diagnosis.Keyservers, 1)
+	s.True(errors.Is(diagnosis.Keyservers[0].Err, ErrOffline))
+	s.False(diagnosis.Keyservers[0].Reachable())
+	s.True(diagnosis.OK())
+}
+
+func TestDoctorTest(t *testing.T) {
+	suite.Run(t, new(DoctorTest))
+}
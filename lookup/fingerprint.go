@@ -0,0 +1,122 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package lookup
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// ErrFingerprintMismatch means a key service came back with a key that isn't
+// the one that was expected.
+var ErrFingerprintMismatch = errors.New("Key doesn't have the expected fingerprint")
+
+// FingerprintService implements the KeyService interface by wrapping another
+// KeyService, and only letting through the key with one full fingerprint,
+// decided before anything's looked up. A keyserver that's been tampered with
+// can hand out whatever keys it likes for an author's email address, but it
+// can't make one of them have that fingerprint.
+type FingerprintService struct {
+	service     KeyService
+	fingerprint string
+}
+
+// NewFingerprintService wraps service, so the only key it finds is the one
+// with fingerprint. The fingerprint has to be a full one (spaces are fine);
+// key ids are too easy to collide.
+func NewFingerprintService(service KeyService, fingerprint string) (*FingerprintService, error) {
+	normalized, err := ParseFingerprint(fingerprint)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FingerprintService{service: service, fingerprint: normalized}, nil
+}
+
+// ParseFingerprint checks that raw is a full fingerprint, and returns it in
+// plain uppercase hex.
+func ParseFingerprint(raw string) (string, error) {
+	fingerprint := NormalizeFingerprint(raw)
+	if _, err := hex.DecodeString(fingerprint); err != nil || len(fingerprint) != 40 {
+		return "", fmt.Errorf("Expected a full fingerprint: %s", raw)
+	}
+
+	return fingerprint, nil
+}
+
+// Fingerprint is the full fingerprint the service expects, in plain
+// uppercase hex.
+func (f FingerprintService) Fingerprint() string {
+	return f.fingerprint
+}
+
+// Matches gets the wrapped service's matches for query, and drops all of them
+// but the one with the expected fingerprint. If the wrapped service cut its
+// matches short (ErrTooManyMatches), the expected key may have been one of the
+// ones dropped, so Matches asks again for the fingerprint itself. If it still
+// isn't found, Matches returns ErrNoMatches.
+func (f FingerprintService) Matches(ctx context.Context, query string) ([]User, error) {
+	users, err := f.service.Matches(ctx, query)
+	if user, ok := f.find(users); ok {
+		return []User{user}, nil
+	}
+
+	if errors.Is(err, ErrTooManyMatches) {
+		users, err = f.service.Matches(ctx, f.fingerprint)
+		if user, ok := f.find(users); ok {
+			return []User{user}, nil
+		}
+	}
+
+	if len(users) == 0 && err != nil {
+		return nil, err
+	}
+
+	return nil, fmt.Errorf("%w with fingerprint %s", ErrNoMatches, f.fingerprint)
+}
+
+// find picks the user with the expected fingerprint out of users.
+func (f FingerprintService) find(users []User) (User, bool) {
+	for _, user := range users {
+		if NormalizeFingerprint(user.Fingerprint) == f.fingerprint {
+			return user, true
+		}
+	}
+
+	return User{}, false
+}
+
+func (f FingerprintService) Key(ctx context.Context, user User) (openpgp.EntityList, error) {
+	return f.pinned(f.service.Key(ctx, user))
+}
+
+// FullKey works like Key, but gets the key whole from the wrapped service.
+func (f FingerprintService) FullKey(ctx context.Context, user User) (openpgp.EntityList, error) {
+	return f.pinned(FullKey(ctx, f.service, user))
+}
+
+// pinned drops every key in ring but the one with the expected fingerprint.
+func (f FingerprintService) pinned(ring openpgp.EntityList, err error) (openpgp.EntityList, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range ring {
+		if keyFingerprint(key) == f.fingerprint {
+			return openpgp.EntityList{key}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: wanted %s", ErrFingerprintMismatch, f.fingerprint)
+}
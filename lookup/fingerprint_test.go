@@ -0,0 +1,95 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package lookup
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/crypto/openpgp"
+)
+
+type FingerprintTest struct {
+	keys openpgp.EntityList
+	suite.Suite
+}
+
+func (s *FingerprintTest) SetupSuite() {
+	// three keys that all claim the same author
+	for _, name := range []string{"First", "Second", "Third"} {
+		s.keys = append(s.keys, newTestEntity(s.T(), name, "author@example.com"))
+	}
+}
+
+func (s *FingerprintTest) TestOnlyThePinnedKeyIsFound() {
+	memory := NewMemoryService(s.keys)
+	_, _, err := Find(context.Background(), memory, "author@example.com", true)
+	s.Require().Error(err, "without a pin there's no single match")
+
+	pinned := keyFingerprint(s.keys[1])
+	service, err := NewFingerprintService(memory, strings.ToLower(pinned))
+	s.Require().NoError(err)
+	s.Equal(pinned, service.Fingerprint())
+
+	match, ring, err := Find(context.Background(), service, "author@example.com", true)
+	s.Require().NoError(err)
+	s.Equal(pinned, match.Fingerprint)
+	s.Require().Len(ring, 1)
+	s.Equal(pinned, keyFingerprint(ring[0]))
+}
+
+func (s *FingerprintTest) TestMissingPinFindsNothing() {
+	stranger := newTestEntity(s.T(), "Stranger", "stranger@example.com")
+	service, err := NewFingerprintService(NewMemoryService(s.keys), keyFingerprint(stranger))
+	s.Require().NoError(err)
+
+	_, err = service.Matches(context.Background(), "author@example.com")
+	s.True(errors.Is(err, ErrNoMatches), err)
+}
+
+func (s *FingerprintTest) TestPinPastMaxMatchesIsFound() {
+	memory := NewMemoryService(s.keys)
+	memory.MaxMatches = 1
+
+	pinned := keyFingerprint(s.keys[2])
+	service, err := NewFingerprintService(memory, pinned)
+	s.Require().NoError(err)
+
+	users, err := service.Matches(context.Background(), "author@example.com")
+	s.Require().NoError(err)
+	s.Require().Len(users, 1)
+	s.Equal(pinned, users[0].Fingerprint)
+}
+
+func (s *FingerprintTest) TestKeyIgnoresOtherFingerprints() {
+	service, err := NewFingerprintService(NewMemoryService(s.keys), keyFingerprint(s.keys[0]))
+	s.Require().NoError(err)
+
+	_, err = service.Key(context.Background(), User{Fingerprint: keyFingerprint(s.keys[2])})
+	s.True(errors.Is(err, ErrFingerprintMismatch), err)
+}
+
+func (s *FingerprintTest) TestRejectsPartialFingerprints() {
+	for _, bad := range []string{"", "A5034EFD4162D102", "not a fingerprint", keyFingerprint(s.keys[0]) + "00"} {
+		_, err := NewFingerprintService(NewMemoryService(s.keys), bad)
+		s.Error(err, bad)
+	}
+
+	fingerprint, err := ParseFingerprint("0x134E 0DE0 D18F B090 F7C1  7C10 A503 4EFD 4162 D102")
+	s.NoError(err)
+	s.Equal("134E0DE0D18FB090F7C17C10A5034EFD4162D102", fingerprint)
+}
+
+func TestFingerprintTest(t *testing.T) {
+	suite.Run(t, new(FingerprintTest))
+}
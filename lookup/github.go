@@ -0,0 +1,111 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package lookup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// DefaultGitHubURL is where GitHubService finds users' keys when it isn't
+// pointed at a GitHub Enterprise server.
+const DefaultGitHubURL = "https://github.com"
+
+// GitHubService implements the KeyService interface for the GPG keys GitHub
+// users have uploaded to their accounts.
+type GitHubService struct {
+	remote
+	base string
+}
+
+// NewGitHubService creates a GitHubService for the GitHub server at base. If
+// base is empty, DefaultGitHubURL is used.
+func NewGitHubService(base string, options ...RemoteOption) *GitHubService {
+	if base == "" {
+		base = DefaultGitHubURL
+	}
+
+	return &GitHubService{remote: newRemote(options), base: strings.TrimRight(base, "/")}
+}
+
+// fetch gets all the keys username has uploaded. GitHub sends back one armored
+// block per key.
+func (g GitHubService) fetch(ctx context.Context, username string) (openpgp.EntityList, error) {
+	if matches, _ := regexp.MatchString(`^[a-zA-Z0-9\-]+$`, username); !matches {
+		return nil, errors.New("Invalid user requested")
+	}
+
+	resp, err := g.getKey(ctx, g.base+"/"+username+".gpg")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errors.New("GitHub user " + username + " not found")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusError(resp, fmt.Sprintf("GitHub returned %s for %s", resp.Status, username))
+	}
+
+	ring, err := parseKey(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ring) == 0 {
+		return nil, errors.New("GitHub user " + username + " hasn't uploaded any GPG keys")
+	}
+
+	return ring, nil
+}
+
+// Matches finds all the GPG keys uploaded by the GitHub user named in query.
+// If the user doesn't exist or hasn't uploaded any keys, Matches returns an
+// error.
+func (g GitHubService) Matches(ctx context.Context, query string) ([]User, error) {
+	ring, err := g.fetch(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	users := []User{}
+	for _, key := range ring {
+		user := entityToUser(key)
+		user.Username = query
+		user.GitHub = query
+
+		users = append(users, user)
+	}
+
+	return mergeUsers(users), nil
+}
+
+// Key gets the GPG key matching the user's fingerprint from the user's GitHub
+// account. If there isn't exactly one, Key returns an error, and if the
+// account only has other keys, that's ErrFingerprintMismatch.
+func (g GitHubService) Key(ctx context.Context, user User) (openpgp.EntityList, error) {
+	if err := checkKeyID(user.Fingerprint); err != nil {
+		return nil, err
+	}
+
+	ring, err := g.fetch(ctx, user.GitHub)
+	if err != nil {
+		return nil, err
+	}
+
+	return fetchedKey(ring, user.Fingerprint)
+}
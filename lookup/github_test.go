@@ -0,0 +1,110 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package lookup
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type GitHubTest struct {
+	suite.Suite
+}
+
+func (s *GitHubTest) server(body []byte) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/foo.gpg":
+			w.Write(body)
+		case "/nokeys.gpg":
+			fmt.Fprint(w, "This user hasn't uploaded any GPG keys.")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func (s *GitHubTest) TestNewGitHubServiceDefaultsToGitHub() {
+	s.Equal(DefaultGitHubURL, NewGitHubService("").base)
+	s.Equal("https://github.example.com", NewGitHubService("https://github.example.com/").base)
+}
+
+func (s *GitHubTest) TestMatchesReadsEveryKey() {
+	other := newTestEntity(s.T(), "Other", "other@example.com")
+	body := armorTestRing(s.T(), readTestRing(s.T(), "testdata/pubring.gpg")...)
+	body = append(body, '\n')
+	body = append(body, armorTestRing(s.T(), other)...)
+
+	server := s.server(body)
+	defer server.Close()
+
+	users, err := NewGitHubService(server.URL).Matches(context.Background(), "foo")
+
+	s.NoError(err)
+	s.Require().Len(users, 2)
+
+	// users come back sorted by fingerprint, and other's is random
+	if users[0].Fingerprint != fixtureFingerprint {
+		users[0], users[1] = users[1], users[0]
+	}
+	s.Equal(fixtureFingerprint, users[0].Fingerprint)
+	s.Equal("foo", users[0].GitHub)
+	s.Equal([]string{"test@example.com"}, users[0].Emails)
+	s.Equal(keyFingerprint(other), users[1].Fingerprint)
+}
+
+func (s *GitHubTest) TestMatchesFailsForMissingUsers() {
+	server := s.server(nil)
+	defer server.Close()
+
+	_, err := NewGitHubService(server.URL).Matches(context.Background(), "bar")
+	s.Error(err)
+	s.Contains(err.Error(), "not found")
+}
+
+func (s *GitHubTest) TestMatchesFailsWithoutKeys() {
+	server := s.server(nil)
+	defer server.Close()
+
+	_, err := NewGitHubService(server.URL).Matches(context.Background(), "nokeys")
+	s.Error(err)
+	s.Contains(err.Error(), "hasn't uploaded any GPG keys")
+}
+
+func (s *GitHubTest) TestMatchesRejectsBadUsernames() {
+	_, err := NewGitHubService("").Matches(context.Background(), "../foo")
+	s.Error(err)
+}
+
+func (s *GitHubTest) TestKeyPicksRequestedKey() {
+	other := newTestEntity(s.T(), "Other", "other@example.com")
+	body := armorTestRing(s.T(), append(readTestRing(s.T(), "testdata/pubring.gpg"), other)...)
+
+	server := s.server(body)
+	defer server.Close()
+
+	ring, err := NewGitHubService(server.URL).Key(context.Background(), User{GitHub: "foo", Fingerprint: fixtureFingerprint})
+
+	s.NoError(err)
+	s.Len(ring, 1)
+	s.Equal(fixtureKeyID, ring[0].PrimaryKey.KeyIdString())
+
+	_, err = NewGitHubService(server.URL).Key(context.Background(), User{GitHub: "foo", Fingerprint: "1111111111111111"})
+	s.Error(err)
+}
+
+func TestGitHubTest(t *testing.T) {
+	suite.Run(t, new(GitHubTest))
+}
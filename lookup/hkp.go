@@ -0,0 +1,436 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package lookup
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// DefaultHKPServer is the keyserver RemoteHKPService uses when it isn't given
+// one.
+const DefaultHKPServer = "hkps://keyserver.ubuntu.com"
+
+// hkpLookupPath is where the lookups are on a standard HKP keyserver, as a
+// template for RemoteHKPService.
+const hkpLookupPath = "/pks/lookup?op={op}&options=mr&search={search}"
+
+// RemoteHKPService implements the KeyService interface for an HKP keyserver,
+// or a list of mirrors of one.
+type RemoteHKPService struct {
+	remote
+
+	// mirrors are the keyservers to try, in order
+	mirrors []hkpMirror
+}
+
+// hkpMirror is one of the keyservers a RemoteHKPService tries.
+type hkpMirror struct {
+	server string
+
+	// template is the lookup URL, with {op} and {search} to fill in
+	template string
+}
+
+// NewRemoteHKPService creates a RemoteHKPService for server, which can be an
+// hkp://, hkps://, http:// or https:// URL. If server is empty,
+// DefaultHKPServer is used.
+//
+// Keyservers that don't have their lookups at the standard /pks/lookup can be
+// given as a URL template instead, with {search} where the search term goes,
+// and optionally {op} for "index" or "get", like
+// https://keys.example.com/api/{op}?q={search}. The search term is escaped
+// for wherever it ends up, in the path or in the query string.
+func NewRemoteHKPService(server string, options ...RemoteOption) (*RemoteHKPService, error) {
+	return NewRemoteHKPMirrors([]string{server}, options...)
+}
+
+// NewRemoteHKPMirrors creates a RemoteHKPService that tries each of servers
+// in order, until one of them answers with what was asked for: a mirror that
+// fails, or doesn't have the key (with a 404 or otherwise), just means asking
+// the next one. Each server is given the same way as to NewRemoteHKPService.
+// If servers is empty, DefaultHKPServer is used.
+func NewRemoteHKPMirrors(servers []string, options ...RemoteOption) (*RemoteHKPService, error) {
+	if len(servers) == 0 {
+		servers = []string{""}
+	}
+
+	service := &RemoteHKPService{remote: newRemote(options)}
+	for _, server := range servers {
+		mirror, err := newHKPMirror(server)
+		if err != nil {
+			return nil, err
+		}
+		service.mirrors = append(service.mirrors, mirror)
+	}
+
+	return service, nil
+}
+
+// newHKPMirror works out where the lookups are for server, which is a URL or
+// a URL template the way NewRemoteHKPService takes them.
+func newHKPMirror(server string) (hkpMirror, error) {
+	if server == "" {
+		server = DefaultHKPServer
+	}
+
+	isTemplate := strings.Contains(server, "{")
+	if isTemplate {
+		if err := checkHKPTemplate(server); err != nil {
+			return hkpMirror{}, err
+		}
+	}
+
+	// the placeholders aren't URL material, so check the URL with them
+	// filled in; they can't be in the host, since then it wouldn't match
+	parsed, err := url.Parse(expandHKPTemplate(server, "index", "test"))
+	if err != nil || parsed.Host == "" {
+		return hkpMirror{}, errors.New("Invalid keyserver URL: " + server)
+	}
+	userinfo := ""
+	if parsed.User != nil {
+		userinfo = parsed.User.String() + "@"
+	}
+	prefix := parsed.Scheme + "://" + userinfo + parsed.Host
+	if !strings.HasPrefix(strings.ToLower(server), strings.ToLower(prefix)) {
+		return hkpMirror{}, errors.New("Invalid keyserver URL: " + server)
+	}
+	rest := server[len(prefix):]
+
+	switch parsed.Scheme {
+	case "hkps":
+		parsed.Scheme = "https"
+	case "hkp":
+		// plain HKP lives on 11371 unless somebody says otherwise
+		parsed.Scheme = "http"
+		if parsed.Port() == "" {
+			parsed.Host = parsed.Host + ":11371"
+		}
+	case "http", "https":
+	default:
+		return hkpMirror{}, errors.New("Unsupported keyserver scheme: " + parsed.Scheme)
+	}
+
+	base := parsed.Scheme + "://" + userinfo + parsed.Host + rest
+
+	if isTemplate {
+		return hkpMirror{server: base, template: base}, nil
+	}
+
+	base = strings.TrimRight(base, "/")
+
+	return hkpMirror{server: base, template: base + hkpLookupPath}, nil
+}
+
+// checkHKPTemplate makes sure the only placeholders in template are {op} and
+// {search}, and that {search} is there.
+func checkHKPTemplate(template string) error {
+	rest := template
+	for {
+		start := strings.Index(rest, "{")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(rest[start:], "}")
+		if end < 0 {
+			return errors.New("Unclosed placeholder in keyserver URL: " + template)
+		}
+
+		switch placeholder := rest[start : start+end+1]; placeholder {
+		case "{op}", "{search}":
+		default:
+			return fmt.Errorf("Unknown placeholder %s in keyserver URL: %s (only {op} and {search} are allowed)", placeholder, template)
+		}
+		rest = rest[start+end+1:]
+	}
+
+	if !strings.Contains(template, "{search}") {
+		return errors.New("Keyserver URL template has to have a {search}: " + template)
+	}
+
+	return nil
+}
+
+// expandHKPTemplate fills in the {op} and {search} placeholders in template,
+// escaping each for the path or the query string, wherever it is.
+func expandHKPTemplate(template, op, search string) string {
+	query := strings.Index(template, "?")
+	if query < 0 {
+		query = len(template)
+	}
+
+	expanded := &strings.Builder{}
+	for i := 0; i < len(template); {
+		var placeholder, value string
+		switch {
+		case strings.HasPrefix(template[i:], "{op}"):
+			placeholder, value = "{op}", op
+		case strings.HasPrefix(template[i:], "{search}"):
+			placeholder, value = "{search}", search
+		default:
+			expanded.WriteByte(template[i])
+			i++
+			continue
+		}
+
+		if i > query {
+			expanded.WriteString(url.QueryEscape(value))
+		} else {
+			expanded.WriteString(url.PathEscape(value))
+		}
+		i += len(placeholder)
+	}
+
+	return expanded.String()
+}
+
+// Server is the HTTP(S) location of the keyserver, or its lookup URL template
+// if it was given one. With mirrors, it's the first one.
+func (h RemoteHKPService) Server() string {
+	return h.mirrors[0].server
+}
+
+// Servers is the HTTP(S) location (or lookup URL template) of every mirror,
+// in the order they're tried.
+func (h RemoteHKPService) Servers() []string {
+	servers := []string{}
+	for _, mirror := range h.mirrors {
+		servers = append(servers, mirror.server)
+	}
+
+	return servers
+}
+
+// lookupURL is where to look up search with op ("index" or "get").
+func (m hkpMirror) lookupURL(op, search string) string {
+	return expandHKPTemplate(m.template, op, search)
+}
+
+func (h RemoteHKPService) lookup(ctx context.Context, mirror hkpMirror, op, search string) (io.ReadCloser, error) {
+	get := h.get
+	if op == "get" {
+		get = h.getKey
+	}
+
+	resp, err := get(ctx, mirror.lookupURL(op, search))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, statusError(resp, fmt.Sprintf("Keyserver returned %s for %s", resp.Status, search))
+	}
+
+	return resp.Body, nil
+}
+
+// failover calls try with each mirror in turn, until one of them works. If
+// none do, it returns every mirror's error, in a mirrorError. Once ctx is
+// done, there's no point asking the rest, so it stops there.
+func (h RemoteHKPService) failover(ctx context.Context, try func(hkpMirror) error) error {
+	errs := mirrorError{}
+
+	for _, mirror := range h.mirrors {
+		err := try(mirror)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+
+		if len(h.mirrors) > 1 {
+			logf(h.logger, "keyserver %s failed: %v", mirror.server, err)
+		}
+		errs = append(errs, err)
+	}
+
+	if len(errs) == 1 {
+		return errs[0]
+	}
+
+	return errs
+}
+
+// mirrorError is the errors from every mirror a RemoteHKPService tried, in
+// order.
+type mirrorError []error
+
+func (e mirrorError) Error() string {
+	messages := []string{}
+	for _, err := range e {
+		messages = append(messages, err.Error())
+	}
+
+	return "All keyservers failed: " + strings.Join(messages, "; ")
+}
+
+// Is makes errors.Is match target when every mirror's error does, e.g. when
+// none of them have the key.
+func (e mirrorError) Is(target error) bool {
+	for _, err := range e {
+		if !errors.Is(err, target) {
+			return false
+		}
+	}
+
+	return len(e) > 0
+}
+
+// parseIndex reads the machine-readable op=index output: one pub line per key,
+// followed by that key's uid lines. Everything else is ignored. Revoked keys
+// (with an "r" in the pub flags) and expired keys (with an "e" in the flags, or
+// an expiration date that's passed) are marked, so the caller can decide what
+// to do with them.
+func (h RemoteHKPService) parseIndex(body io.Reader) ([]User, error) {
+	users := []User{}
+
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+
+		switch fields[0] {
+		case "pub":
+			if len(fields) < 2 || fields[1] == "" {
+				continue
+			}
+			user := User{Fingerprint: strings.ToUpper(fields[1])}
+			if len(fields) > 6 && strings.Contains(fields[6], "r") {
+				user.Revoked = true
+			}
+			if len(fields) > 6 && strings.Contains(fields[6], "e") {
+				user.Expired = true
+			}
+			if len(fields) > 5 && fields[5] != "" {
+				expiry, err := strconv.ParseInt(fields[5], 10, 64)
+				user.Expired = user.Expired || (err == nil && time.Now().Unix() > expiry)
+			}
+			users = append(users, user)
+		case "uid":
+			if len(fields) < 2 || len(users) == 0 {
+				continue
+			}
+			last := &users[len(users)-1]
+			last.addUserID(fields[1])
+		}
+	}
+
+	return users, scanner.Err()
+}
+
+// partialFingerprint is query as a normalized fingerprint, if it looks like
+// (at least 8 hex characters of) one, or "" if it doesn't.
+func partialFingerprint(query string) string {
+	fingerprint := NormalizeFingerprint(query)
+	if _, err := hex.DecodeString(fingerprint); err != nil || len(fingerprint) < 8 {
+		return ""
+	}
+
+	return fingerprint
+}
+
+// Matches finds all the keys on the keyserver with a key id, fingerprint, or
+// identity that matches query, so the caller can pick one before asking for
+// its Key. A query that looks like part of a fingerprint (with or without
+// spaces or a 0x prefix) is sent as a key id search, and only the keys with
+// that in their fingerprint are kept. With mirrors, the matches come from the
+// first one that finds any. If no matches are found, Matches returns an
+// error.
+func (h RemoteHKPService) Matches(ctx context.Context, query string) ([]User, error) {
+	search := query
+	fingerprint := partialFingerprint(query)
+	if fingerprint != "" {
+		search = "0x" + fingerprint
+	}
+
+	var users []User
+	err := h.failover(ctx, func(mirror hkpMirror) (err error) {
+		users, err = h.matches(ctx, mirror, search, fingerprint)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return mergeUsers(users), nil
+}
+
+// matches does the work for Matches, on one mirror.
+func (h RemoteHKPService) matches(ctx context.Context, mirror hkpMirror, search, fingerprint string) ([]User, error) {
+	body, err := h.lookup(ctx, mirror, "index", search)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	users, err := h.parseIndex(body)
+	if err != nil {
+		return nil, err
+	}
+
+	if fingerprint != "" {
+		found := []User{}
+		for _, user := range users {
+			if strings.Contains(NormalizeFingerprint(user.Fingerprint), fingerprint) {
+				found = append(found, user)
+			}
+		}
+		users = found
+	}
+
+	if len(users) == 0 {
+		return nil, ErrNoMatches
+	}
+
+	return users, nil
+}
+
+// Key gets the PGP public key for a user's fingerprint from the keyserver. The
+// keyserver might send back more than one key, so Key only returns the one
+// that matches the fingerprint; if there isn't exactly one, Key tries the
+// next mirror, and returns an error once there are none left. A keyserver
+// that only sends back other keys fails with ErrFingerprintMismatch.
+func (h RemoteHKPService) Key(ctx context.Context, user User) (openpgp.EntityList, error) {
+	if err := checkKeyID(user.Fingerprint); err != nil {
+		return nil, err
+	}
+	fingerprint := NormalizeFingerprint(user.Fingerprint)
+
+	var ring openpgp.EntityList
+	err := h.failover(ctx, func(mirror hkpMirror) error {
+		body, err := h.lookup(ctx, mirror, "get", "0x"+fingerprint)
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+
+		keys, err := parseKey(body)
+		if err != nil {
+			return err
+		}
+
+		ring, err = fetchedKey(keys, user.Fingerprint)
+		return err
+	})
+
+	return ring, err
+}
@@ -0,0 +1,487 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package lookup
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+const hkpIndex = `info:1:2
+pub:2DEC361C395B52E763A95873A018A3D90DC0FA52:1:2048:1792044699::
+uid:Pipethis Test <test@example.com>:1792044699::
+pub:1111111111111111:1:2048:1792044699::r
+uid:Someone Else <else@example.com>:1792044699::
+uid:Also Someone Else <also@example.com>:1792044699::
+`
+
+// hkpSeveralIndex is an index for a key id search that found the key that
+// was asked for, plus a couple more that the keyserver threw in.
+const hkpSeveralIndex = `info:1:3
+pub:2DEC361C395B52E763A95873A018A3D90DC0FA52:1:2048:1792044699::
+uid:Pipethis Test <test@example.com>:1792044699::
+pub:3333333333333333333333330DC0FA5200000000:1:4096:1792044699::
+uid:Pipethis Lookalike <test@example.com>:1792044699::
+pub:2222222222222222222222222222222222222222:17:2048:1792044699::
+uid:Bystander <bystander@example.com>:1792044699::
+`
+
+// hkpThreeUIDIndex is an index with one key that has three user ids, escaped
+// the way keyservers escape them.
+const hkpThreeUIDIndex = `info:1:1
+pub:2DEC361C395B52E763A95873A018A3D90DC0FA52:1:2048:1792044699::
+uid:Pipethis Test <test@example.com>:1792044699::
+uid:Pipethis Test %28work%29 <test%40work.example.com>:1792044699::
+uid:J%C3%BCrgen %3A Test <juergen@example.com>:1792044699::
+`
+
+type HKPTest struct {
+	suite.Suite
+}
+
+func (s *HKPTest) TestNewRemoteHKPServiceMapsSchemes() {
+	tests := map[string]string{
+		"":                           "https://keyserver.ubuntu.com",
+		"hkps://keys.example.com":    "https://keys.example.com",
+		"hkp://keys.example.com":     "http://keys.example.com:11371",
+		"hkp://keys.example.com:80":  "http://keys.example.com:80",
+		"https://keys.example.com/":  "https://keys.example.com",
+		"http://keys.example.com:81": "http://keys.example.com:81",
+	}
+
+	for server, expected := range tests {
+		service, err := NewRemoteHKPService(server)
+		s.NoError(err, server)
+		s.Equal(expected, service.Server(), server)
+	}
+}
+
+func (s *HKPTest) TestNewRemoteHKPServiceRejectsBadServers() {
+	for _, server := range []string{"ftp://keys.example.com", "keys.example.com", "://"} {
+		_, err := NewRemoteHKPService(server)
+		s.Error(err, server)
+	}
+}
+
+func (s *HKPTest) TestLookupURLs() {
+	tests := map[string][2]string{
+		"https://keys.example.com/internal/": {
+			"https://keys.example.com/internal/pks/lookup?op=index&options=mr&search=alice%2Bpipethis%40example.com",
+			"https://keys.example.com/internal/pks/lookup?op=get&options=mr&search=0x2DEC361C",
+		},
+		"http://keys.corp:8080/api/{op}?q={search}": {
+			"http://keys.corp:8080/api/index?q=alice%2Bpipethis%40example.com",
+			"http://keys.corp:8080/api/get?q=0x2DEC361C",
+		},
+		"hkps://keys.corp/keys/{search}.asc": {
+			"https://keys.corp/keys/alice+pipethis@example.com.asc",
+			"https://keys.corp/keys/0x2DEC361C.asc",
+		},
+		"hkp://keys.corp/lookup?search={search}&kind={op}": {
+			"http://keys.corp:11371/lookup?search=alice%2Bpipethis%40example.com&kind=index",
+			"http://keys.corp:11371/lookup?search=0x2DEC361C&kind=get",
+		},
+	}
+
+	for server, expected := range tests {
+		service, err := NewRemoteHKPService(server)
+		s.Require().NoError(err, server)
+
+		s.Equal(expected[0], service.mirrors[0].lookupURL("index", "alice+pipethis@example.com"), server)
+		s.Equal(expected[1], service.mirrors[0].lookupURL("get", "0x2DEC361C"), server)
+	}
+
+	// a space in the path can't turn into a +
+	service, _ := NewRemoteHKPService("https://keys.corp/keys/{search}")
+	s.Equal("https://keys.corp/keys/Jane%20Doe", service.mirrors[0].lookupURL("index", "Jane Doe"))
+}
+
+func (s *HKPTest) TestTemplateSearchesReachTheServer() {
+	var query string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.Equal("/api/index", r.URL.Path)
+		query = r.URL.Query().Get("q")
+		fmt.Fprint(w, hkpIndex)
+	}))
+	defer server.Close()
+
+	service, err := NewRemoteHKPService(server.URL + "/api/{op}?q={search}")
+	s.Require().NoError(err)
+	_, err = service.Matches(context.Background(), "test+pipethis@example.com")
+
+	s.NoError(err)
+	s.Equal("test+pipethis@example.com", query)
+}
+
+func (s *HKPTest) TestNewRemoteHKPServiceRejectsBadTemplates() {
+	tests := map[string]string{
+		"https://keys.corp/api/{op}":          "Keyserver URL template has to have a {search}: https://keys.corp/api/{op}",
+		"https://keys.corp/api?q={query}":     "Unknown placeholder {query} in keyserver URL: https://keys.corp/api?q={query} (only {op} and {search} are allowed)",
+		"https://keys.corp/api?q={search":     "Unclosed placeholder in keyserver URL: https://keys.corp/api?q={search",
+		"https://{search}.keys.corp/":         "Invalid keyserver URL: https://{search}.keys.corp/",
+		"ftp://keys.corp/api?search={search}": "Unsupported keyserver scheme: ftp",
+	}
+
+	for server, expected := range tests {
+		_, err := NewRemoteHKPService(server)
+		s.EqualError(err, expected, server)
+	}
+}
+
+func (s *HKPTest) TestMatchesParsesIndex() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.Equal("/pks/lookup", r.URL.Path)
+		s.Equal("index", r.URL.Query().Get("op"))
+		s.Equal("mr", r.URL.Query().Get("options"))
+		s.Equal("test@example.com", r.URL.Query().Get("search"))
+		fmt.Fprint(w, hkpIndex)
+	}))
+	defer server.Close()
+
+	service, _ := NewRemoteHKPService(server.URL)
+	users, err := service.Matches(context.Background(), "test@example.com")
+
+	s.NoError(err)
+	s.Len(users, 2)
+	s.Equal("1111111111111111", users[0].Fingerprint)
+	s.Len(users[0].Emails, 2)
+	s.True(users[0].Revoked)
+	s.Equal("2DEC361C395B52E763A95873A018A3D90DC0FA52", users[1].Fingerprint)
+	s.Equal([]string{"test@example.com"}, users[1].Emails)
+	s.Equal([]string{"Pipethis Test"}, users[1].Names)
+	s.False(users[1].Revoked)
+}
+
+func (s *HKPTest) TestMatchesMarksExpiredKeys() {
+	index := `info:1:3
+pub:2DEC361C395B52E763A95873A018A3D90DC0FA52:1:2048:1792044699::
+uid:Pipethis Test <test@example.com>:1792044699::
+pub:1111111111111111111111111111111111111111:1:2048:1000000000:1000086400:
+uid:Expired By Date <test@example.com>:1000000000::
+pub:2222222222222222222222222222222222222222:1:2048:1000000000::e
+uid:Expired By Flag <test@example.com>:1000000000::
+`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, index)
+	}))
+	defer server.Close()
+
+	service, _ := NewRemoteHKPService(server.URL)
+	users, err := service.Matches(context.Background(), "test@example.com")
+	s.Require().NoError(err)
+
+	expired := map[string]bool{}
+	for _, user := range users {
+		expired[user.Fingerprint] = user.Expired
+	}
+	s.Equal(map[string]bool{
+		"2DEC361C395B52E763A95873A018A3D90DC0FA52": false,
+		"1111111111111111111111111111111111111111": true,
+		"2222222222222222222222222222222222222222": true,
+	}, expired)
+}
+
+func (s *HKPTest) TestMatchesKeepsEveryUserID() {
+	var search string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		search = r.URL.Query().Get("search")
+		fmt.Fprint(w, hkpThreeUIDIndex)
+	}))
+	defer server.Close()
+
+	service, _ := NewRemoteHKPService(server.URL)
+	users, err := service.Matches(context.Background(), "test@work.example.com")
+
+	s.NoError(err)
+	s.Equal("test@work.example.com", search)
+	s.Len(users, 1)
+	s.Equal([]string{"juergen@example.com", "test@example.com", "test@work.example.com"}, users[0].Emails)
+	s.Equal([]string{"J\u00fcrgen : Test", "Pipethis Test", "Pipethis Test (work)"}, users[0].Names)
+}
+
+func (s *HKPTest) TestAddUserIDSplitsNameAndEmail() {
+	user := User{}
+	user.addUserID("Jane Doe <jane@example.com>")
+	user.addUserID("bare@example.com")
+	user.addUserID("Just A Name")
+	user.addUserID("Broken %zz <broken@example.com>")
+
+	s.Equal([]string{"jane@example.com", "bare@example.com", "broken@example.com"}, user.Emails)
+	s.Equal([]string{"Jane Doe", "Just A Name", "Broken %zz"}, user.Names)
+}
+
+func (s *HKPTest) TestMatchesSearchesPartialFingerprints() {
+	var search string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.Equal("index", r.URL.Query().Get("op"))
+		search = r.URL.Query().Get("search")
+		fmt.Fprint(w, hkpSeveralIndex)
+	}))
+	defer server.Close()
+
+	service, _ := NewRemoteHKPService(server.URL)
+
+	users, err := service.Matches(context.Background(), "a018 a3d9 0dc0 fa52")
+	s.NoError(err)
+	s.Equal("0xA018A3D90DC0FA52", search)
+	s.Len(users, 1)
+	s.Equal(fixtureFingerprint, users[0].Fingerprint)
+
+	users, err = service.Matches(context.Background(), "0x0DC0FA52")
+	s.NoError(err)
+	s.Equal("0x0DC0FA52", search)
+	s.Len(users, 2)
+
+	_, err = service.Matches(context.Background(), "0xDEADBEEF")
+	s.Error(err)
+
+	users, err = service.Matches(context.Background(), "test@example.com")
+	s.NoError(err)
+	s.Equal("test@example.com", search)
+	s.Len(users, 3)
+}
+
+func (s *HKPTest) TestMatchesFailsWithoutMatches() {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	service, _ := NewRemoteHKPService(server.URL)
+	_, err := service.Matches(context.Background(), "nobody")
+	s.Error(err)
+}
+
+func (s *HKPTest) TestKeyPicksRequestedKey() {
+	other := newTestEntity(s.T(), "Other", "other@example.com")
+	armored := armorTestRing(s.T(), append(readTestRing(s.T(), "testdata/pubring.gpg"), other)...)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.Equal("get", r.URL.Query().Get("op"))
+		s.Equal("0xA018A3D90DC0FA52", r.URL.Query().Get("search"))
+		w.Write(armored)
+	}))
+	defer server.Close()
+
+	service, _ := NewRemoteHKPService(server.URL)
+	ring, err := service.Key(context.Background(), User{Fingerprint: fixtureKeyID})
+
+	s.NoError(err)
+	s.Len(ring, 1)
+	s.Equal(fixtureKeyID, ring[0].PrimaryKey.KeyIdString())
+}
+
+func (s *HKPTest) TestKeyNeedsALongKeyID() {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	}))
+	defer server.Close()
+
+	service, _ := NewRemoteHKPService(server.URL)
+	_, err := service.Key(context.Background(), User{Fingerprint: "0DC0FA52"})
+	s.EqualError(err, "Expected a full fingerprint or a long key id: 0DC0FA52")
+	s.Zero(requests)
+}
+
+func (s *HKPTest) TestKeyAcceptsBinaryKeys() {
+	binary, err := ioutil.ReadFile("testdata/pubring.gpg")
+	s.Require().NoError(err)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.Contains(r.Header.Get("Accept"), "application/pgp-keys")
+		w.Write(binary)
+	}))
+	defer server.Close()
+
+	service, _ := NewRemoteHKPService(server.URL)
+	ring, err := service.Key(context.Background(), User{Fingerprint: fixtureKeyID})
+
+	s.NoError(err)
+	s.Len(ring, 1)
+}
+
+func (s *HKPTest) TestKeyFailsWithoutRequestedKey() {
+	armored := armorTestRing(s.T(), newTestEntity(s.T(), "Other", "other@example.com"))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(armored)
+	}))
+	defer server.Close()
+
+	service, _ := NewRemoteHKPService(server.URL)
+	_, err := service.Key(context.Background(), User{Fingerprint: fixtureKeyID})
+	s.True(errors.Is(err, ErrFingerprintMismatch), err)
+}
+
+func (s *HKPTest) TestMatchesAbortsWhenCancelled() {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	service, _ := NewRemoteHKPService(server.URL)
+
+	start := time.Now()
+	_, err := service.Matches(ctx, "test@example.com")
+
+	s.Error(err)
+	s.True(errors.Is(err, context.Canceled), err.Error())
+	s.True(time.Since(start) < time.Second)
+}
+
+// mirrors starts a fake keyserver for each handler, and a RemoteHKPService
+// that tries them in order. Each server counts its requests in hits.
+func (s *HKPTest) mirrors(handlers ...http.HandlerFunc) (*RemoteHKPService, []int, func()) {
+	hits := make([]int, len(handlers))
+	servers := []*httptest.Server{}
+	urls := []string{}
+	for i, handler := range handlers {
+		i, handler := i, handler
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits[i]++
+			handler(w, r)
+		}))
+		servers = append(servers, server)
+		urls = append(urls, server.URL)
+	}
+
+	service, err := NewRemoteHKPMirrors(urls, WithRetries(0))
+	s.Require().NoError(err)
+
+	return service, hits, func() {
+		for _, server := range servers {
+			server.Close()
+		}
+	}
+}
+
+func (s *HKPTest) TestMatchesFailsOverToTheNextMirror() {
+	index := func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, hkpIndex) }
+	broken := func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down for maintenance", http.StatusServiceUnavailable)
+	}
+
+	for name, first := range map[string]http.HandlerFunc{"404": http.NotFound, "503": broken} {
+		service, hits, done := s.mirrors(first, index, index)
+
+		users, err := service.Matches(context.Background(), "test@example.com")
+		s.NoError(err, name)
+		s.Len(users, 2, name)
+		s.Equal([]int{1, 1, 0}, hits, name)
+		done()
+	}
+}
+
+func (s *HKPTest) TestKeyFailsOverToTheNextMirror() {
+	armored := armorTestRing(s.T(), readTestRing(s.T(), "testdata/pubring.gpg")...)
+	stranger := armorTestRing(s.T(), newTestEntity(s.T(), "Other", "other@example.com"))
+
+	service, hits, done := s.mirrors(
+		http.NotFound,
+		func(w http.ResponseWriter, r *http.Request) { w.Write(stranger) },
+		func(w http.ResponseWriter, r *http.Request) { w.Write(armored) },
+	)
+	defer done()
+
+	ring, err := service.Key(context.Background(), User{Fingerprint: fixtureFingerprint})
+	s.Require().NoError(err)
+	s.Len(ring, 1)
+	s.Equal([]int{1, 1, 1}, hits)
+}
+
+func (s *HKPTest) TestMirrorsOnlyFailTogether() {
+	broken := func(w http.ResponseWriter, r *http.Request) { http.Error(w, "down", http.StatusInternalServerError) }
+
+	service, hits, done := s.mirrors(http.NotFound, broken)
+	defer done()
+
+	_, err := service.Matches(context.Background(), "test@example.com")
+	s.Require().Error(err)
+	s.Equal([]int{1, 1}, hits)
+	s.True(strings.HasPrefix(err.Error(), "All keyservers failed: Keyserver returned 404 Not Found for test@example.com: 404 page not found; "), err.Error())
+	s.Contains(err.Error(), "500 Internal Server Error")
+	s.False(errors.Is(err, ErrKeyNotFound), "only one of them didn't have it")
+
+	// but when none of them has the key, that's what it says
+	service, _, done = s.mirrors(http.NotFound, http.NotFound)
+	defer done()
+
+	_, err = service.Key(context.Background(), User{Fingerprint: fixtureFingerprint})
+	s.True(errors.Is(err, ErrKeyNotFound), err)
+}
+
+func (s *HKPTest) TestNewRemoteHKPMirrorsChecksEveryServer() {
+	_, err := NewRemoteHKPMirrors([]string{"hkps://keys.example.com", "ftp://mirror.example.org"})
+	s.Error(err)
+
+	service, err := NewRemoteHKPMirrors(nil)
+	s.Require().NoError(err)
+	s.Equal([]string{"https://keyserver.ubuntu.com"}, service.Servers())
+}
+
+func TestHKPTest(t *testing.T) {
+	suite.Run(t, new(HKPTest))
+}
+
+// readTestRing loads a binary keyring fixture.
+func readTestRing(t *testing.T, filename string) openpgp.EntityList {
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal("Failed opening the test keyring:", err)
+	}
+	defer f.Close()
+
+	ring, err := openpgp.ReadKeyRing(f)
+	if err != nil {
+		t.Fatal("Failed reading the test keyring:", err)
+	}
+
+	return ring
+}
+
+// armorTestRing serializes the public parts of entities into an armored key
+// block.
+func armorTestRing(t *testing.T, entities ...*openpgp.Entity) []byte {
+	buf := &bytes.Buffer{}
+
+	w, err := armor.Encode(buf, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal("Failed armoring the test keyring:", err)
+	}
+
+	for _, entity := range entities {
+		if err := entity.Serialize(w); err != nil {
+			t.Fatal("Failed writing the test keyring:", err)
+		}
+	}
+	w.Close()
+
+	return buf.Bytes()
+}
@@ -0,0 +1,479 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package lookup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultTimeout is how long a remote KeyService waits for each request
+	// before giving up.
+	DefaultTimeout = 10 * time.Second
+
+	// DefaultRetries is how many more times a remote KeyService tries a
+	// request after a connection error or a 5xx response.
+	DefaultRetries = 2
+
+	// DefaultBackoff is how long a remote KeyService waits before its first
+	// retry. The wait doubles for each retry after that.
+	DefaultBackoff = 250 * time.Millisecond
+
+	// DefaultMaxBodySize is the most a remote KeyService reads from one
+	// response.
+	DefaultMaxBodySize = 10 << 20
+
+	// MaxRetryAfter is the longest a remote KeyService will wait when a
+	// rate-limiting keyserver asks it to (with Retry-After) before trying
+	// again. If the keyserver asks for longer, the service gives up right
+	// away with ErrRateLimited.
+	MaxRetryAfter = 10 * time.Second
+
+	// maxErrorBody is the most that's read from an error response, looking
+	// for the keyserver's explanation.
+	maxErrorBody = 4 << 10
+)
+
+var (
+	// ErrBodyTooLarge means a response was bigger than the service will read.
+	ErrBodyTooLarge = errors.New("Response is too large")
+
+	// ErrOffline means offline mode stopped something that needs the
+	// network.
+	ErrOffline = errors.New("Blocked by offline mode")
+
+	// ErrRateLimited means the keyserver turned the request down (with a
+	// 429) because it's had too many. The *KeyserverError says how long it
+	// asked to be left alone, if it did.
+	ErrRateLimited = errors.New("Keyserver is rate limiting requests")
+
+	// ErrKeyNotFound means the keyserver answered, but it doesn't have what
+	// was asked for (a 404 or 410).
+	ErrKeyNotFound = errors.New("Keyserver doesn't have the key")
+
+	// ErrServerError means the keyserver broke (with a 5xx) trying to
+	// answer.
+	ErrServerError = errors.New("Keyserver failed")
+
+	// ErrProxyBypassed means a SOCKS proxy was asked for, but the service's
+	// HTTP client can't be made to use it, so nothing is sent at all.
+	ErrProxyBypassed = errors.New("Won't send requests around the SOCKS proxy")
+)
+
+// KeyserverError is an answer from a remote KeyService that wasn't what it
+// asked for. It matches ErrRateLimited, ErrKeyNotFound, or ErrServerError
+// (with errors.Is), depending on the status.
+type KeyserverError struct {
+	// StatusCode is the HTTP status the keyserver answered with.
+	StatusCode int
+
+	// Message is the keyserver's own explanation, if it sent one that could
+	// be read (JSON with an "error" or "message", or a line of plain text).
+	Message string
+
+	// RetryAfter is how long a rate-limiting keyserver asked to be left
+	// alone, or zero if it didn't say.
+	RetryAfter time.Duration
+
+	// what says who answered, and what they were asked for.
+	what string
+}
+
+func (e *KeyserverError) Error() string {
+	message := e.what
+	if e.Message != "" {
+		message += ": " + e.Message
+	}
+	if e.RetryAfter > 0 {
+		message += fmt.Sprintf(" (try again in %s)", e.RetryAfter)
+	}
+
+	return message
+}
+
+// Is makes errors.Is match the Err that goes with the status.
+func (e *KeyserverError) Is(target error) bool {
+	switch target {
+	case ErrRateLimited:
+		return e.StatusCode == http.StatusTooManyRequests
+	case ErrKeyNotFound:
+		return e.StatusCode == http.StatusNotFound || e.StatusCode == http.StatusGone
+	case ErrServerError:
+		return e.StatusCode >= http.StatusInternalServerError
+	}
+
+	return false
+}
+
+// statusError reads what it can of resp's body for the keyserver's
+// explanation, and turns resp into a *KeyserverError. what is the start of
+// the error message, saying who answered and what for.
+func statusError(resp *http.Response, what string) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+
+	return &KeyserverError{
+		StatusCode: resp.StatusCode,
+		Message:    errorMessage(resp.Header.Get("Content-Type"), body),
+		RetryAfter: retryAfter(resp),
+		what:       what,
+	}
+}
+
+// errorMessage digs the explanation out of an error response body, if it's
+// JSON or plain text. HTML error pages are no use to anyone, so they're
+// skipped.
+func errorMessage(contentType string, body []byte) string {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+
+	switch mediaType {
+	case "application/json", "application/problem+json":
+		var parsed struct {
+			Error   string `json:"error"`
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(body, &parsed) != nil {
+			return ""
+		}
+		if parsed.Error != "" {
+			return parsed.Error
+		}
+		return parsed.Message
+	case "text/plain":
+		line := strings.TrimSpace(strings.SplitN(string(body), "\n", 2)[0])
+		if len(line) > 200 {
+			line = line[:200] + "..."
+		}
+		return line
+	}
+
+	return ""
+}
+
+// retryAfter is how long resp's Retry-After header (in seconds, or as a date)
+// asks to wait, or zero if it doesn't say.
+func retryAfter(resp *http.Response) time.Duration {
+	header := strings.TrimSpace(resp.Header.Get("Retry-After"))
+	if header == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(header); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if date, err := http.ParseTime(header); err == nil && time.Until(date) > 0 {
+		return time.Until(date).Round(time.Second)
+	}
+
+	return 0
+}
+
+// defaultTransport is what remote services' clients use unless they're given
+// their own. It's http.DefaultTransport, which sends requests through the
+// proxy in HTTP_PROXY or HTTPS_PROXY (except for hosts in NO_PROXY), spelled
+// out so it stays that way.
+var defaultTransport = newTransport(http.ProxyFromEnvironment)
+
+// defaultClient is used by remote services that weren't given a client.
+var defaultClient = &http.Client{Timeout: DefaultTimeout, Transport: defaultTransport}
+
+// newTransport is a copy of http.DefaultTransport that picks its proxy with
+// proxy.
+func newTransport(proxy func(*http.Request) (*url.URL, error)) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = proxy
+
+	return transport
+}
+
+// remote holds the HTTP settings shared by the KeyServices that make
+// requests. Its zero value uses defaultClient, never retries, and reads
+// responses of any size.
+type remote struct {
+	client  *http.Client
+	retries int
+	backoff time.Duration
+	logger  Logger
+	maxBody int64
+	offline bool
+	proxy   *url.URL
+
+	// bypassed is set when proxy is a SOCKS proxy that client won't use
+	bypassed bool
+}
+
+// RemoteOption changes how a remote KeyService makes its requests.
+type RemoteOption func(*remote)
+
+// WithTimeout gives the service a client that gives up on each request after
+// timeout.
+func WithTimeout(timeout time.Duration) RemoteOption {
+	return func(r *remote) {
+		r.client = &http.Client{Timeout: timeout, Transport: defaultTransport}
+	}
+}
+
+// WithHTTPClient makes the service use client for its requests.
+func WithHTTPClient(client *http.Client) RemoteOption {
+	return func(r *remote) {
+		r.client = client
+	}
+}
+
+// WithRetries sets how many times the service retries a failed request. Zero
+// turns retries off.
+func WithRetries(retries int) RemoteOption {
+	return func(r *remote) {
+		r.retries = retries
+	}
+}
+
+// WithBackoff sets how long the service waits before its first retry.
+func WithBackoff(backoff time.Duration) RemoteOption {
+	return func(r *remote) {
+		r.backoff = backoff
+	}
+}
+
+// WithMaxBodySize sets the most the service reads from one response. Zero
+// means there's no limit.
+func WithMaxBodySize(size int64) RemoteOption {
+	return func(r *remote) {
+		r.maxBody = size
+	}
+}
+
+// WithLogger makes the service log each request to logger.
+func WithLogger(logger Logger) RemoteOption {
+	return func(r *remote) {
+		r.logger = logger
+	}
+}
+
+// WithOffline keeps the service off the network: every request fails with
+// ErrOffline, and the service factories refuse to create remote services at
+// all.
+func WithOffline() RemoteOption {
+	return func(r *remote) {
+		r.offline = true
+	}
+}
+
+// WithProxy sends every request through the proxy at proxy, whatever the
+// environment says. It works with WithTimeout, and with WithHTTPClient as long
+// as the client's Transport is an *http.Transport (or nil); any other
+// Transport is left alone, since there's no telling how it connects. A SOCKS
+// proxy (socks5:// or socks5h://) is the exception: see WithSOCKS5.
+func WithProxy(proxy *url.URL) RemoteOption {
+	return func(r *remote) {
+		r.proxy = proxy
+	}
+}
+
+// WithSOCKS5 sends every request through the SOCKS5 proxy at address (like
+// DefaultTorProxy), host names and all, so the requests don't go through the
+// local resolver either. It's WithProxy with a socks5h:// URL, except that
+// it fails closed: if the service's client can't be made to use the proxy,
+// every request fails with ErrProxyBypassed.
+func WithSOCKS5(address string) RemoteOption {
+	return WithProxy(&url.URL{Scheme: "socks5h", Host: address})
+}
+
+// DefaultTorProxy is where Tor listens for SOCKS connections, unless it's
+// been told otherwise.
+const DefaultTorProxy = "127.0.0.1:9050"
+
+// ParseProxy parses a proxy URL for WithProxy: http://, https://, socks5://,
+// or socks5h:// (which Go treats the same as socks5://: host names are always
+// resolved by the proxy). "tor" is short for socks5h://127.0.0.1:9050.
+func ParseProxy(raw string) (*url.URL, error) {
+	if raw == "tor" {
+		return &url.URL{Scheme: "socks5h", Host: DefaultTorProxy}, nil
+	}
+
+	proxy, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("Bad proxy URL %q: %w", raw, err)
+	}
+
+	switch proxy.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("Bad proxy URL %q: the scheme has to be http, https, socks5, or socks5h", raw)
+	}
+	if proxy.Host == "" {
+		return nil, fmt.Errorf("Bad proxy URL %q: there's no host", raw)
+	}
+
+	return proxy, nil
+}
+
+// isSOCKS is true when proxy is a SOCKS proxy.
+func isSOCKS(proxy *url.URL) bool {
+	return proxy.Scheme == "socks5" || proxy.Scheme == "socks5h"
+}
+
+// isOffline is true when options include WithOffline.
+func isOffline(options []RemoteOption) bool {
+	return newRemote(options).offline
+}
+
+// newRemote applies options on top of the defaults.
+func newRemote(options []RemoteOption) remote {
+	r := remote{client: defaultClient, retries: DefaultRetries, backoff: DefaultBackoff, maxBody: DefaultMaxBodySize}
+	for _, option := range options {
+		option(&r)
+	}
+
+	if r.proxy != nil {
+		client, ok := proxyClient(r.client, r.proxy)
+		r.client = client
+		r.bypassed = !ok && isSOCKS(r.proxy)
+	}
+
+	return r
+}
+
+// proxyClient is a copy of client that connects through proxy, if client's
+// Transport can be told to. Otherwise it's client, and ok is false.
+func proxyClient(client *http.Client, proxy *url.URL) (proxied *http.Client, ok bool) {
+	transport, ok := client.Transport.(*http.Transport)
+	if client.Transport == nil {
+		transport, ok = http.DefaultTransport.(*http.Transport)
+	}
+	if !ok {
+		return client, false
+	}
+
+	copied := *client
+	transport = transport.Clone()
+	transport.Proxy = http.ProxyURL(proxy)
+	copied.Transport = transport
+
+	return &copied, true
+}
+
+// keyAccept is the Accept header for key downloads. Servers are free to ignore
+// it, so what comes back gets sniffed anyway.
+const keyAccept = "application/pgp-keys, application/octet-stream;q=0.9, */*;q=0.8"
+
+// getKey fetches the key (or keys) at location like get, but asks for them as
+// application/pgp-keys.
+func (r remote) getKey(ctx context.Context, location string) (*http.Response, error) {
+	return r.request(ctx, location, keyAccept)
+}
+
+// get fetches location, retrying connection errors, 5xx responses, and 429s
+// with exponential backoff. A 429 that asks (with Retry-After) for a longer
+// wait gets it, up to MaxRetryAfter; past that, it isn't retried at all. Once
+// the retries run out, get returns whatever the last attempt got, so the
+// caller can report it. It gives up as soon as ctx is done. Reading more than
+// the size limit from the response body fails with ErrBodyTooLarge. In offline
+// mode, get fails with ErrOffline without making any requests.
+func (r remote) get(ctx context.Context, location string) (*http.Response, error) {
+	return r.request(ctx, location, "")
+}
+
+// request is get, with an Accept header if accept isn't empty.
+func (r remote) request(ctx context.Context, location, accept string) (*http.Response, error) {
+	if r.offline {
+		return nil, fmt.Errorf("%w: won't fetch %s", ErrOffline, location)
+	}
+	if r.bypassed {
+		return nil, fmt.Errorf("%w: won't fetch %s", ErrProxyBypassed, location)
+	}
+
+	client := r.client
+	if client == nil {
+		client = defaultClient
+	}
+
+	wait := r.backoff
+	for attempt := 0; ; attempt++ {
+		logf(r.logger, "querying %s", location)
+		resp, err := httpGet(ctx, client, location, accept)
+
+		retry := err != nil || resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests
+		if err == nil && resp.StatusCode == http.StatusTooManyRequests {
+			if after := retryAfter(resp); after > MaxRetryAfter {
+				retry = false
+			} else if after > wait {
+				wait = after
+			}
+		}
+
+		if !retry || attempt >= r.retries || ctx.Err() != nil {
+			if err == nil && r.maxBody > 0 {
+				resp.Body = &limitedBody{ReadCloser: resp.Body, remaining: r.maxBody}
+			}
+			return resp, err
+		}
+
+		if resp != nil {
+			resp.Body.Close()
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+}
+
+// limitedBody is a response body that fails with ErrBodyTooLarge instead of
+// reading past remaining bytes.
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (l *limitedBody) Read(p []byte) (int, error) {
+	// ask for one byte past the limit, to find out if there is one
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+
+	n, err := l.ReadCloser.Read(p)
+	if int64(n) > l.remaining {
+		n = int(l.remaining)
+		l.remaining = 0
+		return n, ErrBodyTooLarge
+	}
+	l.remaining -= int64(n)
+
+	return n, err
+}
+
+// httpGet fetches location with client, and gives up as soon as ctx is done.
+// If accept isn't empty, it's sent as the Accept header.
+func httpGet(ctx context.Context, client *http.Client, location, accept string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", location, nil)
+	if err != nil {
+		return nil, err
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+
+	return client.Do(req)
+}
@@ -0,0 +1,541 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package lookup
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type HTTPTest struct {
+	suite.Suite
+}
+
+// flakyServer fails the first failures requests with a 503, and serves the
+// HKP index after that.
+func (s *HTTPTest) flakyServer(failures int, requests *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requests++
+		if *requests <= failures {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, hkpIndex)
+	}))
+}
+
+func (s *HTTPTest) TestRetriesUntilSuccess() {
+	requests := 0
+	server := s.flakyServer(2, &requests)
+	defer server.Close()
+
+	service, _ := NewRemoteHKPService(server.URL, WithRetries(2), WithBackoff(time.Millisecond))
+	users, err := service.Matches(context.Background(), "test@example.com")
+
+	s.NoError(err)
+	s.Len(users, 2)
+	s.Equal(3, requests)
+}
+
+func (s *HTTPTest) TestGivesUpAfterRetries() {
+	requests := 0
+	server := s.flakyServer(5, &requests)
+	defer server.Close()
+
+	service, _ := NewRemoteHKPService(server.URL, WithRetries(1), WithBackoff(time.Millisecond))
+	_, err := service.Matches(context.Background(), "test@example.com")
+
+	s.EqualError(err, "Keyserver returned 503 Service Unavailable for test@example.com: try again")
+	s.Equal(2, requests)
+}
+
+func (s *HTTPTest) TestDoesNotRetryClientErrors() {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+
+	service, _ := NewRemoteHKPService(server.URL, WithBackoff(time.Millisecond))
+	_, err := service.Matches(context.Background(), "test@example.com")
+
+	s.Error(err)
+	s.Equal(1, requests)
+}
+
+func (s *HTTPTest) TestRetriesConnectionErrors() {
+	server := httptest.NewServer(http.NotFoundHandler())
+	location := server.URL
+	server.Close()
+
+	start := time.Now()
+	r := newRemote([]RemoteOption{WithRetries(2), WithBackoff(10 * time.Millisecond)})
+	_, err := r.get(context.Background(), location)
+
+	s.Error(err)
+	s.True(time.Since(start) >= 30*time.Millisecond)
+}
+
+func (s *HTTPTest) TestTimeoutGivesUp() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer server.Close()
+
+	r := newRemote([]RemoteOption{WithTimeout(20 * time.Millisecond), WithRetries(0)})
+	_, err := r.get(context.Background(), server.URL)
+
+	s.Error(err)
+}
+
+func (s *HTTPTest) TestLogsRequests() {
+	requests := 0
+	server := s.flakyServer(1, &requests)
+	defer server.Close()
+
+	var buf bytes.Buffer
+	service, _ := NewRemoteHKPService(server.URL, WithBackoff(time.Millisecond), WithLogger(log.New(&buf, "", 0)))
+	_, err := service.Matches(context.Background(), "test@example.com")
+
+	s.NoError(err)
+	s.Equal(2, strings.Count(buf.String(), "querying "+server.URL+"/pks/lookup?"), buf.String())
+}
+
+func (s *HTTPTest) TestNewRemoteUsesDefaults() {
+	r := newRemote(nil)
+
+	s.Equal(DefaultTimeout, r.client.Timeout)
+	s.Equal(DefaultRetries, r.retries)
+	s.Equal(DefaultBackoff, r.backoff)
+	s.Equal(int64(DefaultMaxBodySize), r.maxBody)
+}
+
+func (s *HTTPTest) TestLimitsResponseSize() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, hkpIndex)
+	}))
+	defer server.Close()
+
+	service, _ := NewRemoteHKPService(server.URL, WithMaxBodySize(int64(len(hkpIndex))))
+	users, err := service.Matches(context.Background(), "test@example.com")
+	s.NoError(err)
+	s.Len(users, 2)
+
+	service, _ = NewRemoteHKPService(server.URL, WithMaxBodySize(int64(len(hkpIndex)-1)))
+	_, err = service.Matches(context.Background(), "test@example.com")
+	s.True(errors.Is(err, ErrBodyTooLarge), err)
+}
+
+func (s *HTTPTest) TestOfflineMakesNoRequests() {
+	requests := 0
+	server := s.flakyServer(0, &requests)
+	defer server.Close()
+
+	// going around NewRemoteService, which wouldn't create it at all
+	service := &RemoteHKPService{remote: newRemote([]RemoteOption{WithOffline()}), mirrors: []hkpMirror{{server: server.URL, template: server.URL + hkpLookupPath}}}
+	_, err := service.Matches(context.Background(), "test@example.com")
+
+	s.True(errors.Is(err, ErrOffline), err)
+	s.Contains(err.Error(), "offline mode")
+	s.Zero(requests)
+}
+
+// statusServer answers every request with status, the headers, and body (as
+// JSON), and counts the requests it gets.
+func (s *HTTPTest) statusServer(status int, headers map[string]string, body string, requests *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requests++
+		w.Header().Set("Content-Type", "application/json")
+		for name, value := range headers {
+			w.Header().Set(name, value)
+		}
+		w.WriteHeader(status)
+		fmt.Fprint(w, body)
+	}))
+}
+
+func (s *HTTPTest) TestRateLimitedWithRetryAfter() {
+	requests := 0
+	server := s.statusServer(http.StatusTooManyRequests, map[string]string{"Retry-After": "120"}, `{"error": "Slow down"}`, &requests)
+	defer server.Close()
+
+	service := NewVKSService(server.URL, WithBackoff(time.Millisecond))
+	_, err := service.Matches(context.Background(), "test@example.com")
+
+	var keyserverErr *KeyserverError
+	s.Require().True(errors.As(err, &keyserverErr), err)
+	s.True(errors.Is(err, ErrRateLimited))
+	s.False(errors.Is(err, ErrServerError))
+	s.Equal(2*time.Minute, keyserverErr.RetryAfter)
+	s.Equal("Slow down", keyserverErr.Message)
+	s.Contains(err.Error(), "try again in 2m0s")
+
+	// two minutes is too long to wait around for a retry
+	s.Equal(1, requests)
+}
+
+func (s *HTTPTest) TestRateLimitedRetriesShortWaits() {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		fmt.Fprint(w, hkpIndex)
+	}))
+	defer server.Close()
+
+	service, _ := NewRemoteHKPService(server.URL, WithBackoff(time.Millisecond))
+	_, err := service.Matches(context.Background(), "test@example.com")
+
+	s.NoError(err)
+	s.Equal(2, requests)
+}
+
+func (s *HTTPTest) TestKeyNotFound() {
+	requests := 0
+	server := s.statusServer(http.StatusNotFound, nil, `{"error": "No key found for fingerprint"}`, &requests)
+	defer server.Close()
+
+	service, _ := NewRemoteHKPService(server.URL)
+	_, err := service.Matches(context.Background(), "test@example.com")
+
+	s.True(errors.Is(err, ErrKeyNotFound), err)
+	s.False(errors.Is(err, ErrRateLimited))
+	s.EqualError(err, "Keyserver returned 404 Not Found for test@example.com: No key found for fingerprint")
+
+	// VKS has its own name for it
+	_, err = NewVKSService(server.URL).Matches(context.Background(), "test@example.com")
+	s.True(errors.Is(err, ErrKeyNotFound), err)
+	s.Equal(ErrNoVerifiedKey, err)
+}
+
+func (s *HTTPTest) TestServerError() {
+	requests := 0
+	server := s.statusServer(http.StatusInternalServerError, map[string]string{"Content-Type": "text/html"}, "<html>Oops</html>", &requests)
+	defer server.Close()
+
+	service, _ := NewRemoteHKPService(server.URL, WithRetries(1), WithBackoff(time.Millisecond))
+	_, err := service.Matches(context.Background(), "test@example.com")
+
+	s.True(errors.Is(err, ErrServerError), err)
+	s.False(errors.Is(err, ErrKeyNotFound))
+
+	// HTML error pages aren't worth repeating
+	s.EqualError(err, "Keyserver returned 500 Internal Server Error for test@example.com")
+	s.Equal(2, requests)
+}
+
+// proxyServer is a plain HTTP proxy that serves the HKP index for
+// keyserver.example, and counts the requests it gets.
+func (s *HTTPTest) proxyServer(requests *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requests++
+		if r.URL.Host != "keyserver.example" {
+			http.Error(w, "unexpected host "+r.URL.Host, http.StatusBadGateway)
+			return
+		}
+		fmt.Fprint(w, hkpIndex)
+	}))
+}
+
+func (s *HTTPTest) TestWithProxyRoutesThroughProxy() {
+	requests := 0
+	proxy := s.proxyServer(&requests)
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+
+	options := [][]RemoteOption{
+		{WithProxy(proxyURL)},
+		{WithProxy(proxyURL), WithTimeout(time.Second)},
+		{WithHTTPClient(&http.Client{}), WithProxy(proxyURL)},
+	}
+
+	for i, option := range options {
+		service, _ := NewRemoteHKPService("http://keyserver.example", option...)
+		users, err := service.Matches(context.Background(), "test@example.com")
+
+		s.NoError(err, i)
+		s.Len(users, 2, i)
+		s.Equal(i+1, requests, i)
+	}
+}
+
+func (s *HTTPTest) TestProxyFromEnvironment() {
+	requests := 0
+	proxy := s.proxyServer(&requests)
+	defer proxy.Close()
+
+	// http.ProxyFromEnvironment only reads the environment once per process,
+	// so this has to happen in a fresh one
+	cmd := exec.Command(os.Args[0], "-test.run=^TestProxyFromEnvironmentChild$")
+	cmd.Env = append(os.Environ(), "PIPETHIS_PROXY_CHILD=1", "HTTP_PROXY="+proxy.URL, "http_proxy=", "NO_PROXY=", "no_proxy=")
+	out, err := cmd.CombinedOutput()
+
+	s.NoError(err, string(out))
+	s.Equal(1, requests)
+}
+
+// TestProxyFromEnvironmentChild is the other half of
+// HTTPTest.TestProxyFromEnvironment.
+func TestProxyFromEnvironmentChild(t *testing.T) {
+	if os.Getenv("PIPETHIS_PROXY_CHILD") == "" {
+		t.Skip("Only run by TestProxyFromEnvironment")
+	}
+
+	service, _ := NewRemoteHKPService("http://keyserver.example")
+	if _, err := service.Matches(context.Background(), "test@example.com"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// socksServer is a SOCKS5 proxy that connects everything to backend, and
+// keeps track of the addresses it was asked for. If hang is set, it takes
+// connections but never answers them.
+type socksServer struct {
+	listener net.Listener
+	backend  string
+	hang     bool
+
+	mu      sync.Mutex
+	targets []string
+}
+
+func newSOCKSServer(s *HTTPTest, backend string, hang bool) *socksServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	s.Require().NoError(err)
+
+	proxy := &socksServer{listener: listener, backend: backend, hang: hang}
+	go proxy.serve()
+
+	return proxy
+}
+
+func (p *socksServer) Addr() string {
+	return p.listener.Addr().String()
+}
+
+func (p *socksServer) Close() {
+	p.listener.Close()
+}
+
+// Targets is every address the proxy has been asked to connect to, or
+// "hung" for each connection it didn't answer.
+func (p *socksServer) Targets() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return append([]string{}, p.targets...)
+}
+
+func (p *socksServer) serve() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		go p.handle(conn)
+	}
+}
+
+func (p *socksServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	if p.hang {
+		p.record("hung")
+		io.Copy(ioutil.Discard, conn)
+		return
+	}
+
+	// greeting: version, and the auth methods; only "none" is offered back
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return
+	}
+	if _, err := io.ReadFull(conn, make([]byte, header[1])); err != nil {
+		return
+	}
+	conn.Write([]byte{5, 0})
+
+	// request: version, CONNECT, reserved, then the address
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return
+	}
+	var host string
+	switch request[3] {
+	case 1:
+		ip := make([]byte, net.IPv4len)
+		io.ReadFull(conn, ip)
+		host = net.IP(ip).String()
+	case 3:
+		length := make([]byte, 1)
+		io.ReadFull(conn, length)
+		name := make([]byte, length[0])
+		io.ReadFull(conn, name)
+		host = string(name)
+	default:
+		return
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return
+	}
+	p.record(net.JoinHostPort(host, fmt.Sprint(int(port[0])<<8|int(port[1]))))
+
+	backend, err := net.Dial("tcp", p.backend)
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer backend.Close()
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+
+	go io.Copy(backend, conn)
+	io.Copy(conn, backend)
+}
+
+func (p *socksServer) record(target string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.targets = append(p.targets, target)
+}
+
+func (s *HTTPTest) TestWithSOCKS5RoutesThroughProxy() {
+	requests := 0
+	backend := s.flakyServer(0, &requests)
+	defer backend.Close()
+	proxy := newSOCKSServer(s, backend.Listener.Addr().String(), false)
+	defer proxy.Close()
+	proxyURL, err := ParseProxy("socks5://" + proxy.Addr())
+	s.Require().NoError(err)
+
+	options := [][]RemoteOption{
+		{WithSOCKS5(proxy.Addr())},
+		{WithSOCKS5(proxy.Addr()), WithTimeout(time.Second)},
+		{WithHTTPClient(&http.Client{}), WithProxy(proxyURL)},
+	}
+
+	for i, option := range options {
+		// keyserver.example doesn't resolve, so the proxy has to do it
+		service, _ := NewRemoteHKPService("http://keyserver.example", option...)
+		users, err := service.Matches(context.Background(), "test@example.com")
+
+		s.NoError(err, i)
+		s.Len(users, 2, i)
+		s.Equal(i+1, requests, i)
+	}
+
+	s.Equal([]string{"keyserver.example:80", "keyserver.example:80", "keyserver.example:80"}, proxy.Targets())
+}
+
+func (s *HTTPTest) TestSOCKS5RetriesAndTimeouts() {
+	requests := 0
+	backend := s.flakyServer(2, &requests)
+	defer backend.Close()
+	proxy := newSOCKSServer(s, backend.Listener.Addr().String(), false)
+	defer proxy.Close()
+
+	service, _ := NewRemoteHKPService("http://keyserver.example", WithSOCKS5(proxy.Addr()), WithRetries(2), WithBackoff(time.Millisecond))
+	users, err := service.Matches(context.Background(), "test@example.com")
+
+	s.NoError(err)
+	s.Len(users, 2)
+	s.Equal(3, requests)
+	for _, target := range proxy.Targets() {
+		s.Equal("keyserver.example:80", target)
+	}
+
+	// a proxy that never answers runs into the timeout on every attempt
+	hung := newSOCKSServer(s, "", true)
+	defer hung.Close()
+
+	service, _ = NewRemoteHKPService("http://keyserver.example", WithSOCKS5(hung.Addr()), WithTimeout(50*time.Millisecond), WithRetries(1), WithBackoff(time.Millisecond))
+	start := time.Now()
+	_, err = service.Matches(context.Background(), "test@example.com")
+
+	s.Error(err)
+	s.Less(int64(time.Since(start)), int64(5*time.Second))
+	s.Equal([]string{"hung", "hung"}, hung.Targets())
+}
+
+// countingTransport is an http.RoundTripper that only counts its requests.
+type countingTransport struct {
+	requests int
+}
+
+func (c *countingTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	c.requests++
+	return nil, errors.New("not connected")
+}
+
+func (s *HTTPTest) TestWithSOCKS5FailsClosed() {
+	transport := &countingTransport{}
+
+	service, _ := NewRemoteHKPService("http://keyserver.example", WithHTTPClient(&http.Client{Transport: transport}), WithSOCKS5(DefaultTorProxy))
+	_, err := service.Matches(context.Background(), "test@example.com")
+
+	s.True(errors.Is(err, ErrProxyBypassed), err)
+	s.Equal(0, transport.requests)
+
+	// plain HTTP proxies keep the old behavior
+	proxyURL, _ := url.Parse("http://proxy.example")
+	service, _ = NewRemoteHKPService("http://keyserver.example", WithHTTPClient(&http.Client{Transport: transport}), WithProxy(proxyURL), WithRetries(0))
+	service.Matches(context.Background(), "test@example.com")
+
+	s.Equal(1, transport.requests)
+}
+
+func (s *HTTPTest) TestParseProxy() {
+	valid := map[string]string{
+		"tor":                     "socks5h://127.0.0.1:9050",
+		"socks5://127.0.0.1:1080": "socks5://127.0.0.1:1080",
+		"socks5h://tor:9150":      "socks5h://tor:9150",
+		"http://proxy:3128":       "http://proxy:3128",
+	}
+	for raw, expected := range valid {
+		proxy, err := ParseProxy(raw)
+		s.NoError(err, raw)
+		s.Equal(expected, proxy.String(), raw)
+	}
+
+	for _, raw := range []string{"127.0.0.1:9050", "ftp://proxy", "socks5://", "socks4://proxy:1080"} {
+		_, err := ParseProxy(raw)
+		s.Error(err, raw)
+	}
+}
+
+func TestHTTPTest(t *testing.T) {
+	suite.Run(t, new(HTTPTest))
+}
@@ -0,0 +1,194 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package lookup
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+// ErrCantImport means keys can't be added to a keyring, because of what's
+// already in it or what kind of keyring it is.
+var ErrCantImport = errors.New("Can't import into the keyring")
+
+// ImportKeys adds the public parts of keys to the binary keyring at ringpath
+// (or the public keyring in the GnuPG home directory, if ringpath is empty),
+// creating it if it isn't there yet, so they can be found later without the
+// network. Keys with a fingerprint that's already in the keyring are skipped,
+// and ImportKeys returns how many were added. New keys are only ever appended,
+// and never to a keyring with secret keys in it; keyboxes and armored keyrings
+// can't be imported into either (use gpg --import for those). Those errors
+// match ErrCantImport.
+func ImportKeys(ringpath string, keys openpgp.EntityList) (int, error) {
+	ringfile := publicRingFile(expandPath(ringpath))
+	if ringpath == "" {
+		var err error
+		if ringfile, err = newPublicRingFile(); err != nil {
+			return 0, err
+		}
+	}
+
+	return importKeys(ringfile, keys)
+}
+
+// Import adds the public parts of keys to the LocalPGPService's keyring, the
+// same way ImportKeys does, and makes sure the next Matches sees them. If
+// the service was loaded from several keyrings, the keys go in the first one.
+func (l *LocalPGPService) Import(keys openpgp.EntityList) (int, error) {
+	added, err := importKeys(l.ringfile, keys)
+	if added > 0 {
+		l.Reload()
+	}
+
+	return added, err
+}
+
+func importKeys(ringfile publicRingFile, keys openpgp.EntityList) (int, error) {
+	existing, err := readImportTarget(ringfile)
+	if err != nil {
+		return 0, err
+	}
+
+	seen := map[string]bool{}
+	for _, key := range existing {
+		seen[keyFingerprint(key)] = true
+	}
+
+	if err := os.MkdirAll(path.Dir(string(ringfile)), 0700); err != nil {
+		return 0, err
+	}
+
+	file, err := os.OpenFile(string(ringfile), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	added := 0
+	for _, key := range keys {
+		fingerprint := keyFingerprint(key)
+		if seen[fingerprint] {
+			continue
+		}
+		seen[fingerprint] = true
+
+		// Serialize only ever writes the public parts
+		if err := key.Serialize(file); err != nil {
+			return added, err
+		}
+		added++
+	}
+
+	return added, file.Close()
+}
+
+// readImportTarget reads the keys already in ringfile, if there is one, and
+// makes sure new keys can be appended to it.
+func readImportTarget(ringfile publicRingFile) (openpgp.EntityList, error) {
+	if _, err := ringfile.Stat(); errors.Is(err, ErrRingMissing) || errors.Is(err, ErrRingEmpty) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	file, err := ringfile.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	head, _ := reader.Peek(64)
+	switch {
+	case isKeybox(head):
+		return nil, fmt.Errorf("%w: %s is a keybox", ErrCantImport, ringfile)
+	case isArmored(head):
+		return nil, fmt.Errorf("%w: %s is armored", ErrCantImport, ringfile)
+	}
+
+	ring, err := openpgp.ReadKeyRing(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range ring {
+		if key.PrivateKey != nil {
+			return nil, fmt.Errorf("%w: %s has secret keys in it", ErrCantImport, ringfile)
+		}
+	}
+
+	return ring, nil
+}
+
+// Import writes the public parts of each of keys to its own armored key file
+// (named for its fingerprint) in the DirectoryService's directory, so the
+// next Matches sees them. Keys that are already in the directory are
+// skipped, existing files are never replaced, and Import returns how many
+// keys were added.
+func (d *DirectoryService) Import(keys openpgp.EntityList) (int, error) {
+	ring, err := d.Ring()
+	if err != nil {
+		return 0, err
+	}
+
+	seen := map[string]bool{}
+	for _, key := range ring {
+		seen[keyFingerprint(key)] = true
+	}
+
+	added := 0
+	for _, key := range keys {
+		fingerprint := keyFingerprint(key)
+		if seen[fingerprint] {
+			continue
+		}
+		seen[fingerprint] = true
+
+		if err := writeKeyFile(path.Join(d.dir, strings.ToUpper(fingerprint)+".asc"), key); err != nil {
+			return added, err
+		}
+		d.ring = nil
+		added++
+	}
+
+	return added, nil
+}
+
+// writeKeyFile writes the armored public parts of key to a new file at
+// filename.
+func writeKeyFile(filename string, key *openpgp.Entity) error {
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w, err := armor.Encode(file, openpgp.PublicKeyType, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := key.Serialize(w); err != nil {
+		return err
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return file.Close()
+}
@@ -0,0 +1,147 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package lookup
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/crypto/openpgp"
+)
+
+type ImportTest struct {
+	dir string
+	suite.Suite
+}
+
+func (s *ImportTest) SetupTest() {
+	dir, err := ioutil.TempDir("", "pipethis-test-")
+	s.Require().NoError(err)
+	s.dir = dir
+}
+
+func (s *ImportTest) TearDownTest() {
+	os.RemoveAll(s.dir)
+}
+
+func (s *ImportTest) TestImportKeysCreatesTheRing() {
+	ringpath := path.Join(s.dir, "gnupg", "pubring.gpg")
+
+	added, err := ImportKeys(ringpath, readTestRing(s.T(), "testdata/pubring.gpg"))
+	s.Require().NoError(err)
+	s.Equal(1, added)
+
+	local, err := NewLocalPGPServiceFromPath(ringpath)
+	s.Require().NoError(err)
+
+	users, err := local.Matches(context.Background(), "test@example.com")
+	s.NoError(err)
+	s.Require().Len(users, 1)
+	s.Equal(fixtureFingerprint, users[0].Fingerprint)
+}
+
+func (s *ImportTest) TestImportKeysSkipsKeysAlreadyThere() {
+	ringpath := path.Join(s.dir, "pubring.gpg")
+	keys := readTestRing(s.T(), "testdata/pubring.gpg")
+
+	_, err := ImportKeys(ringpath, keys)
+	s.Require().NoError(err)
+	before, err := ioutil.ReadFile(ringpath)
+	s.Require().NoError(err)
+
+	added, err := ImportKeys(ringpath, append(keys, keys...))
+	s.NoError(err)
+	s.Equal(0, added)
+
+	after, err := ioutil.ReadFile(ringpath)
+	s.Require().NoError(err)
+	s.Equal(before, after)
+}
+
+func (s *ImportTest) TestImportKeysLeavesPrivatePartsOut() {
+	ringpath := path.Join(s.dir, "pubring.gpg")
+	key := newTestEntity(s.T(), "Author", "author@example.com")
+
+	_, err := ImportKeys(ringpath, openpgp.EntityList{key})
+	s.Require().NoError(err)
+
+	ring := readTestRing(s.T(), ringpath)
+	s.Require().Len(ring, 1)
+	s.Nil(ring[0].PrivateKey)
+	s.Equal(key.PrimaryKey.Fingerprint, ring[0].PrimaryKey.Fingerprint)
+}
+
+func (s *ImportTest) TestImportKeysRefusesRingsItCantAppendTo() {
+	for _, fixture := range []string{"secring.gpg", "pubring.kbx", "pubring.asc"} {
+		ringpath := path.Join(s.dir, fixture)
+		contents, err := ioutil.ReadFile(path.Join("testdata", fixture))
+		s.Require().NoError(err)
+		s.Require().NoError(ioutil.WriteFile(ringpath, contents, 0600))
+
+		added, err := ImportKeys(ringpath, openpgp.EntityList{newTestEntity(s.T(), "Author", "author@example.com")})
+		s.True(errors.Is(err, ErrCantImport), fixture)
+		s.Equal(0, added)
+
+		after, err := ioutil.ReadFile(ringpath)
+		s.Require().NoError(err)
+		s.Equal(contents, after, fixture)
+	}
+}
+
+func (s *ImportTest) TestLocalImportIsMatchedRightAway() {
+	ringpath := path.Join(s.dir, "pubring.gpg")
+	contents, err := ioutil.ReadFile("testdata/pubring.gpg")
+	s.Require().NoError(err)
+	s.Require().NoError(ioutil.WriteFile(ringpath, contents, 0600))
+
+	local, err := NewLocalPGPServiceFromPath(ringpath)
+	s.Require().NoError(err)
+	_, err = local.Matches(context.Background(), "author@example.com")
+	s.True(errors.Is(err, ErrNoMatches))
+
+	key := newTestEntity(s.T(), "Author", "author@example.com")
+	added, err := local.Import(openpgp.EntityList{key})
+	s.NoError(err)
+	s.Equal(1, added)
+
+	users, err := local.Matches(context.Background(), "author@example.com")
+	s.NoError(err)
+	s.Require().Len(users, 1)
+	s.Equal(keyFingerprint(key), users[0].Fingerprint)
+}
+
+func (s *ImportTest) TestDirectoryImportWritesKeyFiles() {
+	dir, err := NewDirectoryService(s.dir)
+	s.Require().NoError(err)
+
+	keys := readTestRing(s.T(), "testdata/pubring.gpg")
+	added, err := dir.Import(keys)
+	s.NoError(err)
+	s.Equal(1, added)
+	s.FileExists(path.Join(s.dir, fixtureFingerprint+".asc"))
+
+	users, err := dir.Matches(context.Background(), "test@example.com")
+	s.NoError(err)
+	s.Require().Len(users, 1)
+	s.Equal(fixtureFingerprint, users[0].Fingerprint)
+
+	added, err = dir.Import(keys)
+	s.NoError(err)
+	s.Equal(0, added)
+}
+
+func TestImportTest(t *testing.T) {
+	suite.Run(t, new(ImportTest))
+}
@@ -0,0 +1,104 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package lookup
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// shortIDLength is how much of the end of a fingerprint ringIndex files keys
+// under. Nothing shorter can be looked up anyway.
+const shortIDLength = 8
+
+// ringIndex files the keys in a ring by email address and by the end of each
+// of their fingerprints, so the lookups that can use it don't have to go
+// through the whole ring. It only ever narrows the ring down to candidates;
+// the candidates are checked the same way the whole ring would be.
+type ringIndex struct {
+	emails   map[string]openpgp.EntityList
+	shortIDs map[string]openpgp.EntityList
+}
+
+// newRingIndex indexes every key in ring: the email addresses on its bound
+// identities, and the short ids of its primary key and all its subkeys.
+func newRingIndex(ring openpgp.EntityList) *ringIndex {
+	index := &ringIndex{
+		emails:   map[string]openpgp.EntityList{},
+		shortIDs: map[string]openpgp.EntityList{},
+	}
+
+	for _, key := range ring {
+		for _, email := range entityToUser(key).Emails {
+			email = indexEmail(email)
+			index.emails[email] = append(index.emails[email], key)
+		}
+
+		index.addShortID(keyFingerprint(key), key)
+		for _, subkey := range key.Subkeys {
+			index.addShortID(fmt.Sprintf("%X", subkey.PublicKey.Fingerprint[:]), key)
+		}
+	}
+
+	return index
+}
+
+func (r *ringIndex) addShortID(fingerprint string, key *openpgp.Entity) {
+	id := fingerprint[len(fingerprint)-shortIDLength:]
+
+	// a subkey can share the primary key's short id, but the key only needs
+	// to be listed once
+	if keys := r.shortIDs[id]; len(keys) > 0 && keys[len(keys)-1] == key {
+		return
+	}
+	r.shortIDs[id] = append(r.shortIDs[id], key)
+}
+
+// indexEmail is email the way the index files it, so addresses that are the
+// same by SameEmail end up in the same place.
+func indexEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// byFingerprint is the keys with a primary key or subkey whose fingerprint
+// ends the same way as fingerprint. ok is false when fingerprint isn't hex,
+// or is too short to look up, so the caller has to fall back to the whole
+// ring.
+func (r *ringIndex) byFingerprint(fingerprint string) (keys openpgp.EntityList, ok bool) {
+	fingerprint = NormalizeFingerprint(fingerprint)
+	if _, err := hex.DecodeString(fingerprint); err != nil || len(fingerprint) < shortIDLength {
+		return nil, false
+	}
+
+	return r.shortIDs[fingerprint[len(fingerprint)-shortIDLength:]], true
+}
+
+// exactCandidates is the keys that could be a MatchExact match for query:
+// the ones with query as an email address, or with a fingerprint that ends
+// the same way.
+func (r *ringIndex) exactCandidates(query string) openpgp.EntityList {
+	candidates := append(openpgp.EntityList{}, r.emails[indexEmail(query)]...)
+
+	keys, _ := r.byFingerprint(query)
+	for _, key := range keys {
+		found := false
+		for _, candidate := range candidates {
+			found = found || candidate == key
+		}
+		if !found {
+			candidates = append(candidates, key)
+		}
+	}
+
+	return candidates
+}
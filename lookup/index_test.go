@@ -0,0 +1,249 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package lookup
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+const (
+	// testRingSize is how many keys go in the generated ring for the tests.
+	// Every linear Matches checks the self-signature on every key, so it's
+	// kept small.
+	testRingSize = 300
+
+	// benchRingSize is how many keys go in the generated ring for the
+	// benchmarks.
+	benchRingSize = 2000
+)
+
+type IndexTest struct {
+	ringfile string
+	keys     openpgp.EntityList
+	suite.Suite
+}
+
+func (s *IndexTest) SetupSuite() {
+	s.ringfile, s.keys = writeBigRing(s.T(), testRingSize)
+}
+
+func (s *IndexTest) TearDownSuite() {
+	os.Remove(s.ringfile)
+}
+
+// services is the same ring, once linear and once indexed.
+func (s *IndexTest) services(mode MatchMode) (*LocalPGPService, *LocalPGPService) {
+	linear, err := NewLocalPGPServiceFromPaths([]string{s.ringfile, "testdata/usage.gpg"})
+	s.Require().NoError(err)
+	linear.MatchMode = mode
+	linear.MaxMatches = -1
+
+	indexed, err := NewLocalPGPServiceFromPaths([]string{s.ringfile, "testdata/usage.gpg"})
+	s.Require().NoError(err)
+	indexed.MatchMode = mode
+	indexed.MaxMatches = -1
+	s.Require().NoError(indexed.BuildIndex())
+
+	return linear, indexed
+}
+
+// queries are a mix of hits and misses, in every form Matches and Key take.
+func (s *IndexTest) queries() []string {
+	queries := []string{
+		"nobody@example.com",
+		"DEADBEEF",
+		"not hex",
+		"signer@example.com",
+		" SIGNER@Example.com ",
+		"encrypt@example.com",
+		"134E0DE0D18FB090F7C17C10A5034EFD4162D102",
+		"191F 1AA0 8536 6BD4 B06C  F65C F989 58A5 1041 0C31",
+		"F98958A510410C31",
+		"0x10410C31",
+		"43BDB3728915C80F4529ED0CDFDBAB9168012643",
+	}
+
+	for i := 0; i < len(s.keys); i += 61 {
+		fingerprint := keyFingerprint(s.keys[i])
+		queries = append(queries,
+			fmt.Sprintf("user%d@example.com", i),
+			fingerprint,
+			fingerprint[24:],
+			fingerprint[32:],
+			fingerprint[20:],
+			FormatFingerprint(fingerprint),
+		)
+	}
+
+	return queries
+}
+
+func (s *IndexTest) TestIndexedMatchesAreTheSame() {
+	for _, mode := range []MatchMode{MatchExact, MatchSubstring} {
+		linear, indexed := s.services(mode)
+
+		for _, query := range s.queries() {
+			expected, expectedErr := linear.Matches(context.Background(), query)
+			actual, actualErr := indexed.Matches(context.Background(), query)
+
+			s.Equal(expected, actual, query)
+			s.Equal(expectedErr, actualErr, query)
+		}
+	}
+}
+
+func (s *IndexTest) TestIndexedKeysAreTheSame() {
+	linear, indexed := s.services(MatchExact)
+
+	for _, query := range s.queries() {
+		expected, expectedErr := linear.Key(context.Background(), User{Fingerprint: query})
+		actual, actualErr := indexed.Key(context.Background(), User{Fingerprint: query})
+
+		s.Equal(fmt.Sprint(expectedErr), fmt.Sprint(actualErr), query)
+		s.Require().Equal(len(expected), len(actual), query)
+		for i := range expected {
+			s.Equal(keyFingerprint(expected[i]), keyFingerprint(actual[i]), query)
+		}
+	}
+}
+
+func (s *IndexTest) TestIndexFollowsReloads() {
+	ringfile, _ := writeBigRing(s.T(), 3)
+	defer os.Remove(ringfile)
+
+	indexed, err := NewLocalPGPServiceFromPath(ringfile)
+	s.Require().NoError(err)
+	indexed.MatchMode = MatchExact
+	s.Require().NoError(indexed.BuildIndex())
+
+	_, err = indexed.Matches(context.Background(), "author@example.com")
+	s.Equal(ErrNoMatches, err)
+
+	key := newTestEntity(s.T(), "Author", "author@example.com")
+	_, err = ImportKeys(ringfile, openpgp.EntityList{key})
+	s.Require().NoError(err)
+	indexed.Reload()
+
+	users, err := indexed.Matches(context.Background(), "author@example.com")
+	s.NoError(err)
+	s.Len(users, 1)
+}
+
+func TestIndexTest(t *testing.T) {
+	suite.Run(t, new(IndexTest))
+}
+
+func BenchmarkMatchesLinear(b *testing.B) {
+	benchmarkMatches(b, false)
+}
+
+func BenchmarkMatchesIndexed(b *testing.B) {
+	benchmarkMatches(b, true)
+}
+
+func benchmarkMatches(b *testing.B, index bool) {
+	ringfile, keys := writeBigRing(b, benchRingSize)
+	defer os.Remove(ringfile)
+
+	local, err := NewLocalPGPServiceFromPath(ringfile)
+	if err != nil {
+		b.Fatal(err)
+	}
+	local.MatchMode = MatchExact
+	if index {
+		err = local.BuildIndex()
+	} else {
+		_, err = local.Ring()
+	}
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := local.Matches(context.Background(), keyFingerprint(keys[i%len(keys)])); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// writeBigRing saves a ring of size generated keys (user0@example.com and
+// so on) to a temporary file, and returns its name and the keys. The keys are
+// ECDSA, since RSA keys take far too long to generate by the thousand.
+func writeBigRing(t testing.TB, size int) (string, openpgp.EntityList) {
+	file, err := ioutil.TempFile("", "pipethis-ring-")
+	if err != nil {
+		t.Fatal("Failed creating the test keyring:", err)
+	}
+	defer file.Close()
+
+	keys := openpgp.EntityList{}
+	for i := 0; i < size; i++ {
+		key := newECDSAEntity(t, fmt.Sprintf("User %d", i), fmt.Sprintf("user%d@example.com", i))
+		if err := key.Serialize(file); err != nil {
+			t.Fatal("Failed writing the test keyring:", err)
+		}
+		keys = append(keys, key)
+	}
+
+	return file.Name(), keys
+}
+
+// newECDSAEntity generates a P-256 signing key for a single identity.
+func newECDSAEntity(t testing.TB, name, email string) *openpgp.Entity {
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("Failed generating the test key:", err)
+	}
+
+	created := time.Unix(1600000000, 0)
+	key := &openpgp.Entity{
+		PrivateKey: packet.NewECDSAPrivateKey(created, private),
+		Identities: map[string]*openpgp.Identity{},
+	}
+	key.PrimaryKey = &key.PrivateKey.PublicKey
+
+	primary := true
+	uid := packet.NewUserId(name, "", email)
+	identity := &openpgp.Identity{
+		Name:   uid.Id,
+		UserId: uid,
+		SelfSignature: &packet.Signature{
+			CreationTime: created,
+			SigType:      packet.SigTypePositiveCert,
+			PubKeyAlgo:   packet.PubKeyAlgoECDSA,
+			Hash:         crypto.SHA256,
+			IsPrimaryId:  &primary,
+			FlagsValid:   true,
+			FlagSign:     true,
+			FlagCertify:  true,
+			IssuerKeyId:  &key.PrimaryKey.KeyId,
+		},
+	}
+	if err := identity.SelfSignature.SignUserId(uid.Id, key.PrimaryKey, key.PrivateKey, nil); err != nil {
+		t.Fatal("Failed signing the test key:", err)
+	}
+	key.Identities[uid.Id] = identity
+
+	return key
+}
@@ -10,15 +10,29 @@ the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
 package lookup
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"regexp"
+	"strings"
 
 	"golang.org/x/crypto/openpgp"
 )
 
+// DefaultKeybaseURL is where KeybaseService looks users up when it isn't
+// pointed somewhere else.
+const DefaultKeybaseURL = "https://keybase.io"
+
+// ErrKeybaseNoKey means a Keybase user exists, but hasn't added a PGP key.
+var ErrKeybaseNoKey = errors.New("Keybase user has no public key")
+
+// keybaseUsername is (I think) Keybase's own username pattern.
+var keybaseUsername = regexp.MustCompile(`^[a-zA-Z0-9_\-\.]+$`)
+
 type keybaseResponse struct {
 	Status struct {
 		Code int    `json:"code"`
@@ -42,26 +56,143 @@ type keybaseUserVal struct {
 	Value string `json:"val"`
 }
 
+// keybaseLookupResponse is the part of the user/lookup API response
+// KeybaseService uses. Users that don't exist come back as null.
+type keybaseLookupResponse struct {
+	Status struct {
+		Code int    `json:"code"`
+		Name string `json:"name"`
+	} `json:"status"`
+	Them []*struct {
+		Basics struct {
+			Username string `json:"username"`
+		} `json:"basics"`
+		Profile *struct {
+			FullName string `json:"full_name"`
+		} `json:"profile"`
+		PublicKeys struct {
+			Primary *struct {
+				Fingerprint string `json:"key_fingerprint"`
+				Bundle      string `json:"bundle"`
+			} `json:"primary"`
+		} `json:"public_keys"`
+		ProofsSummary struct {
+			All []struct {
+				ProofType  string `json:"proof_type"`
+				Nametag    string `json:"nametag"`
+				ServiceURL string `json:"service_url"`
+			} `json:"all"`
+		} `json:"proofs_summary"`
+	} `json:"them"`
+}
+
 // KeybaseService implements the KeyService interface for https://keybase.io
-type KeybaseService struct{}
+type KeybaseService struct {
+	remote
+	base string
+}
 
-func (k KeybaseService) lookup(query string) ([]byte, error) {
-	if matches, _ := regexp.MatchString(`^[a-zA-Z0-9_\-\.]+$`, query); !matches {
-		return nil, errors.New("Invalid user requested")
+// NewKeybaseService creates a KeybaseService for the Keybase server at base.
+// If base is empty, DefaultKeybaseURL is used.
+func NewKeybaseService(base string, options ...RemoteOption) *KeybaseService {
+	return &KeybaseService{remote: newRemote(options), base: strings.TrimRight(base, "/")}
+}
+
+func (k KeybaseService) url(path string) string {
+	if k.base == "" {
+		return DefaultKeybaseURL + path
 	}
 
-	resp, err := http.Get("https://keybase.io/_/api/1.0/user/autocomplete.json?q=" + query)
+	return k.base + path
+}
+
+// fetch gets the API response at path. Failing to reach Keybase at all is
+// reported differently from Keybase not having what we asked for.
+func (k KeybaseService) fetch(ctx context.Context, path string) ([]byte, error) {
+	resp, err := k.get(ctx, k.url(path))
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("Couldn't reach Keybase: %w", err)
 	}
 	defer resp.Body.Close()
 
-	results, err := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests {
+		return nil, statusError(resp, "Couldn't reach Keybase: "+resp.Status)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (k KeybaseService) lookup(ctx context.Context, query string) ([]byte, error) {
+	if !keybaseUsername.MatchString(query) {
+		return nil, errors.New("Invalid user requested")
+	}
+
+	return k.fetch(ctx, "/_/api/1.0/user/autocomplete.json?q="+query)
+}
+
+// lookupUser gets a Keybase user's details and primary public key from the
+// user/lookup API. If the user doesn't exist, or exists but doesn't have a
+// key (ErrKeybaseNoKey), lookupUser returns an error.
+func (k KeybaseService) lookupUser(ctx context.Context, username string) (User, openpgp.EntityList, error) {
+	if !keybaseUsername.MatchString(username) {
+		return User{}, nil, errors.New("Invalid user requested")
+	}
+
+	query := url.Values{}
+	query.Set("usernames", username)
+	query.Set("fields", "basics,profile,public_keys,proofs_summary")
+
+	body, err := k.fetch(ctx, "/_/api/1.0/user/lookup.json?"+query.Encode())
 	if err != nil {
-		return nil, err
+		return User{}, nil, err
 	}
 
-	return results, nil
+	lookup := &keybaseLookupResponse{}
+	if err := json.Unmarshal(body, lookup); err != nil {
+		return User{}, nil, err
+	}
+	if lookup.Status.Name == "NOT_FOUND" || (lookup.Status.Code == 0 && (len(lookup.Them) == 0 || lookup.Them[0] == nil)) {
+		return User{}, nil, errors.New("Keybase user " + username + " not found")
+	}
+	if lookup.Status.Code != 0 {
+		return User{}, nil, errors.New("Bad status code: " + lookup.Status.Name)
+	}
+
+	them := lookup.Them[0]
+	if them.PublicKeys.Primary == nil || them.PublicKeys.Primary.Bundle == "" {
+		return User{}, nil, fmt.Errorf("%w: %s", ErrKeybaseNoKey, username)
+	}
+
+	ring, err := parseKey(strings.NewReader(them.PublicKeys.Primary.Bundle))
+	if err != nil {
+		return User{}, nil, err
+	}
+	if len(ring) != 1 {
+		return User{}, nil, ErrAmbiguousKey
+	}
+
+	user := entityToUser(ring[0])
+	user.Username = them.Basics.Username
+	if them.Profile != nil {
+		user.FullName = them.Profile.FullName
+	}
+
+	for _, proof := range them.ProofsSummary.All {
+		switch proof.ProofType {
+		case "twitter":
+			user.Twitter = proof.Nametag
+		case "github":
+			user.GitHub = proof.Nametag
+		case "hackernews":
+			user.HackerNews = proof.Nametag
+		case "reddit":
+			user.Reddit = proof.Nametag
+		case "generic_web_site", "dns":
+			user.Sites = append(user.Sites, proof.ServiceURL)
+		}
+	}
+
+	return user, ring, nil
 }
 
 func (k KeybaseService) parse(body []byte) (*keybaseResponse, error) {
@@ -78,10 +209,20 @@ func (k KeybaseService) parse(body []byte) (*keybaseResponse, error) {
 
 // Matches finds all the Keybase users that match query in any of their details
 // (username, Twitter identity, Github identity, public key fingerprint,
-// etc.). At most 10 matches will be found. If no matches are found, Matches
-// returns an error.
-func (k KeybaseService) Matches(query string) ([]User, error) {
-	results, err := k.lookup(query)
+// etc.). At most 10 matches will be found. A "keybase:<username>" query skips
+// the search and finds exactly that user, along with the email addresses on
+// their key. If no matches are found, Matches returns an error.
+func (k KeybaseService) Matches(ctx context.Context, query string) ([]User, error) {
+	if username := strings.TrimPrefix(query, "keybase:"); username != query {
+		user, _, err := k.lookupUser(ctx, username)
+		if err != nil {
+			return nil, err
+		}
+
+		return []User{user}, nil
+	}
+
+	results, err := k.lookup(ctx, query)
 	if err != nil {
 		return nil, err
 	}
@@ -113,28 +254,32 @@ func (k KeybaseService) Matches(query string) ([]User, error) {
 	return matches, nil
 }
 
-// Key finds the PGP public key for one Keybase user by Keybase username and
-// returns the key ring representation of the key. If the Keybase username is
-// invalid, or the key itself is missing or invalid, Key returns an error.
-func (k KeybaseService) Key(user User) (openpgp.EntityList, error) {
-
-	// I think I set this up to match Keybase's own username pattern. I think.
-	if matches, _ := regexp.MatchString(`^[a-zA-Z0-9_\-\.]+$`, user.Username); !matches {
-		return nil, errors.New("Invalid user requested")
+// Key finds the primary PGP public key for one Keybase user by Keybase
+// username and returns the key ring representation of the key. If the Keybase
+// username is invalid, the key itself is missing or invalid, or it doesn't
+// match the user's fingerprint, Key returns an error.
+func (k KeybaseService) Key(ctx context.Context, user User) (openpgp.EntityList, error) {
+	if user.Fingerprint != "" {
+		if err := checkKeyID(user.Fingerprint); err != nil {
+			return nil, err
+		}
 	}
 
-	resp, err := http.Get("https://keybase.io/" + user.Username + "/key.asc")
-	defer resp.Body.Close()
+	_, ring, err := k.lookupUser(ctx, user.Username)
 	if err != nil {
 		return nil, err
 	}
 
-	ring, err := openpgp.ReadArmoredKeyRing(resp.Body)
-	if err != nil {
-		return nil, err
+	if user.Fingerprint != "" {
+		if _, err := fetchedKey(ring, user.Fingerprint); err != nil {
+			return nil, fmt.Errorf("The Keybase key for %s doesn't match: %w", user.Username, err)
+		}
 	}
-	if len(ring) != 1 {
-		return nil, errors.New("More than one key returned, not sure what to do")
+
+	for _, key := range ring {
+		if err := checkExpiry(key, keyFingerprint(key)); err != nil {
+			return nil, err
+		}
 	}
 
 	return ring, nil
@@ -0,0 +1,154 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package lookup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type KeybaseTest struct {
+	suite.Suite
+}
+
+// server mirrors the user/lookup API: "pipethis" has a key and some proofs,
+// "nokey" has neither, and everybody else doesn't exist.
+func (s *KeybaseTest) server() *httptest.Server {
+	bundle := string(armorTestRing(s.T(), readTestRing(s.T(), "testdata/pubring.gpg")...))
+
+	users := map[string]interface{}{
+		"pipethis": map[string]interface{}{
+			"basics":  map[string]interface{}{"username": "pipethis"},
+			"profile": map[string]interface{}{"full_name": "Pipethis Test"},
+			"public_keys": map[string]interface{}{
+				"primary": map[string]interface{}{
+					"key_fingerprint": strings.ToLower(fixtureFingerprint),
+					"bundle":          bundle,
+				},
+			},
+			"proofs_summary": map[string]interface{}{
+				"all": []map[string]interface{}{
+					{"proof_type": "twitter", "nametag": "pipethis_tw"},
+					{"proof_type": "github", "nametag": "pipethis_gh"},
+					{"proof_type": "generic_web_site", "nametag": "example.com", "service_url": "https://example.com"},
+				},
+			},
+		},
+		"nokey": map[string]interface{}{
+			"basics":      map[string]interface{}{"username": "nokey"},
+			"public_keys": map[string]interface{}{},
+		},
+	}
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.Equal("/_/api/1.0/user/lookup.json", r.URL.Path)
+
+		user, ok := users[r.URL.Query().Get("usernames")]
+		if !ok {
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"status": map[string]interface{}{"code": 205, "name": "NOT_FOUND"},
+			})
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": map[string]interface{}{"code": 0, "name": "OK"},
+			"them":   []interface{}{user},
+		})
+	}))
+}
+
+func (s *KeybaseTest) TestNewKeybaseServiceDefaultsToKeybase() {
+	s.Equal("https://keybase.io/foo", KeybaseService{}.url("/foo"))
+	s.Equal("https://keybase.example.com/foo", NewKeybaseService("https://keybase.example.com/").url("/foo"))
+}
+
+func (s *KeybaseTest) TestMatchesLooksUpKeybaseUsernames() {
+	server := s.server()
+	defer server.Close()
+
+	users, err := NewKeybaseService(server.URL).Matches(context.Background(), "keybase:pipethis")
+
+	s.Require().NoError(err)
+	s.Len(users, 1)
+	s.Equal("pipethis", users[0].Username)
+	s.Equal("Pipethis Test", users[0].FullName)
+	s.Equal(fixtureFingerprint, users[0].Fingerprint)
+	s.Equal([]string{"test@example.com"}, users[0].Emails)
+	s.Equal("pipethis_tw", users[0].Twitter)
+	s.Equal("pipethis_gh", users[0].GitHub)
+	s.Equal([]string{"https://example.com"}, users[0].Sites)
+}
+
+func (s *KeybaseTest) TestKeyReturnsPrimaryKey() {
+	server := s.server()
+	defer server.Close()
+	service := NewKeybaseService(server.URL)
+
+	ring, err := service.Key(context.Background(), User{Username: "pipethis", Fingerprint: strings.ToLower(fixtureFingerprint)})
+	s.Require().NoError(err)
+	s.Len(ring, 1)
+	s.Equal(fixtureFingerprint, keyFingerprint(ring[0]))
+
+	_, err = service.Key(context.Background(), User{Username: "pipethis", Fingerprint: "1111111111111111"})
+	s.Error(err)
+}
+
+func (s *KeybaseTest) TestLookupFailsWithoutKey() {
+	server := s.server()
+	defer server.Close()
+
+	_, err := NewKeybaseService(server.URL).Matches(context.Background(), "keybase:nokey")
+	s.True(errors.Is(err, ErrKeybaseNoKey), err)
+
+	_, err = NewKeybaseService(server.URL).Key(context.Background(), User{Username: "nokey"})
+	s.True(errors.Is(err, ErrKeybaseNoKey), err)
+}
+
+func (s *KeybaseTest) TestLookupFailsWithoutUser() {
+	server := s.server()
+	defer server.Close()
+
+	_, err := NewKeybaseService(server.URL).Matches(context.Background(), "keybase:nobody")
+	s.EqualError(err, "Keybase user nobody not found")
+}
+
+func (s *KeybaseTest) TestLookupReportsNetworkFailures() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	_, err := NewKeybaseService(server.URL, WithRetries(0)).Matches(context.Background(), "keybase:pipethis")
+	s.EqualError(err, "Couldn't reach Keybase: 502 Bad Gateway: down")
+
+	server.Close()
+	_, err = NewKeybaseService(server.URL, WithRetries(1), WithBackoff(time.Millisecond)).Matches(context.Background(), "keybase:pipethis")
+	s.Error(err)
+	s.True(strings.HasPrefix(err.Error(), "Couldn't reach Keybase: "), err.Error())
+	s.False(errors.Is(err, ErrKeybaseNoKey))
+}
+
+func (s *KeybaseTest) TestLookupRejectsBadUsernames() {
+	_, err := NewKeybaseService("http://localhost:1").Matches(context.Background(), "keybase:../etc")
+	s.EqualError(err, "Invalid user requested")
+}
+
+func TestKeybaseTest(t *testing.T) {
+	suite.Run(t, new(KeybaseTest))
+}
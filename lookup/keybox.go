@@ -0,0 +1,80 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package lookup
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// GnuPG 2.1+ keeps public keys in a keybox (pubring.kbx) instead of a plain
+// keyring. A keybox is a list of blobs, and each blob starts with a 4-byte
+// big-endian length (which counts itself) and a 1-byte type. OpenPGP blobs
+// point at the raw key packets with a 4-byte offset and 4-byte length, right
+// after the version and flags.
+const (
+	keyboxBlobHeader  = 6
+	keyboxTypeOpenPGP = 2
+	keyboxMagic       = "KBXf"
+)
+
+// isKeybox checks for the magic "KBXf" in the keybox header blob.
+func isKeybox(head []byte) bool {
+	return len(head) >= 12 && string(head[8:12]) == keyboxMagic
+}
+
+// readKeybox pulls the OpenPGP key blocks out of a keybox and parses them into
+// a single key ring with parse. Blobs of any other type (header, X.509) are
+// skipped.
+func readKeybox(reader io.Reader, parse ringParser) (openpgp.EntityList, error) {
+	packets := &bytes.Buffer{}
+	size := make([]byte, 4)
+
+	for {
+		if _, err := io.ReadFull(reader, size); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		length := binary.BigEndian.Uint32(size)
+		if length < keyboxBlobHeader {
+			return nil, errors.New("Invalid keybox blob length")
+		}
+
+		blob := make([]byte, length)
+		copy(blob, size)
+		if _, err := io.ReadFull(reader, blob[4:]); err != nil {
+			return nil, err
+		}
+
+		if blob[4] != keyboxTypeOpenPGP {
+			continue
+		}
+
+		if length < 16 {
+			return nil, errors.New("Invalid keybox OpenPGP blob")
+		}
+
+		offset := binary.BigEndian.Uint32(blob[8:12])
+		keylen := binary.BigEndian.Uint32(blob[12:16])
+		if uint64(offset)+uint64(keylen) > uint64(length) {
+			return nil, errors.New("Invalid keybox OpenPGP blob")
+		}
+
+		packets.Write(blob[offset : offset+keylen])
+	}
+
+	return parse(packets)
+}
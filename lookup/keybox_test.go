@@ -0,0 +1,72 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package lookup
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/crypto/openpgp"
+)
+
+// the key in testdata/pubring.gpg and testdata/pubring.kbx
+const (
+	fixtureKeyID       = "A018A3D90DC0FA52"
+	fixtureFingerprint = "2DEC361C395B52E763A95873A018A3D90DC0FA52"
+)
+
+type KeyboxTest struct {
+	suite.Suite
+}
+
+func (s *KeyboxTest) TestIsKeyboxChecksMagic() {
+	contents, err := ioutil.ReadFile("testdata/pubring.kbx")
+	s.Require().NoError(err)
+	s.True(isKeybox(contents))
+
+	contents, err = ioutil.ReadFile("testdata/pubring.gpg")
+	s.Require().NoError(err)
+	s.False(isKeybox(contents))
+
+	s.False(isKeybox([]byte("short")))
+}
+
+func (s *KeyboxTest) TestReadKeyboxFindsKeys() {
+	contents, err := ioutil.ReadFile("testdata/pubring.kbx")
+	s.Require().NoError(err)
+
+	ring, err := readKeybox(bytes.NewReader(contents), openpgp.ReadKeyRing)
+	s.NoError(err)
+	s.Len(ring, 1)
+	s.Equal(fixtureKeyID, ring[0].PrimaryKey.KeyIdString())
+}
+
+func (s *KeyboxTest) TestReadKeyboxFailsWithBadLength() {
+	blob := make([]byte, 8)
+	binary.BigEndian.PutUint32(blob, 2)
+
+	_, err := readKeybox(bytes.NewReader(blob), openpgp.ReadKeyRing)
+	s.Error(err)
+}
+
+func (s *KeyboxTest) TestReadKeyboxFailsWithTruncatedBlob() {
+	contents, err := ioutil.ReadFile("testdata/pubring.kbx")
+	s.Require().NoError(err)
+
+	_, err = readKeybox(bytes.NewReader(contents[:len(contents)-10]), openpgp.ReadKeyRing)
+	s.Error(err)
+}
+
+func TestKeyboxTest(t *testing.T) {
+	suite.Run(t, new(KeyboxTest))
+}
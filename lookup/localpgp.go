@@ -10,97 +10,683 @@ the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
 package lookup
 
 import (
+	"bufio"
+	"context"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"io"
 	"os"
+	"os/user"
 	"path"
 	"strconv"
 	"strings"
+	"time"
 
 	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
 )
 
 // LocalPGPService implements the KeyService interface for a local GnuPG
 // public keyring.
 type LocalPGPService struct {
-	ringfile string
+	ringfile publicRingFile
 	ring     openpgp.EntityList
+
+	// more are keyrings loaded along with ringfile, for keys split across
+	// several rings.
+	more []publicRingFile
+
+	// MatchMode decides how Matches compares the query to each key.
+	// Substring matching is handy for finding keys; exact matching is safer
+	// when the result is going to be trusted without a human looking at it.
+	MatchMode MatchMode
+
+	// ShowExpired makes Matches include expired keys (marked with
+	// User.Expired) instead of skipping them, for callers that would rather
+	// warn than hide.
+	ShowExpired bool
+
+	// MaxMatches is the most keys Matches returns. Past that, it returns the
+	// first MaxMatches (in the usual order) along with ErrTooManyMatches,
+	// so a broad query on a big keyring doesn't bury anyone. Zero means
+	// DefaultMaxMatches, and a negative number means there's no limit.
+	MaxMatches int
+
+	// Capability is what a key has to be able to do for Matches to offer
+	// it. The default, CapabilitySign, leaves out keys that couldn't have
+	// signed a script; CapabilityAll is for finding keys instead.
+	Capability Capability
+
+	// Logger, if it's set, hears about the keyring being loaded.
+	Logger Logger
+
+	// SkipCorruptKeys makes Ring skip the keys it can't parse (with
+	// ReadResilientKeyRing) instead of failing, so one bad key doesn't hide
+	// all the others. The ones that were skipped are logged, and listed by
+	// Skipped.
+	SkipCorruptKeys bool
+
+	// skipped is why each key was skipped in the last load.
+	skipped []error
+
+	// AutoReload makes Ring check whether any of the keyrings have changed
+	// since they were loaded, and load them again if they have. It's for
+	// long-running programs; everything else can skip the extra stats.
+	AutoReload bool
+
+	// modified is when each keyring was last changed, as of the last load.
+	modified map[publicRingFile]time.Time
+
+	// now is the clock expiry is checked against. It's only replaced in
+	// tests.
+	now func() time.Time
+
+	// open opens each keyring for reading. It's only replaced in tests.
+	open func(publicRingFile) ringSource
+
+	// filter, if it's set, trims the ring after it's loaded.
+	filter func(openpgp.EntityList) openpgp.EntityList
+
+	// indexed is set by BuildIndex, so index is built again every time the
+	// ring is loaded.
+	indexed bool
+	index   *ringIndex
+}
+
+// MatchMode is a way of comparing a query to a key's fingerprint and
+// identities.
+type MatchMode int
+
+const (
+	// MatchSubstring matches when the query is part of the fingerprint, or
+	// part of a name or email address. It's the default.
+	MatchSubstring MatchMode = iota
+
+	// MatchExact matches when the query is the full fingerprint (of the
+	// primary key or a signing subkey), or exactly one of the email
+	// addresses.
+	MatchExact
+)
+
+// Capability is something a key can do, according to the key flags on its
+// primary key and subkeys.
+type Capability int
+
+const (
+	// CapabilitySign matches keys with a primary key or subkey that can make
+	// signatures. It's the default, since those are the only keys that can
+	// have signed a script.
+	CapabilitySign Capability = iota
+
+	// CapabilityEncrypt matches keys with a primary key or subkey that can
+	// encrypt.
+	CapabilityEncrypt
+
+	// CapabilityAll matches keys whatever they can do, even if it's only
+	// certifying other keys.
+	CapabilityAll
+)
+
+// has is true when key can do what c says.
+func (c Capability) has(key *openpgp.Entity) bool {
+	switch c {
+	case CapabilityAll:
+		return true
+	case CapabilityEncrypt:
+		return canEncrypt(key)
+	}
+
+	return canSign(key)
+}
+
+var (
+	// ErrRingMissing means there's no keyring where one was expected.
+	ErrRingMissing = errors.New("Keyring not found")
+
+	// ErrRingEmpty means the keyring is there, but there's nothing in it.
+	ErrRingEmpty = errors.New("Keyring is empty")
+
+	// ErrRingUnreadable means the keyring is there, but it can't be read
+	// (usually because of its permissions).
+	ErrRingUnreadable = errors.New("Keyring can't be read")
+
+	// ErrNoHome means there's no home directory to find the GnuPG home
+	// directory in.
+	ErrNoHome = errors.New("No home directory")
+)
+
+// currentUser finds the user pipethis is running as. It's only replaced in
+// tests.
+var currentUser = user.Current
+
+// ringError is why a keyring can't be used: one of the ErrRing errors, and
+// the error that caused it, if there was one.
+type ringError struct {
+	kind error
+	path string
+	err  error
+}
+
+func (e *ringError) Error() string {
+	if e.err == nil {
+		return e.kind.Error() + ": " + e.path
+	}
+
+	return e.kind.Error() + ": " + e.err.Error()
+}
+
+// Is makes errors.Is match the ErrRing error.
+func (e *ringError) Is(target error) bool {
+	return target == e.kind
+}
+
+// Unwrap gives errors.Is and errors.As the cause, e.g. an *os.PathError.
+func (e *ringError) Unwrap() error {
+	return e.err
+}
+
+// publicRingFile is the location of a local public keyring, in either the
+// classic keyring format (pubring.gpg) or the GnuPG 2.1+ keybox format
+// (pubring.kbx).
+type publicRingFile string
+
+// gnupgHome is the GnuPG home directory: GNUPGHOME, or ~/.gnupg if that's not
+// set. A leading ~ and any environment variables in GNUPGHOME are expanded.
+// If GNUPGHOME isn't set and there's no home directory either, gnupgHome
+// returns ErrNoHome.
+func gnupgHome() (string, error) {
+	if home := os.Getenv("GNUPGHOME"); home != "" {
+		return expandPath(home), nil
+	}
+
+	home, err := homeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return path.Join(home, ".gnupg"), nil
+}
+
+// homeDir is HOME, or the current user's home directory if HOME is empty
+// (like it is in some containers and systemd units). If neither is there,
+// homeDir returns ErrNoHome.
+func homeDir() (string, error) {
+	if home := os.Getenv("HOME"); home != "" {
+		return home, nil
+	}
+
+	if current, err := currentUser(); err == nil && current.HomeDir != "" {
+		return current.HomeDir, nil
+	}
+
+	return "", fmt.Errorf("%w: HOME isn't set and the current user doesn't have one, so set GNUPGHOME", ErrNoHome)
+}
+
+// expandPath expands environment variables in location, and a leading ~ (but
+// not ~user) to the home directory, if there is one.
+func expandPath(location string) string {
+	location = os.ExpandEnv(location)
+
+	if location == "~" || strings.HasPrefix(location, "~/") {
+		if home, err := homeDir(); err == nil {
+			location = path.Join(home, location[1:])
+		}
+	}
+
+	return location
+}
+
+// newPublicRingFile finds the public keyring in the GnuPG home directory.
+func newPublicRingFile() (publicRingFile, error) {
+	home, err := gnupgHome()
+	if err != nil {
+		return "", err
+	}
+
+	return findPublicRingFile(home), nil
+}
+
+// findPublicRingFile finds the public keyring in home. pubring.gpg wins if it
+// exists and isn't empty; otherwise pubring.kbx gets a shot.
+func findPublicRingFile(home string) publicRingFile {
+	home = expandPath(home)
+
+	ringfile := publicRingFile(path.Join(home, "pubring.gpg"))
+	if _, err := ringfile.Stat(); err == nil {
+		return ringfile
+	}
+
+	keybox := publicRingFile(path.Join(home, "pubring.kbx"))
+	if _, err := keybox.Stat(); err == nil {
+		return keybox
+	}
+
+	return ringfile
+}
+
+// Stat returns the file info for the keyring, if it's there and can be read.
+// Otherwise the error matches ErrRingMissing, ErrRingEmpty, or
+// ErrRingUnreadable (with errors.Is), and wraps the underlying error if there
+// is one.
+func (p publicRingFile) Stat() (os.FileInfo, error) {
+	info, err := os.Stat(string(p))
+	switch {
+	case os.IsNotExist(err):
+		return nil, &ringError{kind: ErrRingMissing, path: string(p), err: err}
+	case err != nil:
+		return nil, &ringError{kind: ErrRingUnreadable, path: string(p), err: err}
+	case info.Size() == 0:
+		return nil, &ringError{kind: ErrRingEmpty, path: string(p)}
+	}
+
+	// stat doesn't need read permission, so make sure it can be opened too
+	file, err := p.Open()
+	if err != nil {
+		return nil, &ringError{kind: ErrRingUnreadable, path: string(p), err: err}
+	}
+	file.Close()
+
+	return info, nil
+}
+
+// Open opens the keyring for reading. It's a ringSource.
+func (p publicRingFile) Open() (io.ReadCloser, error) {
+	return os.Open(string(p))
+}
+
+// ringSource opens a keyring for reading. Whoever calls it has to close what
+// it returns, which readRingSource takes care of.
+type ringSource func() (io.ReadCloser, error)
+
+// readRingSource opens the keyring from open, reads its keys with readRing and
+// parse, and closes it again however that went.
+func readRingSource(open ringSource, parse ringParser) (openpgp.EntityList, error) {
+	source, err := open()
+	if err != nil {
+		return nil, err
+	}
+	defer source.Close()
+
+	return readRing(bufio.NewReader(source), parse)
 }
 
 // NewLocalPGPService creates a new LocalPGPService if it finds a local
 // public keyring; otherwise it bails.
 func NewLocalPGPService() (*LocalPGPService, error) {
-	ringfile := path.Join(os.Getenv("HOME"), ".gnupg", "pubring.gpg")
-
-	info, err := os.Stat(ringfile)
-	if err != nil || info.Size() == 0 {
+	ringfile, err := newPublicRingFile()
+	if err != nil {
 		return nil, err
 	}
 
-	return &LocalPGPService{ringfile: ringfile}, nil
+	return newLocalPGPService(ringfile)
+}
+
+// NewLocalPGPServiceFromPath creates a new LocalPGPService for the keyring (or
+// keybox) at ringpath, if it exists; otherwise it bails.
+func NewLocalPGPServiceFromPath(ringpath string) (*LocalPGPService, error) {
+	return newLocalPGPService(publicRingFile(ringpath))
+}
+
+// NewLocalPGPServiceFromPaths creates a new LocalPGPService for all the
+// keyrings (or keyboxes) in ringpaths, merged into one ring. If any of them
+// doesn't exist, it bails.
+func NewLocalPGPServiceFromPaths(ringpaths []string) (*LocalPGPService, error) {
+	if len(ringpaths) == 0 {
+		return nil, fmt.Errorf("%w: no keyrings given", ErrNoRing)
+	}
+
+	more := []publicRingFile{}
+	for _, ringpath := range ringpaths[1:] {
+		more = append(more, publicRingFile(ringpath))
+	}
+
+	return newLocalPGPService(publicRingFile(ringpaths[0]), more...)
 }
 
-// Ring loads the local public keyring so LocalPGPService can use it later. If
-// it's already been loaded, Ring returns the existing version.
-func (l *LocalPGPService) Ring() openpgp.EntityList {
-	if l.ring != nil {
-		return l.ring
+func newLocalPGPService(ringfile publicRingFile, more ...publicRingFile) (*LocalPGPService, error) {
+	for _, file := range append([]publicRingFile{ringfile}, more...) {
+		if _, err := file.Stat(); err != nil {
+			return nil, err
+		}
+	}
+
+	return &LocalPGPService{ringfile: ringfile, more: more}, nil
+}
+
+// Ring loads the local public keyring (and any more keyrings, with repeated
+// keys dropped) so LocalPGPService can use it later. If it's already been
+// loaded, Ring returns the existing version, unless AutoReload is set and one
+// of the keyrings has changed since. If a keyring can't be opened or parsed,
+// Ring returns the reason.
+func (l *LocalPGPService) Ring() (openpgp.EntityList, error) {
+	if l.ring != nil && !(l.AutoReload && l.changed()) {
+		return l.ring, nil
+	}
+
+	ring := openpgp.EntityList{}
+	modified := map[publicRingFile]time.Time{}
+	l.skipped = nil
+	for _, ringfile := range l.ringfiles() {
+		if info, err := ringfile.Stat(); err == nil {
+			modified[ringfile] = info.ModTime()
+		}
+
+		keys, err := l.load(ringfile)
+		if err != nil {
+			return nil, err
+		}
+		ring = append(ring, keys...)
+	}
+
+	ring = uniqueKeys(ring)
+	if l.filter != nil {
+		ring = l.filter(ring)
+	}
+	l.ring = ring
+	l.modified = modified
+
+	l.index = nil
+	if l.indexed {
+		l.index = newRingIndex(ring)
 	}
 
-	reader, err := os.Open(l.ringfile)
+	return l.ring, nil
+}
+
+// Reload drops the loaded keyring, so the next Ring (or Matches, or Key)
+// reads the keyrings again and sees any keys added since.
+func (l *LocalPGPService) Reload() {
+	l.ring = nil
+	l.modified = nil
+	l.index = nil
+}
+
+// BuildIndex loads the keyring (if it isn't loaded yet) and indexes its keys
+// by email address and fingerprint, and keeps doing that every time the ring
+// is loaded again. After that, Key, and Matches with MatchExact, only have to
+// look at the keys that could be the one instead of the whole ring, which
+// adds up on a ring with tens of thousands of keys. Matches with
+// MatchSubstring still goes through every key. The answers are the same
+// either way.
+func (l *LocalPGPService) BuildIndex() error {
+	l.indexed = true
+
+	ring, err := l.Ring()
 	if err != nil {
-		return nil
+		return err
+	}
+
+	if l.index == nil {
+		l.index = newRingIndex(ring)
 	}
-	defer reader.Close()
 
-	ring, err := openpgp.ReadKeyRing(reader)
+	return nil
+}
+
+func (l *LocalPGPService) ringfiles() []publicRingFile {
+	return append([]publicRingFile{l.ringfile}, l.more...)
+}
+
+// changed is true when any of the keyrings has a different modification time
+// than it did when it was loaded, or can't be checked anymore.
+func (l *LocalPGPService) changed() bool {
+	for _, ringfile := range l.ringfiles() {
+		info, err := ringfile.Stat()
+		if err != nil {
+			return true
+		}
+
+		if modified, ok := l.modified[ringfile]; !ok || !modified.Equal(info.ModTime()) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// load reads the keys in one keyring.
+func (l *LocalPGPService) load(ringfile publicRingFile) (openpgp.EntityList, error) {
+	open := ringSource(ringfile.Open)
+	if l.open != nil {
+		open = l.open(ringfile)
+	}
+
+	parse := ringParser(openpgp.ReadKeyRing)
+	var skipped []error
+	if l.SkipCorruptKeys {
+		parse = func(r io.Reader) (openpgp.EntityList, error) {
+			ring, errs, err := ReadResilientKeyRing(r)
+			skipped = errs
+			return ring, err
+		}
+	}
+
+	ring, err := readRingSource(open, parse)
 	if err != nil {
-		return nil
+		return nil, err
+	}
+	logf(l.Logger, "loaded %d keys from %s", len(ring), path.Base(string(ringfile)))
+
+	for _, reason := range skipped {
+		logf(l.Logger, "skipped a corrupt key in %s: %v", path.Base(string(ringfile)), reason)
+		l.skipped = append(l.skipped, fmt.Errorf("%s: %w", ringfile, reason))
 	}
 
-	return ring
+	return ring, nil
 }
 
-// Matches finds all the public keys that have a fingerprint or identity (name
-// and email address) that match query. If no matches are found, Matches
-// returns an error.
-func (l *LocalPGPService) Matches(query string) ([]User, error) {
-	users := []User{}
+// Skipped is why each of the keys SkipCorruptKeys skipped the last time the
+// keyrings were loaded couldn't be parsed.
+func (l *LocalPGPService) Skipped() []error {
+	return l.skipped
+}
+
+// uniqueKeys drops every key with a fingerprint that's already in ring.
+func uniqueKeys(ring openpgp.EntityList) openpgp.EntityList {
+	unique := openpgp.EntityList{}
+	seen := map[string]bool{}
+
+	for _, key := range ring {
+		if fingerprint := keyFingerprint(key); !seen[fingerprint] {
+			seen[fingerprint] = true
+			unique = append(unique, key)
+		}
+	}
+
+	return unique
+}
+
+func (l *LocalPGPService) clock() time.Time {
+	if l.now == nil {
+		return time.Now()
+	}
+
+	return l.now()
+}
+
+// ringParser parses the packets in a binary keyring, like openpgp.ReadKeyRing.
+type ringParser func(io.Reader) (openpgp.EntityList, error)
+
+// readRing parses a keybox, an armored keyring, or a binary keyring, depending
+// on what it finds at the start of reader. Whichever it is, the keys
+// themselves are parsed with parse.
+func readRing(reader *bufio.Reader, parse ringParser) (openpgp.EntityList, error) {
+	head, _ := reader.Peek(64)
+
+	if isKeybox(head) {
+		return readKeybox(reader, parse)
+	}
+
+	if isArmored(head) {
+		return readArmoredRing(reader, parse)
+	}
+
+	return parse(reader)
+}
+
+// readArmoredRing parses every armored key block in reader, one after the
+// other, like the ones gpg --export --armor leaves when its output is
+// appended to the same file more than once, and merges them into one ring.
+func readArmoredRing(reader *bufio.Reader, parse ringParser) (openpgp.EntityList, error) {
+	ring := openpgp.EntityList{}
+	for blocks := 0; ; blocks++ {
+		block, err := armor.Decode(reader)
+		if err == io.EOF && blocks > 0 {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if block.Type != openpgp.PublicKeyType && block.Type != openpgp.PrivateKeyType {
+			return nil, errors.New("Expected a key block, got " + block.Type)
+		}
 
-	ring := l.Ring()
-	if ring == nil {
-		return nil, errors.New("No key ring loaded")
+		keys, err := parse(block.Body)
+		if err != nil {
+			return nil, err
+		}
+		ring = append(ring, keys...)
 	}
 
+	return ring, nil
+}
+
+// Matches finds all the public keys that have a fingerprint, name, or email
+// address that match query, according to the LocalPGPService's MatchMode.
+// Revoked keys are skipped, and so are keys without the Capability, and
+// expired keys unless ShowExpired is set.
+// If no matches are found, Matches returns an error, and if there are more
+// than MaxMatches, it returns the first ones and ErrTooManyMatches.
+func (l *LocalPGPService) Matches(ctx context.Context, query string) ([]User, error) {
+	ring, err := l.Ring()
+	if err != nil {
+		return nil, err
+	}
+
+	if l.index != nil && l.MatchMode == MatchExact && len(ring) > 0 {
+		if ring = l.index.exactCandidates(query); len(ring) == 0 {
+			return nil, ErrNoMatches
+		}
+	}
+
+	users, err := matchRing(ctx, ring, query, l.MatchMode, l.Capability, l.ShowExpired, l.clock())
+	if err != nil {
+		return nil, err
+	}
+
+	return limitMatches(users, l.MaxMatches)
+}
+
+// matchRing does the work for Matches: it finds the keys in ring with
+// capability that match query according to mode, as of now.
+func matchRing(ctx context.Context, ring openpgp.EntityList, query string, mode MatchMode, capability Capability, showExpired bool, now time.Time) ([]User, error) {
+	if len(ring) == 0 {
+		return nil, ErrNoRing
+	}
+
+	users := []User{}
+
 	// this is why LocalPGPService.ring has to be an EntityList instead of the
 	// more generic KeyRing: can't iterate through the latter. Botheration.
 	for _, key := range ring {
-		user := User{
-			Fingerprint: key.PrimaryKey.KeyIdString(),
+		// big rings take a while, so check in now and then
+		if err := ctx.Err(); err != nil {
+			return nil, err
 		}
 
-		for name := range key.Identities {
-			user.Emails = append(user.Emails, name)
+		// a revoked key should never be trusted, so don't even offer it
+		if isRevoked(key) {
+			continue
 		}
 
-		if l.isMatch(query, user) {
+		// neither is one that can't make signatures (like an
+		// encryption-only key), since it can't have signed the script,
+		// unless the caller is just looking
+		if !capability.has(key) {
+			continue
+		}
+
+		user := entityToUser(key)
+
+		// or one that nobody's identity is bound to
+		if user.Unverified {
+			continue
+		}
+
+		expired := isExpired(key, now)
+		if expired && !showExpired {
+			continue
+		}
+
+		user.Expired = expired
+
+		if mode.isMatch(query, user) {
 			users = append(users, user)
 		}
 	}
 
 	if len(users) == 0 {
-		return nil, errors.New("No matches")
+		return nil, ErrNoMatches
 	}
 
-	return users, nil
+	return mergeUsers(users), nil
 }
 
-func (l LocalPGPService) isMatch(query string, user User) bool {
-	if strings.Contains(strings.ToUpper(user.Fingerprint), strings.ToUpper(query)) {
-		return true
+// List is every key in the local keyring, sorted by fingerprint. Unlike
+// Matches, it leaves nothing out: keys that are revoked, expired, or have no
+// bound identities are there too, marked as such, so it's clear why they
+// never match.
+func (l *LocalPGPService) List(ctx context.Context) ([]User, error) {
+	ring, err := l.Ring()
+	if err != nil {
+		return nil, err
+	}
+
+	return listRing(ctx, ring, l.clock())
+}
+
+// listRing does the work for List: it's every key in ring as a User, as of
+// now.
+func listRing(ctx context.Context, ring openpgp.EntityList, now time.Time) ([]User, error) {
+	users := []User{}
+	for _, key := range ring {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		user := entityToUser(key)
+		user.Revoked = isRevoked(key)
+		user.Expired = isExpired(key, now)
+		users = append(users, user)
+	}
+
+	return mergeUsers(users), nil
+}
+
+func (l *LocalPGPService) isMatch(query string, user User) bool {
+	return l.MatchMode.isMatch(query, user)
+}
+
+func (m MatchMode) isMatch(query string, user User) bool {
+	if m == MatchExact {
+		return isExactMatch(query, user)
+	}
+
+	return matchUser(query, user)
+}
+
+func isExactMatch(query string, user User) bool {
+	if fingerprint := NormalizeFingerprint(query); len(fingerprint) == 40 {
+		for _, candidate := range append([]string{user.Fingerprint}, user.Subkeys...) {
+			if fingerprint == NormalizeFingerprint(candidate) {
+				return true
+			}
+		}
 	}
 
 	for _, email := range user.Emails {
-		if strings.Contains(strings.ToUpper(email), strings.ToUpper(query)) {
+		if SameEmail(email, query) {
 			return true
 		}
 	}
@@ -109,21 +695,128 @@ func (l LocalPGPService) isMatch(query string, user User) bool {
 }
 
 // Key gets the PGP public key from the local public keyring for a user's
-// fingerprint and returns the keyRing representation. If the fingerprint is
-// invalid or more than one public key is found, Key returns an error.
-func (l *LocalPGPService) Key(user User) (openpgp.EntityList, error) {
-	id, err := strconv.ParseUint(user.Fingerprint, 16, 64)
+// fingerprint and returns the keyRing representation. The fingerprint can be
+// a short (8 hex characters) or long (16) key id, or the full 40-character
+// fingerprint of the primary key or a subkey, with or without spaces or a 0x
+// prefix. A full fingerprint picks out the one key it belongs to even when key
+// ids collide. Expired subkeys, and subkeys that aren't for signing, are left
+// off the returned key. If the fingerprint is invalid, the key has been
+// revoked (ErrKeyRevoked), has expired or can't sign, or there's no single key
+// that matches, Key returns an error.
+func (l *LocalPGPService) Key(ctx context.Context, user User) (openpgp.EntityList, error) {
+	key, err := l.findKey(user)
+	if err != nil {
+		return nil, err
+	}
+
+	return openpgp.EntityList{signingKey(key, l.clock())}, nil
+}
+
+// FullKey gets the key for user the same way Key does, with every one of its
+// subkeys.
+func (l *LocalPGPService) FullKey(ctx context.Context, user User) (openpgp.EntityList, error) {
+	key, err := l.findKey(user)
 	if err != nil {
 		return nil, err
 	}
 
-	ring := l.Ring()
-	keys := ring.KeysById(id)
-	if len(keys) != 1 {
-		return nil, errors.New("More than one key returned, not sure what to do")
+	return openpgp.EntityList{key}, nil
+}
+
+// findKey does the work for Key and FullKey, using the index if there is one.
+func (l *LocalPGPService) findKey(user User) (*openpgp.Entity, error) {
+	ring, err := l.Ring()
+	if err != nil {
+		return nil, err
 	}
 
-	list := []*openpgp.Entity{keys[0].Entity}
+	if l.index != nil && len(ring) > 0 {
+		if keys, ok := l.index.byFingerprint(user.Fingerprint); ok {
+			if len(keys) == 0 {
+				return nil, errNoKey(user)
+			}
+			ring = keys
+		}
+	}
+
+	return findRingKey(ring, user, l.clock())
+}
+
+// errNoKey says there's no key for user's fingerprint.
+func errNoKey(user User) error {
+	return errors.New("No key found for " + user.Fingerprint)
+}
+
+// keyFromRing finds the one key in ring for user's fingerprint, as of now,
+// trimmed down to what can verify a signature.
+func keyFromRing(ring openpgp.EntityList, user User, now time.Time) (openpgp.EntityList, error) {
+	key, err := findRingKey(ring, user, now)
+	if err != nil {
+		return nil, err
+	}
+
+	return openpgp.EntityList{signingKey(key, now)}, nil
+}
+
+// findRingKey finds the one key in ring for user's fingerprint, as of now, and
+// makes sure it's still good for signing. The key is left whole.
+func findRingKey(ring openpgp.EntityList, user User, now time.Time) (*openpgp.Entity, error) {
+	if len(ring) == 0 {
+		return nil, ErrNoRing
+	}
+
+	fingerprint := NormalizeFingerprint(user.Fingerprint)
+
+	if _, err := hex.DecodeString(fingerprint); err != nil || len(fingerprint) < 8 {
+		return nil, errors.New("Invalid fingerprint requested")
+	}
+
+	var list openpgp.EntityList
+
+	switch len(fingerprint) {
+	case 40:
+		list = findExactKeys(ring, fingerprint)
+	case 16:
+		// long key ids can go straight to the ring. a key can show up more
+		// than once if a subkey shares the id.
+		id, err := strconv.ParseUint(fingerprint, 16, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		seen := map[*openpgp.Entity]bool{}
+		for _, key := range ring.KeysById(id) {
+			if !seen[key.Entity] {
+				seen[key.Entity] = true
+				list = append(list, key.Entity)
+			}
+		}
+	default:
+		// everything else has to be matched against the end of the full
+		// fingerprint
+		list = findKeys(ring, fingerprint)
+	}
+
+	if len(list) == 0 {
+		return nil, errNoKey(user)
+	}
+	if len(list) > 1 {
+		return nil, fmt.Errorf("%w: %d keys for %s", ErrAmbiguousKey, len(list), user.Fingerprint)
+	}
+
+	key := list[0]
+
+	if isRevoked(key) {
+		return nil, fmt.Errorf("%w: %s", ErrKeyRevoked, user.Fingerprint)
+	}
+
+	if isExpired(key, now) {
+		return nil, errors.New("The key for " + user.Fingerprint + " has expired")
+	}
+
+	if !canSign(key) {
+		return nil, errors.New("The key for " + user.Fingerprint + " can't make signatures")
+	}
 
-	return list, nil
+	return key, nil
 }
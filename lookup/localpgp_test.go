@@ -10,9 +10,23 @@ the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
 package lookup
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/user"
+	"path"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/suite"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
 )
 
 type LocalPGPTest struct {
@@ -29,6 +43,18 @@ func (s *LocalPGPTest) TestIsMatchMatchesOnFingerprint() {
 	s.True(local.isMatch("FOOBAR", user))
 }
 
+func (s *LocalPGPTest) TestIsMatchNormalizesFingerprints() {
+	local := LocalPGPService{}
+	user := User{Fingerprint: "2DEC361C395B52E763A95873DEADBEEF"}
+
+	s.True(local.isMatch("0xdeadbeef", user))
+	s.True(local.isMatch("DEAD BEEF", user))
+	s.True(local.isMatch("2dec 361c 395b", user))
+	s.True(local.isMatch("0XA95873", user))
+	s.True(local.isMatch("DEADBEEF", User{Fingerprint: "dead beef"}))
+	s.False(local.isMatch("0xbeefdead", user))
+}
+
 func (s *LocalPGPTest) TestIsMatchMatchesOnEmails() {
 	local := LocalPGPService{}
 	user := User{Emails: []string{"foobar", "bizbaz", "THINGS"}}
@@ -41,6 +67,367 @@ func (s *LocalPGPTest) TestIsMatchMatchesOnEmails() {
 	s.True(local.isMatch("thin", user))
 }
 
+func (s *LocalPGPTest) TestIsMatchMatchesOnNames() {
+	local := LocalPGPService{}
+	user := User{Names: []string{"Foo Bar (work)"}, Emails: []string{"fb@example.com"}}
+
+	s.True(local.isMatch("foo bar", user))
+	s.True(local.isMatch("WORK", user))
+	s.True(local.isMatch("fb@", user))
+	s.False(local.isMatch("baz", user))
+}
+
+func (s *LocalPGPTest) TestMatchesSplitsIdentities() {
+	local := &LocalPGPService{ringfile: publicRingFile("testdata/pubring.gpg")}
+
+	users, err := local.Matches(context.Background(), "pipethis test")
+	s.NoError(err)
+	s.Len(users, 1)
+	s.Equal([]string{"Pipethis Test"}, users[0].Names)
+	s.Equal([]string{"test@example.com"}, users[0].Emails)
+}
+
+func (s *LocalPGPTest) TestIsMatchExactNeedsWholeFingerprintOrEmail() {
+	local := LocalPGPService{MatchMode: MatchExact}
+	user := User{
+		Fingerprint: fixtureFingerprint,
+		Names:       []string{"Bob"},
+		Emails:      []string{"bob@example.com"},
+	}
+
+	s.True(local.isMatch(fixtureFingerprint, user))
+	s.True(local.isMatch("0x2dec 361c 395b 52e7 63a9 5873 a018 a3d9 0dc0 fa52", user))
+	s.True(local.isMatch("BOB@example.com", user))
+
+	s.False(local.isMatch(fixtureKeyID, user))
+	s.False(local.isMatch("bob", user))
+	s.False(local.isMatch("Bob", user))
+	s.False(local.isMatch("example.com", user))
+}
+
+func (s *LocalPGPTest) TestMatchesSubstringVersusExact() {
+	ringfile := writeTestRing(s.T(),
+		newTestEntity(s.T(), "Bob", "bob@example.com"),
+		newTestEntity(s.T(), "Bobby", "bobby@example.com"),
+		newTestEntity(s.T(), "H Bob", "hbob@example.com"),
+	)
+	defer os.Remove(ringfile)
+
+	local := &LocalPGPService{ringfile: publicRingFile(ringfile)}
+
+	users, err := local.Matches(context.Background(), "bob@")
+	s.NoError(err)
+	s.Len(users, 2)
+
+	users, err = local.Matches(context.Background(), "bob")
+	s.NoError(err)
+	s.Len(users, 3)
+
+	local.MatchMode = MatchExact
+
+	users, err = local.Matches(context.Background(), "bob@example.com")
+	s.NoError(err)
+	s.Len(users, 1)
+	s.Equal([]string{"bob@example.com"}, users[0].Emails)
+
+	users, err = local.Matches(context.Background(), users[0].Fingerprint)
+	s.NoError(err)
+	s.Len(users, 1)
+
+	_, err = local.Matches(context.Background(), "bob")
+	s.Error(err)
+}
+
+func (s *LocalPGPTest) TestMatchesCapsBroadQueries() {
+	entities := []*openpgp.Entity{}
+	for i := 0; i < DefaultMaxMatches+5; i++ {
+		entities = append(entities, newTestEntity(s.T(), fmt.Sprintf("User %d", i), fmt.Sprintf("user%d@example.com", i)))
+	}
+	ringfile := writeTestRing(s.T(), entities...)
+	defer os.Remove(ringfile)
+
+	local := &LocalPGPService{ringfile: publicRingFile(ringfile)}
+
+	users, err := local.Matches(context.Background(), "example.com")
+	s.True(errors.Is(err, ErrTooManyMatches), err)
+	s.EqualError(err, "Too many matches (25 of them, kept the first 20)")
+	s.Len(users, DefaultMaxMatches)
+
+	// the same first ones every time
+	all := []User{}
+	for _, entity := range entities {
+		all = append(all, entityToUser(entity))
+	}
+	s.Equal(sortUsers(all)[:DefaultMaxMatches], users)
+
+	_, _, err = Find(context.Background(), local, "example.com", true)
+	s.True(errors.Is(err, ErrTooManyMatches), err)
+	s.Contains(err.Error(), "for example.com; try a full fingerprint or email address")
+
+	// narrow queries, or a bigger limit, are fine
+	users, err = local.Matches(context.Background(), "user1@")
+	s.NoError(err)
+	s.Len(users, 1)
+
+	local.MaxMatches = -1
+	users, err = local.Matches(context.Background(), "example.com")
+	s.NoError(err)
+	s.Len(users, DefaultMaxMatches+5)
+
+	local.MaxMatches = 3
+	users, err = local.Matches(context.Background(), "example.com")
+	s.True(errors.Is(err, ErrTooManyMatches), err)
+	s.Len(users, 3)
+}
+
+func (s *LocalPGPTest) TestMatchesSkipsTamperedIdentities() {
+	// the fixture key with a Mallory identity that borrows its real
+	// self-signature, then an untouched key
+	local, err := NewLocalPGPServiceFromPath("testdata/tampered.gpg")
+	s.Require().NoError(err)
+
+	_, err = local.Matches(context.Background(), "mallory")
+	s.True(errors.Is(err, ErrNoMatches), err)
+
+	users, err := local.Matches(context.Background(), "example.com")
+	s.NoError(err)
+	s.Require().Len(users, 1)
+	s.Equal([]string{"self@example.com"}, users[0].Emails)
+}
+
+func (s *LocalPGPTest) TestMatchesSkipsRevokedKeys() {
+	local := &LocalPGPService{ringfile: publicRingFile("testdata/revoked.gpg")}
+
+	ring, err := local.Ring()
+	s.NoError(err)
+	s.Len(ring, 2)
+
+	users, err := local.Matches(context.Background(), "example.com")
+	s.NoError(err)
+	s.Len(users, 1)
+	s.Equal([]string{"live@example.com"}, users[0].Emails)
+	s.False(users[0].Revoked)
+
+	_, err = local.Matches(context.Background(), "revoked@example.com")
+	s.Error(err)
+}
+
+func (s *LocalPGPTest) TestFullKeyKeepsEverySubkey() {
+	local := &LocalPGPService{ringfile: publicRingFile("testdata/usage.gpg")}
+	user := User{Fingerprint: corruptFirst}
+
+	trimmed, err := local.Key(context.Background(), user)
+	s.Require().NoError(err)
+	full, err := FullKey(context.Background(), local, user)
+	s.Require().NoError(err)
+
+	ring, err := local.Ring()
+	s.Require().NoError(err)
+	whole := findKeys(ring, corruptFirst)[0]
+
+	s.Equal(openpgp.EntityList{whole}, full)
+	s.Less(len(trimmed[0].Subkeys), len(full[0].Subkeys))
+
+	// the wrappers hand it over whole too
+	pinned, err := NewFingerprintService(local, corruptFirst)
+	s.Require().NoError(err)
+	full, err = FullKey(context.Background(), pinned, user)
+	s.Require().NoError(err)
+	s.Equal(openpgp.EntityList{whole}, full)
+
+	full, err = FullKey(context.Background(), NewCascadeService(false, local), user)
+	s.Require().NoError(err)
+	s.Equal(openpgp.EntityList{whole}, full)
+}
+
+func (s *LocalPGPTest) TestKeyRejectsRevokedKeys() {
+	local := &LocalPGPService{ringfile: publicRingFile("testdata/revoked.gpg")}
+
+	_, err := local.Key(context.Background(), User{Fingerprint: "B459B2AE741F00C4604DB74AA5F0EED3D90CCB39"})
+	s.True(errors.Is(err, ErrKeyRevoked), err)
+
+	ring, err := local.Key(context.Background(), User{Fingerprint: "5C0A586B5385A0351E2AB8EE1D5D3F973EA6B98A"})
+	s.NoError(err)
+	s.Len(ring, 1)
+}
+
+func (s *LocalPGPTest) TestMatchesSkipsExpiredKeys() {
+	local := &LocalPGPService{ringfile: publicRingFile("testdata/expiring.gpg")}
+
+	// testdata/expiring.gpg was created at 1792045183, and expires 10 days
+	// later
+	created := time.Unix(1792045183, 0)
+
+	local.now = func() time.Time { return created.Add(10*24*time.Hour - time.Second) }
+	users, err := local.Matches(context.Background(), "expiring@example.com")
+	s.NoError(err)
+	s.Len(users, 1)
+	s.False(users[0].Expired)
+
+	local.now = func() time.Time { return created.Add(10*24*time.Hour + time.Second) }
+	_, err = local.Matches(context.Background(), "expiring@example.com")
+	s.Error(err)
+
+	local.ShowExpired = true
+	users, err = local.Matches(context.Background(), "expiring@example.com")
+	s.NoError(err)
+	s.Len(users, 1)
+	s.True(users[0].Expired)
+}
+
+func (s *LocalPGPTest) TestKeyFailsForExpiredKeys() {
+	local := &LocalPGPService{ringfile: publicRingFile("testdata/expiring.gpg")}
+	created := time.Unix(1792045183, 0)
+
+	local.now = func() time.Time { return created.Add(11 * 24 * time.Hour) }
+	_, err := local.Key(context.Background(), User{Fingerprint: "75F74B66408EC6D7"})
+	s.Error(err)
+	s.Contains(err.Error(), "expired")
+}
+
+func (s *LocalPGPTest) TestKeyDropsExpiredSubkeys() {
+	local := &LocalPGPService{ringfile: publicRingFile("testdata/expiring.gpg")}
+	created := time.Unix(1792045183, 0)
+
+	// the signing subkey only lasts a day
+	local.now = func() time.Time { return created.Add(time.Hour) }
+	ring, err := local.Key(context.Background(), User{Fingerprint: "EE07973C69F2918FC570C78875F74B66408EC6D7"})
+	s.NoError(err)
+	s.Len(ring[0].Subkeys, 1)
+	s.Equal("525D234B89E929FF", ring[0].Subkeys[0].PublicKey.KeyIdString())
+
+	local.now = func() time.Time { return created.Add(2 * 24 * time.Hour) }
+	ring, err = local.Key(context.Background(), User{Fingerprint: "EE07973C69F2918FC570C78875F74B66408EC6D7"})
+	s.NoError(err)
+	s.Empty(ring[0].Subkeys)
+
+	// the original key in the ring is left alone
+	full, _ := local.Ring()
+	s.Len(full[0].Subkeys, 1)
+}
+
+func (s *LocalPGPTest) TestOnlySigningKeysAreOffered() {
+	// testdata/usage.gpg has an encryption-only key (43BDB372...), and a key
+	// with a signing subkey (F98958A510410C31) and an encryption subkey
+	local := &LocalPGPService{ringfile: publicRingFile("testdata/usage.gpg")}
+
+	users, err := local.Matches(context.Background(), "example.com")
+	s.NoError(err)
+	s.Len(users, 1)
+	s.Equal("134E0DE0D18FB090F7C17C10A5034EFD4162D102", users[0].Fingerprint)
+
+	_, err = local.Key(context.Background(), User{Fingerprint: "43BDB3728915C80F4529ED0CDFDBAB9168012643"})
+	s.Error(err)
+	s.Contains(err.Error(), "can't make signatures")
+
+	ring, err := local.Key(context.Background(), User{Fingerprint: users[0].Fingerprint})
+	s.NoError(err)
+	s.Len(ring[0].Subkeys, 1)
+	s.Equal("F98958A510410C31", ring[0].Subkeys[0].PublicKey.KeyIdString())
+}
+
+func (s *LocalPGPTest) TestCapabilityFiltersMatches() {
+	// testdata/capabilities.gpg is testdata/usage.gpg plus a certify-only key
+	// (A3D2270CC1FE83168CCD56C9C5657D3FDA8FE88C) without any subkeys
+	const (
+		encryptOnly = "43BDB3728915C80F4529ED0CDFDBAB9168012643"
+		signing     = "134E0DE0D18FB090F7C17C10A5034EFD4162D102"
+		certifyOnly = "A3D2270CC1FE83168CCD56C9C5657D3FDA8FE88C"
+	)
+
+	fingerprints := func(capability Capability) []string {
+		local := &LocalPGPService{ringfile: publicRingFile("testdata/capabilities.gpg"), Capability: capability}
+
+		users, err := local.Matches(context.Background(), "example.com")
+		s.Require().NoError(err)
+
+		found := []string{}
+		for _, user := range users {
+			found = append(found, user.Fingerprint)
+		}
+		return found
+	}
+
+	s.Equal([]string{signing}, fingerprints(CapabilitySign))
+	s.Equal([]string{signing, encryptOnly}, fingerprints(CapabilityEncrypt))
+	s.Equal([]string{signing, encryptOnly, certifyOnly}, fingerprints(CapabilityAll))
+
+	// finding a key isn't the same as trusting it
+	local := &LocalPGPService{ringfile: publicRingFile("testdata/capabilities.gpg"), Capability: CapabilityAll}
+	_, err := local.Key(context.Background(), User{Fingerprint: certifyOnly})
+	s.Error(err)
+	s.Contains(err.Error(), "can't make signatures")
+}
+
+func (s *LocalPGPTest) TestMatchesFindsSigningSubkeys() {
+	local := &LocalPGPService{ringfile: publicRingFile("testdata/usage.gpg")}
+
+	// the signing subkey's long id and fingerprint both find the key
+	for _, query := range []string{"F98958A510410C31", "0x191F 1AA0 8536 6BD4 B06C  F65C F989 58A5 1041 0C31"} {
+		users, err := local.Matches(context.Background(), query)
+		s.NoError(err, query)
+		s.Len(users, 1, query)
+		s.Equal("134E0DE0D18FB090F7C17C10A5034EFD4162D102", users[0].Fingerprint, query)
+		s.Equal([]string{"191F1AA085366BD4B06CF65CF98958A510410C31"}, users[0].Subkeys, query)
+	}
+
+	// the encryption subkey never signs anything, so it doesn't count
+	_, err := local.Matches(context.Background(), "E6AEFEB163CD9322")
+	s.Error(err)
+
+	local.MatchMode = MatchExact
+	users, err := local.Matches(context.Background(), "191F1AA085366BD4B06CF65CF98958A510410C31")
+	s.NoError(err)
+	s.Len(users, 1)
+	_, err = local.Matches(context.Background(), "F98958A510410C31")
+	s.Error(err)
+}
+
+func (s *LocalPGPTest) TestMatchesStopsWhenCancelled() {
+	local := &LocalPGPService{ringfile: publicRingFile("testdata/pubring.gpg")}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := local.Matches(ctx, "test@example.com")
+	s.Equal(context.Canceled, err)
+}
+
+func (s *LocalPGPTest) TestKeyPrefersExactFingerprint() {
+	first := newTestEntity(s.T(), "First", "first@example.com")
+	second := newTestEntity(s.T(), "Second", "second@example.com")
+
+	// give the second key the same key id as the first, but leave the front
+	// of the fingerprint alone
+	second.PrimaryKey.KeyId = first.PrimaryKey.KeyId
+	copy(second.PrimaryKey.Fingerprint[12:], first.PrimaryKey.Fingerprint[12:])
+
+	local := &LocalPGPService{ring: openpgp.EntityList{first, second}}
+
+	for _, expected := range []*openpgp.Entity{first, second} {
+		ring, err := local.Key(context.Background(), User{Fingerprint: keyFingerprint(expected)})
+		s.NoError(err)
+		s.Len(ring, 1)
+		s.Equal(expected.PrimaryKey.Fingerprint, ring[0].PrimaryKey.Fingerprint)
+	}
+
+	// the ids really are ambiguous
+	_, err := local.Key(context.Background(), User{Fingerprint: first.PrimaryKey.KeyIdString()})
+	s.Error(err)
+	_, err = local.Key(context.Background(), User{Fingerprint: first.PrimaryKey.KeyIdShortString()})
+	s.Error(err)
+}
+
+func (s *LocalPGPTest) TestKeyMatchesSubkeyFingerprint() {
+	local := &LocalPGPService{ringfile: publicRingFile("testdata/expiring.gpg")}
+	local.now = func() time.Time { return time.Unix(1792045183, 0) }
+
+	ring, err := local.Key(context.Background(), User{Fingerprint: "C53FAC9974B15B5EC1E329E9525D234B89E929FF"})
+	s.NoError(err)
+	s.Len(ring, 1)
+	s.Equal("75F74B66408EC6D7", ring[0].PrimaryKey.KeyIdString())
+}
+
 func (s *LocalPGPTest) TestIsMatchFailsWithoutMatches() {
 	local := LocalPGPService{}
 	user := User{}
@@ -48,6 +435,583 @@ func (s *LocalPGPTest) TestIsMatchFailsWithoutMatches() {
 	s.False(local.isMatch("foo", user))
 }
 
+func (s *LocalPGPTest) TestRingIsCached() {
+	ringfile := writeTestRing(s.T(), newTestEntity(s.T(), "Foo", "foo@example.com"))
+	defer os.Remove(ringfile)
+
+	local := &LocalPGPService{ringfile: publicRingFile(ringfile)}
+	first, err := local.Ring()
+	s.NoError(err)
+	s.Len(first, 1)
+
+	// if Ring() goes back to the file, it'll come up empty the second time
+	os.Remove(ringfile)
+
+	second, err := local.Ring()
+	s.NoError(err)
+	s.Len(second, 1)
+	s.Equal(first[0].PrimaryKey.Fingerprint, second[0].PrimaryKey.Fingerprint)
+}
+
+func (s *LocalPGPTest) TestRingLogsLoadedKeys() {
+	var buf bytes.Buffer
+	local := &LocalPGPService{ringfile: publicRingFile("testdata/revoked.gpg"), Logger: log.New(&buf, "", 0)}
+
+	_, err := local.Ring()
+
+	s.NoError(err)
+	s.Equal("loaded 2 keys from revoked.gpg\n", buf.String())
+}
+
+func (s *LocalPGPTest) TestRingReadsKeyringAndKeybox() {
+	for _, ringfile := range []string{"testdata/pubring.gpg", "testdata/pubring.kbx", "testdata/pubring.asc"} {
+		local := &LocalPGPService{ringfile: publicRingFile(ringfile)}
+		ring, err := local.Ring()
+
+		s.NoError(err, ringfile)
+		s.Len(ring, 1, ringfile)
+		s.Equal(fixtureKeyID, ring[0].PrimaryKey.KeyIdString(), ringfile)
+	}
+}
+
+func (s *LocalPGPTest) TestRingReadsArmoredAndBinaryTheSame() {
+	binary, _ := (&LocalPGPService{ringfile: publicRingFile("testdata/pubring.gpg")}).Ring()
+	armored, _ := (&LocalPGPService{ringfile: publicRingFile("testdata/pubring.asc")}).Ring()
+
+	s.Require().Len(binary, 1)
+	s.Require().Len(armored, 1)
+	s.Equal(binary[0].PrimaryKey.Fingerprint, armored[0].PrimaryKey.Fingerprint)
+	s.Equal(len(binary[0].Identities), len(armored[0].Identities))
+	for name := range binary[0].Identities {
+		s.Contains(armored[0].Identities, name)
+	}
+	s.Equal(len(binary[0].Subkeys), len(armored[0].Subkeys))
+}
+
+// newPublicRingFile is newPublicRingFile, for when there's bound to be a home
+// directory.
+func (s *LocalPGPTest) TestRingReadsConcatenatedArmoredBlocks() {
+	// testdata/bundle.asc is pubring.gpg and then the signing key from
+	// usage.gpg, each exported with gpg --armor
+	local := &LocalPGPService{ringfile: publicRingFile("testdata/bundle.asc")}
+
+	ring, err := local.Ring()
+	s.Require().NoError(err)
+	s.Require().Len(ring, 2)
+	s.Equal(fixtureFingerprint, keyFingerprint(ring[0]))
+	s.Equal("134E0DE0D18FB090F7C17C10A5034EFD4162D102", keyFingerprint(ring[1]))
+
+	for _, query := range []string{"test@example.com", "signer@example.com"} {
+		users, err := local.Matches(context.Background(), query)
+		s.NoError(err, query)
+		s.Len(users, 1, query)
+	}
+}
+
+func (s *LocalPGPTest) TestRingRejectsArmoredBlocksThatArentKeys() {
+	bundle, err := ioutil.ReadFile("testdata/bundle.asc")
+	s.Require().NoError(err)
+	bundle = append(bundle, "-----BEGIN PGP SIGNATURE-----\n\nwsBcBAABCAAQBQJ=\n=abcd\n-----END PGP SIGNATURE-----\n"...)
+
+	_, err = readRing(bufio.NewReader(bytes.NewReader(bundle)), openpgp.ReadKeyRing)
+	s.EqualError(err, "Expected a key block, got PGP SIGNATURE")
+}
+
+func (s *LocalPGPTest) newPublicRingFile() publicRingFile {
+	ringfile, err := newPublicRingFile()
+	s.Require().NoError(err)
+
+	return ringfile
+}
+
+func (s *LocalPGPTest) TestNewPublicRingFileFallsBackToKeybox() {
+	home, err := ioutil.TempDir("", "pipethis-test-")
+	s.Require().NoError(err)
+	defer os.RemoveAll(home)
+
+	gnupghome := os.Getenv("GNUPGHOME")
+	defer os.Setenv("GNUPGHOME", gnupghome)
+	os.Setenv("GNUPGHOME", home)
+
+	// nothing there: stick with pubring.gpg
+	s.Equal(publicRingFile(path.Join(home, "pubring.gpg")), s.newPublicRingFile())
+
+	// only a keybox
+	kbx, _ := ioutil.ReadFile("testdata/pubring.kbx")
+	ioutil.WriteFile(path.Join(home, "pubring.kbx"), kbx, 0600)
+	s.Equal(publicRingFile(path.Join(home, "pubring.kbx")), s.newPublicRingFile())
+
+	// an empty keyring doesn't count
+	ioutil.WriteFile(path.Join(home, "pubring.gpg"), nil, 0600)
+	s.Equal(publicRingFile(path.Join(home, "pubring.kbx")), s.newPublicRingFile())
+
+	// but a real one does
+	gpg, _ := ioutil.ReadFile("testdata/pubring.gpg")
+	ioutil.WriteFile(path.Join(home, "pubring.gpg"), gpg, 0600)
+	s.Equal(publicRingFile(path.Join(home, "pubring.gpg")), s.newPublicRingFile())
+
+	service, err := NewLocalPGPService()
+	s.NoError(err)
+	ring, err := service.Ring()
+	s.NoError(err)
+	s.Len(ring, 1)
+}
+
+func (s *LocalPGPTest) TestNewPublicRingFileExpandsGNUPGHOME() {
+	gnupghome, home := os.Getenv("GNUPGHOME"), os.Getenv("HOME")
+	defer os.Setenv("GNUPGHOME", gnupghome)
+	defer os.Setenv("HOME", home)
+
+	os.Setenv("HOME", "/home/foo")
+	os.Setenv("KEYS", "keys")
+
+	tests := map[string]string{
+		"~/sub":          "/home/foo/sub/pubring.gpg",
+		"~":              "/home/foo/pubring.gpg",
+		"$HOME/sub":      "/home/foo/sub/pubring.gpg",
+		"${HOME}/$KEYS":  "/home/foo/keys/pubring.gpg",
+		"/plain/path":    "/plain/path/pubring.gpg",
+		"~other/sub":     "~other/sub/pubring.gpg",
+		"/plain/~/tilde": "/plain/~/tilde/pubring.gpg",
+	}
+
+	for value, expected := range tests {
+		os.Setenv("GNUPGHOME", value)
+		s.Equal(publicRingFile(expected), s.newPublicRingFile(), value)
+	}
+}
+
+func (s *LocalPGPTest) TestNewPublicRingFileWithoutHome() {
+	gnupghome, home := os.Getenv("GNUPGHOME"), os.Getenv("HOME")
+	defer os.Setenv("GNUPGHOME", gnupghome)
+	defer os.Setenv("HOME", home)
+	defer func() { currentUser = user.Current }()
+
+	os.Unsetenv("GNUPGHOME")
+	os.Setenv("HOME", "")
+
+	// the current user's home directory fills in
+	currentUser = func() (*user.User, error) {
+		return &user.User{Username: "foo", HomeDir: "/home/foo"}, nil
+	}
+	s.Equal(publicRingFile("/home/foo/.gnupg/pubring.gpg"), s.newPublicRingFile())
+
+	// but with no user either, there's nowhere to look
+	for _, lookup := range []func() (*user.User, error){
+		func() (*user.User, error) { return nil, errors.New("No such user") },
+		func() (*user.User, error) { return &user.User{Username: "foo"}, nil },
+	} {
+		currentUser = lookup
+
+		_, err := newPublicRingFile()
+		s.True(errors.Is(err, ErrNoHome), err)
+		s.EqualError(err, "No home directory: HOME isn't set and the current user doesn't have one, so set GNUPGHOME")
+
+		_, err = NewLocalPGPService()
+		s.True(errors.Is(err, ErrNoHome), err)
+
+		_, err = NewLocalSecretPGPService()
+		s.True(errors.Is(err, ErrNoHome), err)
+	}
+
+	// and GNUPGHOME doesn't need one
+	os.Setenv("GNUPGHOME", "/plain/path")
+	s.Equal(publicRingFile("/plain/path/pubring.gpg"), s.newPublicRingFile())
+}
+
+func (s *LocalPGPTest) TestKeyAcceptsIdsAndFingerprints() {
+	local := &LocalPGPService{ringfile: publicRingFile("testdata/pubring.gpg")}
+
+	for _, fingerprint := range []string{
+		"0DC0FA52",
+		fixtureKeyID,
+		fixtureFingerprint,
+		"0x" + fixtureFingerprint,
+		"2DEC 361C 395B 52E7 63A9  5873 A018 A3D9 0DC0 FA52",
+	} {
+		ring, err := local.Key(context.Background(), User{Fingerprint: fingerprint})
+		s.NoError(err, fingerprint)
+		s.Len(ring, 1, fingerprint)
+		s.Equal(fixtureKeyID, ring[0].PrimaryKey.KeyIdString(), fingerprint)
+	}
+}
+
+func (s *LocalPGPTest) TestKeyFailsWithBadFingerprints() {
+	local := &LocalPGPService{ringfile: publicRingFile("testdata/pubring.gpg")}
+
+	for _, fingerprint := range []string{"", "FA52", "not hex at all", "1111111111111111", "1111111111111111111111111111111111111111"} {
+		_, err := local.Key(context.Background(), User{Fingerprint: fingerprint})
+		s.Error(err, fingerprint)
+	}
+}
+
+func (s *LocalPGPTest) TestNewLocalPGPServiceFromPathLoadsRing() {
+	for _, ringfile := range []string{"testdata/pubring.gpg", "testdata/pubring.kbx"} {
+		local, err := NewLocalPGPServiceFromPath(ringfile)
+		s.NoError(err, ringfile)
+
+		users, err := local.Matches(context.Background(), "test@example.com")
+		s.NoError(err, ringfile)
+		s.Len(users, 1, ringfile)
+	}
+}
+
+func (s *LocalPGPTest) TestNewLocalPGPServiceFromPathBailsWithoutRing() {
+	_, err := NewLocalPGPServiceFromPath("testdata/not-a-real-ring.gpg")
+	s.True(errors.Is(err, ErrRingMissing), err)
+	s.True(errors.Is(err, os.ErrNotExist), err)
+}
+
+func (s *LocalPGPTest) TestStatExplainsUnusableRings() {
+	_, err := publicRingFile("testdata/not-a-real-ring.gpg").Stat()
+	s.True(errors.Is(err, ErrRingMissing), err)
+	s.EqualError(err, "Keyring not found: stat testdata/not-a-real-ring.gpg: no such file or directory")
+
+	empty := writeTestFile(s.T(), nil, 0600)
+	defer os.Remove(empty)
+
+	_, err = publicRingFile(empty).Stat()
+	s.True(errors.Is(err, ErrRingEmpty), err)
+	s.EqualError(err, "Keyring is empty: "+empty)
+
+	_, err = NewLocalPGPServiceFromPath(empty)
+	s.True(errors.Is(err, ErrRingEmpty), err)
+
+	// a path that goes through a file isn't missing, it's just wrong
+	_, err = publicRingFile("testdata/pubring.gpg/pubring.gpg").Stat()
+	s.True(errors.Is(err, ErrRingUnreadable), err)
+
+	info, err := publicRingFile("testdata/pubring.gpg").Stat()
+	s.NoError(err)
+	s.NotNil(info)
+}
+
+func (s *LocalPGPTest) TestStatExplainsUnreadableRings() {
+	if os.Geteuid() == 0 {
+		s.T().Skip("root can read anything")
+	}
+
+	contents, _ := ioutil.ReadFile("testdata/pubring.gpg")
+	ringfile := writeTestFile(s.T(), contents, 0000)
+	defer os.Remove(ringfile)
+
+	_, err := publicRingFile(ringfile).Stat()
+	s.True(errors.Is(err, ErrRingUnreadable), err)
+	s.True(errors.Is(err, os.ErrPermission), err)
+
+	_, err = NewLocalPGPServiceFromPath(ringfile)
+	s.True(errors.Is(err, ErrRingUnreadable), err)
+}
+
+func (s *LocalPGPTest) TestNewLocalPGPServiceFromPathsMergesRings() {
+	local, err := NewLocalPGPServiceFromPaths([]string{"testdata/pubring.gpg", "testdata/revoked.gpg", "testdata/pubring.asc"})
+	s.Require().NoError(err)
+
+	// pubring.asc is the same key as pubring.gpg
+	ring, err := local.Ring()
+	s.NoError(err)
+	s.Len(ring, 3)
+
+	users, err := local.Matches(context.Background(), "test@example.com")
+	s.NoError(err)
+	s.Len(users, 1)
+
+	users, err = local.Matches(context.Background(), "live@example.com")
+	s.NoError(err)
+	s.Len(users, 1)
+
+	keys, err := local.Key(context.Background(), User{Fingerprint: fixtureKeyID})
+	s.NoError(err)
+	s.Len(keys, 1)
+}
+
+func (s *LocalPGPTest) TestNewLocalPGPServiceFromPathsBailsWithoutEveryRing() {
+	_, err := NewLocalPGPServiceFromPaths([]string{"testdata/pubring.gpg", "testdata/not-a-real-ring.gpg"})
+	s.True(errors.Is(err, ErrRingMissing), err)
+
+	_, err = NewLocalPGPServiceFromPaths(nil)
+	s.Error(err)
+}
+
+// copyRing copies the fixture ring at from into a temporary file, and
+// returns its name.
+func (s *LocalPGPTest) copyRing(from string) string {
+	contents, err := ioutil.ReadFile(from)
+	s.Require().NoError(err)
+
+	file, err := ioutil.TempFile("", "pipethis-ring-")
+	s.Require().NoError(err)
+	defer file.Close()
+
+	_, err = file.Write(contents)
+	s.Require().NoError(err)
+
+	return file.Name()
+}
+
+// appendRing adds the keys in the fixture ring at from to the ring at to.
+func (s *LocalPGPTest) appendRing(to, from string) {
+	contents, err := ioutil.ReadFile(from)
+	s.Require().NoError(err)
+
+	file, err := os.OpenFile(to, os.O_APPEND|os.O_WRONLY, 0600)
+	s.Require().NoError(err)
+	defer file.Close()
+
+	_, err = file.Write(contents)
+	s.Require().NoError(err)
+}
+
+func (s *LocalPGPTest) TestReloadPicksUpNewKeys() {
+	ringfile := s.copyRing("testdata/pubring.gpg")
+	defer os.Remove(ringfile)
+
+	local, err := NewLocalPGPServiceFromPath(ringfile)
+	s.Require().NoError(err)
+
+	ring, err := local.Ring()
+	s.NoError(err)
+	s.Len(ring, 1)
+
+	s.appendRing(ringfile, "testdata/usage.gpg")
+
+	// without a reload, the old ring sticks around
+	ring, err = local.Ring()
+	s.NoError(err)
+	s.Len(ring, 1)
+	_, err = local.Matches(context.Background(), "signer@example.com")
+	s.Error(err)
+
+	local.Reload()
+
+	ring, err = local.Ring()
+	s.NoError(err)
+	s.Len(ring, 3)
+	users, err := local.Matches(context.Background(), "signer@example.com")
+	s.NoError(err)
+	s.Len(users, 1)
+}
+
+func (s *LocalPGPTest) TestAutoReloadWatchesModificationTime() {
+	ringfile := s.copyRing("testdata/pubring.gpg")
+	defer os.Remove(ringfile)
+
+	local, err := NewLocalPGPServiceFromPath(ringfile)
+	s.Require().NoError(err)
+	local.AutoReload = true
+
+	ring, err := local.Ring()
+	s.NoError(err)
+	s.Len(ring, 1)
+
+	// make sure the change shows up even on filesystems with coarse
+	// timestamps
+	s.appendRing(ringfile, "testdata/usage.gpg")
+	later := time.Now().Add(time.Minute)
+	s.Require().NoError(os.Chtimes(ringfile, later, later))
+
+	ring, err = local.Ring()
+	s.NoError(err)
+	s.Len(ring, 3)
+
+	// nothing changed this time, so it's the same ring
+	again, err := local.Ring()
+	s.NoError(err)
+	s.Same(ring[0], again[0])
+}
+
+func (s *LocalPGPTest) TestRingReturnsOpenErrors() {
+	local := &LocalPGPService{ringfile: publicRingFile("testdata/not-a-real-ring.gpg")}
+
+	_, err := local.Ring()
+	s.True(os.IsNotExist(err))
+
+	_, err = local.Matches(context.Background(), "foo")
+	s.True(os.IsNotExist(err))
+
+	_, err = local.Key(context.Background(), User{Fingerprint: fixtureKeyID})
+	s.True(os.IsNotExist(err))
+}
+
+func (s *LocalPGPTest) TestRingReturnsPermissionErrors() {
+	if os.Geteuid() == 0 {
+		s.T().Skip("root can read anything")
+	}
+
+	contents, _ := ioutil.ReadFile("testdata/pubring.gpg")
+	ringfile := writeTestFile(s.T(), contents, 0000)
+	defer os.Remove(ringfile)
+
+	local := &LocalPGPService{ringfile: publicRingFile(ringfile)}
+
+	_, err := local.Ring()
+	s.True(os.IsPermission(err))
+
+	_, err = local.Matches(context.Background(), "foo")
+	s.True(os.IsPermission(err))
+}
+
+func (s *LocalPGPTest) TestRingReturnsParseErrors() {
+	contents, _ := ioutil.ReadFile("testdata/pubring.gpg")
+	ringfile := writeTestFile(s.T(), contents[:100], 0600)
+	defer os.Remove(ringfile)
+
+	local := &LocalPGPService{ringfile: publicRingFile(ringfile)}
+
+	_, err := local.Ring()
+	s.Error(err)
+	s.Equal(io.ErrUnexpectedEOF, err)
+
+	_, err = local.Matches(context.Background(), "foo")
+	s.Equal(io.ErrUnexpectedEOF, err)
+
+	_, err = local.Key(context.Background(), User{Fingerprint: fixtureFingerprint})
+	s.Equal(io.ErrUnexpectedEOF, err)
+}
+
+func (s *LocalPGPTest) TestListReturnsEveryKey() {
+	local := &LocalPGPService{ringfile: publicRingFile("testdata/capabilities.gpg")}
+
+	users, err := local.List(context.Background())
+	s.Require().NoError(err)
+	s.Require().Len(users, 3)
+
+	// sorted by fingerprint, whatever they can do
+	s.Equal("134E0DE0D18FB090F7C17C10A5034EFD4162D102", users[0].Fingerprint)
+	s.Equal([]string{"signer@example.com"}, users[0].Emails)
+	s.Equal([]string{"191F1AA085366BD4B06CF65CF98958A510410C31"}, users[0].Subkeys)
+	s.Equal("43BDB3728915C80F4529ED0CDFDBAB9168012643", users[1].Fingerprint)
+	s.Equal([]string{"encrypt@example.com"}, users[1].Emails)
+	s.Equal("A3D2270CC1FE83168CCD56C9C5657D3FDA8FE88C", users[2].Fingerprint)
+	s.Equal([]string{"certify@example.com"}, users[2].Emails)
+
+	// revoked keys are listed too, just marked
+	local = &LocalPGPService{ringfile: publicRingFile("testdata/revoked.gpg")}
+	users, err = local.List(context.Background())
+	s.Require().NoError(err)
+	s.Require().Len(users, 2)
+	s.Equal("5C0A586B5385A0351E2AB8EE1D5D3F973EA6B98A", users[0].Fingerprint)
+	s.False(users[0].Revoked)
+	s.Equal("B459B2AE741F00C4604DB74AA5F0EED3D90CCB39", users[1].Fingerprint)
+	s.True(users[1].Revoked)
+
+	var _ Lister = local
+}
+
+// fakeRingSource is a keyring in memory that remembers whether it was
+// closed.
+type fakeRingSource struct {
+	*bytes.Reader
+	closed bool
+}
+
+func (f *fakeRingSource) Close() error {
+	f.closed = true
+	return nil
+}
+
+// fakeOpen makes every keyring LocalPGPService opens come from source.
+func fakeOpen(source *fakeRingSource, err error) func(publicRingFile) ringSource {
+	return func(publicRingFile) ringSource {
+		return func() (io.ReadCloser, error) {
+			if err != nil {
+				return nil, err
+			}
+			return source, nil
+		}
+	}
+}
+
+func (s *LocalPGPTest) TestRingClosesWhatItOpens() {
+	contents, err := ioutil.ReadFile("testdata/usage.gpg")
+	s.Require().NoError(err)
+	source := &fakeRingSource{Reader: bytes.NewReader(contents)}
+	local := &LocalPGPService{ringfile: publicRingFile("fake.gpg"), open: fakeOpen(source, nil)}
+
+	ring, err := local.Ring()
+	s.Require().NoError(err)
+	s.NotEmpty(ring)
+	s.True(source.closed)
+
+	// and when the keyring turns out to be junk
+	source = &fakeRingSource{Reader: bytes.NewReader([]byte("not a keyring at all"))}
+	local = &LocalPGPService{ringfile: publicRingFile("fake.gpg"), open: fakeOpen(source, nil)}
+
+	_, err = local.Ring()
+	s.Error(err)
+	s.True(source.closed)
+}
+
+func (s *LocalPGPTest) TestRingReturnsSourceErrors() {
+	unreadable := errors.New("Disk on fire")
+	local := &LocalPGPService{ringfile: publicRingFile("fake.gpg"), open: fakeOpen(nil, unreadable)}
+
+	_, err := local.Ring()
+	s.Equal(unreadable, err)
+}
+
 func TestLocalPGPTest(t *testing.T) {
 	suite.Run(t, new(LocalPGPTest))
 }
+
+// newTestEntity generates a small throwaway key for a single identity.
+func newTestEntity(t *testing.T, name, email string) *openpgp.Entity {
+	entity, err := openpgp.NewEntity(name, "", email, &packet.Config{RSABits: 1024})
+	if err != nil {
+		t.Fatal("Failed generating the test key:", err)
+	}
+
+	return entity
+}
+
+// newExpiredTestEntity generates a small throwaway key like newTestEntity,
+// made two days ago and good for one.
+func newExpiredTestEntity(t *testing.T, name, email string) *openpgp.Entity {
+	made := time.Now().Add(-48 * time.Hour)
+	entity, err := openpgp.NewEntity(name, "", email, &packet.Config{RSABits: 1024, Time: func() time.Time { return made }})
+	if err != nil {
+		t.Fatal("Failed generating the test key:", err)
+	}
+
+	lifetime := uint32((24 * time.Hour).Seconds())
+	for _, identity := range entity.Identities {
+		identity.SelfSignature.KeyLifetimeSecs = &lifetime
+		if err := identity.SelfSignature.SignUserId(identity.UserId.Id, entity.PrimaryKey, entity.PrivateKey, nil); err != nil {
+			t.Fatal("Failed signing the test key:", err)
+		}
+	}
+
+	return entity
+}
+
+// writeTestFile saves contents to a temporary file with mode perm, and
+// returns the file name.
+func writeTestFile(t *testing.T, contents []byte, perm os.FileMode) string {
+	f, err := ioutil.TempFile("", "pipethis-test-")
+	if err != nil {
+		t.Fatal("Failed creating the test file")
+	}
+	f.Write(contents)
+	f.Close()
+	os.Chmod(f.Name(), perm)
+
+	return f.Name()
+}
+
+// writeTestRing serializes the public parts of entities into a binary keyring
+// file, and returns the file name.
+func writeTestRing(t *testing.T, entities ...*openpgp.Entity) string {
+	f, err := ioutil.TempFile("", "pipethis-test-")
+	if err != nil {
+		t.Fatal("Failed creating the test keyring")
+	}
+	defer f.Close()
+
+	for _, entity := range entities {
+		if err := entity.Serialize(f); err != nil {
+			t.Fatal("Failed writing the test keyring:", err)
+		}
+	}
+
+	return f.Name()
+}
@@ -0,0 +1,23 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package lookup
+
+// Logger is where services report what they're doing, for debugging failed
+// runs. A *log.Logger will do. A nil Logger logs nothing.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// logf logs to logger, unless it's nil.
+func logf(logger Logger, format string, v ...interface{}) {
+	if logger != nil {
+		logger.Printf(format, v...)
+	}
+}
@@ -12,15 +12,50 @@ the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
 package lookup
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
-	"strconv"
+	"net/mail"
+	"net/url"
+	"sort"
 	"strings"
+	"time"
 
 	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
 )
 
+var (
+	// ErrNoMatches means a KeyService didn't find anyone matching the query.
+	ErrNoMatches = errors.New("No matches")
+
+	// ErrNoRing means there weren't any keys to look through at all.
+	ErrNoRing = errors.New("No key ring loaded")
+
+	// ErrAmbiguousKey means more than one key fits, and there's no way to
+	// tell which one was meant.
+	ErrAmbiguousKey = errors.New("More than one key returned, not sure what to do")
+
+	// ErrTooManyMatches means a query matched more keys than the KeyService
+	// will return, so the ones it did return are only the first few.
+	ErrTooManyMatches = errors.New("Too many matches")
+
+	// ErrKeyRevoked means the key that was asked for has been revoked, so it
+	// can't be trusted to verify anything.
+	ErrKeyRevoked = errors.New("Key has been revoked")
+)
+
+// DefaultMaxMatches is the most keys a keyring's Matches returns, unless its
+// MaxMatches says otherwise.
+const DefaultMaxMatches = 20
+
 // KeyService defines the interface for third-party identity verification and
 // public key services, like Keybase or Onename.
 //
@@ -28,24 +63,107 @@ import (
 // KeyService.
 //
 // Key gets the PGP public key for one user.
+//
+// Both give up when ctx is done, so a slow service can be cancelled or timed
+// out.
 type KeyService interface {
-	Matches(query string) ([]User, error)
-	Key(user User) (openpgp.EntityList, error)
+	Matches(ctx context.Context, query string) ([]User, error)
+	Key(ctx context.Context, user User) (openpgp.EntityList, error)
+}
+
+// Lister is a KeyService that can list every key it has, without a query.
+// Only the services with their keys on hand (like LocalPGPService) can.
+type Lister interface {
+	List(ctx context.Context) ([]User, error)
+}
+
+// FullKeyer is a KeyService that trims the keys it hands out from Key (leaving
+// off the subkeys that can't verify a signature), but can also hand over a key
+// whole, for exporting or importing it. Services that never trim (like the
+// remote ones) don't need to be FullKeyers.
+type FullKeyer interface {
+	FullKey(ctx context.Context, user User) (openpgp.EntityList, error)
+}
+
+// FullKey gets the key for user from service, whole: from its FullKey if it's
+// a FullKeyer, and from its Key if it isn't.
+func FullKey(ctx context.Context, service KeyService, user User) (openpgp.EntityList, error) {
+	if full, ok := service.(FullKeyer); ok {
+		return full.FullKey(ctx, user)
+	}
+
+	return service.Key(ctx, user)
 }
 
-// User represents an author's identity.
+// User represents an author's identity. In JSON, the fields are named
+// username, fingerprint, full_name, twitter, github, hacker_news, reddit,
+// sites, names, emails, subkeys, revoked, expired, unverified, and trust (which
+// is left out unless it was checked), and the lists are sorted.
 type User struct {
-	Username    string
-	Fingerprint string
-	FullName    string
-	Twitter     string
-	GitHub      string
-	HackerNews  string
-	Reddit      string
-	Sites       []string
-	Emails      []string
+	Username    string   `json:"username"`
+	Fingerprint string   `json:"fingerprint"`
+	FullName    string   `json:"full_name"`
+	Twitter     string   `json:"twitter"`
+	GitHub      string   `json:"github"`
+	HackerNews  string   `json:"hacker_news"`
+	Reddit      string   `json:"reddit"`
+	Sites       []string `json:"sites"`
+	Names       []string `json:"names"`
+	Emails      []string `json:"emails"`
+	Subkeys     []string `json:"subkeys"`
+	Revoked     bool     `json:"revoked"`
+	Expired     bool     `json:"expired"`
+
+	// Unverified means none of the key's identities has a valid
+	// self-signature, so there's nothing tying the key to anyone.
+	Unverified bool `json:"unverified"`
+
+	// CreatedAt is when the primary key was created, or the zero time if
+	// there's no key to tell.
+	CreatedAt time.Time `json:"created_at"`
+
+	// ExpiresAt is when the primary key expires, according to its most
+	// recent self-signature, or nil if it never does.
+	ExpiresAt *time.Time `json:"expires_at"`
+
+	// Trust is how far GnuPG trusts the key's owner, if anyone checked (see
+	// OwnerTrust.Rank).
+	Trust Trust `json:"trust,omitempty"`
+}
+
+// MarshalJSON encodes the User with its lists sorted (and empty instead of
+// null), so the same User always comes out the same way.
+func (u User) MarshalJSON() ([]byte, error) {
+	// a different type, so json.Marshal doesn't end up back here
+	type plainUser User
+
+	sorted := func(list []string) []string {
+		copied := append([]string{}, list...)
+		sort.Strings(copied)
+		return copied
+	}
+
+	plain := plainUser(u)
+	plain.Sites = sorted(u.Sites)
+	plain.Names = sorted(u.Names)
+	plain.Emails = sorted(u.Emails)
+	plain.Subkeys = sorted(u.Subkeys)
+
+	// a creation time nobody knows is null, not the year 1
+	var created *time.Time
+	if !u.CreatedAt.IsZero() {
+		created = &u.CreatedAt
+	}
+
+	return json.Marshal(struct {
+		plainUser
+		CreatedAt *time.Time `json:"created_at"`
+	}{plain, created})
 }
 
+// dateFormat is how User.String shows when a key was created and expires.
+const dateFormat = "2006-01-02"
+
 // String returns a representation of all the User's identity details.
 func (u User) String() string {
 	format := "%15s: %s\n"
@@ -56,67 +174,748 @@ func (u User) String() string {
 	s = s + fmt.Sprintf(format, "Github", u.GitHub)
 	s = s + fmt.Sprintf(format, "Hacker News", u.HackerNews)
 	s = s + fmt.Sprintf(format, "Reddit", u.Reddit)
-	s = s + fmt.Sprintf(format, "Fingerprint", u.Fingerprint)
+	s = s + fmt.Sprintf(format, "Fingerprint", FormatFingerprint(u.Fingerprint))
 
 	for _, site := range u.Sites {
 		s = s + fmt.Sprintf(format, "Site", site)
 	}
 
+	for _, name := range u.Names {
+		s = s + fmt.Sprintf(format, "Name", name)
+	}
+
 	for _, email := range u.Emails {
 		s = s + fmt.Sprintf(format, "Email", email)
 	}
 
+	if !u.CreatedAt.IsZero() {
+		s = s + fmt.Sprintf(format, "Created", u.CreatedAt.Format(dateFormat))
+
+		expires := "never"
+		if u.ExpiresAt != nil {
+			expires = u.ExpiresAt.Format(dateFormat)
+		}
+		s = s + fmt.Sprintf(format, "Expires", expires)
+	}
+
+	if u.Revoked {
+		s = s + fmt.Sprintf(format, "Status", "REVOKED")
+	}
+
+	if u.Expired {
+		s = s + fmt.Sprintf(format, "Status", "EXPIRED")
+	}
+
+	if u.Unverified {
+		s = s + fmt.Sprintf(format, "Status", "UNVERIFIED")
+	}
+
+	if u.Trust == TrustUnknown {
+		s = s + fmt.Sprintf(format, "Trust", "UNKNOWN")
+	} else if u.Trust != TrustNotChecked {
+		s = s + fmt.Sprintf(format, "Trust", u.Trust)
+	}
+
 	return s
 }
 
+// addIdentity splits a PGP identity into its name (with the comment, if
+// there is one) and email address, and adds whichever parts are present to the
+// User.
+func (u *User) addIdentity(identity *openpgp.Identity) {
+	if identity.UserId == nil {
+		return
+	}
+
+	name := identity.UserId.Name
+	if identity.UserId.Comment != "" {
+		name = strings.TrimSpace(name + " (" + identity.UserId.Comment + ")")
+	}
+
+	if name != "" {
+		u.Names = append(u.Names, name)
+	}
+	if identity.UserId.Email != "" {
+		u.Emails = append(u.Emails, identity.UserId.Email)
+	}
+}
+
+// addUserID adds the name and email address in an escaped user id from a
+// keyserver index, like "Jane Doe (work) <jane%40example.com>", to the User.
+// Anything that can't be unescaped is used as is.
+func (u *User) addUserID(uid string) {
+	if unescaped, err := url.PathUnescape(uid); err == nil {
+		uid = unescaped
+	}
+	uid = strings.TrimSpace(uid)
+
+	name, email := uid, ""
+	if start := strings.LastIndex(uid, "<"); start >= 0 && strings.HasSuffix(uid, ">") {
+		name, email = strings.TrimSpace(uid[:start]), uid[start+1:len(uid)-1]
+	} else if strings.Contains(uid, "@") && !strings.Contains(uid, " ") {
+		name, email = "", uid
+	}
+
+	if name != "" {
+		u.Names = append(u.Names, name)
+	}
+	if email != "" {
+		u.Emails = append(u.Emails, email)
+	}
+}
+
+// entityToUser builds the User for key: its fingerprint, the names and email
+// addresses on its identities, the fingerprints of its signing subkeys, and
+// whether it's expired by now. Identities and subkeys are only used if the
+// primary key really did sign them; if none of the identities is left, the
+// User is Unverified.
+func entityToUser(key *openpgp.Entity) User {
+	// in whole seconds, like OpenPGP keeps them (a key that was just made
+	// hasn't been rounded yet), and in UTC, so the JSON is the same wherever
+	// it's made
+	user := User{Fingerprint: keyFingerprint(key), Unverified: true, CreatedAt: key.PrimaryKey.CreationTime.Truncate(time.Second).UTC()}
+	if expiry := KeyExpiry(key).Truncate(time.Second).UTC(); !expiry.IsZero() {
+		user.ExpiresAt = &expiry
+	}
+	user.Expired = isExpired(key, time.Now())
+
+	for _, identity := range key.Identities {
+		if isBoundIdentity(key, identity) {
+			user.addIdentity(identity)
+			user.Unverified = false
+		}
+	}
+
+	for _, subkey := range key.Subkeys {
+		if allowsSigning(subkey.Sig) && isBoundSubkey(key, subkey) {
+			user.Subkeys = append(user.Subkeys, fmt.Sprintf("%X", subkey.PublicKey.Fingerprint[:]))
+		}
+	}
+
+	return user
+}
+
+// isBoundIdentity is true when identity's self-signature is a good signature
+// by key's primary key over that identity. Keys that were parsed have already
+// been checked, but one that was put together (or changed) in memory might
+// not have been.
+func isBoundIdentity(key *openpgp.Entity, identity *openpgp.Identity) bool {
+	if identity.UserId == nil || identity.SelfSignature == nil {
+		return false
+	}
+
+	return key.PrimaryKey.VerifyUserIdSignature(identity.UserId.Id, key.PrimaryKey, identity.SelfSignature) == nil
+}
+
+// isBoundSubkey is true when subkey's binding signature is a good signature by
+// key's primary key (along with the subkey's own signature back, for signing
+// subkeys).
+func isBoundSubkey(key *openpgp.Entity, subkey openpgp.Subkey) bool {
+	if subkey.Sig == nil {
+		return false
+	}
+
+	return key.PrimaryKey.VerifyKeySignature(subkey.PublicKey, subkey.Sig) == nil
+}
+
+// matchUser is true when query is part of user's fingerprint or one of its
+// subkeys' fingerprints (ignoring spaces, case, and a 0x prefix), or part of
+// one of user's names or email addresses (ignoring case).
+func matchUser(query string, user User) bool {
+	if fingerprint := NormalizeFingerprint(query); fingerprint != "" {
+		for _, candidate := range append([]string{user.Fingerprint}, user.Subkeys...) {
+			if strings.Contains(NormalizeFingerprint(candidate), fingerprint) {
+				return true
+			}
+		}
+	}
+
+	for _, name := range user.Names {
+		if strings.Contains(strings.ToUpper(name), strings.ToUpper(query)) {
+			return true
+		}
+	}
+
+	for _, email := range user.Emails {
+		if strings.Contains(strings.ToUpper(email), strings.ToUpper(query)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SameEmail is true when a and b are the same email address, ignoring case and
+// surrounding space.
+func SameEmail(a, b string) bool {
+	return strings.EqualFold(strings.TrimSpace(a), strings.TrimSpace(b))
+}
+
+// bareAddress is the bare email address in query, which can have a name with
+// it, like "Jane Doe <jane@example.com>". Anything that isn't an address comes
+// back as it is.
+func bareAddress(query string) string {
+	if address, err := mail.ParseAddress(query); err == nil {
+		return address.Address
+	}
+
+	return query
+}
+
+// FormatFingerprint spaces fingerprint out into groups of four hex characters
+// (with an extra space in the middle of a full fingerprint), the way GnuPG
+// shows them, so people can compare them by eye. Formatting a fingerprint
+// that's already formatted doesn't change it.
+func FormatFingerprint(fingerprint string) string {
+	fingerprint = NormalizeFingerprint(fingerprint)
+
+	groups := []string{}
+	for len(fingerprint) > 4 {
+		groups = append(groups, fingerprint[:4])
+		fingerprint = fingerprint[4:]
+	}
+	if fingerprint != "" {
+		groups = append(groups, fingerprint)
+	}
+
+	if len(groups) == 10 {
+		return strings.Join(groups[:5], " ") + "  " + strings.Join(groups[5:], " ")
+	}
+
+	return strings.Join(groups, " ")
+}
+
+// ShortID is the long key id for fingerprint: its last 16 hex characters. A
+// fingerprint that's already shorter than that (like an 8-character short key
+// id) comes back whole.
+func ShortID(fingerprint string) string {
+	fingerprint = NormalizeFingerprint(fingerprint)
+	if len(fingerprint) <= 16 {
+		return fingerprint
+	}
+
+	return fingerprint[len(fingerprint)-16:]
+}
+
+// NormalizeFingerprint turns a fingerprint or key id into the plain uppercase
+// hex form, without the spaces or 0x prefix people tend to copy along with it.
+func NormalizeFingerprint(fingerprint string) string {
+	fingerprint = strings.ToUpper(strings.Join(strings.Fields(fingerprint), ""))
+
+	return strings.TrimPrefix(fingerprint, "0X")
+}
+
+// isArmored checks for an ASCII armor header at the start of head (give or
+// take some whitespace).
+func isArmored(head []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(head), []byte("-----BEGIN PGP"))
+}
+
+// parseKey reads the keys in r, armored or binary, whichever it turns out to
+// be. Armored keys can come in more than one block, one after the other, with
+// text around them; if there's nothing but text, there are no keys.
+func parseKey(r io.Reader) (openpgp.EntityList, error) {
+	// armor.Decode buffers its input, and it'll only reuse the buffer
+	// (instead of losing whatever's in it) if it gets a bufio.Reader
+	reader := bufio.NewReader(r)
+	head, _ := reader.Peek(1)
+
+	if isBinaryPacket(head) {
+		return openpgp.ReadKeyRing(reader)
+	}
+
+	ring := openpgp.EntityList{}
+	for {
+		block, err := armor.Decode(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if block.Type != openpgp.PublicKeyType {
+			return nil, errors.New("Expected a public key block, got " + block.Type)
+		}
+
+		keys, err := openpgp.ReadKeyRing(block.Body)
+		if err != nil {
+			return nil, err
+		}
+		ring = append(ring, keys...)
+	}
+
+	return ring, nil
+}
+
+// isBinaryPacket checks for an OpenPGP packet tag at the start of head. Every
+// tag byte has its high bit set, and no armor or text does.
+func isBinaryPacket(head []byte) bool {
+	return len(head) > 0 && head[0]&0x80 != 0
+}
+
+// isRevoked is true when key's primary key has been revoked. The revocation
+// signatures have already been checked by the time the key's been read.
+func isRevoked(key *openpgp.Entity) bool {
+	return len(key.Revocations) > 0
+}
+
+// KeyExpiry is when key's primary key expires, according to its most recent
+// self-signature. It's the zero time if the key never expires.
+func KeyExpiry(key *openpgp.Entity) time.Time {
+	var selfSig *packet.Signature
+	for _, identity := range key.Identities {
+		if identity.SelfSignature == nil {
+			continue
+		}
+		if selfSig == nil || identity.SelfSignature.CreationTime.After(selfSig.CreationTime) {
+			selfSig = identity.SelfSignature
+		}
+	}
+
+	if selfSig == nil || selfSig.KeyLifetimeSecs == nil || *selfSig.KeyLifetimeSecs == 0 {
+		return time.Time{}
+	}
+
+	return key.PrimaryKey.CreationTime.Add(time.Duration(*selfSig.KeyLifetimeSecs) * time.Second)
+}
+
+// isExpired is true when key's primary key expired before now.
+func isExpired(key *openpgp.Entity, now time.Time) bool {
+	expiry := KeyExpiry(key)
+
+	return !expiry.IsZero() && now.After(expiry)
+}
+
+// isSubkeyExpired is true when the subkey's binding signature says it expired
+// before now.
+func isSubkeyExpired(subkey openpgp.Subkey, now time.Time) bool {
+	if subkey.Sig == nil || subkey.Sig.KeyLifetimeSecs == nil || *subkey.Sig.KeyLifetimeSecs == 0 {
+		return false
+	}
+
+	expiry := subkey.PublicKey.CreationTime.Add(time.Duration(*subkey.Sig.KeyLifetimeSecs) * time.Second)
+
+	return now.After(expiry)
+}
+
+// withoutExpiredSubkeys returns a copy of key that only has the subkeys that
+// haven't expired yet.
+func withoutExpiredSubkeys(key *openpgp.Entity, now time.Time) *openpgp.Entity {
+	live := *key
+	live.Subkeys = nil
+
+	for _, subkey := range key.Subkeys {
+		if !isSubkeyExpired(subkey, now) {
+			live.Subkeys = append(live.Subkeys, subkey)
+		}
+	}
+
+	return &live
+}
+
+// allowsSigning is true unless sig has key flags that leave out signing. Keys
+// without any flags at all are allowed to do anything, same as openpgp does.
+func allowsSigning(sig *packet.Signature) bool {
+	return sig != nil && (!sig.FlagsValid || sig.FlagSign)
+}
+
+// primaryCanSign is true when one of key's identities lets the primary key
+// make signatures.
+func primaryCanSign(key *openpgp.Entity) bool {
+	for _, identity := range key.Identities {
+		if allowsSigning(identity.SelfSignature) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// canSign is true when key's primary key or any of its subkeys is flagged for
+// signing. Expiry doesn't come into it; that's checked separately.
+func canSign(key *openpgp.Entity) bool {
+	if primaryCanSign(key) {
+		return true
+	}
+
+	for _, subkey := range key.Subkeys {
+		if allowsSigning(subkey.Sig) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// allowsEncryption is true unless sig has key flags that leave out
+// encryption (of either kind).
+func allowsEncryption(sig *packet.Signature) bool {
+	return sig != nil && (!sig.FlagsValid || sig.FlagEncryptCommunications || sig.FlagEncryptStorage)
+}
+
+// canEncrypt is true when key's primary key or any of its subkeys is flagged
+// for encryption.
+func canEncrypt(key *openpgp.Entity) bool {
+	for _, identity := range key.Identities {
+		if allowsEncryption(identity.SelfSignature) {
+			return true
+		}
+	}
+
+	for _, subkey := range key.Subkeys {
+		if allowsEncryption(subkey.Sig) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// signingKey returns a copy of key that only has the subkeys that can still
+// make signatures: the ones that haven't expired and are flagged for signing.
+func signingKey(key *openpgp.Entity, now time.Time) *openpgp.Entity {
+	live := withoutExpiredSubkeys(key, now)
+	subkeys := live.Subkeys
+	live.Subkeys = nil
+
+	for _, subkey := range subkeys {
+		if allowsSigning(subkey.Sig) {
+			live.Subkeys = append(live.Subkeys, subkey)
+		}
+	}
+
+	return live
+}
+
+// keyFingerprint is the full fingerprint of key's primary key, as uppercase
+// hex.
+func keyFingerprint(key *openpgp.Entity) string {
+	return fmt.Sprintf("%X", key.PrimaryKey.Fingerprint[:])
+}
+
+// exactlyOneKey makes sure there's only one key in keys, the ones found for
+// fingerprint.
+func exactlyOneKey(keys openpgp.EntityList, fingerprint string) (openpgp.EntityList, error) {
+	if len(keys) > 1 {
+		return nil, fmt.Errorf("%w: found %d keys for %s", ErrAmbiguousKey, len(keys), fingerprint)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("Found 0 keys for %s, need exactly 1", fingerprint)
+	}
+
+	return keys, nil
+}
+
+// fetchedKey picks the key for fingerprint out of ring, what a remote service
+// sent back when it was asked for that key. The key can match by its primary
+// key or any of its subkeys. A service that only sent back other keys could be
+// trying to pass off a substitute, so that's ErrFingerprintMismatch, not just
+// a missing key. An expired key is an error too, the same as it is in a local
+// keyring: openpgp doesn't check expiry when it verifies a signature.
+func fetchedKey(ring openpgp.EntityList, fingerprint string) (openpgp.EntityList, error) {
+	keys := openpgp.EntityList{}
+	for _, key := range ring {
+		if hasFingerprint(key, fingerprint) {
+			keys = append(keys, key)
+		}
+	}
+
+	if len(keys) == 0 && len(ring) > 0 {
+		return nil, fmt.Errorf("%w: asked for %s, got %s", ErrFingerprintMismatch, fingerprint, keyFingerprint(ring[0]))
+	}
+
+	keys, err := exactlyOneKey(keys, fingerprint)
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, checkExpiry(keys[0], fingerprint)
+}
+
+// checkExpiry returns an error if key, the one asked for with fingerprint, has
+// expired by now.
+func checkExpiry(key *openpgp.Entity, fingerprint string) error {
+	if isExpired(key, time.Now()) {
+		return errors.New("The key for " + fingerprint + " has expired")
+	}
+
+	return nil
+}
+
+// hasFingerprint is true when key's primary key or one of its subkeys has
+// fingerprint: the whole fingerprint, if fingerprint is a full one, or else a
+// fingerprint that ends with it. Anything shorter than a long key id never
+// matches, since a short one is too easy to collide with.
+func hasFingerprint(key *openpgp.Entity, fingerprint string) bool {
+	fingerprint = NormalizeFingerprint(fingerprint)
+	if len(fingerprint) < 16 {
+		return false
+	}
+
+	matches := func(candidate string) bool {
+		if len(fingerprint) == 40 {
+			return candidate == fingerprint
+		}
+		return strings.HasSuffix(candidate, fingerprint)
+	}
+
+	if matches(keyFingerprint(key)) {
+		return true
+	}
+	for _, subkey := range key.Subkeys {
+		if matches(fmt.Sprintf("%X", subkey.PublicKey.Fingerprint[:])) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkKeyID returns an error unless fingerprint, the key a remote service is
+// about to be asked for, is at least a long key id. Whatever the service sends
+// back is only checked against fingerprint, so a short id would leave it
+// almost nothing to live up to.
+func checkKeyID(fingerprint string) error {
+	normalized := NormalizeFingerprint(fingerprint)
+	if _, err := hex.DecodeString(normalized); err != nil || len(normalized) < 16 {
+		return fmt.Errorf("Expected a full fingerprint or a long key id: %s", fingerprint)
+	}
+
+	return nil
+}
+
+// findKeys returns all the keys in ring with a fingerprint that ends with
+// fingerprint, so short and long key ids work as well as full fingerprints.
+func findKeys(ring openpgp.EntityList, fingerprint string) openpgp.EntityList {
+	fingerprint = NormalizeFingerprint(fingerprint)
+	keys := openpgp.EntityList{}
+
+	if fingerprint == "" {
+		return keys
+	}
+
+	for _, key := range ring {
+		if strings.HasSuffix(keyFingerprint(key), fingerprint) {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+// findExactKeys returns the keys in ring with a primary key or subkey that has
+// exactly the full fingerprint.
+func findExactKeys(ring openpgp.EntityList, fingerprint string) openpgp.EntityList {
+	fingerprint = NormalizeFingerprint(fingerprint)
+	keys := openpgp.EntityList{}
+
+	for _, key := range ring {
+		if keyFingerprint(key) == fingerprint {
+			keys = append(keys, key)
+			continue
+		}
+
+		for _, subkey := range key.Subkeys {
+			if fmt.Sprintf("%X", subkey.PublicKey.Fingerprint[:]) == fingerprint {
+				keys = append(keys, key)
+				break
+			}
+		}
+	}
+
+	return keys
+}
+
+// mergeUsers folds every User with a fingerprint that's already been seen into
+// the first User with that fingerprint: their sites, names, and emails are
+// added (without repeats), any details the first User is missing are filled
+// in, and the result is revoked or expired if any of them were. Users without
+// a fingerprint are left alone. The merged Users are sorted by sortUsers.
+func mergeUsers(users []User) []User {
+	merged := []User{}
+	seen := map[string]int{}
+
+	for _, user := range users {
+		fingerprint := NormalizeFingerprint(user.Fingerprint)
+		idx, ok := seen[fingerprint]
+		if !ok || fingerprint == "" {
+			seen[fingerprint] = len(merged)
+			merged = append(merged, user)
+			continue
+		}
+
+		merged[idx].merge(user)
+	}
+
+	return sortUsers(merged)
+}
+
+// sortUsers puts users in order by fingerprint, and sorts each one's names and
+// email addresses, so the same keys always come out the same way no matter
+// what order they were found in.
+func sortUsers(users []User) []User {
+	sorted := func(list []string) []string {
+		if list == nil {
+			return nil
+		}
+		copied := append([]string{}, list...)
+		sort.Strings(copied)
+		return copied
+	}
+
+	for i := range users {
+		users[i].Names = sorted(users[i].Names)
+		users[i].Emails = sorted(users[i].Emails)
+	}
+
+	// anyone without a fingerprint goes last, in the order they came in
+	sort.SliceStable(users, func(i, j int) bool {
+		a, b := NormalizeFingerprint(users[i].Fingerprint), NormalizeFingerprint(users[j].Fingerprint)
+		if a == "" || b == "" {
+			return b == "" && a != ""
+		}
+		return a < b
+	})
+
+	return users
+}
+
+// merge adds other's details to the User.
+func (u *User) merge(other User) {
+	union := func(list, more []string) []string {
+		for _, item := range more {
+			found := false
+			for _, existing := range list {
+				found = found || existing == item
+			}
+			if !found {
+				list = append(list, item)
+			}
+		}
+		return list
+	}
+
+	fill := func(field *string, value string) {
+		if *field == "" {
+			*field = value
+		}
+	}
+
+	fill(&u.Username, other.Username)
+	fill(&u.FullName, other.FullName)
+	fill(&u.Twitter, other.Twitter)
+	fill(&u.GitHub, other.GitHub)
+	fill(&u.HackerNews, other.HackerNews)
+	fill(&u.Reddit, other.Reddit)
+
+	u.Sites = union(u.Sites, other.Sites)
+	u.Names = union(u.Names, other.Names)
+	u.Emails = union(u.Emails, other.Emails)
+	u.Subkeys = union(u.Subkeys, other.Subkeys)
+	if u.CreatedAt.IsZero() {
+		u.CreatedAt = other.CreatedAt
+	}
+	if u.ExpiresAt == nil {
+		u.ExpiresAt = other.ExpiresAt
+	}
+	u.Revoked = u.Revoked || other.Revoked
+	u.Expired = u.Expired || other.Expired
+	u.Unverified = u.Unverified || other.Unverified
+	if other.Trust > u.Trust {
+		u.Trust = other.Trust
+	}
+}
+
 // NewKeyService creates the KeyService implementation requested by name. If
-// fromPipe is true, it creates a LocalPGPService type.
-func NewKeyService(name string, fromPipe bool) (KeyService, error) {
-	// force the local keyring when reading the script from a pipe
-	if fromPipe {
+// fromPipe is true, it creates a LocalPGPService type. The options are passed
+// along to remote services; if they include WithOffline, asking for a remote
+// service fails with ErrOffline.
+func NewKeyService(name string, fromPipe bool, options ...RemoteOption) (KeyService, error) {
+	// force a local keyring when reading the script from a pipe
+	if fromPipe && name != "secret" {
 		name = "local"
 	}
 
-	switch name {
-	case "keybase":
-		return &KeybaseService{}, nil
-	case "local":
+	switch remote := name == "keybase" || name == "hkp"; {
+	case name == "local":
 		return NewLocalPGPService()
+	case name == "secret":
+		return NewLocalSecretPGPService()
+	case remote && isOffline(options):
+		return nil, fmt.Errorf("%w: can't use the %s service", ErrOffline, name)
+	case name == "keybase":
+		return NewKeybaseService("", options...), nil
+	case name == "hkp":
+		return NewRemoteHKPService("", options...)
 	}
 
 	return nil, errors.New("Unrecognized key service")
 }
 
-// chooseMatch prints all the matches provided, prompts for a choice, and
-// returns the chosen match.
-func chooseMatch(matches []User) (User, error) {
-	log.Println("I found", len(matches), "results:")
-	fmt.Println()
-	for idx, user := range matches {
-		fmt.Printf("%d:\n\n", idx)
-		fmt.Println(user)
-		fmt.Println()
+// NewRemoteService creates the remote KeyService described by keyserver:
+//
+//	hkps://host, hkp://host, https://host, http://host
+//	    the HKP keyserver at that URL (DefaultHKPServer if keyserver is empty)
+//	hkps://host,hkps://mirror,...
+//	    each of the HKP keyservers in turn, until one answers
+//	vks, vks:<url>
+//	    the verifying keyserver at DefaultVKSServer, or at url
+//	wkd
+//	    each author's own domain, through Web Key Directory
+//	wkd+vks
+//	    Web Key Directory for email addresses, then DefaultVKSServer
+//	github, github:<url>
+//	    GitHub's GPG keys, at DefaultGitHubURL or at url
+//
+// The options are passed along to the service. If they include WithOffline,
+// NewRemoteService fails with ErrOffline.
+func NewRemoteService(keyserver string, options ...RemoteOption) (KeyService, error) {
+	keyserver = strings.TrimSpace(keyserver)
+
+	if isOffline(options) {
+		return nil, fmt.Errorf("%w: can't use keyserver %q", ErrOffline, keyserver)
 	}
 
-	response := "q"
-	fmt.Print("\nEnter the number to use, or 'q' to cancel: ")
-	fmt.Scanf("%s", &response)
+	kind, rest := keyserver, ""
+	if idx := strings.Index(keyserver, ":"); idx >= 0 {
+		kind, rest = keyserver[:idx], keyserver[idx+1:]
+	}
 
-	if strings.ToLower(response) == "q" {
-		return User{}, errors.New("No match selected")
+	switch {
+	case keyserver == "":
+		return NewRemoteHKPService("", options...)
+	case kind == "vks":
+		return NewVKSService(rest, options...), nil
+	case keyserver == "wkd":
+		return NewWKDService(options...), nil
+	case keyserver == "wkd+vks":
+		return NewWKDCascadeService("", options...), nil
+	case kind == "github":
+		return NewGitHubService(rest, options...), nil
+	case kind == "hkp" || kind == "hkps" || kind == "http" || kind == "https":
+		mirrors := []string{}
+		for _, mirror := range strings.Split(keyserver, ",") {
+			mirrors = append(mirrors, strings.TrimSpace(mirror))
+		}
+		return NewRemoteHKPMirrors(mirrors, options...)
 	}
 
-	n, err := strconv.Atoi(response)
-	if err != nil {
-		return User{}, err
+	return nil, errors.New("Unrecognized keyserver: " + keyserver)
+}
+
+// limitMatches keeps the first limit users (DefaultMaxMatches if limit is
+// zero, and all of them if it's negative). If any were dropped, it says so
+// with ErrTooManyMatches.
+func limitMatches(users []User, limit int) ([]User, error) {
+	if limit == 0 {
+		limit = DefaultMaxMatches
 	}
 
-	if n < 0 || n >= len(matches) {
-		return User{}, errors.New("Invalid match selected")
+	if limit < 0 || len(users) <= limit {
+		return users, nil
 	}
-	fmt.Println()
 
-	return matches[n], nil
+	return users[:limit], fmt.Errorf("%w (%d of them, kept the first %d)", ErrTooManyMatches, len(users), limit)
 }
 
 func chooseSingleMatch(matches []User) (User, error) {
@@ -132,16 +931,45 @@ func chooseSingleMatch(matches []User) (User, error) {
 // user when there is one and only one match (if single is true). It returns an
 // error if no matches were found, if no match was chosen, or if no PGP public
 // was found.
-func Key(service KeyService, query string, single bool) (openpgp.KeyRing, error) {
+func Key(ctx context.Context, service KeyService, query string, single bool) (openpgp.EntityList, error) {
+	_, ring, err := Find(ctx, service, query, single)
+
+	return ring, err
+}
+
+// Find works like Key, but also returns the User that was chosen.
+func Find(ctx context.Context, service KeyService, query string, single bool) (User, openpgp.EntityList, error) {
+	return FindWith(ctx, service, query, single, nil)
+}
+
+// FindWith works like Find, but asks prompter to choose between the matches
+// (unless single is true). If prompter is nil, it asks on the terminal.
+func FindWith(ctx context.Context, service KeyService, query string, single bool, prompter Prompter) (User, openpgp.EntityList, error) {
 	// get possible matches from the key service
-	matches, err := service.Matches(query)
+	matches, err := service.Matches(ctx, query)
+	if errors.Is(err, ErrTooManyMatches) {
+		return User{}, nil, fmt.Errorf("%w for %s; try a full fingerprint or email address", err, query)
+	}
 	if err != nil {
-		return nil, err
+		return User{}, nil, err
 	}
 
 	if len(matches) < 1 {
-		return nil, errors.New("No author matches found for " + query)
+		return User{}, nil, fmt.Errorf("%w for %s", ErrNoMatches, query)
+	}
+
+	// some services (like HKP) only flag revoked keys, so they're dropped
+	// here, before anyone can pick one
+	live := []User{}
+	for _, match := range matches {
+		if !match.Revoked {
+			live = append(live, match)
+		}
+	}
+	if len(live) < 1 {
+		return User{}, nil, fmt.Errorf("%w: every match for %s", ErrKeyRevoked, query)
 	}
+	matches = live
 
 	// verify that the author is who the user was expecting by showing all the
 	// details (twitter handle, github handle, websites, etc.)
@@ -149,19 +977,19 @@ func Key(service KeyService, query string, single bool) (openpgp.KeyRing, error)
 	if single {
 		match, err = chooseSingleMatch(matches)
 	} else {
-		match, err = chooseMatch(matches)
+		match, err = NewSelector(prompter).Choose(matches)
 	}
 
 	if err != nil {
-		return nil, err
+		return User{}, nil, err
 	}
 
 	// get the public key for the selected author
-	ring, err := service.Key(match)
+	ring, err := service.Key(ctx, match)
 	if err != nil {
-		return nil, err
+		return User{}, nil, err
 	}
 	log.Printf("Verifying your script against\n%v", match)
 
-	return ring, nil
+	return match, ring, nil
 }
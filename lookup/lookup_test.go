@@ -10,10 +10,21 @@ the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
 package lookup
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/suite"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
 )
 
 type LookupTest struct {
@@ -41,11 +52,145 @@ func (s *LookupTest) TestNewKeyServiceForcesLocalWithPipe() {
 	_, err := NewKeyService("keybase", true)
 	s.Error(err)
 
-	perr, ok := err.(*os.PathError)
-	s.True(ok)
+	s.True(errors.Is(err, ErrRingMissing), err)
+
+	var perr *os.PathError
+	s.True(errors.As(err, &perr))
 	s.Equal("/tmp/.gnupg/pubring.gpg", perr.Path)
 }
 
+func (s *LookupTest) TestNewRemoteServiceMapsKeyservers() {
+	service, err := NewRemoteService("")
+	s.NoError(err)
+	s.Equal("https://keyserver.ubuntu.com", service.(*RemoteHKPService).Server())
+
+	service, err = NewRemoteService("hkps://keys.example.com")
+	s.NoError(err)
+	s.Equal("https://keys.example.com", service.(*RemoteHKPService).Server())
+
+	service, err = NewRemoteService("hkp://keys.example.com")
+	s.NoError(err)
+	s.Equal("http://keys.example.com:11371", service.(*RemoteHKPService).Server())
+
+	service, err = NewRemoteService("hkps://keys.example.com, hkp://mirror.example.org")
+	s.NoError(err)
+	s.Equal([]string{"https://keys.example.com", "http://mirror.example.org:11371"}, service.(*RemoteHKPService).Servers())
+
+	service, err = NewRemoteService("vks")
+	s.NoError(err)
+	s.Equal(DefaultVKSServer, service.(*VKSService).server)
+
+	service, err = NewRemoteService("vks:https://vks.example.com/")
+	s.NoError(err)
+	s.Equal("https://vks.example.com", service.(*VKSService).server)
+
+	service, err = NewRemoteService(" wkd ")
+	s.NoError(err)
+	s.IsType(&WKDService{}, service)
+
+	service, err = NewRemoteService("wkd+vks")
+	s.NoError(err)
+	s.IsType(&CascadeService{}, service)
+
+	service, err = NewRemoteService("github")
+	s.NoError(err)
+	s.Equal(DefaultGitHubURL, service.(*GitHubService).base)
+
+	service, err = NewRemoteService("github:https://github.example.com")
+	s.NoError(err)
+	s.Equal("https://github.example.com", service.(*GitHubService).base)
+
+	for _, keyserver := range []string{"ftp://keys.example.com", "keys.example.com", "wkd:example.com"} {
+		_, err = NewRemoteService(keyserver)
+		s.Error(err, keyserver)
+	}
+}
+
+func (s *LookupTest) TestOfflineRefusesRemoteServices() {
+	for _, keyserver := range []string{"", "hkps://keys.example.com", "vks", "wkd", "github"} {
+		_, err := NewRemoteService(keyserver, WithOffline())
+		s.True(errors.Is(err, ErrOffline), keyserver)
+	}
+
+	for _, name := range []string{"keybase", "hkp"} {
+		_, err := NewKeyService(name, false, WithOffline())
+		s.True(errors.Is(err, ErrOffline), name)
+	}
+}
+
+func (s *LookupTest) TestExactlyOneKeyNeedsOneKey() {
+	ring := readTestRing(s.T(), "testdata/pubring.gpg")
+
+	keys, err := exactlyOneKey(ring, fixtureFingerprint)
+	s.NoError(err)
+	s.Equal(ring, keys)
+
+	_, err = exactlyOneKey(append(ring, ring...), fixtureFingerprint)
+	s.True(errors.Is(err, ErrAmbiguousKey), err)
+
+	_, err = exactlyOneKey(nil, fixtureFingerprint)
+	s.Error(err)
+	s.False(errors.Is(err, ErrAmbiguousKey))
+}
+
+func (s *LookupTest) TestFetchedKeyMatchesPrimaryKeysAndSubkeys() {
+	ring := readTestRing(s.T(), "testdata/usage.gpg")
+	signer := findKeys(ring, corruptFirst)[0]
+	subkey := fmt.Sprintf("%X", signer.Subkeys[0].PublicKey.Fingerprint[:])
+
+	for _, fingerprint := range []string{corruptFirst, subkey, subkey[24:]} {
+		keys, err := fetchedKey(ring, fingerprint)
+		s.Require().NoError(err, fingerprint)
+		s.Equal(openpgp.EntityList{signer}, keys, fingerprint)
+	}
+
+	// a short id is too easy to collide with to count
+	for _, short := range []string{corruptFirst[32:], corruptFirst[39:]} {
+		_, err := fetchedKey(ring, short)
+		s.True(errors.Is(err, ErrFingerprintMismatch), short)
+	}
+
+	_, err := fetchedKey(ring, fixtureFingerprint)
+	s.True(errors.Is(err, ErrFingerprintMismatch), err)
+
+	// nothing at all isn't a substitute, just missing
+	_, err = fetchedKey(nil, fixtureFingerprint)
+	s.Error(err)
+	s.False(errors.Is(err, ErrFingerprintMismatch))
+}
+
+func (s *LookupTest) TestFetchedKeyRejectsExpiredKeys() {
+	expired := newExpiredTestEntity(s.T(), "Expired", "expired@example.com")
+	fingerprint := keyFingerprint(expired)
+
+	_, err := fetchedKey(openpgp.EntityList{expired}, fingerprint)
+	s.EqualError(err, "The key for "+fingerprint+" has expired")
+
+	s.True(entityToUser(expired).Expired)
+	s.False(entityToUser(newTestEntity(s.T(), "Fresh", "fresh@example.com")).Expired)
+}
+
+func (s *LookupTest) TestFindDropsRevokedMatches() {
+	live := User{Fingerprint: "AAAA", Username: "live"}
+	service := &fakeService{users: []User{{Fingerprint: "BBBB", Revoked: true}, live}, ring: openpgp.EntityList{&openpgp.Entity{}}}
+
+	// only one match is left to pick, so single works
+	match, _, err := Find(context.Background(), service, "author", true)
+	s.NoError(err)
+	s.Equal(live, match)
+
+	service.users = service.users[:1]
+	_, _, err = Find(context.Background(), service, "author", true)
+	s.True(errors.Is(err, ErrKeyRevoked), err)
+	s.Equal(1, service.keys, "revoked matches never get their key fetched")
+}
+
+func (s *LookupTest) TestFindFailsWithoutMatches() {
+	_, _, err := Find(context.Background(), &fakeService{}, "foo", true)
+	s.True(errors.Is(err, ErrNoMatches), err)
+	s.EqualError(err, "No matches for foo")
+}
+
 func (s *LookupTest) TestChooseSingleMatchBailsWithoutMatches() {
 	user, err := chooseSingleMatch([]User{})
 
@@ -67,6 +212,312 @@ func (s *LookupTest) TestChooseSingleMatchReturnsSingleMatch() {
 	s.Equal("foo", user.Username)
 }
 
+func (s *LookupTest) TestNormalizeFingerprint() {
+	s.Equal("DEADBEEF", NormalizeFingerprint("deadbeef"))
+	s.Equal("DEADBEEF", NormalizeFingerprint("0xdeadbeef"))
+	s.Equal("DEADBEEF", NormalizeFingerprint("0XDEADBEEF"))
+	s.Equal("DEADBEEF", NormalizeFingerprint(" dead beef\t"))
+	s.Equal("2DEC361C395B52E763A95873A018A3D90DC0FA52", NormalizeFingerprint("2DEC 361C 395B 52E7 63A9  5873 A018 A3D9 0DC0 FA52"))
+	s.Equal("", NormalizeFingerprint(""))
+}
+
+func (s *LookupTest) TestFormatFingerprintGroupsHex() {
+	full := "2DEC 361C 395B 52E7 63A9  5873 A018 A3D9 0DC0 FA52"
+
+	s.Equal(full, FormatFingerprint("2DEC361C395B52E763A95873A018A3D90DC0FA52"))
+	s.Equal(full, FormatFingerprint("0x2dec361c395b52e763a95873a018a3d90dc0fa52"))
+	s.Equal(full, FormatFingerprint(full))
+	s.Equal(full, FormatFingerprint(FormatFingerprint(full)))
+	s.Equal("A018 A3D9 0DC0 FA52", FormatFingerprint("A018A3D90DC0FA52"))
+	s.Equal("0DC0 FA52", FormatFingerprint("0dc0fa52"))
+	s.Equal("0DC0 FA", FormatFingerprint("0DC0FA"))
+	s.Equal("", FormatFingerprint(""))
+}
+
+func (s *LookupTest) TestShortIDKeepsTheEnd() {
+	s.Equal("A018A3D90DC0FA52", ShortID("2DEC361C395B52E763A95873A018A3D90DC0FA52"))
+	s.Equal("A018A3D90DC0FA52", ShortID("2DEC 361C 395B 52E7 63A9  5873 A018 A3D9 0DC0 FA52"))
+	s.Equal("A018A3D90DC0FA52", ShortID("0xa018a3d90dc0fa52"))
+	s.Equal("0DC0FA52", ShortID("0DC0FA52"))
+	s.Equal("", ShortID(""))
+}
+
+func (s *LookupTest) TestAddIdentitySplitsUserIds() {
+	user := User{}
+	user.addIdentity(&openpgp.Identity{UserId: packet.NewUserId("Foo Bar", "work", "foo@example.com")})
+	user.addIdentity(&openpgp.Identity{UserId: packet.NewUserId("", "", "bare@example.com")})
+	user.addIdentity(&openpgp.Identity{UserId: packet.NewUserId("Nameless", "", "")})
+	user.addIdentity(&openpgp.Identity{})
+
+	s.Equal([]string{"Foo Bar (work)", "Nameless"}, user.Names)
+	s.Equal([]string{"foo@example.com", "bare@example.com"}, user.Emails)
+}
+
+func (s *LookupTest) TestEntityToUserUsesFingerprintAndIdentities() {
+	ring := readTestRing(s.T(), "testdata/pubring.gpg")
+	user := entityToUser(ring[0])
+
+	s.Equal(fixtureFingerprint, user.Fingerprint)
+	s.Contains(user.Emails, "test@example.com")
+	s.NotEmpty(user.Names)
+	s.False(user.Revoked)
+	s.False(user.Expired)
+}
+
+func (s *LookupTest) TestEntityToUserDropsUnboundIdentities() {
+	key := readTestRing(s.T(), "testdata/pubring.gpg")[0]
+
+	// an identity with somebody else's self-signature
+	var genuine *openpgp.Identity
+	for _, identity := range key.Identities {
+		genuine = identity
+	}
+	forged := packet.NewUserId("Mallory", "", "mallory@example.com")
+	key.Identities[forged.Id] = &openpgp.Identity{Name: forged.Id, UserId: forged, SelfSignature: genuine.SelfSignature}
+
+	user := entityToUser(key)
+	s.Equal([]string{"test@example.com"}, user.Emails)
+	s.Equal([]string{"Pipethis Test"}, user.Names)
+	s.False(user.Unverified)
+
+	// with nothing left, the key isn't anybody's
+	delete(key.Identities, genuine.Name)
+	user = entityToUser(key)
+	s.Empty(user.Emails)
+	s.True(user.Unverified)
+	s.Contains(user.String(), "UNVERIFIED")
+
+	_, err := NewMemoryService(openpgp.EntityList{key}).Matches(context.Background(), fixtureFingerprint)
+	s.True(errors.Is(err, ErrNoMatches), err)
+}
+
+func (s *LookupTest) TestEntityToUserDropsUnboundSubkeys() {
+	key := readTestRing(s.T(), "testdata/usage.gpg")[1]
+	s.Require().Len(entityToUser(key).Subkeys, 1)
+
+	// the signing subkey's binding signature, on the encryption subkey
+	for i := range key.Subkeys {
+		if !allowsSigning(key.Subkeys[i].Sig) {
+			encryption := key.Subkeys[i].PublicKey
+			key.Subkeys[i].PublicKey = key.Subkeys[1-i].PublicKey
+			key.Subkeys[1-i].PublicKey = encryption
+		}
+	}
+
+	s.Empty(entityToUser(key).Subkeys)
+}
+
+func (s *LookupTest) TestMatchUserChecksFingerprintNamesAndEmails() {
+	user := User{
+		Fingerprint: "2DEC361C395B52E763A95873DEADBEEF",
+		Names:       []string{"Foo Bar (work)"},
+		Emails:      []string{"fb@example.com"},
+	}
+
+	s.True(matchUser("0xdeadbeef", user))
+	s.True(matchUser("2dec 361c", user))
+	s.True(matchUser("foo bar", user))
+	s.True(matchUser("WORK", user))
+	s.True(matchUser("fb@", user))
+	s.False(matchUser("0xbeefdead", user))
+	s.False(matchUser("baz", user))
+	s.False(matchUser("anything", User{}))
+}
+
+func (s *LookupTest) TestIsArmoredChecksHeader() {
+	s.True(isArmored([]byte("-----BEGIN PGP PUBLIC KEY BLOCK-----\n")))
+	s.True(isArmored([]byte("\n  -----BEGIN PGP SIGNATURE-----")))
+	s.False(isArmored([]byte("")))
+	s.False(isArmored([]byte{0x99, 0x01, 0x0d}))
+	s.False(isArmored([]byte("hello -----BEGIN PGP")))
+}
+
+func (s *LookupTest) TestParseKeyReadsArmoredAndBinary() {
+	binary, err := ioutil.ReadFile("testdata/pubring.gpg")
+	s.Require().NoError(err)
+	armored, err := ioutil.ReadFile("testdata/pubring.asc")
+	s.Require().NoError(err)
+
+	for name, body := range map[string][]byte{"binary": binary, "armored": armored} {
+		ring, err := parseKey(bytes.NewReader(body))
+
+		s.NoError(err, name)
+		s.Require().Len(ring, 1, name)
+		s.Equal(fixtureFingerprint, keyFingerprint(ring[0]), name)
+	}
+}
+
+func (s *LookupTest) TestParseKeyReadsEveryArmoredBlock() {
+	other := newTestEntity(s.T(), "Other", "other@example.com")
+	body := append([]byte("some keys:\n"), armorTestRing(s.T(), readTestRing(s.T(), "testdata/pubring.gpg")...)...)
+	body = append(body, '\n')
+	body = append(body, armorTestRing(s.T(), other)...)
+
+	ring, err := parseKey(bytes.NewReader(body))
+
+	s.NoError(err)
+	s.Len(ring, 2)
+}
+
+func (s *LookupTest) TestParseKeyFindsNothingInText() {
+	for _, body := range []string{"", "No keys here.\n"} {
+		ring, err := parseKey(strings.NewReader(body))
+
+		s.NoError(err, body)
+		s.Empty(ring, body)
+	}
+
+	_, err := parseKey(bytes.NewReader([]byte{0x99, 0x01, 0x0d}))
+	s.Error(err)
+
+	_, err = parseKey(strings.NewReader("-----BEGIN PGP SIGNATURE-----\n\nabc=\n-----END PGP SIGNATURE-----\n"))
+	s.Error(err)
+}
+
+func (s *LookupTest) TestStringFlagsRevokedUsers() {
+	s.NotContains(User{}.String(), "REVOKED")
+	s.Contains(User{Revoked: true}.String(), "REVOKED")
+}
+
+func (s *LookupTest) TestStringFlagsExpiredUsers() {
+	s.NotContains(User{}.String(), "EXPIRED")
+	s.Contains(User{Expired: true}.String(), "EXPIRED")
+}
+
+func (s *LookupTest) TestMergeUsersCombinesDuplicates() {
+	users := mergeUsers([]User{
+		{Fingerprint: "2DEC361C395B52E763A95873A018A3D90DC0FA52", Emails: []string{"a@example.com"}, Names: []string{"A"}},
+		{Fingerprint: "1111111111111111", Emails: []string{"other@example.com"}},
+		{Fingerprint: "2dec 361c 395b 52e7 63a9 5873 a018 a3d9 0dc0 fa52", Username: "pipethis", Emails: []string{"b@example.com", "a@example.com"}, Names: []string{"A", "B"}, Revoked: true},
+		{Username: "nofingerprint"},
+		{Username: "nofingerprint"},
+	})
+
+	s.Len(users, 4)
+	s.Equal("1111111111111111", users[0].Fingerprint)
+	s.Equal("2DEC361C395B52E763A95873A018A3D90DC0FA52", users[1].Fingerprint)
+	s.Equal("pipethis", users[1].Username)
+	s.Equal([]string{"a@example.com", "b@example.com"}, users[1].Emails)
+	s.Equal([]string{"A", "B"}, users[1].Names)
+	s.True(users[1].Revoked)
+	s.Equal("nofingerprint", users[2].Username)
+	s.Equal("nofingerprint", users[3].Username)
+}
+
+func (s *LookupTest) TestMatchesSortsUsers() {
+	ring := readTestRing(s.T(), "testdata/usage.gpg")
+	ring = append(ring, readTestRing(s.T(), "testdata/revoked.gpg")...)
+	ring = append(ring, readTestRing(s.T(), "testdata/pubring.gpg")...)
+	expected := []string{
+		"134E0DE0D18FB090F7C17C10A5034EFD4162D102",
+		"2DEC361C395B52E763A95873A018A3D90DC0FA52",
+		"5C0A586B5385A0351E2AB8EE1D5D3F973EA6B98A",
+	}
+
+	// the same order, however the ring is shuffled
+	for i := 0; i < 5; i++ {
+		rand.Shuffle(len(ring), func(a, b int) { ring[a], ring[b] = ring[b], ring[a] })
+
+		users, err := NewMemoryService(ring).Matches(context.Background(), "example.com")
+		s.Require().NoError(err)
+
+		fingerprints := []string{}
+		for _, user := range users {
+			fingerprints = append(fingerprints, user.Fingerprint)
+		}
+		s.Equal(expected, fingerprints)
+	}
+
+	users := mergeUsers([]User{{Fingerprint: "AAAA", Names: []string{"Zed", "Amy"}, Emails: []string{"z@example.com", "a@example.com"}}})
+	s.Equal([]string{"Amy", "Zed"}, users[0].Names)
+	s.Equal([]string{"a@example.com", "z@example.com"}, users[0].Emails)
+}
+
+func (s *LookupTest) TestMatchesMergesRepeatedKeys() {
+	ring := readTestRing(s.T(), "testdata/pubring.gpg")
+	local := &LocalPGPService{ring: append(ring, ring...)}
+
+	users, err := local.Matches(context.Background(), "test@example.com")
+
+	s.NoError(err)
+	s.Len(users, 1)
+}
+
+func (s *LookupTest) TestSameEmailIgnoresCaseAndSpace() {
+	s.True(SameEmail("jane@example.com", " Jane@Example.com "))
+	s.False(SameEmail("jane@example.com", "jane@example.org"))
+	s.False(SameEmail("jane@example.com", "jane"))
+}
+
+func (s *LookupTest) TestMarshalJSONMatchesGolden() {
+	local := &LocalPGPService{ringfile: publicRingFile("testdata/pubring.gpg")}
+	users, err := local.Matches(context.Background(), "test@example.com")
+	s.Require().NoError(err)
+
+	// add some out-of-order extras, to make sure they get sorted
+	user := users[0]
+	user.Username = "pipethis"
+	user.Emails = append([]string{"zed@example.com"}, user.Emails...)
+	user.Sites = []string{"https://b.example.com", "https://a.example.com"}
+
+	actual, err := json.MarshalIndent(user, "", "  ")
+	s.Require().NoError(err)
+
+	expected, err := ioutil.ReadFile("testdata/user.golden.json")
+	s.Require().NoError(err)
+	s.JSONEq(string(expected), string(actual))
+
+	// and the original wasn't touched
+	s.Equal("zed@example.com", user.Emails[0])
+}
+
+func (s *LookupTest) TestUserHasKeyDates() {
+	local := &LocalPGPService{ringfile: publicRingFile("testdata/expiring.gpg")}
+	local.now = func() time.Time { return time.Unix(1792045183, 0) }
+
+	// testdata/expiring.gpg was created at 1792045183, and expires 10 days
+	// later
+	users, err := local.Matches(context.Background(), "expiring@example.com")
+	s.Require().NoError(err)
+	s.Require().Len(users, 1)
+	s.True(users[0].CreatedAt.Equal(time.Unix(1792045183, 0)), users[0].CreatedAt)
+	s.Require().NotNil(users[0].ExpiresAt)
+	s.True(users[0].ExpiresAt.Equal(time.Unix(1792045183+10*24*60*60, 0)), users[0].ExpiresAt)
+
+	s.Contains(users[0].String(), "        Created: 2026-10-15\n        Expires: 2026-10-25\n")
+
+	encoded, err := json.Marshal(users[0])
+	s.Require().NoError(err)
+	s.Contains(string(encoded), `"created_at":"2026-10-15T06:19:43Z"`)
+	s.Contains(string(encoded), `"expires_at":"2026-10-25T06:19:43Z"`)
+}
+
+func (s *LookupTest) TestUserWithoutExpiryNeverExpires() {
+	local := &LocalPGPService{ringfile: publicRingFile("testdata/pubring.gpg")}
+	users, err := local.Matches(context.Background(), "test@example.com")
+	s.Require().NoError(err)
+
+	s.False(users[0].CreatedAt.IsZero())
+	s.Nil(users[0].ExpiresAt)
+	s.Contains(users[0].String(), "Expires: never\n")
+
+	// and there's nothing to say without a key
+	s.NotContains(User{Fingerprint: "DEADBEEF"}.String(), "Created")
+}
+
+func (s *LookupTest) TestMarshalJSONUsesEmptyLists() {
+	actual, err := json.Marshal(User{Fingerprint: "DEADBEEF", Revoked: true})
+
+	s.NoError(err)
+	s.JSONEq(`{
+		"username": "", "fingerprint": "DEADBEEF", "full_name": "",
+		"twitter": "", "github": "", "hacker_news": "", "reddit": "",
+		"sites": [], "names": [], "emails": [], "subkeys": [],
+		"revoked": true, "expired": false, "unverified": false,
+		"created_at": null, "expires_at": null
+	}`, string(actual))
+}
+
 func TestLookupTest(t *testing.T) {
 	suite.Run(t, new(LookupTest))
 }
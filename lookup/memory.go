@@ -0,0 +1,93 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package lookup
+
+import (
+	"context"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// MemoryService implements the KeyService interface for keys the caller
+// already has in memory, like a pinned set of trusted keys shipped with a
+// program (or a handful of keys in a test). It matches keys exactly the way
+// LocalPGPService does.
+type MemoryService struct {
+	ring openpgp.EntityList
+
+	// MatchMode decides how Matches compares the query to each key, like
+	// LocalPGPService.MatchMode.
+	MatchMode MatchMode
+
+	// ShowExpired makes Matches include expired keys, like
+	// LocalPGPService.ShowExpired.
+	ShowExpired bool
+
+	// MaxMatches is the most keys Matches returns, like
+	// LocalPGPService.MaxMatches.
+	MaxMatches int
+
+	// Capability is what a key has to be able to do for Matches to offer
+	// it, like LocalPGPService.Capability.
+	Capability Capability
+
+	// now is the clock expiry is checked against. It's only replaced in
+	// tests.
+	now func() time.Time
+}
+
+// NewMemoryService creates a MemoryService for the keys in ring.
+func NewMemoryService(ring openpgp.EntityList) *MemoryService {
+	return &MemoryService{ring: ring}
+}
+
+func (m *MemoryService) clock() time.Time {
+	if m.now == nil {
+		return time.Now()
+	}
+
+	return m.now()
+}
+
+// Matches finds all the keys that have a fingerprint, name, or email address
+// that match query, the same way LocalPGPService.Matches does. If no matches
+// are found, Matches returns an error.
+func (m *MemoryService) Matches(ctx context.Context, query string) ([]User, error) {
+	users, err := matchRing(ctx, m.ring, query, m.MatchMode, m.Capability, m.ShowExpired, m.clock())
+	if err != nil {
+		return nil, err
+	}
+
+	return limitMatches(users, m.MaxMatches)
+}
+
+// List is every key the service has, the same way LocalPGPService.List does.
+func (m *MemoryService) List(ctx context.Context) ([]User, error) {
+	return listRing(ctx, m.ring, m.clock())
+}
+
+// Key gets the key for a user's fingerprint, the same way LocalPGPService.Key
+// does. If the fingerprint is invalid, the key has expired, or there's no
+// single key that matches, Key returns an error.
+func (m *MemoryService) Key(ctx context.Context, user User) (openpgp.EntityList, error) {
+	return keyFromRing(m.ring, user, m.clock())
+}
+
+// FullKey gets the key for user the same way Key does, with every one of its
+// subkeys.
+func (m *MemoryService) FullKey(ctx context.Context, user User) (openpgp.EntityList, error) {
+	key, err := findRingKey(m.ring, user, m.clock())
+	if err != nil {
+		return nil, err
+	}
+
+	return openpgp.EntityList{key}, nil
+}
@@ -0,0 +1,98 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package lookup
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type MemoryTest struct {
+	suite.Suite
+}
+
+func (s *MemoryTest) TestMatchesLikeLocalPGPService() {
+	for _, filename := range []string{"testdata/pubring.gpg", "testdata/revoked.gpg"} {
+		local := &LocalPGPService{ringfile: publicRingFile(filename)}
+		memory := NewMemoryService(readTestRing(s.T(), filename))
+
+		for _, mode := range []MatchMode{MatchSubstring, MatchExact} {
+			local.MatchMode = mode
+			memory.MatchMode = mode
+
+			for _, query := range []string{"example.com", "test@example.com", "revoked@example.com", fixtureFingerprint, "nobody"} {
+				expected, expectedErr := local.Matches(context.Background(), query)
+				actual, err := memory.Matches(context.Background(), query)
+
+				s.Equal(expectedErr, err, query)
+				s.Equal(expected, actual, query)
+			}
+		}
+	}
+}
+
+func (s *MemoryTest) TestKeyLikeLocalPGPService() {
+	local := &LocalPGPService{ringfile: publicRingFile("testdata/pubring.gpg")}
+	memory := NewMemoryService(readTestRing(s.T(), "testdata/pubring.gpg"))
+
+	for _, fingerprint := range []string{"0DC0FA52", fixtureKeyID, fixtureFingerprint, "", "FA52", "1111111111111111"} {
+		expected, expectedErr := local.Key(context.Background(), User{Fingerprint: fingerprint})
+		actual, err := memory.Key(context.Background(), User{Fingerprint: fingerprint})
+
+		s.Equal(expectedErr, err, fingerprint)
+		s.Equal(expected, actual, fingerprint)
+	}
+}
+
+func (s *MemoryTest) TestExpiryLikeLocalPGPService() {
+	memory := NewMemoryService(readTestRing(s.T(), "testdata/expiring.gpg"))
+	created := time.Unix(1792045183, 0)
+
+	memory.now = func() time.Time { return created.Add(11 * 24 * time.Hour) }
+
+	_, err := memory.Matches(context.Background(), "expiring@example.com")
+	s.Error(err)
+
+	memory.ShowExpired = true
+	users, err := memory.Matches(context.Background(), "expiring@example.com")
+	s.NoError(err)
+	s.True(users[0].Expired)
+
+	_, err = memory.Key(context.Background(), User{Fingerprint: "75F74B66408EC6D7"})
+	s.Error(err)
+	s.Contains(err.Error(), "expired")
+}
+
+func (s *MemoryTest) TestErrorsCanBeCheckedWithErrorsIs() {
+	ring := readTestRing(s.T(), "testdata/pubring.gpg")
+
+	_, err := NewMemoryService(ring).Matches(context.Background(), "nobody@example.com")
+	s.True(errors.Is(err, ErrNoMatches), err)
+
+	empty := NewMemoryService(nil)
+	_, err = empty.Matches(context.Background(), "test@example.com")
+	s.True(errors.Is(err, ErrNoRing), err)
+	_, err = empty.Key(context.Background(), User{Fingerprint: fixtureFingerprint})
+	s.True(errors.Is(err, ErrNoRing), err)
+
+	// the same key twice can't be told apart
+	twice := NewMemoryService(append(ring, ring...))
+	_, err = twice.Key(context.Background(), User{Fingerprint: fixtureFingerprint})
+	s.True(errors.Is(err, ErrAmbiguousKey), err)
+	s.Contains(err.Error(), "More than one key returned")
+}
+
+func TestMemoryTest(t *testing.T) {
+	suite.Run(t, new(MemoryTest))
+}
@@ -0,0 +1,212 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package lookup
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// Trust is how far a key's owner is trusted, according to GnuPG's trustdb.
+type Trust int
+
+const (
+	// TrustNotChecked means nobody looked the key up in a trustdb. It's the
+	// zero value, so Users from services that don't know about trust have
+	// it.
+	TrustNotChecked Trust = iota
+
+	// TrustUnknown means the trustdb doesn't have an opinion on the key:
+	// it isn't there, or its trust is undefined or expired.
+	TrustUnknown
+
+	// TrustNever means the key's owner is explicitly not trusted.
+	TrustNever
+
+	// TrustMarginal means the key's owner is marginally trusted.
+	TrustMarginal
+
+	// TrustFull means the key's owner is fully trusted.
+	TrustFull
+
+	// TrustUltimate means the key is one of your own.
+	TrustUltimate
+)
+
+// trustNames are the Trusts' names in JSON.
+var trustNames = map[Trust]string{
+	TrustNotChecked: "",
+	TrustUnknown:    "unknown",
+	TrustNever:      "never",
+	TrustMarginal:   "marginal",
+	TrustFull:       "full",
+	TrustUltimate:   "ultimate",
+}
+
+// String is the Trust's name, like "full" or "unknown".
+func (t Trust) String() string {
+	return trustNames[t]
+}
+
+// MarshalText makes the Trust show up by name in JSON.
+func (t Trust) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// gnupgDisabled is the flag GnuPG adds to the ownertrust of disabled keys.
+const gnupgDisabled = 0x80
+
+// gnupgTrust maps GnuPG's ownertrust values (without the flags in the high
+// bits) to Trusts. Anything that isn't here is TrustUnknown.
+var gnupgTrust = map[int]Trust{
+	3: TrustNever,
+	4: TrustMarginal,
+	5: TrustFull,
+	6: TrustUltimate,
+}
+
+// OwnerTrust is the trust GnuPG has for each key, by fingerprint, from the
+// output of gpg --export-ownertrust.
+type OwnerTrust map[string]Trust
+
+// ReadOwnerTrust parses the gpg --export-ownertrust format: one
+// "fingerprint:trust:" line per key, with # comments. Disabled keys are
+// TrustNever. If a line is anything else, ReadOwnerTrust bails.
+func ReadOwnerTrust(r io.Reader) (OwnerTrust, error) {
+	trust := OwnerTrust{}
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Split(text, ":")
+		fingerprint := NormalizeFingerprint(fields[0])
+		if _, err := hex.DecodeString(fingerprint); err != nil || len(fingerprint) != 40 || len(fields) < 2 {
+			return nil, fmt.Errorf("Bad ownertrust on line %d: %s", line, text)
+		}
+
+		value, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("Bad ownertrust on line %d: %s", line, text)
+		}
+
+		level, ok := gnupgTrust[value&0x0f]
+		switch {
+		case value&gnupgDisabled != 0:
+			level = TrustNever
+		case !ok:
+			level = TrustUnknown
+		}
+		trust[fingerprint] = level
+	}
+
+	return trust, scanner.Err()
+}
+
+// LoadOwnerTrust reads the output of gpg --export-ownertrust from filename.
+func LoadOwnerTrust(filename string) (OwnerTrust, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return ReadOwnerTrust(file)
+}
+
+// Trust is how far the owner of the key with fingerprint is trusted.
+// Fingerprints that aren't in the OwnerTrust are TrustUnknown.
+func (o OwnerTrust) Trust(fingerprint string) Trust {
+	if trust, ok := o[NormalizeFingerprint(fingerprint)]; ok {
+		return trust
+	}
+
+	return TrustUnknown
+}
+
+// Rank sets each User's Trust, drops the Users whose owners are never
+// trusted, and puts the rest in order from most to least trusted. Users that
+// are trusted the same stay in the order they came in.
+func (o OwnerTrust) Rank(users []User) []User {
+	ranked := []User{}
+	for _, user := range users {
+		user.Trust = o.Trust(user.Fingerprint)
+		if user.Trust != TrustNever {
+			ranked = append(ranked, user)
+		}
+	}
+
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return ranked[i].Trust > ranked[j].Trust
+	})
+
+	return ranked
+}
+
+// TrustRankingService implements the KeyService interface by wrapping
+// another KeyService, and ranking its matches with an OwnerTrust.
+type TrustRankingService struct {
+	service KeyService
+	trust   OwnerTrust
+}
+
+// NewTrustRankingService wraps service, so its matches are ranked by trust.
+func NewTrustRankingService(service KeyService, trust OwnerTrust) *TrustRankingService {
+	return &TrustRankingService{service: service, trust: trust}
+}
+
+// Matches gets the wrapped service's matches for query, ranked by
+// OwnerTrust.Rank. If every match is never trusted, Matches returns
+// ErrNoMatches.
+func (t TrustRankingService) Matches(ctx context.Context, query string) ([]User, error) {
+	users, err := t.service.Matches(ctx, query)
+	if len(users) == 0 {
+		return users, err
+	}
+
+	ranked := t.trust.Rank(users)
+	if len(ranked) == 0 {
+		return nil, ErrNoMatches
+	}
+
+	return ranked, err
+}
+
+// Key gets the key for user from the wrapped service, unless its owner is
+// never trusted.
+func (t TrustRankingService) Key(ctx context.Context, user User) (openpgp.EntityList, error) {
+	if t.trust.Trust(user.Fingerprint) == TrustNever {
+		return nil, errors.New("The owner of " + user.Fingerprint + " is never trusted")
+	}
+
+	return t.service.Key(ctx, user)
+}
+
+// FullKey works like Key, but gets the key whole from the wrapped service.
+func (t TrustRankingService) FullKey(ctx context.Context, user User) (openpgp.EntityList, error) {
+	if t.trust.Trust(user.Fingerprint) == TrustNever {
+		return nil, errors.New("The owner of " + user.Fingerprint + " is never trusted")
+	}
+
+	return FullKey(ctx, t.service, user)
+}
@@ -0,0 +1,103 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package lookup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type OwnerTrustTest struct {
+	suite.Suite
+}
+
+func (s *OwnerTrustTest) TestLoadOwnerTrust() {
+	trust, err := LoadOwnerTrust("testdata/ownertrust.txt")
+	s.Require().NoError(err)
+
+	s.Equal(TrustMarginal, trust.Trust("134E0DE0D18FB090F7C17C10A5034EFD4162D102"))
+	s.Equal(TrustUltimate, trust.Trust("d315 78c3 d585 6f87 35f3  cd37 22a7 3aa2 a6f2 0a03"))
+	s.Equal(TrustNever, trust.Trust("5C0A586B5385A0351E2AB8EE1D5D3F973EA6B98A"))
+	s.Equal(TrustUnknown, trust.Trust(fixtureFingerprint))
+
+	// fully trusted, but disabled
+	s.Equal(TrustNever, trust.Trust("43BDB3728915C80F4529ED0CDFDBAB9168012643"))
+}
+
+func (s *OwnerTrustTest) TestReadOwnerTrustRejectsGarbage() {
+	_, err := ReadOwnerTrust(strings.NewReader("# fine\nDEADBEEF:5:\n"))
+	s.EqualError(err, "Bad ownertrust on line 2: DEADBEEF:5:")
+
+	_, err = ReadOwnerTrust(strings.NewReader(fixtureFingerprint + ":full:\n"))
+	s.Error(err)
+}
+
+func (s *OwnerTrustTest) TestRankOrdersAndFlagsMatches() {
+	trust, err := LoadOwnerTrust("testdata/ownertrust.txt")
+	s.Require().NoError(err)
+
+	local, err := NewLocalPGPServiceFromPaths([]string{"testdata/pubring.gpg", "testdata/usage.gpg", "testdata/tampered.gpg", "testdata/revoked.gpg"})
+	s.Require().NoError(err)
+
+	users, err := NewTrustRankingService(local, trust).Matches(context.Background(), "example.com")
+	s.Require().NoError(err)
+
+	// the live@example.com key is never trusted, so it's gone
+	s.Require().Len(users, 3)
+	s.Equal("D31578C3D5856F8735F3CD3722A73AA2A6F20A03", users[0].Fingerprint)
+	s.Equal(TrustUltimate, users[0].Trust)
+	s.Equal("134E0DE0D18FB090F7C17C10A5034EFD4162D102", users[1].Fingerprint)
+	s.Equal(TrustMarginal, users[1].Trust)
+	s.Equal(fixtureFingerprint, users[2].Fingerprint)
+	s.Equal(TrustUnknown, users[2].Trust)
+	s.Contains(users[2].String(), "Trust: UNKNOWN")
+
+	encoded, err := json.Marshal(users[1])
+	s.Require().NoError(err)
+	s.Contains(string(encoded), `"trust":"marginal"`)
+}
+
+func (s *OwnerTrustTest) TestRankingRefusesNeverTrustedKeys() {
+	trust, err := LoadOwnerTrust("testdata/ownertrust.txt")
+	s.Require().NoError(err)
+
+	local, err := NewLocalPGPServiceFromPath("testdata/revoked.gpg")
+	s.Require().NoError(err)
+	service := NewTrustRankingService(local, trust)
+
+	_, err = service.Matches(context.Background(), "live@example.com")
+	s.True(errors.Is(err, ErrNoMatches), err)
+
+	_, err = service.Key(context.Background(), User{Fingerprint: "5C0A586B5385A0351E2AB8EE1D5D3F973EA6B98A"})
+	s.Error(err)
+}
+
+func (s *OwnerTrustTest) TestUntrustedMatchesAreUnchanged() {
+	local, err := NewLocalPGPServiceFromPath("testdata/pubring.gpg")
+	s.Require().NoError(err)
+
+	users, err := local.Matches(context.Background(), "test@example.com")
+	s.Require().NoError(err)
+	s.Equal(TrustNotChecked, users[0].Trust)
+	s.NotContains(users[0].String(), "Trust")
+
+	encoded, err := json.Marshal(users[0])
+	s.Require().NoError(err)
+	s.NotContains(string(encoded), "trust")
+}
+
+func TestOwnerTrustTest(t *testing.T) {
+	suite.Run(t, new(OwnerTrustTest))
+}
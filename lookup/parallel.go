@@ -0,0 +1,84 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package lookup
+
+import (
+	"context"
+	"fmt"
+)
+
+type parallelResult struct {
+	idx   int
+	users []User
+	err   error
+}
+
+// ParallelMatches runs Matches on every service at the same time, and returns
+// all the matches, with duplicate fingerprints merged and everything sorted by
+// fingerprint (the same as mergeUsers), not in the order of the services.
+// Every service gets ctx, and ParallelMatches stops waiting when ctx is done,
+// so a hung service can't hold up the whole lookup. If some of the services
+// fail (or don't finish in time), ParallelMatches returns whatever the others
+// found along with an error listing the failures.
+func ParallelMatches(ctx context.Context, query string, services ...KeyService) ([]User, error) {
+	// buffered, so the stragglers can still finish (and get garbage
+	// collected) after we've stopped listening
+	results := make(chan parallelResult, len(services))
+
+	for idx, service := range services {
+		go func(idx int, service KeyService) {
+			users, err := service.Matches(ctx, query)
+			results <- parallelResult{idx: idx, users: users, err: err}
+		}(idx, service)
+	}
+
+	found := make([][]User, len(services))
+	done := make([]bool, len(services))
+	errs := []string{}
+
+	for range services {
+		select {
+		case result := <-results:
+			done[result.idx] = true
+			if result.err != nil {
+				errs = append(errs, result.err.Error())
+				continue
+			}
+			found[result.idx] = result.users
+		case <-ctx.Done():
+			for idx := range services {
+				if !done[idx] {
+					errs = append(errs, fmt.Sprintf("service %d: %s", idx, ctx.Err()))
+				}
+			}
+			return collectParallel(found, errs)
+		}
+	}
+
+	return collectParallel(found, errs)
+}
+
+func collectParallel(found [][]User, errs []string) ([]User, error) {
+	users := []User{}
+	for _, matches := range found {
+		users = append(users, matches...)
+	}
+	users = mergeUsers(users)
+
+	if len(errs) > 0 {
+		return users, cascadeError(errs)
+	}
+
+	if len(users) == 0 {
+		return users, ErrNoMatches
+	}
+
+	return users, nil
+}
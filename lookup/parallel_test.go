@@ -0,0 +1,108 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package lookup
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/crypto/openpgp"
+)
+
+// slowService is a KeyService that takes its time answering, unless it's
+// cancelled.
+type slowService struct {
+	delay time.Duration
+	users []User
+	err   error
+}
+
+func (f slowService) Matches(ctx context.Context, query string) ([]User, error) {
+	select {
+	case <-time.After(f.delay):
+		return f.users, f.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (f slowService) Key(ctx context.Context, user User) (openpgp.EntityList, error) {
+	return nil, errors.New("Not implemented")
+}
+
+type ParallelTest struct {
+	suite.Suite
+}
+
+func (s *ParallelTest) TestParallelMatchesRunsConcurrently() {
+	services := []KeyService{
+		slowService{delay: 100 * time.Millisecond, users: []User{User{Fingerprint: "AAAA"}}},
+		slowService{delay: 150 * time.Millisecond, users: []User{User{Fingerprint: "BBBB"}, User{Fingerprint: "AAAA"}}},
+		slowService{delay: 100 * time.Millisecond, users: []User{User{Fingerprint: "CCCC"}}},
+	}
+
+	start := time.Now()
+	users, err := ParallelMatches(context.Background(), "foo", services...)
+	elapsed := time.Since(start)
+
+	s.NoError(err)
+	s.Equal([]User{User{Fingerprint: "AAAA"}, User{Fingerprint: "BBBB"}, User{Fingerprint: "CCCC"}}, users)
+
+	// serially this would be 350ms
+	s.True(elapsed >= 150*time.Millisecond, elapsed.String())
+	s.True(elapsed < 300*time.Millisecond, elapsed.String())
+}
+
+func (s *ParallelTest) TestParallelMatchesRespectsDeadline() {
+	services := []KeyService{
+		slowService{delay: 50 * time.Millisecond, users: []User{User{Fingerprint: "AAAA"}}},
+		slowService{delay: 5 * time.Second, users: []User{User{Fingerprint: "BBBB"}}},
+		slowService{delay: 100 * time.Millisecond, users: []User{User{Fingerprint: "CCCC"}}},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	users, err := ParallelMatches(ctx, "foo", services...)
+	elapsed := time.Since(start)
+
+	s.Error(err)
+	s.Contains(err.Error(), "service 1")
+	s.Equal([]User{User{Fingerprint: "AAAA"}, User{Fingerprint: "CCCC"}}, users)
+	s.True(elapsed < time.Second, elapsed.String())
+}
+
+func (s *ParallelTest) TestParallelMatchesReturnsPartialResults() {
+	services := []KeyService{
+		slowService{err: errors.New("broken")},
+		slowService{users: []User{User{Fingerprint: "BBBB"}}},
+	}
+
+	users, err := ParallelMatches(context.Background(), "foo", services...)
+
+	s.Error(err)
+	s.Contains(err.Error(), "broken")
+	s.Equal([]User{User{Fingerprint: "BBBB"}}, users)
+}
+
+func (s *ParallelTest) TestParallelMatchesFailsWithoutMatches() {
+	users, err := ParallelMatches(context.Background(), "foo", slowService{users: []User{}})
+
+	s.Error(err)
+	s.Empty(users)
+}
+
+func TestParallelTest(t *testing.T) {
+	suite.Run(t, new(ParallelTest))
+}
@@ -0,0 +1,125 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package lookup
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ErrNoChoice is returned when a prompt is cancelled or answered with nothing
+// usable.
+var ErrNoChoice = errors.New("Nothing chosen")
+
+// Prompter asks a person questions. Everything pipethis asks interactively
+// goes through one, so the terminal can be swapped for something else (a GUI,
+// a test, an automated run).
+type Prompter interface {
+	// Confirm asks msg as a yes or no question.
+	Confirm(msg string) (bool, error)
+
+	// Choose asks for one of options, and returns its index.
+	Choose(options []string) (int, error)
+}
+
+// TerminalPrompter is a Prompter that asks on a terminal: questions go to Out,
+// and answers are read from In, a line at a time.
+type TerminalPrompter struct {
+	In  io.Reader
+	Out io.Writer
+
+	scanner *bufio.Scanner
+}
+
+// NewTerminalPrompter creates a TerminalPrompter that asks on STDERR (so the
+// questions never end up mixed in with output meant for another program) and
+// reads the answers from STDIN.
+func NewTerminalPrompter() *TerminalPrompter {
+	return &TerminalPrompter{In: os.Stdin, Out: os.Stderr}
+}
+
+// answer reads the next line from In. Lines are read through the same scanner
+// every time, so nothing it buffered past one answer is lost for the next.
+func (t *TerminalPrompter) answer() (string, error) {
+	if t.scanner == nil {
+		t.scanner = bufio.NewScanner(t.In)
+	}
+
+	if !t.scanner.Scan() {
+		if err := t.scanner.Err(); err != nil {
+			return "", err
+		}
+		return "", io.EOF
+	}
+
+	return strings.TrimSpace(t.scanner.Text()), nil
+}
+
+// Confirm prints msg and reads the answer. "y" or "yes" (in any case) is yes,
+// and anything else is no. An empty answer takes the default msg offers: yes
+// if it ends with "(Y/n)", and no otherwise. Reaching the end of In is always
+// no.
+func (t *TerminalPrompter) Confirm(msg string) (bool, error) {
+	fmt.Fprint(t.Out, msg)
+
+	response, err := t.answer()
+	if err == io.EOF {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	switch strings.ToLower(response) {
+	case "y", "yes":
+		return true, nil
+	case "":
+		return strings.HasSuffix(strings.TrimSpace(msg), "(Y/n)"), nil
+	}
+
+	return false, nil
+}
+
+// Choose prints the numbered options and reads the number of the one that's
+// picked. It returns ErrNoChoice if the choice is cancelled ('q' or the end of
+// In) or isn't one of the options.
+func (t *TerminalPrompter) Choose(options []string) (int, error) {
+	fmt.Fprintf(t.Out, "I found %d results:\n\n", len(options))
+	for idx, option := range options {
+		fmt.Fprintf(t.Out, "%d: %s\n\n", idx, option)
+	}
+
+	fmt.Fprint(t.Out, "Enter the number to use, or 'q' to cancel: ")
+
+	response, err := t.answer()
+	if err == io.EOF {
+		return 0, ErrNoChoice
+	}
+	if err != nil {
+		return 0, err
+	}
+	fmt.Fprintln(t.Out)
+
+	if strings.ToLower(response) == "q" {
+		return 0, ErrNoChoice
+	}
+
+	n, err := strconv.Atoi(response)
+	if err != nil || n < 0 || n >= len(options) {
+		return 0, fmt.Errorf("%w: %q isn't one of the options", ErrNoChoice, response)
+	}
+
+	return n, nil
+}
@@ -0,0 +1,138 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package lookup
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/crypto/openpgp"
+)
+
+// fakePrompter is a Prompter with canned answers, given out in order. It
+// remembers what it was asked.
+type fakePrompter struct {
+	answers []bool
+	choices []int
+	err     error
+
+	messages []string
+	options  [][]string
+}
+
+func (f *fakePrompter) Confirm(msg string) (bool, error) {
+	f.messages = append(f.messages, msg)
+	if f.err != nil {
+		return false, f.err
+	}
+
+	answer := f.answers[0]
+	f.answers = f.answers[1:]
+
+	return answer, nil
+}
+
+func (f *fakePrompter) Choose(options []string) (int, error) {
+	f.options = append(f.options, options)
+	if f.err != nil {
+		return 0, f.err
+	}
+
+	choice := f.choices[0]
+	f.choices = f.choices[1:]
+
+	return choice, nil
+}
+
+type PromptTest struct {
+	suite.Suite
+}
+
+func (s *PromptTest) prompter(input string) (*TerminalPrompter, *bytes.Buffer) {
+	out := &bytes.Buffer{}
+	return &TerminalPrompter{In: strings.NewReader(input), Out: out}, out
+}
+
+func (s *PromptTest) TestConfirmNeedsYes() {
+	tests := map[string]bool{
+		"y\n":     true,
+		"YES\n":   true,
+		" y ":     true,
+		"n\n":     false,
+		"\n":      false,
+		"":        false,
+		"yep, ok": false,
+	}
+
+	for input, expected := range tests {
+		prompter, out := s.prompter(input)
+
+		actual, err := prompter.Confirm("Go? (y/N) ")
+		s.NoError(err, input)
+		s.Equal(expected, actual, input)
+		s.Equal("Go? (y/N) ", out.String(), input)
+	}
+}
+
+func (s *PromptTest) TestConfirmTakesTheOfferedDefault() {
+	prompter, _ := s.prompter("\nn\n")
+
+	ok, err := prompter.Confirm("Go? (Y/n) ")
+	s.NoError(err)
+	s.True(ok)
+
+	ok, err = prompter.Confirm("Go? (Y/n) ")
+	s.NoError(err)
+	s.False(ok)
+
+	// the end of the input is never a yes
+	ok, err = prompter.Confirm("Go? (Y/n) ")
+	s.NoError(err)
+	s.False(ok)
+}
+
+func (s *PromptTest) TestChooseReadsEachAnswerOnce() {
+	prompter, out := s.prompter("1\nq\n")
+
+	n, err := prompter.Choose([]string{"first", "second"})
+	s.NoError(err)
+	s.Equal(1, n)
+	s.Contains(out.String(), "I found 2 results:\n\n0: first\n\n1: second\n\n")
+
+	_, err = prompter.Choose([]string{"first", "second"})
+	s.True(errors.Is(err, ErrNoChoice), err)
+
+	_, err = prompter.Choose([]string{"first", "second"})
+	s.True(errors.Is(err, ErrNoChoice), err)
+}
+
+func (s *PromptTest) TestFindWithAsksThePrompter() {
+	users := []User{{Fingerprint: "AAAA", Username: "first"}, {Fingerprint: "BBBB", Username: "second"}}
+	service := &fakeService{users: users, ring: openpgp.EntityList{&openpgp.Entity{}}}
+	prompter := &fakePrompter{choices: []int{1}}
+
+	match, _, err := FindWith(context.Background(), service, "author", false, prompter)
+	s.NoError(err)
+	s.Equal(users[1], match)
+	s.Len(prompter.options, 1)
+
+	// a single match is never asked about
+	_, _, err = FindWith(context.Background(), service, "author", true, prompter)
+	s.Error(err)
+	s.Len(prompter.options, 1)
+}
+
+func TestPromptTest(t *testing.T) {
+	suite.Run(t, new(PromptTest))
+}
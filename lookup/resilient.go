@@ -0,0 +1,121 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package lookup
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/openpgp"
+	pgperrors "golang.org/x/crypto/openpgp/errors"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// ReadResilientKeyRing reads a binary keyring like openpgp.ReadKeyRing, except
+// that a key it can't parse (or a stretch of packets that aren't packets at
+// all) is skipped instead of ending the whole read. The keys that did parse
+// come back along with the reason for each one that didn't. Keys with
+// algorithms openpgp doesn't support are left out without a word, the same
+// as openpgp.ReadKeyRing does.
+//
+// A key is everything from its primary key packet to the next one, so
+// garbage in the middle of a key cuts it short: it's kept if what came before
+// the garbage is a whole key by itself, and the garbage is listed as skipped
+// either way. If nothing parsed at all, the first reason is returned as the
+// error.
+func ReadResilientKeyRing(r io.Reader) (openpgp.EntityList, []error, error) {
+	ring := openpgp.EntityList{}
+	skipped := []error{}
+
+	var pending []packet.Packet
+	flush := func() {
+		if len(pending) == 0 {
+			return
+		}
+
+		key, err := readEntity(pending)
+		pending = nil
+		if _, ok := err.(pgperrors.UnsupportedError); ok {
+			return
+		}
+		if err != nil {
+			skipped = append(skipped, err)
+			return
+		}
+		ring = append(ring, key)
+	}
+
+	packets := packet.NewReader(r)
+	discarding := false
+	for {
+		p, err := packets.Next()
+		if err == io.EOF {
+			break
+		}
+		if _, ok := err.(pgperrors.UnsupportedError); ok {
+			// openpgp.ReadKeyRing skips the whole key, quietly
+			flush()
+			discarding = true
+			continue
+		}
+		if err == io.ErrUnexpectedEOF {
+			skipped = append(skipped, fmt.Errorf("Keyring ends in the middle of a packet: %w", err))
+			break
+		}
+		if err != nil {
+			if !discarding {
+				flush()
+				skipped = append(skipped, err)
+			}
+			discarding = true
+			continue
+		}
+
+		if isPrimaryKey(p) {
+			flush()
+			discarding = false
+		}
+		if !discarding {
+			pending = append(pending, p)
+		}
+	}
+	flush()
+
+	if len(ring) == 0 && len(skipped) > 0 {
+		return nil, skipped, skipped[0]
+	}
+
+	return ring, skipped, nil
+}
+
+// isPrimaryKey is true when p starts a new key.
+func isPrimaryKey(p packet.Packet) bool {
+	switch key := p.(type) {
+	case *packet.PublicKey:
+		return !key.IsSubkey
+	case *packet.PrivateKey:
+		return !key.IsSubkey
+	}
+
+	return false
+}
+
+// readEntity parses one key out of packets that have already been read.
+func readEntity(packets []packet.Packet) (*openpgp.Entity, error) {
+	reader := packet.NewReader(bytes.NewReader(nil))
+
+	// Unread works like a stack
+	for i := len(packets) - 1; i >= 0; i-- {
+		reader.Unread(packets[i])
+	}
+
+	return openpgp.ReadEntity(reader)
+}
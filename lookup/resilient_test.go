@@ -0,0 +1,98 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package lookup
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/crypto/openpgp"
+)
+
+// testdata/corrupt.gpg is the signing key from testdata/usage.gpg, a line of
+// text, and then the certify-only key from testdata/capabilities.gpg
+const (
+	corruptFirst  = "134E0DE0D18FB090F7C17C10A5034EFD4162D102"
+	corruptSecond = "A3D2270CC1FE83168CCD56C9C5657D3FDA8FE88C"
+)
+
+type ResilientTest struct {
+	suite.Suite
+}
+
+func (s *ResilientTest) TestReadsAroundGarbage() {
+	contents, err := ioutil.ReadFile("testdata/corrupt.gpg")
+	s.Require().NoError(err)
+
+	_, err = openpgp.ReadKeyRing(bytes.NewReader(contents))
+	s.Require().Error(err, "the fixture should be too broken for openpgp")
+
+	ring, skipped, err := ReadResilientKeyRing(bytes.NewReader(contents))
+	s.Require().NoError(err)
+	s.Require().Len(ring, 2)
+	s.Equal(corruptFirst, keyFingerprint(ring[0]))
+	s.Equal(corruptSecond, keyFingerprint(ring[1]))
+	s.Len(ring[0].Subkeys, 2)
+	s.Len(skipped, 1)
+}
+
+func (s *ResilientTest) TestMatchesStrictReaderOnGoodRings() {
+	for _, ringfile := range []string{"testdata/usage.gpg", "testdata/revoked.gpg", "testdata/pubring.gpg"} {
+		contents, err := ioutil.ReadFile(ringfile)
+		s.Require().NoError(err)
+
+		strict, err := openpgp.ReadKeyRing(bytes.NewReader(contents))
+		s.Require().NoError(err, ringfile)
+		resilient, skipped, err := ReadResilientKeyRing(bytes.NewReader(contents))
+		s.Require().NoError(err, ringfile)
+
+		s.Empty(skipped, ringfile)
+		s.Require().Len(resilient, len(strict), ringfile)
+		for i := range strict {
+			s.Equal(keyFingerprint(strict[i]), keyFingerprint(resilient[i]), ringfile)
+			s.Equal(len(strict[i].Subkeys), len(resilient[i].Subkeys), ringfile)
+			s.Equal(len(strict[i].Revocations), len(resilient[i].Revocations), ringfile)
+		}
+	}
+}
+
+func (s *ResilientTest) TestFailsWhenNothingParses() {
+	ring, skipped, err := ReadResilientKeyRing(bytes.NewBufferString("not a keyring at all"))
+
+	s.Error(err)
+	s.Empty(ring)
+	s.Len(skipped, 1)
+}
+
+func (s *ResilientTest) TestLocalPGPServiceIsStrictByDefault() {
+	local := &LocalPGPService{ringfile: publicRingFile("testdata/corrupt.gpg")}
+
+	_, err := local.Ring()
+	s.Error(err)
+
+	var buf bytes.Buffer
+	local = &LocalPGPService{ringfile: publicRingFile("testdata/corrupt.gpg"), SkipCorruptKeys: true, Logger: log.New(&buf, "", 0)}
+
+	users, err := local.Matches(context.Background(), "signer@example.com")
+	s.Require().NoError(err)
+	s.Require().Len(users, 1)
+	s.Equal(corruptFirst, users[0].Fingerprint)
+
+	s.Len(local.Skipped(), 1)
+	s.Contains(buf.String(), "loaded 2 keys from corrupt.gpg\nskipped a corrupt key in corrupt.gpg: ")
+}
+
+func TestResilientTest(t *testing.T) {
+	suite.Run(t, new(ResilientTest))
+}
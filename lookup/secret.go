@@ -0,0 +1,132 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package lookup
+
+import (
+	"crypto/rsa"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// NewLocalSecretPGPService creates a LocalPGPService for the keys you can sign
+// with, so you can verify your own scripts before you publish them. The keys
+// come from secring.gpg in the GnuPG home directory if there is one. GnuPG
+// 2.1+ doesn't keep a secret keyring, so otherwise the keys come from the
+// public keyring, limited to the ones with a secret key in private-keys-v1.d.
+// Only the public parts of the keys are ever loaded. If there are no secret
+// keys, NewLocalSecretPGPService bails.
+func NewLocalSecretPGPService() (*LocalPGPService, error) {
+	home, err := gnupgHome()
+	if err != nil {
+		return nil, err
+	}
+
+	return newLocalSecretPGPService(home)
+}
+
+func newLocalSecretPGPService(home string) (*LocalPGPService, error) {
+	secring := publicRingFile(path.Join(home, "secring.gpg"))
+	if _, err := secring.Stat(); err == nil {
+		return &LocalPGPService{ringfile: secring, filter: publicOnly}, nil
+	}
+
+	keydir := path.Join(home, "private-keys-v1.d")
+	if info, err := os.Stat(keydir); err != nil || !info.IsDir() {
+		return nil, errors.New("No secret keys found in " + home)
+	}
+
+	local, err := newLocalPGPService(findPublicRingFile(home))
+	if err != nil {
+		return nil, err
+	}
+
+	local.filter = func(ring openpgp.EntityList) openpgp.EntityList {
+		return withSecretKeys(ring, keydir)
+	}
+
+	return local, nil
+}
+
+// publicOnly copies the keys in ring without their private parts.
+func publicOnly(ring openpgp.EntityList) openpgp.EntityList {
+	public := openpgp.EntityList{}
+
+	for _, key := range ring {
+		copied := &openpgp.Entity{
+			PrimaryKey:  key.PrimaryKey,
+			Identities:  key.Identities,
+			Revocations: key.Revocations,
+		}
+
+		for _, subkey := range key.Subkeys {
+			copied.Subkeys = append(copied.Subkeys, openpgp.Subkey{
+				PublicKey: subkey.PublicKey,
+				Sig:       subkey.Sig,
+			})
+		}
+
+		public = append(public, copied)
+	}
+
+	return public
+}
+
+// withSecretKeys keeps the keys in ring that have a secret key (for the
+// primary key or any subkey) in the private-keys-v1.d directory keydir.
+func withSecretKeys(ring openpgp.EntityList, keydir string) openpgp.EntityList {
+	hasSecret := func(key *packet.PublicKey) bool {
+		grip := keygrip(key)
+		if grip == "" {
+			return false
+		}
+
+		_, err := os.Stat(path.Join(keydir, grip+".key"))
+		return err == nil
+	}
+
+	list := openpgp.EntityList{}
+	for _, key := range ring {
+		found := hasSecret(key.PrimaryKey)
+		for _, subkey := range key.Subkeys {
+			found = found || hasSecret(subkey.PublicKey)
+		}
+
+		if found {
+			list = append(list, key)
+		}
+	}
+
+	return list
+}
+
+// keygrip is the name GnuPG gives the secret key file for key. It's only
+// worked out for RSA keys; the other algorithms are hashed in more involved
+// ways, so their keygrips are empty.
+func keygrip(key *packet.PublicKey) string {
+	pub, ok := key.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return ""
+	}
+
+	// the modulus is hashed as a signed integer, so it needs a leading zero
+	// when the top bit is set
+	n := pub.N.Bytes()
+	if len(n) > 0 && n[0]&0x80 != 0 {
+		n = append([]byte{0}, n...)
+	}
+
+	return fmt.Sprintf("%X", sha1.Sum(n))
+}
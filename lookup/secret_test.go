@@ -0,0 +1,92 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package lookup
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// selfFingerprint is the key in testdata/secring.gpg, which also has its secret
+// in testdata/secrethome/private-keys-v1.d.
+const (
+	selfFingerprint = "D31578C3D5856F8735F3CD3722A73AA2A6F20A03"
+	selfKeygrip     = "087190C4D8DE262E0C4DFDE8F8B81E62064D0016"
+)
+
+type SecretTest struct {
+	suite.Suite
+}
+
+func (s *SecretTest) TestSecringMatchesSelfKey() {
+	home, _ := ioutil.TempDir("", "pipethis-")
+	defer os.RemoveAll(home)
+
+	secring, _ := ioutil.ReadFile("testdata/secring.gpg")
+	ioutil.WriteFile(path.Join(home, "secring.gpg"), secring, 0600)
+
+	local, err := newLocalSecretPGPService(home)
+	s.Require().NoError(err)
+
+	users, err := local.Matches(context.Background(), "self@example.com")
+	s.Require().NoError(err)
+	s.Len(users, 1)
+	s.Equal(selfFingerprint, users[0].Fingerprint)
+
+	ring, err := local.Key(context.Background(), users[0])
+	s.Require().NoError(err)
+	s.Nil(ring[0].PrivateKey)
+	for _, subkey := range ring[0].Subkeys {
+		s.Nil(subkey.PrivateKey)
+	}
+}
+
+func (s *SecretTest) TestPrivateKeysDirMatchesSelfKey() {
+	local, err := newLocalSecretPGPService("testdata/secrethome")
+	s.Require().NoError(err)
+
+	users, err := local.Matches(context.Background(), "self@example.com")
+	s.Require().NoError(err)
+	s.Len(users, 1)
+	s.Equal(selfFingerprint, users[0].Fingerprint)
+
+	// the public ring has another key, but there's no secret for it
+	_, err = local.Matches(context.Background(), "test@example.com")
+	s.EqualError(err, "No matches")
+}
+
+func (s *SecretTest) TestNewLocalSecretPGPServiceBailsWithoutSecrets() {
+	home, _ := ioutil.TempDir("", "pipethis-")
+	defer os.RemoveAll(home)
+
+	pubring, _ := ioutil.ReadFile("testdata/pubring.gpg")
+	ioutil.WriteFile(path.Join(home, "pubring.gpg"), pubring, 0600)
+
+	_, err := newLocalSecretPGPService(home)
+	s.Error(err)
+
+	_, err = newLocalSecretPGPService("testdata/nowhere")
+	s.Error(err)
+}
+
+func (s *SecretTest) TestKeygripMatchesGnuPG() {
+	ring := readTestRing(s.T(), "testdata/secring.gpg")
+
+	s.Equal(selfKeygrip, keygrip(ring[0].PrimaryKey))
+}
+
+func TestSecretTest(t *testing.T) {
+	suite.Run(t, new(SecretTest))
+}
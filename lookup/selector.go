@@ -0,0 +1,89 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package lookup
+
+import (
+	"fmt"
+	"os"
+)
+
+// Selector shows a person the matches for an author and asks them to pick
+// one, so nothing gets trusted just because it came back from a search.
+type Selector struct {
+	// Prompter does the asking.
+	Prompter Prompter
+
+	// Interactive says whether there's a person on the other end of the
+	// Prompter. If there isn't, Choose won't guess between several matches.
+	Interactive bool
+}
+
+// NewSelector creates a Selector that asks with prompter. If prompter is nil,
+// it asks with a TerminalPrompter, and is only interactive if STDIN is a
+// terminal.
+func NewSelector(prompter Prompter) *Selector {
+	if prompter == nil {
+		return &Selector{Prompter: NewTerminalPrompter(), Interactive: isTerminal(os.Stdin)}
+	}
+
+	return &Selector{Prompter: prompter, Interactive: true}
+}
+
+// isTerminal is true when file is a terminal (and not a pipe or a regular
+// file).
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// primaryIdentity is the best one-line description of the User: the first name
+// and email, or whichever of those (or the username) there is.
+func (u User) primaryIdentity() string {
+	switch {
+	case len(u.Names) > 0 && len(u.Emails) > 0:
+		return u.Names[0] + " <" + u.Emails[0] + ">"
+	case len(u.Emails) > 0:
+		return u.Emails[0]
+	case len(u.Names) > 0:
+		return u.Names[0]
+	}
+
+	return u.Username
+}
+
+// Choose offers the matches, each with its key id, primary identity, and the
+// rest of its details, and returns the one that gets picked. If the Selector
+// isn't interactive, Choose only returns a match when there's exactly one;
+// otherwise it returns an error instead of guessing. It also returns an error
+// if the choice is cancelled or isn't one of the matches.
+func (s *Selector) Choose(matches []User) (User, error) {
+	if !s.Interactive {
+		if len(matches) != 1 {
+			return User{}, fmt.Errorf("Found %d author matches; need exactly 1 without someone to pick", len(matches))
+		}
+
+		return matches[0], nil
+	}
+
+	options := make([]string, len(matches))
+	for idx, user := range matches {
+		options[idx] = fmt.Sprintf("%s %s\n\n%s", ShortID(user.Fingerprint), user.primaryIdentity(), user)
+	}
+
+	n, err := s.Prompter.Choose(options)
+	if err != nil {
+		return User{}, fmt.Errorf("No match selected: %w", err)
+	}
+	if n < 0 || n >= len(matches) {
+		return User{}, fmt.Errorf("Invalid match selected: %d", n)
+	}
+
+	return matches[n], nil
+}
@@ -0,0 +1,103 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package lookup
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type SelectorTest struct {
+	suite.Suite
+	matches []User
+}
+
+func (s *SelectorTest) SetupTest() {
+	s.matches = []User{
+		{Fingerprint: "2DEC361C395B52E763A95873A018A3D90DC0FA52", Names: []string{"Pipethis Test"}, Emails: []string{"test@example.com"}},
+		{Fingerprint: "1111111111111111", Username: "keybaser"},
+	}
+}
+
+func (s *SelectorTest) selector(input string) (*Selector, *bytes.Buffer) {
+	out := &bytes.Buffer{}
+	return &Selector{Prompter: &TerminalPrompter{In: strings.NewReader(input), Out: out}, Interactive: true}, out
+}
+
+func (s *SelectorTest) TestChooseReturnsPickedMatch() {
+	selector, out := s.selector("1\n")
+
+	user, err := selector.Choose(s.matches)
+
+	s.NoError(err)
+	s.Equal("keybaser", user.Username)
+	s.Contains(out.String(), "0: A018A3D90DC0FA52 Pipethis Test <test@example.com>\n")
+	s.Contains(out.String(), "Fingerprint: 2DEC 361C 395B 52E7 63A9  5873 A018 A3D9 0DC0 FA52\n")
+	s.Contains(out.String(), "1: 1111111111111111 keybaser\n")
+	s.Contains(out.String(), "Enter the number to use, or 'q' to cancel: ")
+}
+
+func (s *SelectorTest) TestChooseFailsWithoutChoice() {
+	for _, input := range []string{"", "q\n", " Q ", "2\n", "-1\n", "first\n"} {
+		selector, _ := s.selector(input)
+
+		user, err := selector.Choose(s.matches)
+
+		s.Error(err, input)
+		s.Equal(User{}, user, input)
+	}
+}
+
+func (s *SelectorTest) TestChooseWontGuessWhenNotInteractive() {
+	selector, out := s.selector("0\n")
+	selector.Interactive = false
+
+	_, err := selector.Choose(s.matches)
+	s.EqualError(err, "Found 2 author matches; need exactly 1 without someone to pick")
+	s.Empty(out.String())
+
+	user, err := selector.Choose(s.matches[:1])
+	s.NoError(err)
+	s.Equal(s.matches[0], user)
+}
+
+func (s *SelectorTest) TestChooseAsksThePrompter() {
+	prompter := &fakePrompter{choices: []int{1}}
+
+	user, err := NewSelector(prompter).Choose(s.matches)
+	s.NoError(err)
+	s.Equal("keybaser", user.Username)
+	s.Require().Len(prompter.options, 1)
+	s.Len(prompter.options[0], 2)
+	s.True(strings.HasPrefix(prompter.options[0][0], "A018A3D90DC0FA52 Pipethis Test <test@example.com>\n\n"))
+
+	prompter = &fakePrompter{err: errors.New("Closed the window")}
+	_, err = NewSelector(prompter).Choose(s.matches)
+	s.EqualError(err, "No match selected: Closed the window")
+
+	prompter = &fakePrompter{choices: []int{5}}
+	_, err = NewSelector(prompter).Choose(s.matches)
+	s.EqualError(err, "Invalid match selected: 5")
+}
+
+func (s *SelectorTest) TestPrimaryIdentity() {
+	s.Equal("A <a@example.com>", User{Names: []string{"A", "B"}, Emails: []string{"a@example.com"}}.primaryIdentity())
+	s.Equal("a@example.com", User{Emails: []string{"a@example.com"}}.primaryIdentity())
+	s.Equal("A", User{Names: []string{"A"}, Username: "a"}.primaryIdentity())
+	s.Equal("a", User{Username: "a"}.primaryIdentity())
+}
+
+func TestSelectorTest(t *testing.T) {
+	suite.Run(t, new(SelectorTest))
+}
@@ -0,0 +1,141 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package lookup
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// DefaultVKSServer is the keyserver VKSService uses when it isn't given one.
+const DefaultVKSServer = "https://keys.openpgp.org"
+
+// ErrNoVerifiedKey means a VKS keyserver doesn't have a key for the query.
+// For email queries, that includes keys where the address hasn't been
+// verified. It matches ErrKeyNotFound too (with errors.Is).
+var ErrNoVerifiedKey error = &notFoundError{"No verified key found"}
+
+// notFoundError is a more specific ErrKeyNotFound.
+type notFoundError struct {
+	message string
+}
+
+func (e *notFoundError) Error() string {
+	return e.message
+}
+
+func (e *notFoundError) Is(target error) bool {
+	return target == ErrKeyNotFound
+}
+
+// VKSService implements the KeyService interface for keyservers with the
+// Verifying Keyserver API, like keys.openpgp.org. Those keyservers only hand
+// out identities for email addresses the key's owner has verified.
+type VKSService struct {
+	remote
+	server string
+}
+
+// NewVKSService creates a VKSService for the keyserver at server. If server
+// is empty, DefaultVKSServer is used.
+func NewVKSService(server string, options ...RemoteOption) *VKSService {
+	if server == "" {
+		server = DefaultVKSServer
+	}
+
+	return &VKSService{remote: newRemote(options), server: strings.TrimRight(server, "/")}
+}
+
+// endpoint picks the lookup URL for query: by-email for email addresses (with
+// any name, like "Jane Doe <jane@example.com>", left off), by-fingerprint for
+// full fingerprints, and by-keyid for long key ids.
+func (v VKSService) endpoint(query string) (string, error) {
+	if strings.Contains(query, "@") {
+		return v.server + "/vks/v1/by-email/" + url.PathEscape(bareAddress(strings.TrimSpace(query))), nil
+	}
+
+	fingerprint := NormalizeFingerprint(query)
+	if _, err := hex.DecodeString(fingerprint); err != nil {
+		return "", errors.New("Invalid query: " + query)
+	}
+
+	switch len(fingerprint) {
+	case 40:
+		return v.server + "/vks/v1/by-fingerprint/" + fingerprint, nil
+	case 16:
+		return v.server + "/vks/v1/by-keyid/" + fingerprint, nil
+	}
+
+	return "", errors.New("Need an email address, a full fingerprint, or a long key id: " + query)
+}
+
+func (v VKSService) fetch(ctx context.Context, query string) (openpgp.EntityList, error) {
+	location, err := v.endpoint(query)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := v.getKey(ctx, location)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNoVerifiedKey
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusError(resp, fmt.Sprintf("Keyserver returned %s for %s", resp.Status, query))
+	}
+
+	return parseKey(resp.Body)
+}
+
+// Matches finds the key for query, which can be an email address, a full
+// fingerprint, or a long key id. If the keyserver doesn't have a (verified)
+// key, Matches returns ErrNoVerifiedKey.
+func (v VKSService) Matches(ctx context.Context, query string) ([]User, error) {
+	ring, err := v.fetch(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	users := []User{}
+	for _, key := range ring {
+		user := entityToUser(key)
+
+		users = append(users, user)
+	}
+
+	return mergeUsers(users), nil
+}
+
+// Key gets the key for the user's fingerprint from the keyserver. If the
+// keyserver sends back anything but that one key, Key returns an error
+// (ErrFingerprintMismatch, if it's some other key).
+func (v VKSService) Key(ctx context.Context, user User) (openpgp.EntityList, error) {
+	if err := checkKeyID(user.Fingerprint); err != nil {
+		return nil, err
+	}
+
+	ring, err := v.fetch(ctx, user.Fingerprint)
+	if err != nil {
+		return nil, err
+	}
+
+	return fetchedKey(ring, user.Fingerprint)
+}
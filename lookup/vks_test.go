@@ -0,0 +1,156 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package lookup
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type VKSTest struct {
+	suite.Suite
+}
+
+func (s *VKSTest) server() *httptest.Server {
+	armored := armorTestRing(s.T(), readTestRing(s.T(), "testdata/pubring.gpg")...)
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/vks/v1/by-email/test@example.com",
+			"/vks/v1/by-fingerprint/" + fixtureFingerprint,
+			"/vks/v1/by-keyid/" + fixtureKeyID:
+			w.Write(armored)
+		case "/vks/v1/by-email/broken@example.com":
+			http.Error(w, "oops", http.StatusInternalServerError)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func (s *VKSTest) TestNewVKSServiceDefaultsToKeysOpenPGPOrg() {
+	s.Equal(DefaultVKSServer, NewVKSService("").server)
+	s.Equal("https://keys.example.com", NewVKSService("https://keys.example.com/").server)
+}
+
+func (s *VKSTest) TestEndpointPicksLookupType() {
+	service := NewVKSService("https://keys.example.com")
+
+	tests := map[string]string{
+		"foo@example.com":           "https://keys.example.com/vks/v1/by-email/foo@example.com",
+		"foo+bar@example.com":       "https://keys.example.com/vks/v1/by-email/foo+bar@example.com",
+		"Foo Bar <foo@example.com>": "https://keys.example.com/vks/v1/by-email/foo@example.com",
+		fixtureFingerprint:          "https://keys.example.com/vks/v1/by-fingerprint/" + fixtureFingerprint,
+		"0xa018 a3d9 0dc0 fa52":     "https://keys.example.com/vks/v1/by-keyid/" + fixtureKeyID,
+	}
+
+	for query, expected := range tests {
+		actual, err := service.endpoint(query)
+		s.NoError(err, query)
+		s.Equal(expected, actual, query)
+	}
+
+	for _, query := range []string{"foo", "0DC0FA52", "../admin"} {
+		_, err := service.endpoint(query)
+		s.Error(err, query)
+	}
+}
+
+func (s *VKSTest) TestMatchesByEmailAndFingerprint() {
+	server := s.server()
+	defer server.Close()
+
+	for _, query := range []string{"test@example.com", fixtureFingerprint, fixtureKeyID} {
+		users, err := NewVKSService(server.URL).Matches(context.Background(), query)
+
+		s.NoError(err, query)
+		s.Len(users, 1, query)
+		s.Equal(fixtureFingerprint, users[0].Fingerprint, query)
+		s.Equal([]string{"test@example.com"}, users[0].Emails, query)
+	}
+}
+
+func (s *VKSTest) TestMatchesSeparatesMissingKeysFromErrors() {
+	server := s.server()
+	defer server.Close()
+
+	_, err := NewVKSService(server.URL).Matches(context.Background(), "nobody@example.com")
+	s.Equal(ErrNoVerifiedKey, err)
+
+	_, err = NewVKSService(server.URL, WithRetries(0)).Matches(context.Background(), "broken@example.com")
+	s.Error(err)
+	s.NotEqual(ErrNoVerifiedKey, err)
+}
+
+func (s *VKSTest) TestKeyFetchesByFingerprint() {
+	server := s.server()
+	defer server.Close()
+
+	ring, err := NewVKSService(server.URL).Key(context.Background(), User{Fingerprint: fixtureFingerprint})
+	s.NoError(err)
+	s.Len(ring, 1)
+	s.Equal(fixtureKeyID, ring[0].PrimaryKey.KeyIdString())
+
+	_, err = NewVKSService(server.URL).Key(context.Background(), User{Fingerprint: "1111111111111111111111111111111111111111"})
+	s.Equal(ErrNoVerifiedKey, err)
+}
+
+func (s *VKSTest) TestKeyNeedsALongKeyID() {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	}))
+	defer server.Close()
+
+	for _, short := range []string{"0DC0FA52", "2", ""} {
+		_, err := NewVKSService(server.URL).Key(context.Background(), User{Fingerprint: short})
+		s.Error(err, short)
+	}
+	s.Zero(requests)
+}
+
+func (s *VKSTest) TestKeyRejectsASubstitute() {
+	armored := armorTestRing(s.T(), newTestEntity(s.T(), "Other", "other@example.com"))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(armored)
+	}))
+	defer server.Close()
+
+	_, err := NewVKSService(server.URL).Key(context.Background(), User{Fingerprint: fixtureFingerprint})
+	s.True(errors.Is(err, ErrFingerprintMismatch), err)
+	s.Contains(err.Error(), "asked for "+fixtureFingerprint+", got ")
+}
+
+func (s *VKSTest) TestExpiredKeysAreMarkedAndRefused() {
+	expired := newExpiredTestEntity(s.T(), "Expired", "expired@example.com")
+	armored := armorTestRing(s.T(), expired)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(armored)
+	}))
+	defer server.Close()
+
+	users, err := NewVKSService(server.URL).Matches(context.Background(), "expired@example.com")
+	s.Require().NoError(err)
+	s.Require().Len(users, 1)
+	s.True(users[0].Expired)
+
+	_, err = NewVKSService(server.URL).Key(context.Background(), users[0])
+	s.Require().Error(err)
+	s.Contains(err.Error(), "has expired")
+}
+
+func TestVKSTest(t *testing.T) {
+	suite.Run(t, new(VKSTest))
+}
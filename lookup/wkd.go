@@ -0,0 +1,128 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package lookup
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// zbase32 is the human-oriented base32 alphabet WKD uses for the local part
+// hash.
+var zbase32 = base32.NewEncoding("ybndrfg8ejkmcpqxot1uwisza345h769").WithPadding(base32.NoPadding)
+
+// WKDService implements the KeyService interface for Web Key Directories,
+// where the key for an email address is published on the address's own
+// domain.
+type WKDService struct {
+	remote
+	keys map[string]*openpgp.Entity
+}
+
+// NewWKDService creates a new WKDService.
+func NewWKDService(options ...RemoteOption) *WKDService {
+	return &WKDService{remote: newRemote(options)}
+}
+
+// wkdURLs builds the advanced and direct WKD locations for email, in the order
+// they should be tried.
+func wkdURLs(email string) ([]string, error) {
+	parts := strings.Split(email, "@")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" || strings.ContainsAny(email, " <>/") {
+		return nil, errors.New("Invalid email address: " + email)
+	}
+
+	local, domain := parts[0], strings.ToLower(parts[1])
+	hash := sha1.Sum([]byte(strings.ToLower(local)))
+	hu := zbase32.EncodeToString(hash[:])
+	l := url.QueryEscape(local)
+
+	return []string{
+		fmt.Sprintf("https://openpgpkey.%s/.well-known/openpgpkey/%s/hu/%s?l=%s", domain, domain, hu, l),
+		fmt.Sprintf("https://%s/.well-known/openpgpkey/hu/%s?l=%s", domain, hu, l),
+	}, nil
+}
+
+func (w *WKDService) fetch(ctx context.Context, location string) (openpgp.EntityList, error) {
+	resp, err := w.getKey(ctx, location)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusError(resp, "Web Key Directory returned "+resp.Status)
+	}
+
+	return parseKey(resp.Body)
+}
+
+// Matches fetches the keys published for the email address in query, trying
+// the advanced method (openpgpkey.<domain>) first and the direct method
+// (<domain>) second. query can have a name with the address, like "Jane Doe
+// <jane@example.com>". If query isn't an email address, or neither method
+// finds a key, Matches returns an error.
+func (w *WKDService) Matches(ctx context.Context, query string) ([]User, error) {
+	locations, err := wkdURLs(bareAddress(query))
+	if err != nil {
+		return nil, err
+	}
+
+	var ring openpgp.EntityList
+	for _, location := range locations {
+		if ring, err = w.fetch(ctx, location); err == nil && len(ring) > 0 {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(ring) == 0 {
+		return nil, ErrNoMatches
+	}
+
+	if w.keys == nil {
+		w.keys = map[string]*openpgp.Entity{}
+	}
+
+	users := []User{}
+	for _, key := range ring {
+		user := entityToUser(key)
+
+		w.keys[user.Fingerprint] = key
+		users = append(users, user)
+	}
+
+	return mergeUsers(users), nil
+}
+
+// Key returns the key fetched by Matches for user. WKD has no way to look up a
+// key by fingerprint, so Key returns an error if Matches hasn't found it
+// first.
+func (w *WKDService) Key(ctx context.Context, user User) (openpgp.EntityList, error) {
+	if err := checkKeyID(user.Fingerprint); err != nil {
+		return nil, err
+	}
+
+	key, ok := w.keys[strings.ToUpper(user.Fingerprint)]
+	if !ok {
+		return nil, errors.New("No key fetched for " + user.Fingerprint)
+	}
+
+	return fetchedKey(openpgp.EntityList{key}, user.Fingerprint)
+}
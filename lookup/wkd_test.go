@@ -0,0 +1,128 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package lookup
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type WKDTest struct {
+	suite.Suite
+}
+
+// wkdTestService points every request at server, whatever the host.
+func wkdTestService(server *httptest.Server) *WKDService {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial("tcp", server.Listener.Addr().String())
+		},
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+
+	service := NewWKDService()
+	service.client = &http.Client{Transport: transport}
+
+	return service
+}
+
+func (s *WKDTest) TestWKDURLsHashesLocalPart() {
+	urls, err := wkdURLs("Joe.Doe@Example.ORG")
+
+	s.NoError(err)
+	s.Equal([]string{
+		"https://openpgpkey.example.org/.well-known/openpgpkey/example.org/hu/iy9q119eutrkn8s1mk4r39qejnbu3n5q?l=Joe.Doe",
+		"https://example.org/.well-known/openpgpkey/hu/iy9q119eutrkn8s1mk4r39qejnbu3n5q?l=Joe.Doe",
+	}, urls)
+}
+
+func (s *WKDTest) TestWKDURLsRejectsBadEmails() {
+	for _, email := range []string{"", "foo", "@example.com", "foo@", "a@b@c", "Foo <foo@example.com>"} {
+		_, err := wkdURLs(email)
+		s.Error(err, email)
+	}
+}
+
+func (s *WKDTest) TestWKDAddressDropsTheName() {
+	s.Equal("jane@example.com", bareAddress("Jane Doe <jane@example.com>"))
+	s.Equal("jane@example.com", bareAddress("jane@example.com"))
+	s.Equal("jane", bareAddress("jane"))
+}
+
+func (s *WKDTest) TestMatchesUsesAdvancedMethod() {
+	key, _ := ioutil.ReadFile("testdata/pubring.gpg")
+	hosts := []string{}
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hosts = append(hosts, r.Host)
+		w.Write(key)
+	}))
+	defer server.Close()
+
+	service := wkdTestService(server)
+	users, err := service.Matches(context.Background(), "test@example.com")
+
+	s.NoError(err)
+	s.Equal([]string{"openpgpkey.example.com"}, hosts)
+	s.Len(users, 1)
+	s.Equal("2DEC361C395B52E763A95873A018A3D90DC0FA52", users[0].Fingerprint)
+	s.Equal([]string{"Pipethis Test"}, users[0].Names)
+	s.Equal([]string{"test@example.com"}, users[0].Emails)
+
+	ring, err := service.Key(context.Background(), users[0])
+	s.NoError(err)
+	s.Len(ring, 1)
+	s.Equal(fixtureKeyID, ring[0].PrimaryKey.KeyIdString())
+}
+
+func (s *WKDTest) TestMatchesFallsBackToDirectMethod() {
+	key, _ := ioutil.ReadFile("testdata/pubring.gpg")
+	hosts := []string{}
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hosts = append(hosts, r.Host)
+		if r.Host != "example.com" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(key)
+	}))
+	defer server.Close()
+
+	users, err := wkdTestService(server).Matches(context.Background(), "test@example.com")
+
+	s.NoError(err)
+	s.Equal([]string{"openpgpkey.example.com", "example.com"}, hosts)
+	s.Len(users, 1)
+}
+
+func (s *WKDTest) TestMatchesFailsWhenNothingIsPublished() {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+
+	_, err := wkdTestService(server).Matches(context.Background(), "test@example.com")
+	s.Error(err)
+}
+
+func (s *WKDTest) TestKeyFailsWithoutMatches() {
+	_, err := NewWKDService().Key(context.Background(), User{Fingerprint: fixtureKeyID})
+	s.Error(err)
+}
+
+func TestWKDTest(t *testing.T) {
+	suite.Run(t, new(WKDTest))
+}
@@ -14,17 +14,26 @@ the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
 package main
 
 import (
-	"bufio"
+	"bytes"
+	"context"
 	"errors"
 	"flag"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"mime"
 	"net/http"
 	"net/url"
 	"os"
-	"regexp"
+	"os/exec"
+	"strings"
+	"time"
 
 	"github.com/ellotheth/pipethis/lookup"
+	"github.com/ellotheth/pipethis/pin"
+	"github.com/ellotheth/pipethis/verify"
+	"golang.org/x/crypto/openpgp"
 )
 
 var (
@@ -42,117 +51,613 @@ type ReadSeekCloser interface {
 func main() {
 	// do log.Panic() instead of log.Fatal(), and all the deferred cleanup will
 	// still happen.
+	exitCode := 0
 	defer func() {
 		if r := recover(); r != nil {
 			flag.Usage()
 			os.Exit(1)
 		}
+		if exitCode != 0 {
+			os.Exit(exitCode)
+		}
 	}()
 
 	var (
-		target      = flag.String("target", os.Getenv("SHELL"), "Executable to run the script")
+		target      = flag.String("target", os.Getenv("SHELL"), "Executable to run the script if it doesn't have a shebang line")
+		interpreter = flag.String("interpreter", "", `Command to run the script with instead of its shebang or -target, with its own arguments (like "bash -x")`)
+		afterVerify = flag.String("after-verify", "", "Command to hand the verified script to instead of running it, with its own arguments (the script's path comes after them, and the signer's fingerprint is in $"+signerEnv+")")
 		inspect     = flag.Bool("inspect", false, "Open an editor to inspect the file before running it")
 		editor      = flag.String("editor", os.Getenv("EDITOR"), "Editor to inspect the script")
 		noVerify    = flag.Bool("no-verify", false, "Don't verify the author or signature")
-		sigSource   = flag.String("signature", "", `Detached signature to verify. (default "<script location>.sig")`)
-		serviceName = flag.String("lookup-with", "keybase", "Key lookup service to use. Could be 'keybase' or 'local'.")
+		dryRun      = flag.Bool("dry-run", false, "Verify the author and signature and print the result, but don't run the script")
+		output      = flag.String("output", "text", "Format for the verification result. Could be 'text' or 'json'.")
+		insecure    = flag.Bool("insecure-transport", false, "Allow fetching the script and signature over plain HTTP")
+		offline     = flag.Bool("offline", false, "Never use the network: only local scripts, signatures, and keyrings")
+		maxSize     = flag.Int64("max-download-size", maxSourceSize, "Largest script or signature to read, in bytes")
+		requireID   = flag.String("require-identity", "", "Email address the signing key has to have")
+		expectFpr   = flag.String("expect-fingerprint", "", "Full fingerprint of the author's key: only that key is looked up and trusted, without asking which match to use")
+		signingKey  = flag.String("require-signing-key", "", "Full fingerprint of the one primary key or subkey the signature has to be made by")
+		allowFile   = flag.String("allowlist", "", "File of the only authors to trust: full fingerprints or email addresses (like *@example.com), one per line")
+		yes         = flag.Bool("yes", false, "Don't ask which author match to use (fail unless there's exactly one), or whether to run the verified script")
+		minKeyBits  = flag.Int("min-key-bits", verify.DefaultKeyPolicy.MinRSABits, "Shortest RSA or DSA signing key to trust (0 to allow any)")
+		rejectSHA1  = flag.Bool("reject-sha1", false, "Reject signatures made with SHA-1 (or RIPEMD-160), not just MD5")
+		cacheVerify = flag.Bool("cache-verifications", false, "Remember the scripts that verified, and skip checking the same signature by the same unchanged key again")
+		clockSkew   = flag.Duration("clock-skew", verify.DefaultTimePolicy.ClockSkew, "How far in the future a signature can be dated before it's rejected")
+		warnTime    = flag.Bool("warn-signature-time", false, "Only warn about signatures dated in the future or before their key was created, instead of rejecting them")
+		acceptNew   = flag.Bool("accept-new-key", false, "Trust (and pin) the author's key even if it's not the one pinned before")
+		sigSource   = flag.String("signature", "", `Detached signature to verify. (default "<script location>.sig", then "<script location>.asc")`)
+		serviceName = flag.String("lookup-with", "keybase", "Key lookup service to use. Could be 'keybase', 'local', 'secret', 'hkp', or 'remote'.")
+		keyserver   = flag.String("keyserver", "", "Remote service for -lookup-with remote: an hkps:// URL, 'vks', 'wkd', 'wkd+vks', or 'github' (default $PIPETHIS_KEYSERVER, then "+lookup.DefaultHKPServer+")")
+		skipCorrupt = flag.Bool("skip-corrupt-keys", false, "Skip the keys in the local keyring that can't be parsed, instead of giving up on the whole keyring")
+		ownerTrust  = flag.String("ownertrust", "", "File from gpg --export-ownertrust, to list the author matches you trust most first (and drop the ones you never trust)")
+		inlineKey   = flag.String("key", "", "Armored public key to verify against instead of looking one up: the key itself, a file with the key in it, or '-' for STDIN")
+		importKey   = flag.Bool("import-key", false, "After verifying, add the author's key to the local keyring, so later runs can use -lookup-with local")
+		printTo     = flag.String("print-key", "", "Write the author's armored public key to this file ('-' for STDOUT) and exit, without verifying or running anything")
+		auditFile   = flag.String("audit-log", os.Getenv("PIPETHIS_AUDIT_LOG"), "File to append a JSON line to for every script: where it came from, who signed it, whether it verified, and whether it ran")
+		proxy       = flag.String("key-proxy", "", "Proxy for key lookups: a socks5://, socks5h://, or http:// URL, or 'tor' for socks5h://"+lookup.DefaultTorProxy)
+		doctor      = flag.Bool("doctor", false, "Check the local keyring and the keyserver, print what's wrong, and exit")
 		version     = flag.Bool("version", false, "Print the pipethis version information and exit")
 	)
-	flag.Parse()
+	location, scriptArgs, err := parseArgs(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		log.Panic(err)
+	}
 
 	if *version {
 		log.Println(bin, build, "("+builder+")")
 		return
 	}
 
+	if *proxy != "" {
+		if keyProxy, err = lookup.ParseProxy(*proxy); err != nil {
+			log.Panic(err)
+		}
+	}
+
+	if *doctor {
+		offlineMode = *offline
+		exitCode = runDoctor(os.Stdout, keyserverSpec(*keyserver))
+		return
+	}
+
+	if *dryRun && *noVerify {
+		log.Panic("Nothing to do with both -dry-run and -no-verify")
+	}
+
+	if *printTo != "" && *noVerify {
+		log.Panic("No key to print with -no-verify")
+	}
+
+	if *importKey && *noVerify {
+		log.Panic("No key to import with -no-verify")
+	}
+
+	if *afterVerify != "" && *noVerify {
+		log.Panic("Nothing to hand to -after-verify with -no-verify")
+	}
+
+	if *inlineKey == "-" && (location == "" || location == "-") {
+		log.Panic("Can't read both the script and the -key from STDIN")
+	}
+
+	if err := checkOutput(*output); err != nil {
+		log.Panic(err)
+	}
+
+	if *expectFpr != "" {
+		if *noVerify {
+			log.Panic("Can't check the -expect-fingerprint with -no-verify")
+		}
+		if *expectFpr, err = lookup.ParseFingerprint(*expectFpr); err != nil {
+			log.Panic(err)
+		}
+	}
+
+	if *signingKey != "" {
+		if *noVerify {
+			log.Panic("Can't check the -require-signing-key with -no-verify")
+		}
+		if *signingKey, err = verify.ParseSigningKey(*signingKey); err != nil {
+			log.Panic(err)
+		}
+	}
+
+	var allowlist *verify.Allowlist
+	if *allowFile != "" {
+		if *noVerify {
+			log.Panic("Can't check the -allowlist with -no-verify")
+		}
+		if allowlist, err = verify.LoadAllowlist(*allowFile); err != nil {
+			log.Panic(err)
+		}
+	}
+
+	allowInsecureSource = *insecure
+	offlineMode = *offline
+	maxSourceSize = *maxSize
+
+	// whatever happens from here on goes in the audit log
+	var audit *AuditLog
+	if *auditFile != "" {
+		if audit, err = OpenAuditLog(*auditFile); err != nil {
+			log.Panic(err)
+		}
+		defer audit.Close()
+	}
+	entry := AuditEntry{Source: location}
+	defer func() { audit.finish(&entry, recover()) }()
+
 	// download the script, store it someplace temporary
-	script, err := NewScript(flag.Arg(0))
+	script, err := NewScript(location)
 	if err != nil {
 		log.Panic(err)
 	}
-	defer os.Remove(script.Name())
+	defer script.Remove()
 	log.Println("Script saved to", script.Name())
 
-	// if we're not reading from a pipe we need a target executable
-	if !script.IsPiped() {
-		if _, err := os.Stat(*target); os.IsNotExist(err) {
-			log.Panic("Script executable does not exist")
+	// if we're not reading from a pipe (or just checking) we need something to
+	// run the script with: -interpreter, or the script's shebang, or -target
+	// (or a hook to hand it to instead). the shebang can't be read until the
+	// script's been inspected and verified, so that waits until then.
+	fallback := []string{*target}
+	var override, hook []string
+	if *afterVerify != "" && !*dryRun && *printTo == "" {
+		if hook, err = interpreterCommand(*afterVerify); err != nil {
+			log.Panic(err)
 		}
 
-		log.Println("Using script executable", *target)
+		log.Println("Handing the verified script to", strings.Join(hook, " "))
+	} else if *interpreter != "" && !script.IsPiped() && !*dryRun && *printTo == "" {
+		if override, err = interpreterCommand(*interpreter); err != nil {
+			log.Panic(err)
+		}
 	}
 
+	// anything that needs an answer from the user asks on the terminal
+	prompter := lookup.NewTerminalPrompter()
+
 	// let the user look at it if they want
-	if cont := script.Inspect(*inspect, *editor); !cont {
+	if cont := script.Inspect(*inspect, *editor, prompter); !cont {
 		log.Panic("Exiting without running", script.Name())
 	}
 
 	// by default, verify the author and signature
+	signer := ""
 	if !*noVerify {
 		author, err := script.Author()
 		if err != nil {
 			log.Panic(err)
 		}
+		entry.Author = author
+
+		var service lookup.KeyService
+		if *inlineKey != "" {
+			service, err = inlineKeyService(*inlineKey, os.Stdin)
+		} else {
+			service, err = newKeyService(*serviceName, keyserverSpec(*keyserver), script.IsPiped())
+		}
+		if err != nil {
+			log.Panic(err)
+		}
+		local, _ := service.(*lookup.LocalPGPService)
+		if local != nil {
+			local.SkipCorruptKeys = *skipCorrupt
+		}
+
+		if *expectFpr != "" {
+			if service, err = lookup.NewFingerprintService(service, *expectFpr); err != nil {
+				log.Panic(err)
+			}
+		}
+
+		if *ownerTrust != "" {
+			trust, err := lookup.LoadOwnerTrust(*ownerTrust)
+			if err != nil {
+				log.Panic(err)
+			}
+			service = lookup.NewTrustRankingService(service, trust)
+		}
+
+		// there's nobody to pick a match when a machine is reading the output
+		// (or any need to, when the key was given up front)
+		single := script.IsPiped() || *output == "json" || *yes || *expectFpr != ""
 
-		service, err := lookup.NewKeyService(*serviceName, script.IsPiped())
+		match, key, err := lookup.FindWith(context.Background(), service, author, single, prompter)
+		if local != nil {
+			for _, reason := range local.Skipped() {
+				log.Println("Warning: skipped a corrupt key in", reason)
+			}
+		}
 		if err != nil {
 			log.Panic(err)
 		}
+		result := Result{Author: author, Match: match}
+
+		// just hand over the key, for a closer look or a gpg --import. it's
+		// the whole key, not the one trimmed down for verifying.
+		if *printTo != "" {
+			full, err := lookup.FullKey(context.Background(), service, match)
+			if err != nil {
+				log.Panic(err)
+			}
+			if err := printKey(*printTo, full[0]); err != nil {
+				log.Panic(err)
+			}
+			return
+		}
 
-		key, err := lookup.Key(service, author, script.IsPiped())
+		// make sure it's the same key that was trusted for this author last
+		// time
+		pins := pin.NewStore("")
+		fingerprint := fmt.Sprintf("%X", key[0].PrimaryKey.Fingerprint)
+		entry.Signer = fingerprint
+		pinned, err := pins.LoadPin(author)
 		if err != nil {
 			log.Panic(err)
 		}
+		if err := pin.Check(pinned, fingerprint, *acceptNew); err != nil {
+			log.Panic(err)
+		}
 
 		signature := NewSignature(key, script, *sigSource)
+		signature.Verifier().RequireEmail = *requireID
+		signature.Verifier().RequireSigner = *expectFpr
+		signature.Verifier().RequireSigningKey = *signingKey
+		signature.Verifier().Policy = &verify.KeyPolicy{MinRSABits: *minKeyBits, MinDSABits: *minKeyBits}
+		signature.Verifier().HashPolicy = &verify.DefaultHashPolicy
+		if *rejectSHA1 {
+			signature.Verifier().HashPolicy = &verify.StrictHashPolicy
+		}
+		signature.Verifier().Allowlist = allowlist
+		signature.Verifier().TimePolicy = &verify.TimePolicy{ClockSkew: *clockSkew, WarnOnly: *warnTime}
+		if *cacheVerify {
+			signature.Verifier().Cache = verify.NewVerificationCache("")
+		}
 		defer os.Remove(signature.Name())
 
-		if err := signature.Verify(); err != nil {
+		// just say what happened, and never run the script
+		if *dryRun {
+			exitCode = checkOnly(os.Stdout, *output, result, signature)
+			entry.Result = auditResult(exitCode == 0)
+			return
+		}
+
+		// keep the JSON out of the script's way on STDOUT
+		if *output == "json" {
+			if checkOnly(os.Stderr, *output, result, signature) != 0 {
+				entry.Result = AuditRejected
+				log.Panic("Failed to verify signature")
+			}
+		} else if err := signature.Verify(); err != nil {
+			entry.Result = AuditRejected
 			log.Panic(err)
 		}
 
+		entry.Result = AuditVerified
 		log.Println("Signature verified!")
+
+		command, err := scriptCommand(script, override, fallback, hook)
+		if err != nil {
+			log.Panic(err)
+		}
+
+		// one last look at who signed it before it runs
+		if !script.IsPiped() && !*yes && !confirm(prompter, key[0], strings.Join(command, " ")) {
+			log.Panic("Exiting without running ", script.Name())
+		}
+
+		if pinned != fingerprint {
+			if err := pins.SavePin(author, fingerprint); err != nil {
+				log.Println("Couldn't pin the key for", author+":", err)
+			} else {
+				log.Println("Pinned key", fingerprint, "for", author)
+			}
+		}
+
+		// the whole key goes into the keyring, so it doesn't shadow the one
+		// the author published with a copy missing some subkeys
+		if *importKey {
+			if full, err := lookup.FullKey(context.Background(), service, match); err != nil {
+				log.Println("Couldn't import the key for", author+":", err)
+			} else if added, err := lookup.ImportKeys("", full); err != nil {
+				log.Println("Couldn't import the key for", author+":", err)
+			} else if added > 0 {
+				log.Println("Imported key", fingerprint, "into the local keyring")
+			}
+		}
+
+		signer = fingerprint
+	} else {
+		entry.Result = AuditUnverified
+
+		if _, err := scriptCommand(script, override, fallback, hook); err != nil {
+			log.Panic(err)
+		}
 	}
 
 	// run the script
-	if script.IsPiped() {
-		err = script.Echo()
-	} else {
-		err = script.Run(*target, flag.Args()...)
+	entry.Executed = true
+	if err := runScript(script, override, fallback, hook, signer, append([]string{location}, scriptArgs...)); err != nil {
+		log.Panic(err)
+	}
+}
+
+// scriptCommand picks what the script is handed to: the hook, if there is one,
+// or else Script.Command(override, fallback), which has to be an executable.
+// Piped scripts aren't run, so there's nothing to pick. It has to be called
+// after the script is inspected and verified, so the shebang it reads is the
+// one on the script that runs.
+func scriptCommand(script *Script, override, fallback, hook []string) ([]string, error) {
+	if hook != nil || script.IsPiped() {
+		return hook, nil
 	}
+
+	command, err := script.Command(override, fallback)
 	if err != nil {
-		log.Panic(err)
+		return nil, err
+	}
+	if _, err := exec.LookPath(command[0]); err != nil {
+		return nil, errors.New("Script executable does not exist")
 	}
+
+	log.Println("Using script executable", strings.Join(command, " "))
+
+	return command, nil
 }
 
-func parseToken(pattern string, reader io.Reader) string {
-	re := regexp.MustCompile(pattern)
+// runScript runs the script (with override, or its shebang interpreter, or
+// fallback, the same as Script.Run), or echoes it if it was piped in. If
+// there's a hook, the script goes to the hook instead, but only if signer (the
+// fingerprint of the key that signed it) is set, since that means it was
+// verified.
+func runScript(script *Script, override, fallback, hook []string, signer string, args []string) error {
+	switch {
+	case hook != nil && signer == "":
+		return errors.New("Not handing an unverified script to -after-verify")
+	case hook != nil:
+		return script.Hook(hook, signer, args...)
+	case script.IsPiped():
+		return script.Echo()
+	}
 
-	scanner := bufio.NewScanner(reader)
-	for scanner.Scan() {
-		matches := re.FindStringSubmatch(scanner.Text())
-		if matches == nil {
-			continue
+	return script.Run(override, fallback, args...)
+}
+
+// parseArgs parses the pipethis flags in args with flags, and returns what's
+// left: the script location, and the arguments for the script itself.
+// Everything after a "--" goes to the script untouched; before that, flags
+// can come before or after the script location. Anything else that isn't a
+// flag goes to the script too.
+func parseArgs(flags *flag.FlagSet, args []string) (string, []string, error) {
+	var passed []string
+	for i, arg := range args {
+		if arg == "--" {
+			args, passed = args[:i], args[i+1:]
+			break
+		}
+	}
+
+	positional := []string{}
+	for {
+		// flags.Parse stops at the first argument that isn't a flag, so
+		// keep going from just past it
+		if err := flags.Parse(args); err != nil {
+			return "", nil, err
+		}
+		if flags.NArg() == 0 {
+			break
+		}
+
+		positional = append(positional, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+
+	if len(positional) == 0 {
+		return "", passed, nil
+	}
+
+	return positional[0], append(positional[1:], passed...), nil
+}
+
+// newKeyService creates the lookup service called name. The "remote" service is
+// whichever one keyserver describes; everything else is up to
+// lookup.NewKeyService, including forcing a local keyring for piped scripts.
+// In offline mode, only the local services are allowed.
+func newKeyService(name, keyserver string, fromPipe bool) (lookup.KeyService, error) {
+	options := remoteOptions()
+
+	if name == "remote" && !fromPipe {
+		return lookup.NewRemoteService(keyserver, options...)
+	}
+
+	return lookup.NewKeyService(name, fromPipe, options...)
+}
+
+// inlineKeyService builds a MemoryService for the armored public key in
+// value, so it's the only key the author can match: value is either the key
+// itself, a file with the key in it, or "-" to read the key from stdin.
+func inlineKeyService(value string, stdin io.Reader) (*lookup.MemoryService, error) {
+	var armored io.Reader
+	switch {
+	case value == "-":
+		armored = stdin
+	case strings.HasPrefix(strings.TrimSpace(value), "-----BEGIN PGP"):
+		armored = strings.NewReader(value)
+	default:
+		file, err := os.Open(value)
+		if err != nil {
+			return nil, err
 		}
+		defer file.Close()
+		armored = file
+	}
+
+	ring, err := openpgp.ReadArmoredKeyRing(armored)
+	if err != nil {
+		return nil, errors.New("Couldn't parse the -key: " + err.Error())
+	}
+	if len(ring) == 0 {
+		return nil, errors.New("No keys in the -key")
+	}
+
+	return lookup.NewMemoryService(ring), nil
+}
+
+// runDoctor checks the local keyring and keyserver, prints what it found to
+// out, and returns the exit code: 0 if everything's fine, 1 otherwise.
+func runDoctor(out io.Writer, keyserver string) int {
+	options := remoteOptions()
+
+	diagnosis := lookup.Diagnose(context.Background(), "", []string{keyserver}, options...)
+	fmt.Fprint(out, diagnosis)
+
+	if !diagnosis.OK() {
+		return 1
+	}
+
+	return 0
+}
+
+// remoteOptions are the settings for the remote lookup services: offline
+// mode, and the -key-proxy.
+func remoteOptions() []lookup.RemoteOption {
+	options := []lookup.RemoteOption{}
+	if offlineMode {
+		options = append(options, lookup.WithOffline())
+	}
+	if keyProxy != nil {
+		options = append(options, lookup.WithProxy(keyProxy))
+	}
+	if keyClient != nil {
+		options = append(options, lookup.WithHTTPClient(keyClient))
+	}
+
+	return options
+}
+
+// keyserverSpec picks the keyserver: the -keyserver flag if it's set, then
+// the PIPETHIS_KEYSERVER environment variable, then the default HKP server.
+func keyserverSpec(flagValue string) string {
+	if flagValue != "" {
+		return flagValue
+	}
+
+	if env := os.Getenv("PIPETHIS_KEYSERVER"); env != "" {
+		return env
+	}
+
+	return lookup.DefaultHKPServer
+}
+
+// checkOnly verifies signature, prints the result to out in format, and
+// returns the exit code: 0 if the signature is good, 1 otherwise.
+func checkOnly(out io.Writer, format string, result Result, signature *Signature) int {
+	result.Verification = signature.Check()
+	if err := printResult(out, format, result); err != nil {
+		log.Println(err)
+		return 1
+	}
 
-		return matches[1]
+	if !result.Verification.OK() {
+		return 1
 	}
 
-	return ""
+	return 0
 }
 
-// getFile tries to find location locally first, then tries remote
-func getFile(location string) (io.ReadCloser, error) {
-	if location == "" {
+// sourceTimeout is how long fetching a remote script or signature can take.
+const sourceTimeout = 30 * time.Second
+
+// sourceClient fetches remote scripts and signatures.
+var sourceClient = &http.Client{Timeout: sourceTimeout, CheckRedirect: checkRedirect}
+
+// allowInsecureSource lets remote scripts and signatures come from plain
+// http:// URLs.
+var allowInsecureSource = false
+
+// offlineMode keeps resolveSource (and the key lookup) off the network.
+var offlineMode = false
+
+// keyProxy is the proxy the key lookups go through, if it's set.
+var keyProxy *url.URL
+
+// keyClient makes the requests for the key lookups, if it's set. It's only set
+// in tests.
+var keyClient *http.Client
+
+// maxSourceSize is the most that's read from a script or signature, so a
+// runaway download can't eat all the memory (or the disk).
+var maxSourceSize int64 = 10 << 20
+
+// resolveSource reads the whole script or signature at arg, which can be "-"
+// (or empty) for STDIN, a local path, a file:// URL, or an https:// URL
+// (http:// too, if allowInsecureSource is set). The contents are read up
+// front, so the returned reader doesn't need the original source anymore. If
+// there's more than maxSourceSize bytes, resolveSource gives up.
+func resolveSource(arg string) (io.ReadCloser, error) {
+	body, err := openSource(arg)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	contents, err := ioutil.ReadAll(limitSource(body, arg))
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(contents)), nil
+}
+
+// openSource opens the script or signature at arg, from the same places as
+// resolveSource, without reading any of it.
+func openSource(arg string) (io.ReadCloser, error) {
+	switch parsed, err := url.Parse(arg); {
+	case arg == "" || arg == "-":
 		return getFromStdin()
+	case err == nil && parsed.Scheme == "file":
+		return getLocal(parsed.Path)
 	}
 
-	body, err := getLocal(location)
-	if err == nil {
+	if body, err := getLocal(arg); err == nil {
 		return body, nil
 	}
 
-	return getRemote(location)
+	return getRemote(arg)
+}
+
+// limitSource reads body, the source at arg, until there's been more than
+// maxSourceSize bytes, and then fails.
+func limitSource(body io.Reader, arg string) io.Reader {
+	// one byte past the limit is enough to know it's too big
+	return &sizeLimiter{r: io.LimitReader(body, maxSourceSize+1), name: sourceName(arg), limit: maxSourceSize}
+}
+
+// sizeLimiter is the reader from limitSource.
+type sizeLimiter struct {
+	r     io.Reader
+	name  string
+	limit int64
+	read  int64
+}
+
+func (l *sizeLimiter) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+	if l.read > l.limit {
+		return n, fmt.Errorf("%s is bigger than the %d byte limit (see -max-download-size)", l.name, l.limit)
+	}
+
+	return n, err
+}
+
+// sourceName is how resolveSource refers to arg in errors.
+func sourceName(arg string) string {
+	if arg == "" || arg == "-" {
+		return "STDIN"
+	}
+
+	return arg
 }
 
 func getFromStdin() (io.ReadCloser, error) {
@@ -175,14 +680,55 @@ func getRemote(location string) (io.ReadCloser, error) {
 		return nil, errors.New("Invalid URL")
 	}
 
-	resp, err := http.Get(location)
+	if offlineMode {
+		return nil, fmt.Errorf("%w: won't fetch %s", lookup.ErrOffline, location)
+	}
+
+	if err := checkTransport(parsed); err != nil {
+		return nil, err
+	}
+
+	resp, err := sourceClient.Get(location)
 	if err != nil {
 		return nil, err
 	}
 
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, errors.New("Couldn't fetch " + location + ": " + resp.Status)
+	}
+
+	// an HTML page is usually an error page or a login screen, not a script
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType == "text/html" {
+		log.Println("Warning:", location, "looks like an HTML page, not a script or signature")
+	}
+
 	return resp.Body, nil
 }
 
+// checkTransport refuses anything but HTTPS, unless allowInsecureSource is
+// set.
+func checkTransport(location *url.URL) error {
+	switch {
+	case location.Scheme == "https":
+	case location.Scheme == "http" && allowInsecureSource:
+	default:
+		return errors.New("Refusing to fetch " + location.String() + " without HTTPS (set -insecure-transport to allow it)")
+	}
+
+	return nil
+}
+
+// checkRedirect runs checkTransport on every redirect, so an HTTPS URL can't
+// hand us off to plain HTTP.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("Stopped after 10 redirects")
+	}
+
+	return checkTransport(req.URL)
+}
+
 func getLocal(location string) (io.ReadCloser, error) {
 	if _, err := os.Stat(location); os.IsNotExist(err) {
 		return nil, err
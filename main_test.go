@@ -0,0 +1,1015 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/ellotheth/pipethis/lookup"
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+type MainTest struct {
+	suite.Suite
+	dir    string
+	author *openpgp.Entity
+	other  *openpgp.Entity
+}
+
+func (s *MainTest) SetupSuite() {
+	var err error
+	config := &packet.Config{RSABits: 1024}
+
+	s.author, err = openpgp.NewEntity("Author", "", "author@example.com", config)
+	s.Require().NoError(err)
+	s.other, err = openpgp.NewEntity("Other", "", "other@example.com", config)
+	s.Require().NoError(err)
+}
+
+func (s *MainTest) SetupTest() {
+	s.dir, _ = ioutil.TempDir("", "pipethis-test-")
+}
+
+func (s *MainTest) TearDownTest() {
+	os.RemoveAll(s.dir)
+}
+
+// signedScript writes a script that leaves a marker file behind if it's ever
+// run, and a detached signature for it from signer.
+func (s *MainTest) signedScript(signer *openpgp.Entity) (*Signature, string) {
+	marker := s.dir + "/ran"
+	contents := "#!/bin/sh\n# PIPETHIS_AUTHOR author\ntouch " + marker + "\n"
+
+	script := &Script{filename: s.dir + "/script.sh"}
+	s.Require().NoError(ioutil.WriteFile(script.Name(), []byte(contents), 0700))
+
+	sig := &bytes.Buffer{}
+	s.Require().NoError(openpgp.DetachSign(sig, signer, strings.NewReader(contents), nil))
+
+	signature := NewSignature(openpgp.EntityList{s.author}, script, "")
+	s.Require().NoError(ioutil.WriteFile(signature.Name(), sig.Bytes(), 0600))
+
+	return signature, marker
+}
+
+func (s *MainTest) TestCheckOnlySucceedsWithGoodSignature() {
+	signature, marker := s.signedScript(s.author)
+	out := &bytes.Buffer{}
+
+	s.Equal(0, checkOnly(out, "text", Result{}, signature))
+	s.True(strings.HasPrefix(out.String(), "Signature valid, signer "), out.String())
+	s.Contains(out.String(), "Author <author@example.com>")
+
+	_, err := os.Stat(marker)
+	s.True(os.IsNotExist(err), "the script was run")
+}
+
+func (s *MainTest) TestCheckOnlyFailsWithUnknownSigner() {
+	signature, marker := s.signedScript(s.other)
+	out := &bytes.Buffer{}
+
+	s.Equal(1, checkOnly(out, "text", Result{}, signature))
+	s.True(strings.HasPrefix(out.String(), "No matching key: "), out.String())
+
+	_, err := os.Stat(marker)
+	s.True(os.IsNotExist(err), "the script was run")
+}
+
+func (s *MainTest) TestCheckOnlyFailsWithBadSignature() {
+	signature, marker := s.signedScript(s.author)
+	ioutil.WriteFile(signature.script.Name(), []byte("#!/bin/sh\ntouch "+marker+"\nrm -rf ~\n"), 0700)
+	out := &bytes.Buffer{}
+
+	s.Equal(1, checkOnly(out, "text", Result{}, signature))
+	s.True(strings.HasPrefix(out.String(), "Bad signature: "), out.String())
+
+	_, err := os.Stat(marker)
+	s.True(os.IsNotExist(err), "the script was run")
+}
+
+func (s *MainTest) TestVerifyRejectsUnexpectedIdentity() {
+	signature, _ := s.signedScript(s.author)
+
+	signature.Verifier().RequireEmail = "author@example.com"
+	s.NoError(signature.Verify())
+
+	signature.Verifier().RequireEmail = "jane@example.com"
+	err := signature.Verify()
+	s.EqualError(err, "Failed to verify signature: Signing key doesn't have the required identity: jane@example.com")
+}
+
+func (s *MainTest) TestInlineKeyIsTheOnlyTrustSource() {
+	armored := &bytes.Buffer{}
+	s.Require().NoError(writeKey(armored, s.author))
+	keyfile := s.dir + "/author.asc"
+	s.Require().NoError(ioutil.WriteFile(keyfile, armored.Bytes(), 0600))
+
+	sources := map[string]string{
+		"file":   keyfile,
+		"inline": armored.String(),
+		"stdin":  "-",
+	}
+
+	for name, value := range sources {
+		service, err := inlineKeyService(value, bytes.NewReader(armored.Bytes()))
+		s.Require().NoError(err, name)
+
+		_, key, err := lookup.Find(context.Background(), service, "author", true)
+		s.Require().NoError(err, name)
+
+		signature, _ := s.signedScript(s.author)
+		signature.key = key
+		s.NoError(signature.Verify(), name)
+
+		// the inline key didn't sign this one
+		signature, _ = s.signedScript(s.other)
+		signature.key = key
+		s.Error(signature.Verify(), name)
+	}
+}
+
+func (s *MainTest) TestInlineKeyHasToParse() {
+	_, err := inlineKeyService("-", strings.NewReader("not a key"))
+	s.Error(err)
+	s.Contains(err.Error(), "Couldn't parse the -key")
+
+	_, err = inlineKeyService("-----BEGIN PGP PUBLIC KEY BLOCK-----\n\nnope\n-----END PGP PUBLIC KEY BLOCK-----\n", nil)
+	s.Error(err)
+
+	_, err = inlineKeyService(s.dir+"/missing.asc", nil)
+	s.True(os.IsNotExist(err), err)
+}
+
+// hookCommand is an -after-verify hook that writes the signer, its
+// arguments, and the script it was handed to out.
+func hookCommand(out string) []string {
+	return []string{"/bin/sh", "-c", `printf '%s\n' "$` + signerEnv + `" "$1" > ` + out + `; cat "$0" >> ` + out}
+}
+
+func (s *MainTest) TestRunScriptHandsVerifiedScriptToHook() {
+	signature, marker := s.signedScript(s.author)
+	s.Require().NoError(signature.Verify())
+	fingerprint := fmt.Sprintf("%X", s.author.PrimaryKey.Fingerprint)
+	out := s.dir + "/hook"
+
+	err := runScript(signature.script, nil, []string{"/bin/sh"}, hookCommand(out), fingerprint, []string{"script.sh", "extra"})
+	s.NoError(err)
+
+	handed, err := ioutil.ReadFile(out)
+	s.NoError(err)
+	s.Equal(fingerprint+"\nextra\n#!/bin/sh\n# PIPETHIS_AUTHOR author\ntouch "+marker+"\n", string(handed))
+
+	// the hook got the script, and the script itself never ran
+	_, err = os.Stat(marker)
+	s.True(os.IsNotExist(err), "the script was run")
+}
+
+func (s *MainTest) TestRunScriptNeverHooksUnverifiedScripts() {
+	signature, marker := s.signedScript(s.other)
+	s.Require().Error(signature.Verify())
+	out := s.dir + "/hook"
+
+	// a failed verification never sets the signer
+	err := runScript(signature.script, nil, []string{"/bin/sh"}, hookCommand(out), "", []string{"script.sh"})
+	s.EqualError(err, "Not handing an unverified script to -after-verify")
+
+	for _, never := range []string{out, marker} {
+		_, err = os.Stat(never)
+		s.True(os.IsNotExist(err), never)
+	}
+}
+
+func (s *MainTest) TestCheckOnlyPrintsJSON() {
+	signature, _ := s.signedScript(s.other)
+	result := Result{
+		Author: "author",
+		Match:  lookup.User{Fingerprint: "DEADBEEF", Emails: []string{"b@example.com", "a@example.com"}},
+	}
+	out := &bytes.Buffer{}
+
+	s.Equal(1, checkOnly(out, "json", result, signature))
+
+	decoded := map[string]interface{}{}
+	s.Require().NoError(json.Unmarshal(out.Bytes(), &decoded))
+	s.Equal("author", decoded["author"])
+	s.Equal([]interface{}{"a@example.com", "b@example.com"}, decoded["match"].(map[string]interface{})["emails"])
+
+	verification := decoded["verification"].(map[string]interface{})
+	s.Equal(false, verification["valid"])
+	s.Equal("no_matching_key", verification["outcome"])
+	s.NotEmpty(verification["error"])
+}
+
+func (s *MainTest) TestKeyserverSpecPrecedence() {
+	env := os.Getenv("PIPETHIS_KEYSERVER")
+	defer os.Setenv("PIPETHIS_KEYSERVER", env)
+
+	os.Unsetenv("PIPETHIS_KEYSERVER")
+	s.Equal(lookup.DefaultHKPServer, keyserverSpec(""))
+	s.Equal("vks", keyserverSpec("vks"))
+
+	os.Setenv("PIPETHIS_KEYSERVER", "wkd")
+	s.Equal("wkd", keyserverSpec(""))
+	s.Equal("vks", keyserverSpec("vks"))
+}
+
+func (s *MainTest) TestNewKeyServiceUsesKeyserverForRemote() {
+	service, err := newKeyService("remote", "wkd", false)
+	s.NoError(err)
+	s.IsType(&lookup.WKDService{}, service)
+
+	service, err = newKeyService("keybase", "wkd", false)
+	s.NoError(err)
+	s.IsType(&lookup.KeybaseService{}, service)
+
+	_, err = newKeyService("remote", "nonsense", false)
+	s.Error(err)
+}
+
+func (s *MainTest) TestOfflineModeOnlyAllowsLocalServices() {
+	offlineMode = true
+	defer func() { offlineMode = false }()
+
+	for _, name := range []string{"keybase", "hkp", "remote"} {
+		_, err := newKeyService(name, "wkd", false)
+		s.True(errors.Is(err, lookup.ErrOffline), name)
+		s.Contains(err.Error(), "offline mode", name)
+	}
+
+	// a piped script uses the local keyring anyway, so it's allowed
+	_, err := newKeyService("keybase", "wkd", true)
+	s.False(errors.Is(err, lookup.ErrOffline), err)
+}
+
+func (s *MainTest) TestPrintKeyRoundTrips() {
+	service, err := lookup.NewLocalPGPServiceFromPath("lookup/testdata/pubring.gpg")
+	s.Require().NoError(err)
+	_, key, err := lookup.Find(context.Background(), service, "test@example.com", true)
+	s.Require().NoError(err)
+
+	filename := s.dir + "/key.asc"
+	s.NoError(printKey(filename, key[0]))
+
+	contents, _ := ioutil.ReadFile(filename)
+	s.True(strings.HasPrefix(string(contents), "-----BEGIN PGP PUBLIC KEY BLOCK-----"))
+
+	ring, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(contents))
+	s.NoError(err)
+	s.Len(ring, 1)
+	s.Equal(key[0].PrimaryKey.Fingerprint, ring[0].PrimaryKey.Fingerprint)
+}
+
+func (s *MainTest) TestPrintKeyExportsTheWholeKey() {
+	// the author has an encryption subkey, which Key trims off
+	service := lookup.NewMemoryService(openpgp.EntityList{s.author})
+	match, key, err := lookup.Find(context.Background(), service, "author@example.com", true)
+	s.Require().NoError(err)
+	s.Empty(key[0].Subkeys)
+
+	full, err := lookup.FullKey(context.Background(), service, match)
+	s.Require().NoError(err)
+
+	filename := s.dir + "/key.asc"
+	s.NoError(printKey(filename, full[0]))
+
+	contents, _ := ioutil.ReadFile(filename)
+	ring, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(contents))
+	s.Require().NoError(err)
+	s.Require().Len(ring, 1)
+	s.Len(ring[0].Subkeys, len(s.author.Subkeys))
+	s.Equal(s.author.Subkeys[0].PublicKey.Fingerprint, ring[0].Subkeys[0].PublicKey.Fingerprint)
+}
+
+func (s *MainTest) TestImportKeyImportsTheWholeKey() {
+	service := lookup.NewMemoryService(openpgp.EntityList{s.author})
+	match, _, err := lookup.Find(context.Background(), service, "author@example.com", true)
+	s.Require().NoError(err)
+
+	full, err := lookup.FullKey(context.Background(), service, match)
+	s.Require().NoError(err)
+
+	ringpath := s.dir + "/pubring.gpg"
+	added, err := lookup.ImportKeys(ringpath, full)
+	s.Require().NoError(err)
+	s.Equal(1, added)
+
+	// and it's the whole key that comes back out of the keyring
+	imported, err := lookup.NewLocalPGPServiceFromPath(ringpath)
+	s.Require().NoError(err)
+	ring, err := lookup.FullKey(context.Background(), imported, match)
+	s.Require().NoError(err)
+	s.Len(ring[0].Subkeys, len(s.author.Subkeys))
+}
+
+func (s *MainTest) TestParseArgsSplitsAtDoubleDash() {
+	newFlags := func() (*flag.FlagSet, *bool) {
+		flags := flag.NewFlagSet("pipethis", flag.ContinueOnError)
+		flags.SetOutput(ioutil.Discard)
+		return flags, flags.Bool("yes", false, "")
+	}
+
+	flags, yes := newFlags()
+	location, scriptArgs, err := parseArgs(flags, []string{"-yes", "install.sh", "--", "--prefix=/opt", "-yes", "two words"})
+	s.NoError(err)
+	s.True(*yes)
+	s.Equal("install.sh", location)
+	s.Equal([]string{"--prefix=/opt", "-yes", "two words"}, scriptArgs)
+
+	// flags after the script are still pipethis's
+	flags, yes = newFlags()
+	location, scriptArgs, err = parseArgs(flags, []string{"install.sh", "-yes", "--", "-x"})
+	s.NoError(err)
+	s.True(*yes)
+	s.Equal("install.sh", location)
+	s.Equal([]string{"-x"}, scriptArgs)
+
+	flags, _ = newFlags()
+	location, scriptArgs, err = parseArgs(flags, []string{"-", "extra"})
+	s.NoError(err)
+	s.Equal("-", location)
+	s.Equal([]string{"extra"}, scriptArgs)
+
+	flags, _ = newFlags()
+	_, _, err = parseArgs(flags, []string{"install.sh", "-unknown"})
+	s.Error(err)
+}
+
+func (s *MainTest) TestInterpreterThenShebangThenShell() {
+	shell := os.Getenv("SHELL")
+	defer os.Setenv("SHELL", shell)
+	os.Setenv("SHELL", "/bin/false")
+
+	// the flags the same way main sets them up: -target defaults to $SHELL
+	flags := flag.NewFlagSet("pipethis", flag.ContinueOnError)
+	target := flags.String("target", os.Getenv("SHELL"), "")
+	interpreter := flags.String("interpreter", "", "")
+	_, _, err := parseArgs(flags, []string{"-interpreter", "sh", "install.sh"})
+	s.Require().NoError(err)
+	s.Equal("/bin/false", *target)
+
+	run := func(contents string, override []string) error {
+		marker := s.dir + "/ran"
+		os.Remove(marker)
+		script := &Script{source: "install.sh", filename: s.dir + "/install.sh", contents: []byte(contents + "touch " + marker + "\n")}
+		if err := runScript(script, override, []string{*target}, nil, "", []string{"install.sh"}); err != nil {
+			return err
+		}
+		_, err := os.Stat(marker)
+		return err
+	}
+
+	override, err := interpreterCommand(*interpreter)
+	s.Require().NoError(err)
+
+	// the flag beats the shebang
+	s.NoError(run("#!/bin/false\n", override))
+
+	// the shebang beats $SHELL
+	s.NoError(run("#!/bin/sh\n", nil))
+
+	// and $SHELL is all that's left without either
+	s.Error(run("", nil))
+}
+
+func (s *MainTest) TestWKDFindsTheScriptsAuthor() {
+	key, err := ioutil.ReadFile("lookup/testdata/pubring.gpg")
+	s.Require().NoError(err)
+
+	hosts := []string{}
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hosts = append(hosts, r.Host)
+		w.Write(key)
+	}))
+	defer server.Close()
+
+	// every key lookup goes to server, whatever the host
+	defer func(client *http.Client) { keyClient = client }(keyClient)
+	keyClient = &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial("tcp", server.Listener.Addr().String())
+		},
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+
+	for _, keyserver := range []string{"wkd", "wkd+vks"} {
+		for _, declared := range []string{"test@example.com", "Pipethis Test <test@example.com>"} {
+			hosts = hosts[:0]
+
+			flags := flag.NewFlagSet("pipethis", flag.ContinueOnError)
+			spec := flags.String("keyserver", "", "")
+			_, _, err := parseArgs(flags, []string{"-keyserver", keyserver, "install.sh"})
+			s.Require().NoError(err)
+
+			script := &Script{source: "install.sh", filename: s.dir + "/install.sh", contents: []byte("#!/bin/sh\n# PIPETHIS_AUTHOR " + declared + "\necho hi\n")}
+			author, err := script.Author()
+			s.Require().NoError(err)
+			s.Equal(declared, author)
+
+			service, err := newKeyService("remote", keyserverSpec(*spec), false)
+			s.Require().NoError(err)
+
+			match, ring, err := lookup.Find(context.Background(), service, author, true)
+			s.Require().NoError(err, keyserver+": "+declared)
+			s.Equal("2DEC361C395B52E763A95873A018A3D90DC0FA52", match.Fingerprint)
+			s.Len(ring, 1)
+			s.Equal([]string{"openpgpkey.example.com"}, hosts, keyserver+": "+declared)
+		}
+	}
+}
+
+func (s *MainTest) TestScriptArgsReachTheScript() {
+	out := s.dir + "/args.txt"
+	contents := "for arg in \"$@\"; do echo \"[$arg]\"; done > " + out + "\n"
+	script := &Script{filename: s.dir + "/args.sh", contents: []byte(contents)}
+
+	flags := flag.NewFlagSet("pipethis", flag.ContinueOnError)
+	location, scriptArgs, err := parseArgs(flags, []string{"args.sh", "--", "--prefix=/opt", "two words", "-v"})
+	s.Require().NoError(err)
+
+	s.NoError(script.Run(nil, []string{"/bin/sh"}, append([]string{location}, scriptArgs...)...))
+
+	ran, err := ioutil.ReadFile(out)
+	s.NoError(err)
+	s.Equal("[--prefix=/opt]\n[two words]\n[-v]\n", string(ran))
+}
+
+func (s *MainTest) TestCheckOutputRejectsUnknownFormats() {
+	s.NoError(checkOutput("text"))
+	s.NoError(checkOutput("json"))
+	s.Error(checkOutput("yaml"))
+}
+
+func (s *MainTest) TestBigScriptsAreStreamed() {
+	const size = 32 << 20
+
+	// a big installer: a comment line, over and over
+	line := []byte("# installing...............................................\n")
+	filename := s.dir + "/install.sh"
+	file, err := os.Create(filename)
+	s.Require().NoError(err)
+	for written := 0; written < size; written += len(line) {
+		_, err = file.Write(line)
+		s.Require().NoError(err)
+	}
+	s.Require().NoError(file.Close())
+
+	sig := &bytes.Buffer{}
+	file, err = os.Open(filename)
+	s.Require().NoError(err)
+	s.Require().NoError(openpgp.DetachSign(sig, s.author, file, nil))
+	file.Close()
+
+	limit := maxSourceSize
+	maxSourceSize = 2 * size
+	defer func() { maxSourceSize = limit }()
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	script, err := NewScript(filename)
+	s.Require().NoError(err)
+	defer script.Remove()
+
+	signature := NewSignature(openpgp.EntityList{s.author}, script, "")
+	s.Require().NoError(ioutil.WriteFile(signature.Name(), sig.Bytes(), 0600))
+	defer os.Remove(signature.Name())
+	s.Require().NoError(signature.Verify())
+
+	runtime.ReadMemStats(&after)
+	s.Nil(script.contents)
+	s.Less(after.TotalAlloc-before.TotalAlloc, uint64(size/8), "the script was buffered")
+
+	// "running" it with cp shows what would have been run
+	ran := s.dir + "/ran.sh"
+	s.Require().NoError(script.Run([]string{"/bin/cp"}, nil, filename, ran))
+	original, err := os.Stat(filename)
+	s.Require().NoError(err)
+	copied, err := os.Stat(ran)
+	s.Require().NoError(err)
+	s.Equal(original.Size(), copied.Size())
+}
+
+func (s *MainTest) TestScriptCommandReadsTheInspectedShebang() {
+	original := s.dir + "/original.sh"
+	s.Require().NoError(ioutil.WriteFile(original, []byte("#!/bin/sh\necho hi\n"), 0600))
+
+	script, err := NewScript(original)
+	s.Require().NoError(err)
+	defer script.Remove()
+
+	// the "editor" swaps in a different shebang
+	editor := s.dir + "/editor.sh"
+	s.Require().NoError(ioutil.WriteFile(editor, []byte("#!/bin/sh\nprintf '#!/bin/cat\\necho hi\\n' > \"$1\"\n"), 0700))
+	s.Require().True(script.Inspect(true, editor, &fakePrompter{answer: true}))
+
+	command, err := scriptCommand(script, nil, []string{"/bin/sh"}, nil)
+	s.Require().NoError(err)
+	s.Equal([]string{"/bin/cat"}, command)
+
+	// a hook, or a piped script, doesn't need the shebang at all
+	command, err = scriptCommand(script, nil, []string{"/bin/sh"}, []string{"/bin/true"})
+	s.NoError(err)
+	s.Equal([]string{"/bin/true"}, command)
+
+	command, err = scriptCommand(&Script{}, nil, []string{"/bin/sh"}, nil)
+	s.NoError(err)
+	s.Nil(command)
+
+	_, err = scriptCommand(script, []string{"/no/such/interpreter"}, nil, nil)
+	s.EqualError(err, "Script executable does not exist")
+}
+
+func (s *MainTest) TestRunsExactlyTheVerifiedScript() {
+	signed := "#!/bin/sh\n# PIPETHIS_AUTHOR author\necho signed\n"
+
+	requests := 0
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.Write([]byte(signed))
+			return
+		}
+		w.Write([]byte("#!/bin/sh\necho switched\n"))
+	}))
+	defer server.Close()
+
+	client := sourceClient
+	sourceClient = server.Client()
+	defer func() { sourceClient = client }()
+
+	script, err := NewScript(server.URL + "/install.sh")
+	s.Require().NoError(err)
+	defer os.Remove(script.Name())
+
+	sig := &bytes.Buffer{}
+	s.Require().NoError(openpgp.DetachSign(sig, s.author, strings.NewReader(signed), nil))
+	signature := NewSignature(openpgp.EntityList{s.author}, script, "")
+	s.Require().NoError(ioutil.WriteFile(signature.Name(), sig.Bytes(), 0600))
+	defer os.Remove(signature.Name())
+
+	// somebody swaps the script out from under us after it's downloaded,
+	// which verifying catches
+	s.Require().NoError(ioutil.WriteFile(script.Name(), []byte("#!/bin/sh\necho tampered\n"), 0600))
+	s.Error(signature.Verify())
+
+	s.Require().NoError(ioutil.WriteFile(script.Name(), []byte(signed), 0600))
+	s.NoError(signature.Verify())
+
+	// or after it's verified, which doesn't change what runs
+	s.Require().NoError(ioutil.WriteFile(script.Name(), []byte("#!/bin/sh\necho tampered\n"), 0600))
+
+	// "running" it with cp shows what would have been run
+	ran := s.dir + "/ran.sh"
+	s.NoError(script.Run([]string{"/bin/cp"}, nil, server.URL+"/install.sh", ran))
+
+	contents, err := ioutil.ReadFile(ran)
+	s.NoError(err)
+	s.Equal(signed, string(contents))
+	s.Equal(1, requests)
+}
+
+// fakePrompter answers every question with answer (or err), and remembers
+// what it was asked.
+type fakePrompter struct {
+	answer   bool
+	err      error
+	messages []string
+}
+
+func (f *fakePrompter) Confirm(msg string) (bool, error) {
+	f.messages = append(f.messages, msg)
+	return f.answer, f.err
+}
+
+func (f *fakePrompter) Choose(options []string) (int, error) {
+	return 0, errors.New("Nothing to choose")
+}
+
+func (s *MainTest) TestConfirmNeedsYes() {
+	tests := map[string]bool{
+		"y\n":     true,
+		"YES\n":   true,
+		" y ":     true,
+		"n\n":     false,
+		"\n":      false,
+		"":        false,
+		"yep, ok": false,
+	}
+
+	for input, expected := range tests {
+		var out bytes.Buffer
+		actual := confirm(&lookup.TerminalPrompter{In: strings.NewReader(input), Out: &out}, s.author, "/bin/sh")
+
+		s.Equal(expected, actual, input)
+		s.Contains(out.String(), lookup.FormatFingerprint(fmt.Sprintf("%X", s.author.PrimaryKey.Fingerprint)), input)
+		s.Contains(out.String(), "Author <author@example.com>", input)
+		s.Contains(out.String(), "Run it with /bin/sh? (y/N)", input)
+	}
+}
+
+func (s *MainTest) TestConfirmAsksThePrompter() {
+	prompter := &fakePrompter{answer: true}
+	s.True(confirm(prompter, s.author, "/bin/sh"))
+	s.Require().Len(prompter.messages, 1)
+	s.Contains(prompter.messages[0], "Author <author@example.com>")
+
+	s.False(confirm(&fakePrompter{answer: false}, s.author, "/bin/sh"))
+	s.False(confirm(&fakePrompter{answer: true, err: errors.New("Closed the window")}, s.author, "/bin/sh"))
+}
+
+func (s *MainTest) readSource(arg string) (string, error) {
+	body, err := resolveSource(arg)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	contents, err := ioutil.ReadAll(body)
+	return string(contents), err
+}
+
+func (s *MainTest) TestResolveSourceReadsStdin() {
+	reader, writer, err := os.Pipe()
+	s.Require().NoError(err)
+
+	stdin := os.Stdin
+	os.Stdin = reader
+	defer func() { os.Stdin = stdin }()
+
+	writer.WriteString("echo from stdin\n")
+	writer.Close()
+
+	contents, err := s.readSource("-")
+	s.NoError(err)
+	s.Equal("echo from stdin\n", contents)
+}
+
+func (s *MainTest) TestResolveSourceReadsLocalFiles() {
+	filename := s.dir + "/local.sh"
+	ioutil.WriteFile(filename, []byte("echo local\n"), 0600)
+
+	for _, arg := range []string{filename, "file://" + filename} {
+		contents, err := s.readSource(arg)
+		s.NoError(err, arg)
+		s.Equal("echo local\n", contents, arg)
+	}
+
+	_, err := s.readSource("file://" + s.dir + "/missing.sh")
+	s.Error(err)
+}
+
+func (s *MainTest) TestResolveSourceReadsHTTPS() {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/install.sh" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("echo remote\n"))
+	}))
+	defer server.Close()
+
+	client := sourceClient
+	sourceClient = server.Client()
+	defer func() { sourceClient = client }()
+
+	contents, err := s.readSource(server.URL + "/install.sh")
+	s.NoError(err)
+	s.Equal("echo remote\n", contents)
+
+	_, err = s.readSource(server.URL + "/missing.sh")
+	s.Error(err)
+}
+
+func (s *MainTest) TestResolveSourceLimitsSize() {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.Repeat([]byte("#"), 1024))
+	}))
+	defer server.Close()
+
+	client := sourceClient
+	sourceClient = server.Client()
+	defer func() { sourceClient = client }()
+
+	size := maxSourceSize
+	defer func() { maxSourceSize = size }()
+
+	maxSourceSize = 1024
+	contents, err := s.readSource(server.URL + "/install.sh")
+	s.NoError(err)
+	s.Len(contents, 1024)
+
+	maxSourceSize = 1023
+	_, err = s.readSource(server.URL + "/install.sh")
+	s.EqualError(err, server.URL+"/install.sh is bigger than the 1023 byte limit (see -max-download-size)")
+
+	// a script streamed to disk has the same limit
+	_, err = NewScript(server.URL + "/install.sh")
+	s.EqualError(err, server.URL+"/install.sh is bigger than the 1023 byte limit (see -max-download-size)")
+}
+
+func (s *MainTest) TestResolveSourceWarnsAboutHTML() {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/login" {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write([]byte("<html>Please log in</html>"))
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("echo remote\n"))
+	}))
+	defer server.Close()
+
+	client := sourceClient
+	sourceClient = server.Client()
+	defer func() { sourceClient = client }()
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	_, err := s.readSource(server.URL + "/install.sh")
+	s.NoError(err)
+	s.Empty(logged.String())
+
+	_, err = s.readSource(server.URL + "/login")
+	s.NoError(err)
+	s.Contains(logged.String(), "Warning: "+server.URL+"/login looks like an HTML page")
+}
+
+func (s *MainTest) TestResolveSourceRejectsPlainHTTP() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("echo insecure\n"))
+	}))
+	defer server.Close()
+
+	_, err := s.readSource(server.URL + "/install.sh")
+	s.EqualError(err, "Refusing to fetch "+server.URL+"/install.sh without HTTPS (set -insecure-transport to allow it)")
+
+	allowInsecureSource = true
+	defer func() { allowInsecureSource = false }()
+
+	contents, err := s.readSource(server.URL + "/install.sh")
+	s.NoError(err)
+	s.Equal("echo insecure\n", contents)
+}
+
+func (s *MainTest) TestRunDoctorReportsTheKeyring() {
+	offlineMode = true
+	defer func() { offlineMode = false }()
+	defer os.Setenv("GNUPGHOME", os.Getenv("GNUPGHOME"))
+
+	os.Setenv("GNUPGHOME", "lookup/testdata/secrethome")
+	out := &bytes.Buffer{}
+	s.Equal(0, runDoctor(out, "vks"))
+	s.Contains(out.String(), "Keyring: lookup/testdata/secrethome/pubring.gpg\n")
+
+	os.Setenv("GNUPGHOME", s.dir)
+	out.Reset()
+	s.Equal(1, runDoctor(out, "vks"))
+	s.Contains(out.String(), "- There's no keyring at "+s.dir+"/pubring.gpg.")
+}
+
+func (s *MainTest) TestResolveSourceStaysOfflineInOfflineMode() {
+	requests := 0
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte("echo online\n"))
+	}))
+	defer server.Close()
+	defer func(client *http.Client) { sourceClient = client }(sourceClient)
+	sourceClient = server.Client()
+
+	offlineMode = true
+	defer func() { offlineMode = false }()
+
+	_, err := s.readSource(server.URL + "/install.sh")
+	s.True(errors.Is(err, lookup.ErrOffline), err)
+	s.Zero(requests)
+
+	// and the signature says why it couldn't be fetched
+	script := &Script{source: server.URL + "/install.sh", filename: s.dir + "/install.sh", contents: []byte("echo hi\n")}
+	signature := NewSignature(nil, script, "")
+	defer os.Remove(signature.Name())
+	err = signature.Verify()
+	s.True(errors.Is(err, lookup.ErrOffline), err)
+
+	// local files are still fine
+	filename := s.dir + "/local.sh"
+	ioutil.WriteFile(filename, []byte("echo local\n"), 0600)
+
+	contents, err := s.readSource(filename)
+	s.NoError(err)
+	s.Equal("echo local\n", contents)
+}
+
+func (s *MainTest) TestResolveSourceRejectsDowngradedRedirects() {
+	insecure := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("echo downgraded\n"))
+	}))
+	defer insecure.Close()
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, insecure.URL+"/install.sh", http.StatusMovedPermanently)
+	}))
+	defer server.Close()
+
+	client := sourceClient
+	sourceClient = server.Client()
+	sourceClient.CheckRedirect = checkRedirect
+	defer func() { sourceClient = client }()
+
+	_, err := s.readSource(server.URL + "/install.sh")
+	s.Error(err)
+	s.Contains(err.Error(), "Refusing to fetch "+insecure.URL+"/install.sh without HTTPS")
+
+	allowInsecureSource = true
+	defer func() { allowInsecureSource = false }()
+
+	contents, err := s.readSource(server.URL + "/install.sh")
+	s.NoError(err)
+	s.Equal("echo downgraded\n", contents)
+}
+
+// discoveryServer serves a signed script at /<name>.sh, with its signature at
+// /<name>.sh<ext> for each extension in sigs.
+func (s *MainTest) discoveryServer(sigs map[string][]string) *httptest.Server {
+	contents := "#!/bin/sh\n# PIPETHIS_AUTHOR author\necho hi\n"
+
+	binary := &bytes.Buffer{}
+	s.Require().NoError(openpgp.DetachSign(binary, s.author, strings.NewReader(contents), nil))
+	armored := &bytes.Buffer{}
+	s.Require().NoError(openpgp.ArmoredDetachSign(armored, s.author, strings.NewReader(contents), nil))
+
+	files := map[string][]byte{}
+	for name, exts := range sigs {
+		files["/"+name+".sh"] = []byte(contents)
+		for _, ext := range exts {
+			if ext == ".asc" {
+				files["/"+name+".sh"+ext] = armored.Bytes()
+			} else {
+				files["/"+name+".sh"+ext] = binary.Bytes()
+			}
+		}
+	}
+
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if body, ok := files[r.URL.Path]; ok {
+			w.Write(body)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+}
+
+func (s *MainTest) TestSignatureDiscoveryFindsSiblingSignatures() {
+	server := s.discoveryServer(map[string][]string{
+		"both":    {".sig", ".asc"},
+		"armored": {".asc"},
+		"none":    {},
+	})
+	defer server.Close()
+
+	client := sourceClient
+	sourceClient = server.Client()
+	defer func() { sourceClient = client }()
+
+	tests := map[string]string{
+		"both":    server.URL + "/both.sh.sig",
+		"armored": server.URL + "/armored.sh.asc",
+		"none":    "",
+	}
+
+	for name, expected := range tests {
+		script, err := NewScript(server.URL + "/" + name + ".sh")
+		s.Require().NoError(err)
+		defer os.Remove(script.Name())
+
+		signature := NewSignature(openpgp.EntityList{s.author}, script, "")
+		defer os.Remove(signature.Name())
+
+		err = signature.Verify()
+		if expected == "" {
+			s.EqualError(err, "Couldn't open the signature source file at "+server.URL+"/none.sh.sig or "+server.URL+"/none.sh.asc: "+
+				"Couldn't fetch "+server.URL+"/none.sh.sig: 404 Not Found; Couldn't fetch "+server.URL+"/none.sh.asc: 404 Not Found (do you need to set -signature?)")
+			continue
+		}
+
+		s.NoError(err, name)
+		s.Equal(expected, signature.Source(), name)
+	}
+}
+
+// auditedRun verifies the script behind signature and hands it to a hook
+// that writes it to out, the way main does, keeping track of it in audit.
+func (s *MainTest) auditedRun(audit *AuditLog, signature *Signature, out string) {
+	entry := AuditEntry{Source: "https://example.com/script.sh", Author: "author", Signer: fmt.Sprintf("%X", s.author.PrimaryKey.Fingerprint)}
+	defer func() { audit.finish(&entry, recover()) }()
+
+	if err := signature.Verify(); err != nil {
+		entry.Result = AuditRejected
+		panic(err)
+	}
+	entry.Result = AuditVerified
+
+	entry.Executed = true
+	s.Require().NoError(runScript(signature.script, nil, nil, hookCommand(out), entry.Signer, []string{"script.sh"}))
+}
+
+// readAuditLog is every line in the audit log at filename.
+func (s *MainTest) readAuditLog(filename string) []map[string]interface{} {
+	contents, err := ioutil.ReadFile(filename)
+	s.Require().NoError(err)
+
+	entries := []map[string]interface{}{}
+	for _, line := range strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n") {
+		entry := map[string]interface{}{}
+		s.Require().NoError(json.Unmarshal([]byte(line), &entry), line)
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
+
+func (s *MainTest) TestAuditLogRecordsEveryDecision() {
+	filename := s.dir + "/audit.log"
+	audit, err := OpenAuditLog(filename)
+	s.Require().NoError(err)
+	defer audit.Close()
+
+	signature, _ := s.signedScript(s.author)
+	s.auditedRun(audit, signature, s.dir+"/verified")
+	_, err = os.Stat(s.dir + "/verified")
+	s.NoError(err, "the script wasn't handed over")
+
+	signature, _ = s.signedScript(s.other)
+	s.Panics(func() { s.auditedRun(audit, signature, s.dir+"/rejected") })
+	_, err = os.Stat(s.dir + "/rejected")
+	s.True(os.IsNotExist(err), "the script was handed over")
+
+	entries := s.readAuditLog(filename)
+	s.Require().Len(entries, 2)
+	fingerprint := fmt.Sprintf("%X", s.author.PrimaryKey.Fingerprint)
+
+	s.Equal("https://example.com/script.sh", entries[0]["source"])
+	s.Equal(fingerprint, entries[0]["signer"])
+	s.Equal("verified", entries[0]["result"])
+	s.Equal(true, entries[0]["executed"])
+	s.NotContains(entries[0], "reason")
+	s.NotEmpty(entries[0]["time"])
+
+	s.Equal("https://example.com/script.sh", entries[1]["source"])
+	s.Equal(fingerprint, entries[1]["signer"])
+	s.Equal("rejected", entries[1]["result"])
+	s.Equal(false, entries[1]["executed"])
+	s.Contains(entries[1]["reason"], "Failed to verify signature")
+
+	info, err := os.Stat(filename)
+	s.Require().NoError(err)
+	s.Equal(os.FileMode(0600), info.Mode().Perm())
+}
+
+func (s *MainTest) TestAuditLogAppends() {
+	filename := s.dir + "/audit.log"
+	s.Require().NoError(ioutil.WriteFile(filename, []byte(`{"result":"verified"}`+"\n"), 0600))
+
+	audit, err := OpenAuditLog(filename)
+	s.Require().NoError(err)
+	s.Require().NoError(audit.Record(AuditEntry{Source: "-", Result: AuditUnverified, Executed: true}))
+	audit.Close()
+
+	entries := s.readAuditLog(filename)
+	s.Require().Len(entries, 2)
+	s.Equal("unverified", entries[1]["result"])
+
+	_, err = OpenAuditLog(s.dir + "/missing/audit.log")
+	s.Error(err)
+}
+
+func TestMainTest(t *testing.T) {
+	suite.Run(t, new(MainTest))
+}
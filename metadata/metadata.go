@@ -0,0 +1,309 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+// Package metadata reads the pipethis settings a script author declares in
+// the script's leading comments.
+package metadata
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// DefaultInterpreter is what ParseInterpreter returns for scripts without a
+// shebang line.
+var DefaultInterpreter = []string{"/bin/sh"}
+
+// Parser reads the pipethis markers out of a script's header comments. Its
+// zero value looks for the default markers in "#" and "//" comments and
+// "/* */" blocks; any field that's set replaces its default.
+type Parser struct {
+	// AuthorMarker starts the line naming the author, like
+	// "PIPETHIS_AUTHOR".
+	AuthorMarker string
+
+	// SignatureMarker starts the line giving the signature location, like
+	// "PIPETHIS_SIGNATURE".
+	SignatureMarker string
+
+	// CommentPrefixes are the line comment markers, like "#" and "//".
+	CommentPrefixes []string
+
+	// Blocks are the start and end markers of block comments, like "/*" and
+	// "*/". YAML front matter is a block from "---" to "---".
+	Blocks [][2]string
+}
+
+// Defaults for the Parser fields.
+var (
+	DefaultAuthorMarker    = "PIPETHIS_AUTHOR"
+	DefaultSignatureMarker = "PIPETHIS_SIGNATURE"
+	DefaultCommentPrefixes = []string{"//", "#"}
+	DefaultBlocks          = [][2]string{{"/*", "*/"}}
+)
+
+func (p Parser) commentPrefixes() []string {
+	if len(p.CommentPrefixes) == 0 {
+		return DefaultCommentPrefixes
+	}
+
+	return p.CommentPrefixes
+}
+
+func (p Parser) blocks() [][2]string {
+	if len(p.Blocks) == 0 {
+		return DefaultBlocks
+	}
+
+	return p.Blocks
+}
+
+// headerLines returns the text of the comment lines at the top of r, with the
+// comment markers and surrounding space stripped. Lines inside a block comment
+// are kept too, without a leading "*". Blank lines in the header are skipped,
+// and the header ends at the first line of code.
+func (p Parser) headerLines(r io.Reader) ([]string, error) {
+	lines := []string{}
+	end := ""
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		// inside a block, everything counts until the block ends
+		if end != "" {
+			if idx := strings.Index(line, end); idx >= 0 {
+				line, end = line[:idx], ""
+			}
+			line = strings.TrimSpace(strings.TrimPrefix(line, "*"))
+			if line != "" {
+				lines = append(lines, line)
+			}
+			continue
+		}
+
+		if line == "" {
+			continue
+		}
+
+		if block, ok := p.blockStart(line); ok {
+			line = strings.TrimPrefix(line, block[0])
+			if idx := strings.Index(line, block[1]); idx >= 0 {
+				line = line[:idx]
+			} else {
+				end = block[1]
+			}
+		} else if prefix, ok := p.commentPrefix(line); ok {
+			line = strings.TrimPrefix(line, prefix)
+		} else {
+			return lines, nil
+		}
+
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	return lines, scanner.Err()
+}
+
+// blockStart finds the block comment that line starts, if there is one.
+func (p Parser) blockStart(line string) ([2]string, bool) {
+	for _, block := range p.blocks() {
+		if strings.HasPrefix(line, block[0]) {
+			return block, true
+		}
+	}
+
+	return [2]string{}, false
+}
+
+// commentPrefix finds the comment marker that line starts with, if there is
+// one.
+func (p Parser) commentPrefix(line string) (string, bool) {
+	for _, prefix := range p.commentPrefixes() {
+		if strings.HasPrefix(line, prefix) {
+			return prefix, true
+		}
+	}
+
+	return "", false
+}
+
+// find returns the value after marker in the header comments of the script in
+// r. If marker shows up more than once with different values, find returns an
+// error, since there's no telling which one is right.
+func (p Parser) find(r io.Reader, marker string) (string, error) {
+	lines, err := p.headerLines(r)
+	if err != nil {
+		return "", err
+	}
+
+	pattern := regexp.MustCompile(`^` + regexp.QuoteMeta(marker) + `:?\s+(.+)$`)
+
+	value := ""
+	for _, line := range lines {
+		match := pattern.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+
+		found := strings.TrimSpace(match[1])
+		if value != "" && found != value {
+			return "", fmt.Errorf("Conflicting %s markers: %q and %q", marker, value, found)
+		}
+		value = found
+	}
+
+	return value, nil
+}
+
+// Author finds the author declared in the header comments of the script in r,
+// after the author marker. If there's no author there, Author returns an
+// error, and if there's more than one, it returns a different one.
+func (p Parser) Author(r io.Reader) (string, error) {
+	marker := p.AuthorMarker
+	if marker == "" {
+		marker = DefaultAuthorMarker
+	}
+
+	author, err := p.find(r, marker)
+	if err != nil {
+		return "", err
+	}
+	if author == "" {
+		return "", errors.New("Author not found")
+	}
+
+	return author, nil
+}
+
+// Signature finds the signature location declared in the header comments of
+// the script in r, after the signature marker. If there isn't one, Signature
+// returns "" and no error, since the signature can live somewhere else.
+func (p Parser) Signature(r io.Reader) (string, error) {
+	marker := p.SignatureMarker
+	if marker == "" {
+		marker = DefaultSignatureMarker
+	}
+
+	return p.find(r, marker)
+}
+
+// ParseAuthor finds the author declared in the header comments of the script
+// in r, on a line like
+//
+//	# PIPETHIS_AUTHOR: Jane Doe <jane@example.com>
+//
+// and returns everything after the marker, ready to be used as a key lookup
+// query. Only the comment lines at the top of the script are checked. If
+// there's no author there, ParseAuthor returns an error. It's the same as
+// Parser{}.Author(r).
+func ParseAuthor(r io.Reader) (string, error) {
+	return Parser{}.Author(r)
+}
+
+// ErrNoEmbeddedSignature means the script doesn't carry its own signature in
+// its header.
+var ErrNoEmbeddedSignature = errors.New("No signature in the script header")
+
+const (
+	signatureBegin = "-----BEGIN PGP SIGNATURE-----"
+	signatureEnd   = "-----END PGP SIGNATURE-----"
+)
+
+// EmbeddedSignature splits a script that carries its own armored signature in
+// its header comments, like
+//
+//	#!/bin/sh
+//	# PIPETHIS_AUTHOR jane@example.com
+//	# -----BEGIN PGP SIGNATURE-----
+//	#
+//	# iQEzBAABCgAdFiEE...
+//	# -----END PGP SIGNATURE-----
+//	echo hello
+//
+// into the signed payload and the signature. The payload is script with the
+// signature lines (from the BEGIN line through the END line, line endings
+// included) taken out, and every other byte left exactly as it was; that's
+// what has to be signed. The signature has the comment markers stripped off.
+// Only line comments count, not blocks. If there's no signature before the
+// header ends, EmbeddedSignature returns ErrNoEmbeddedSignature.
+func (p Parser) EmbeddedSignature(script []byte) ([]byte, []byte, error) {
+	payload := []byte{}
+	signature := &bytes.Buffer{}
+	inSignature := false
+
+	lines := bytes.SplitAfter(script, []byte("\n"))
+	for i, line := range lines {
+		text := strings.TrimSpace(string(line))
+		prefix, isComment := p.commentPrefix(text)
+		if isComment {
+			text = strings.TrimSpace(strings.TrimPrefix(text, prefix))
+		}
+
+		switch {
+		case inSignature && !isComment:
+			return nil, nil, errors.New("The signature in the script header isn't finished")
+		case inSignature:
+			signature.WriteString(text + "\n")
+			if text == signatureEnd {
+				// the rest of the script is left alone
+				payload = append(payload, bytes.Join(lines[i+1:], nil)...)
+				return payload, signature.Bytes(), nil
+			}
+		case isComment && text == signatureBegin:
+			inSignature = true
+			signature.WriteString(text + "\n")
+		case isComment || text == "":
+			payload = append(payload, line...)
+		default:
+			return nil, nil, ErrNoEmbeddedSignature
+		}
+	}
+
+	if inSignature {
+		return nil, nil, errors.New("The signature in the script header isn't finished")
+	}
+
+	return nil, nil, ErrNoEmbeddedSignature
+}
+
+// ParseEmbeddedSignature is the same as Parser{}.EmbeddedSignature(script).
+func ParseEmbeddedSignature(script []byte) ([]byte, []byte, error) {
+	return Parser{}.EmbeddedSignature(script)
+}
+
+// ParseInterpreter reads the shebang line at the top of the script in r and
+// returns the interpreter and its arguments, so "#!/usr/bin/env python3"
+// becomes ["/usr/bin/env", "python3"]. If the script doesn't start with a
+// shebang, ParseInterpreter returns DefaultInterpreter. If the shebang doesn't
+// name an interpreter, ParseInterpreter returns an error.
+func ParseInterpreter(r io.Reader) ([]string, error) {
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if !strings.HasPrefix(line, "#!") {
+		return append([]string{}, DefaultInterpreter...), nil
+	}
+
+	fields := strings.Fields(strings.TrimPrefix(line, "#!"))
+	if len(fields) == 0 {
+		return nil, errors.New("No interpreter in the shebang line")
+	}
+
+	return fields, nil
+}
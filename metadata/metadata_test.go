@@ -0,0 +1,259 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package metadata
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type MetadataTest struct {
+	suite.Suite
+}
+
+func (s *MetadataTest) TestParseAuthorReadsBashHeader() {
+	script := `#!/bin/bash
+# install the thing
+# PIPETHIS_AUTHOR: Jane Doe <jane@example.com>
+
+echo hi
+`
+	author, err := ParseAuthor(bytes.NewBufferString(script))
+
+	s.NoError(err)
+	s.Equal("Jane Doe <jane@example.com>", author)
+}
+
+func (s *MetadataTest) TestParseAuthorReadsPythonHeader() {
+	script := `#!/usr/bin/env python
+# -*- coding: utf-8 -*-
+#PIPETHIS_AUTHOR ellotheth
+import sys
+`
+	author, err := ParseAuthor(bytes.NewBufferString(script))
+
+	s.NoError(err)
+	s.Equal("ellotheth", author)
+}
+
+func (s *MetadataTest) TestParseAuthorReadsCStyleHeader() {
+	script := `// hello.c
+//   PIPETHIS_AUTHOR:   jane@example.com
+#include <stdio.h>
+int main() { return 0; }
+`
+	author, err := ParseAuthor(bytes.NewBufferString(script))
+
+	s.NoError(err)
+	s.Equal("jane@example.com", author)
+}
+
+func (s *MetadataTest) TestParseAuthorStopsAfterHeader() {
+	script := `#!/bin/bash
+echo "starting"
+# PIPETHIS_AUTHOR: Jane Doe <jane@example.com>
+`
+	_, err := ParseAuthor(bytes.NewBufferString(script))
+
+	s.EqualError(err, "Author not found")
+}
+
+func (s *MetadataTest) TestParseAuthorFailsWithoutAuthor() {
+	for _, script := range []string{
+		"",
+		"#!/bin/bash\n# nobody wrote this\n",
+		"# PIPETHIS_AUTHOR:\n",
+		"# PIPETHIS_AUTHORS jane\n",
+	} {
+		_, err := ParseAuthor(bytes.NewBufferString(script))
+		s.Error(err, script)
+	}
+}
+
+func (s *MetadataTest) TestAuthorReadsBlockComments() {
+	script := `<?php
+/*
+ * install the thing
+ * PIPETHIS_AUTHOR: Jane Doe <jane@example.com>
+ */
+echo "hi";
+`
+	// the PHP opening tag isn't a comment, so it needs its own prefix
+	parser := Parser{CommentPrefixes: []string{"<?php", "#", "//"}}
+	author, err := parser.Author(bytes.NewBufferString(script))
+
+	s.NoError(err)
+	s.Equal("Jane Doe <jane@example.com>", author)
+
+	author, err = ParseAuthor(bytes.NewBufferString("/* PIPETHIS_AUTHOR jane */\nint main() {}\n"))
+	s.NoError(err)
+	s.Equal("jane", author)
+}
+
+func (s *MetadataTest) TestAuthorUsesCustomMarkers() {
+	script := `-- install.lua
+-- AUTHOR: jane@example.com
+-- SIGNATURE: https://example.com/install.lua.sig
+print("hi")
+`
+	parser := Parser{AuthorMarker: "AUTHOR", SignatureMarker: "SIGNATURE", CommentPrefixes: []string{"--"}}
+
+	author, err := parser.Author(bytes.NewBufferString(script))
+	s.NoError(err)
+	s.Equal("jane@example.com", author)
+
+	signature, err := parser.Signature(bytes.NewBufferString(script))
+	s.NoError(err)
+	s.Equal("https://example.com/install.lua.sig", signature)
+
+	// the default markers aren't there
+	_, err = ParseAuthor(bytes.NewBufferString(script))
+	s.Error(err)
+}
+
+func (s *MetadataTest) TestAuthorReadsFrontMatter() {
+	script := `---
+title: Installer
+author: jane@example.com
+---
+body
+`
+	parser := Parser{AuthorMarker: "author", Blocks: [][2]string{{"---", "---"}}}
+	author, err := parser.Author(bytes.NewBufferString(script))
+
+	s.NoError(err)
+	s.Equal("jane@example.com", author)
+}
+
+func (s *MetadataTest) TestSignatureIsOptional() {
+	script := "# PIPETHIS_AUTHOR jane\n# PIPETHIS_SIGNATURE install.sh.asc\necho hi\n"
+
+	signature, err := Parser{}.Signature(bytes.NewBufferString(script))
+	s.NoError(err)
+	s.Equal("install.sh.asc", signature)
+
+	signature, err = Parser{}.Signature(bytes.NewBufferString("# PIPETHIS_AUTHOR jane\n"))
+	s.NoError(err)
+	s.Empty(signature)
+}
+
+func (s *MetadataTest) TestAuthorFailsWithConflictingMarkers() {
+	_, err := ParseAuthor(bytes.NewBufferString("# PIPETHIS_AUTHOR jane\n# PIPETHIS_AUTHOR john\necho hi\n"))
+	s.Error(err)
+	s.Contains(err.Error(), "Conflicting")
+
+	// saying the same thing twice is fine
+	author, err := ParseAuthor(bytes.NewBufferString("# PIPETHIS_AUTHOR jane\n// PIPETHIS_AUTHOR: jane\necho hi\n"))
+	s.NoError(err)
+	s.Equal("jane", author)
+}
+
+func (s *MetadataTest) TestParseInterpreterSplitsEnvShebang() {
+	interpreter, err := ParseInterpreter(bytes.NewBufferString("#!/usr/bin/env python3\nimport sys\n"))
+
+	s.NoError(err)
+	s.Equal([]string{"/usr/bin/env", "python3"}, interpreter)
+}
+
+func (s *MetadataTest) TestParseInterpreterReadsAbsolutePath() {
+	tests := map[string][]string{
+		"#!/bin/bash\necho hi\n":       {"/bin/bash"},
+		"#! /bin/bash -e\r\necho hi\n": {"/bin/bash", "-e"},
+		"#!/usr/bin/perl -w":           {"/usr/bin/perl", "-w"},
+	}
+
+	for script, expected := range tests {
+		interpreter, err := ParseInterpreter(bytes.NewBufferString(script))
+
+		s.NoError(err, script)
+		s.Equal(expected, interpreter, script)
+	}
+}
+
+func (s *MetadataTest) TestParseInterpreterFallsBackWithoutShebang() {
+	defer func(original []string) { DefaultInterpreter = original }(DefaultInterpreter)
+
+	for _, script := range []string{"", "echo hi\n", " #!/bin/bash\n", "# PIPETHIS_AUTHOR jane\n"} {
+		interpreter, err := ParseInterpreter(bytes.NewBufferString(script))
+
+		s.NoError(err, script)
+		s.Equal([]string{"/bin/sh"}, interpreter, script)
+	}
+
+	DefaultInterpreter = []string{"/bin/zsh", "-f"}
+	interpreter, err := ParseInterpreter(bytes.NewBufferString("echo hi\n"))
+
+	s.NoError(err)
+	s.Equal([]string{"/bin/zsh", "-f"}, interpreter)
+}
+
+func (s *MetadataTest) TestParseInterpreterFailsWithEmptyShebang() {
+	_, err := ParseInterpreter(bytes.NewBufferString("#!\necho hi\n"))
+
+	s.Error(err)
+}
+
+func (s *MetadataTest) TestEmbeddedSignatureSplitsHeader() {
+	script, err := ioutil.ReadFile("testdata/embedded.sh")
+	s.Require().NoError(err)
+	expected, err := ioutil.ReadFile("testdata/embedded.payload.sh")
+	s.Require().NoError(err)
+
+	payload, signature, err := ParseEmbeddedSignature(script)
+
+	s.NoError(err)
+	s.Equal(string(expected), string(payload))
+	s.True(strings.HasPrefix(string(signature), "-----BEGIN PGP SIGNATURE-----\n\n"))
+	s.True(strings.HasSuffix(string(signature), "\n-----END PGP SIGNATURE-----\n"))
+	s.NotContains(string(signature), "#")
+}
+
+func (s *MetadataTest) TestEmbeddedSignatureKeepsTheBodyAsIs() {
+	script := "// PIPETHIS_AUTHOR jane\r\n// -----BEGIN PGP SIGNATURE-----\r\n//\r\n// abc\r\n// -----END PGP SIGNATURE-----\r\nint main() {}\r\n// -----BEGIN PGP SIGNATURE-----\r\n"
+
+	payload, signature, err := ParseEmbeddedSignature([]byte(script))
+
+	s.NoError(err)
+	s.Equal("// PIPETHIS_AUTHOR jane\r\nint main() {}\r\n// -----BEGIN PGP SIGNATURE-----\r\n", string(payload))
+	s.Equal("-----BEGIN PGP SIGNATURE-----\n\nabc\n-----END PGP SIGNATURE-----\n", string(signature))
+}
+
+func (s *MetadataTest) TestEmbeddedSignatureOnlyReadsHeader() {
+	tests := []string{
+		"",
+		"#!/bin/sh\n# PIPETHIS_AUTHOR jane\necho hi\n",
+		"#!/bin/sh\necho hi\n# -----BEGIN PGP SIGNATURE-----\n# abc\n# -----END PGP SIGNATURE-----\n",
+	}
+
+	for _, script := range tests {
+		_, _, err := ParseEmbeddedSignature([]byte(script))
+		s.Equal(ErrNoEmbeddedSignature, err, script)
+	}
+}
+
+func (s *MetadataTest) TestEmbeddedSignatureFailsWhenUnfinished() {
+	tests := []string{
+		"# -----BEGIN PGP SIGNATURE-----\n# abc\n",
+		"# -----BEGIN PGP SIGNATURE-----\n# abc\necho hi\n# -----END PGP SIGNATURE-----\n",
+	}
+
+	for _, script := range tests {
+		_, _, err := ParseEmbeddedSignature([]byte(script))
+		s.EqualError(err, "The signature in the script header isn't finished", script)
+	}
+}
+
+func TestMetadataTest(t *testing.T) {
+	suite.Run(t, new(MetadataTest))
+}
@@ -0,0 +1,5 @@
+#!/bin/sh
+# install the thing
+# PIPETHIS_AUTHOR self@example.com
+
+echo hello
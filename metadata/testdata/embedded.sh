@@ -0,0 +1,16 @@
+#!/bin/sh
+# install the thing
+# PIPETHIS_AUTHOR self@example.com
+# -----BEGIN PGP SIGNATURE-----
+#
+# iQEzBAABCgAdFiEE0xV4w9WFb4c18803Iqc6oqbyCgMFAmrQekcACgkQIqc6oqby
+# CgMkgwf/c2/WVmT1AzF2eByrl0KvppAJd4jwBu5UaggWEsHymrztZYbmAM4ejMzm
+# IoZTnIZegt2AKbxSaN/wxh+zte6NFmpqLoSydmOXKoKyQDpK17Yj7KOKa8JE0lhf
+# 0SN0BOXk5HYU9v7naFPPTOdzhiR5uek+yIP5oGedZ38jMrrBD+fi1NgMHAIBRwTQ
+# 6Y4lP/IF7bAKPS3QkEEyi98uWAA7n+9U7SoXfP8IvtFB/w+l/7fESwcq0Jae6w7L
+# RXvsED64mrkCz4pBA1B3bwPdHUpU8E9dVCebOM2zu3ae0A8PPTF9iCncWp/frBOo
+# MQ/AUbzBZelvWZRqlSt1cXsD0yEU4w==
+# =ibec
+# -----END PGP SIGNATURE-----
+
+echo hello
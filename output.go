@@ -0,0 +1,94 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ellotheth/pipethis/lookup"
+	"github.com/ellotheth/pipethis/verify"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+// Result is what pipethis found out about a script: who wrote it, which key
+// was used for them, and whether the signature checked out.
+type Result struct {
+	Author       string        `json:"author"`
+	Match        lookup.User   `json:"match"`
+	Verification verify.Report `json:"verification"`
+}
+
+// checkOutput makes sure format is one printResult knows about.
+func checkOutput(format string) error {
+	switch format {
+	case "text", "json":
+		return nil
+	}
+
+	return errors.New("Unrecognized output format: " + format)
+}
+
+// printResult writes result to out, as human-readable text or as JSON
+// depending on format.
+func printResult(out io.Writer, format string, result Result) error {
+	if format == "json" {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(result)
+	}
+
+	_, err := fmt.Fprintln(out, result.Verification)
+	return err
+}
+
+// writeKey writes key to out as an armored public key block, ready for gpg
+// --import.
+func writeKey(out io.Writer, key *openpgp.Entity) error {
+	armored, err := armor.Encode(out, openpgp.PublicKeyType, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := key.Serialize(armored); err != nil {
+		return err
+	}
+
+	if err := armored.Close(); err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintln(out)
+	return err
+}
+
+// printKey writes key to the file at location, or to STDOUT if location is
+// "-".
+func printKey(location string, key *openpgp.Entity) error {
+	if location == "-" {
+		return writeKey(os.Stdout, key)
+	}
+
+	file, err := os.Create(location)
+	if err != nil {
+		return err
+	}
+
+	err = writeKey(file, key)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
@@ -0,0 +1,136 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+// Package pin remembers which key was trusted for each author the first time
+// it was used (trust on first use), so a different key showing up later for
+// the same author doesn't get trusted by accident.
+package pin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// ErrPinMismatch means the key for an author isn't the one that was pinned.
+var ErrPinMismatch = errors.New("Key doesn't match the pinned key")
+
+// Store keeps the pinned fingerprints in a JSON file, keyed by author.
+type Store struct {
+	dir string
+}
+
+// NewStore creates a Store that keeps its pins in dir. If dir is empty,
+// DefaultDir() is used.
+func NewStore(dir string) *Store {
+	if dir == "" {
+		dir = DefaultDir()
+	}
+
+	return &Store{dir: dir}
+}
+
+// DefaultDir is $XDG_CONFIG_HOME/pipethis, or ~/.config/pipethis if
+// XDG_CONFIG_HOME isn't set.
+func DefaultDir() string {
+	if config := os.Getenv("XDG_CONFIG_HOME"); config != "" {
+		return path.Join(config, "pipethis")
+	}
+
+	return path.Join(os.Getenv("HOME"), ".config", "pipethis")
+}
+
+func (s Store) filename() string {
+	return path.Join(s.dir, "pins.json")
+}
+
+// normalize makes the same author look the same no matter how it's typed.
+func normalize(author string) string {
+	return strings.ToLower(strings.TrimSpace(author))
+}
+
+func (s Store) load() (map[string]string, error) {
+	pins := map[string]string{}
+
+	contents, err := ioutil.ReadFile(s.filename())
+	if os.IsNotExist(err) {
+		return pins, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(contents, &pins); err != nil {
+		return nil, errors.New("Couldn't read the pins in " + s.filename() + ": " + err.Error())
+	}
+
+	return pins, nil
+}
+
+// LoadPin returns the fingerprint pinned for author, or an empty string if
+// nothing's been pinned yet.
+func (s Store) LoadPin(author string) (string, error) {
+	pins, err := s.load()
+	if err != nil {
+		return "", err
+	}
+
+	return pins[normalize(author)], nil
+}
+
+// SavePin pins fingerprint for author, replacing any existing pin.
+func (s Store) SavePin(author, fingerprint string) error {
+	pins, err := s.load()
+	if err != nil {
+		return err
+	}
+	pins[normalize(author)] = strings.ToUpper(fingerprint)
+
+	contents, err := json.MarshalIndent(pins, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return err
+	}
+
+	// write someplace temporary first, so a half-written file never replaces
+	// the pins
+	file, err := ioutil.TempFile(s.dir, "pipethis-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	if _, err := file.Write(contents); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), s.filename())
+}
+
+// Check compares fingerprint to the pinned fingerprint. It's fine if nothing
+// is pinned yet, or if they match; otherwise Check returns an error wrapping
+// ErrPinMismatch, unless acceptNew says the new key is expected.
+func Check(pinned, fingerprint string, acceptNew bool) error {
+	if pinned == "" || acceptNew || strings.EqualFold(pinned, fingerprint) {
+		return nil
+	}
+
+	return fmt.Errorf("%w: pinned %s, found %s (use -accept-new-key if the author really changed keys)", ErrPinMismatch, pinned, strings.ToUpper(fingerprint))
+}
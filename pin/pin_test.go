@@ -0,0 +1,109 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package pin
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+const (
+	firstKey  = "2DEC361C395B52E763A95873A018A3D90DC0FA52"
+	secondKey = "EE07973C69F2918FC570C78875F74B66408EC6D7"
+)
+
+type PinTest struct {
+	dir string
+	suite.Suite
+}
+
+func (s *PinTest) SetupTest() {
+	dir, err := ioutil.TempDir("", "pipethis-test-")
+	s.Require().NoError(err)
+	s.dir = dir
+}
+
+func (s *PinTest) TearDownTest() {
+	os.RemoveAll(s.dir)
+}
+
+func (s *PinTest) TestDefaultDir() {
+	xdg, home := os.Getenv("XDG_CONFIG_HOME"), os.Getenv("HOME")
+	defer os.Setenv("XDG_CONFIG_HOME", xdg)
+	defer os.Setenv("HOME", home)
+
+	os.Setenv("HOME", "/home/foo")
+	os.Setenv("XDG_CONFIG_HOME", "")
+	s.Equal("/home/foo/.config/pipethis", DefaultDir())
+
+	os.Setenv("XDG_CONFIG_HOME", "/etc/xdg")
+	s.Equal("/etc/xdg/pipethis", DefaultDir())
+}
+
+func (s *PinTest) TestFirstRunCreatesPin() {
+	store := NewStore(path.Join(s.dir, "pins"))
+
+	pinned, err := store.LoadPin("jane")
+	s.NoError(err)
+	s.Equal("", pinned)
+	s.NoError(Check(pinned, firstKey, false))
+
+	s.NoError(store.SavePin("jane", firstKey))
+
+	info, err := os.Stat(path.Join(s.dir, "pins", "pins.json"))
+	s.Require().NoError(err)
+	s.Equal(os.FileMode(0600), info.Mode().Perm())
+}
+
+func (s *PinTest) TestMatchingRunIsAccepted() {
+	store := NewStore(s.dir)
+	s.Require().NoError(store.SavePin("Jane <jane@example.com>", firstKey))
+
+	pinned, err := store.LoadPin(" jane <JANE@example.com>")
+	s.NoError(err)
+	s.Equal(firstKey, pinned)
+	s.NoError(Check(pinned, "2dec361c395b52e763a95873a018a3d90dc0fa52", false))
+}
+
+func (s *PinTest) TestChangedKeyIsRejected() {
+	store := NewStore(s.dir)
+	s.Require().NoError(store.SavePin("jane", firstKey))
+	s.Require().NoError(store.SavePin("joe", secondKey))
+
+	pinned, _ := store.LoadPin("jane")
+	err := Check(pinned, secondKey, false)
+	s.True(errors.Is(err, ErrPinMismatch))
+
+	// unless the user says so, and then the new key gets pinned
+	s.NoError(Check(pinned, secondKey, true))
+	s.NoError(store.SavePin("jane", secondKey))
+
+	pinned, _ = store.LoadPin("jane")
+	s.Equal(secondKey, pinned)
+	pinned, _ = store.LoadPin("joe")
+	s.Equal(secondKey, pinned)
+}
+
+func (s *PinTest) TestLoadPinFailsWithCorruptFile() {
+	ioutil.WriteFile(path.Join(s.dir, "pins.json"), []byte("{nope"), 0600)
+
+	_, err := NewStore(s.dir).LoadPin("jane")
+	s.Error(err)
+	s.Error(NewStore(s.dir).SavePin("jane", firstKey))
+}
+
+func TestPinTest(t *testing.T) {
+	suite.Run(t, new(PinTest))
+}
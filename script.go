@@ -10,6 +10,7 @@ the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"errors"
 	"fmt"
@@ -18,26 +19,59 @@ import (
 	"log"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path/filepath"
 	"strings"
+	"syscall"
 
+	"github.com/ellotheth/pipethis/lookup"
+	"github.com/ellotheth/pipethis/metadata"
 	"golang.org/x/crypto/openpgp/armor"
 	"golang.org/x/crypto/openpgp/clearsign"
+	"golang.org/x/crypto/openpgp/packet"
 )
 
+// ErrSwappedArguments means the script looks like a signature (or a key), or
+// the signature looks like a script, which almost always means they were given
+// the wrong way around.
+var ErrSwappedArguments = errors.New("The script and the signature look swapped")
+
 // Script represents a shell script to be inspected, verified, and run.
 type Script struct {
 	author      string
 	source      string
 	filename    string
 	clearsigned bool
+
+	// contents are the script, when it had to be read into memory to split
+	// off the signature it carries. Otherwise the script is only in the file
+	// at filename.
+	contents []byte
+
+	// staged is the private copy of the script made by Stage, if there is
+	// one. It's what runs, so the script that runs is exactly the one that
+	// was verified.
+	staged string
 }
 
+// headSize is how much of a script NewScript looks at to decide whether it
+// has to be read into memory: a clearsigned script, or one with a signature in
+// its header, has to be, and anything else is streamed straight to disk.
+const headSize = 64 << 10
+
 // NewScript copies the shell script specified in location (which may be local
-// or remote) to a temporary file and loads it into a Script.
+// or remote) to a temporary file and loads it into a Script. Unless it carries
+// its own signature, the script is never held in memory all at once, so a big
+// installer costs no more than a small one.
 func NewScript(location string) (*Script, error) {
+	// "-" is just another way of saying STDIN
+	if location == "-" {
+		location = ""
+	}
+
 	script := &Script{source: location}
 
-	body, err := getFile(location)
+	body, err := openSource(location)
 	if err != nil {
 		return nil, err
 	}
@@ -51,7 +85,26 @@ func NewScript(location string) (*Script, error) {
 
 	script.filename = file.Name()
 
-	contents, err := ioutil.ReadAll(body)
+	source := bufio.NewReaderSize(limitSource(body, location), headSize)
+	head, err := source.Peek(headSize)
+	if err != nil && err != io.EOF {
+		os.Remove(script.filename)
+		return nil, err
+	}
+
+	if !bytes.Contains(head, []byte("-----BEGIN PGP ")) {
+		if err := script.checkNotPGP(head); err != nil {
+			return nil, err
+		}
+
+		if _, err := io.Copy(file, source); err != nil {
+			os.Remove(script.filename)
+			return nil, err
+		}
+		return script, nil
+	}
+
+	contents, err := ioutil.ReadAll(source)
 	if err != nil {
 		return nil, err
 	}
@@ -61,21 +114,88 @@ func NewScript(location string) (*Script, error) {
 		return nil, err
 	}
 
+	if err := script.checkNotPGP(contents); err != nil {
+		return nil, err
+	}
+
 	_, err = file.Write(contents)
 	if err != nil {
 		return nil, err
 	}
+	script.contents = contents
 
 	return script, nil
 }
 
+// checkNotPGP catches a signature passed as the script before it gets anywhere
+// near verifying (or running). contents is the script, or at least the start
+// of it.
+func (s *Script) checkNotPGP(contents []byte) error {
+	kind := pgpKind(contents)
+	if kind == "" {
+		return nil
+	}
+
+	os.Remove(s.filename)
+
+	name := s.source
+	if s.IsPiped() {
+		name = "STDIN"
+	}
+	return fmt.Errorf("%w: %s is a PGP %s, not a script; the script goes first, and its signature in -signature", ErrSwappedArguments, name, kind)
+}
+
+// pgpKind says what sort of PGP data contents is, if it looks like any: the
+// type of an armored block (like "signature" or "public key block"), or of
+// the first binary packet ("signature", "public key", or "private key").
+// Anything else, including a clearsigned script, is "".
+func pgpKind(contents []byte) string {
+	trimmed := bytes.TrimSpace(contents)
+	if header := []byte("-----BEGIN PGP "); bytes.HasPrefix(trimmed, header) {
+		end := bytes.Index(trimmed[len(header):], []byte("-----"))
+		if end < 0 {
+			return ""
+		}
+		if kind := strings.ToLower(string(trimmed[len(header) : len(header)+end])); kind != "signed message" {
+			return kind
+		}
+		return ""
+	}
+
+	// every packet tag has its high bit set; parsing the packet makes sure
+	// it's not just some text that starts with a funny byte
+	if len(contents) == 0 || contents[0]&0x80 == 0 {
+		return ""
+	}
+	p, err := packet.NewReader(bytes.NewReader(contents)).Next()
+	if err != nil {
+		return ""
+	}
+
+	switch p.(type) {
+	case *packet.Signature, *packet.SignatureV3:
+		return "signature"
+	case *packet.PublicKey:
+		return "public key"
+	case *packet.PrivateKey:
+		return "private key"
+	}
+
+	return ""
+}
+
+// looksLikeScript is true when head, the start of what's supposed to be a
+// signature, is a shebang line or has a PIPETHIS_AUTHOR in it instead.
+func looksLikeScript(head []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(head), []byte("#!")) || bytes.Contains(head, []byte("PIPETHIS_AUTHOR"))
+}
+
 func (s *Script) detachSignature(contents []byte) ([]byte, error) {
 	block, _ := clearsign.Decode(contents)
 
-	// if the signature is not attached, return the contents without
-	// modification
+	// the signature might be in the header comments instead
 	if block == nil {
-		return contents, nil
+		return s.detachEmbeddedSignature(contents)
 	}
 
 	s.clearsigned = true
@@ -106,6 +226,27 @@ func (s *Script) detachSignature(contents []byte) ([]byte, error) {
 	return contents, nil
 }
 
+// detachEmbeddedSignature splits off a signature carried in the script's
+// header comments into its own file, and returns the payload it signed. If
+// there's no signature there, it returns the contents without modification.
+func (s *Script) detachEmbeddedSignature(contents []byte) ([]byte, error) {
+	payload, signature, err := metadata.ParseEmbeddedSignature(contents)
+	if errors.Is(err, metadata.ErrNoEmbeddedSignature) {
+		return contents, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s.clearsigned = true
+
+	if err := ioutil.WriteFile(s.filename+".sig", signature, 0600); err != nil {
+		return nil, err
+	}
+
+	return payload, nil
+}
+
 // IsPiped is true when the script was read from STDIN (so the source location
 // is empty)
 func (s Script) IsPiped() bool {
@@ -122,13 +263,98 @@ func (s Script) Source() string {
 	return s.source
 }
 
-// Body opens Script.Name() for reading.
-func (s Script) Body() (ReadSeekCloser, error) {
-	return os.Open(s.Name())
+// contentsReader is an in-memory ReadSeekCloser.
+type contentsReader struct {
+	*bytes.Reader
 }
 
-// Author parses Script.Body() for the PIPETHIS_AUTHOR token, and saves it if
-// it's found.
+func (contentsReader) Close() error {
+	return nil
+}
+
+// Body returns a reader for the script: the staged copy if there is one, or
+// else the contents, if they were read into memory, or else Script.Name().
+func (s *Script) Body() (ReadSeekCloser, error) {
+	filename := s.Name()
+	switch {
+	case s.staged != "":
+		filename = s.staged
+	case s.contents != nil:
+		return contentsReader{bytes.NewReader(s.contents)}, nil
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// Stage makes a private copy of the script for Run or Hook to use, by handing
+// through a new file and Script.Body(). The copy is only readable by the
+// current user, in a directory that's only readable by the current user. If
+// through fails, the copy is thrown away; otherwise it's what Body, Run, Hook,
+// and Echo use from then on.
+//
+// through is where the script is verified as it's copied (see
+// verify.Verifier.VerifyStream), so the copy can't be changed between being
+// verified and being run, and the script never has to be held in memory.
+func (s *Script) Stage(through func(dst io.Writer, src io.Reader) error) error {
+	s.Unstage()
+
+	src, err := s.Body()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dir, err := ioutil.TempDir("", "pipethis-run-")
+	if err != nil {
+		return err
+	}
+
+	filename := filepath.Join(dir, "script")
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+
+	err = through(file, src)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	s.staged = filename
+
+	return nil
+}
+
+// Unstage throws away the copy made by Stage, if there is one.
+func (s *Script) Unstage() {
+	if s.staged == "" {
+		return
+	}
+
+	os.RemoveAll(filepath.Dir(s.staged))
+	s.staged = ""
+}
+
+// Remove cleans up after the script: the staged copy, and Script.Name().
+func (s *Script) Remove() error {
+	s.Unstage()
+
+	return os.Remove(s.Name())
+}
+
+// Author parses the header comments of Script.Body() for the PIPETHIS_AUTHOR
+// marker with metadata.ParseAuthor, and saves the author if it's found. The
+// author is everything after the marker, so it can be an email address or a
+// name and email, not just a single word.
 func (s *Script) Author() (string, error) {
 	if s.author != "" {
 		return s.author, nil
@@ -140,33 +366,171 @@ func (s *Script) Author() (string, error) {
 	}
 	defer file.Close()
 
-	if author := parseToken(`.*PIPETHIS_AUTHOR\s+(\w+)`, file); author != "" {
-		s.author = author
+	author, err := metadata.ParseAuthor(file)
+	if err != nil {
+		return "", err
+	}
+	s.author = author
+
+	return s.author, nil
+}
 
-		return s.author, nil
+// interpreterCommand splits override (like "bash -x") into the interpreter
+// and its arguments, and makes sure the interpreter is an executable, either
+// on the PATH or at the path given. Nothing fancier than splitting on spaces
+// is done, so no quotes.
+func interpreterCommand(override string) ([]string, error) {
+	fields := strings.Fields(override)
+	if len(fields) == 0 {
+		return nil, errors.New("No interpreter given")
+	}
+
+	path, err := exec.LookPath(fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("Interpreter %s isn't an executable: %w", fields[0], err)
+	}
+	fields[0] = path
+
+	return fields, nil
+}
+
+// Command is what Run runs the script with: override, if it's set, or else the
+// interpreter (and its arguments) from the script's shebang line, or else
+// fallback if there's no shebang.
+func (s *Script) Command(override, fallback []string) ([]string, error) {
+	if len(override) > 0 {
+		return override, nil
+	}
+
+	body, err := s.Body()
+	if err != nil {
+		return nil, err
 	}
+	defer body.Close()
 
-	return "", errors.New("Author not found")
+	reader := bufio.NewReader(body)
+	if head, _ := reader.Peek(2); string(head) != "#!" {
+		return fallback, nil
+	}
+
+	return metadata.ParseInterpreter(reader)
 }
 
-// Run creates a new process, running Script.Name() with target and any
-// additional arguments from the command line. It returns the result of the
-// process.
-func (s Script) Run(target string, args ...string) error {
-	log.Println("Running", s.Name(), "with", target)
+// Run creates a new process, running the script contents with the command
+// from Script.Command(override, fallback) (an executable and its own
+// arguments) and any additional arguments from the command line. It returns
+// the result of the process.
+//
+// What runs is the private copy from Stage, so nothing that happened to
+// Script.Name() since the script was verified can change what runs. (An
+// unverified script is staged by Run itself.) The copy is removed when Run
+// returns, whether the script worked or not. Where the system has /dev/fd, the file is
+// removed before the script even starts: the interpreter gets it as an open
+// file (/dev/fd/3) instead. SIGINT and SIGTERM are passed along to the
+// script instead of stopping pipethis, so the cleanup still happens.
+func (s *Script) Run(override, fallback []string, args ...string) error {
+	command, err := s.Command(override, fallback)
+	if err != nil {
+		return err
+	}
+
+	return s.run(command, nil, true, args...)
+}
+
+// signerEnv is the environment variable that tells an -after-verify hook who
+// signed the script.
+const signerEnv = "PIPETHIS_SIGNER_FINGERPRINT"
+
+// Hook hands the verified script to command instead of running it: command
+// gets the path to a private copy of the script (and then any additional
+// arguments from the command line), and the fingerprint of the key that
+// signed it in PIPETHIS_SIGNER_FINGERPRINT. The copy is a real file, not
+// /dev/fd/3, so command can open it as many times as it likes; it's removed
+// when command exits.
+func (s *Script) Hook(command []string, fingerprint string, args ...string) error {
+	return s.run(command, []string{signerEnv + "=" + fingerprint}, false, args...)
+}
+
+// run does the work for Run and Hook. env is added to the environment, and
+// hide passes the script as /dev/fd/3 where it can.
+func (s *Script) run(command []string, env []string, hide bool, args ...string) error {
+	if s.staged == "" {
+		err := s.Stage(func(dst io.Writer, src io.Reader) error {
+			_, err := io.Copy(dst, src)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	defer s.Unstage()
+
+	filename := s.staged
+	dir := filepath.Dir(filename)
 
 	// the first argument is the script source location. replace it with the
 	// temporary filename.
-	args[0] = s.Name()
+	args[0] = filename
 
-	cmd := exec.Command(target, args...)
+	cmd := exec.Command(command[0])
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	return cmd.Run()
+	if env != nil {
+		cmd.Env = append(os.Environ(), env...)
+	}
+
+	if hide && hasDevFD() {
+		file, err := os.Open(filename)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+
+		// ExtraFiles start at file descriptor 3
+		cmd.ExtraFiles = []*os.File{file}
+		args[0] = "/dev/fd/3"
+	}
+	cmd.Args = append(append(cmd.Args, command[1:]...), args...)
+
+	log.Println("Running", args[0], "with", strings.Join(command, " "))
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				cmd.Process.Signal(sig)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return cmd.Wait()
+}
+
+// hasDevFD is true when open files can be passed to another process as
+// /dev/fd/N.
+func hasDevFD() bool {
+	_, err := os.Stat("/dev/fd")
+	return err == nil
 }
 
 // Echo prints the contents of the script to STDOUT
-func (s Script) Echo() error {
+func (s *Script) Echo() error {
 	log.Println("Sending", s.Name(), "to STDOUT for more processing")
 
 	body, err := s.Body()
@@ -176,17 +540,16 @@ func (s Script) Echo() error {
 	defer body.Close()
 
 	_, err = io.Copy(os.Stdout, body)
-	if err != nil {
-		return err
-	}
 
-	return nil
+	return err
 }
 
 // Inspect checks whether an inspection was requested, and sends Script.Name()
-// to editor if so. When editor exits, Inspect prompts the user to continue
-// processing, and returns true to continue or false to stop.
-func (s Script) Inspect(inspect bool, editor string) bool {
+// to editor if so. When editor exits, Inspect asks prompter whether to continue
+// processing, and returns true to continue or false to stop. Any changes made
+// in the editor are read back, and those are the contents that get verified
+// (and run).
+func (s *Script) Inspect(inspect bool, editor string, prompter lookup.Prompter) bool {
 	if !inspect || s.IsPiped() {
 		return true
 	}
@@ -198,12 +561,11 @@ func (s Script) Inspect(inspect bool, editor string) bool {
 	cmd.Stderr = os.Stderr
 	cmd.Stdin = os.Stdin
 	cmd.Run()
+	s.contents = nil
 
-	runScript := "y"
-	fmt.Print("Continue processing ", s.Name(), "? (Y/n) ")
-	fmt.Scanf("%s", &runScript)
+	ok, err := prompter.Confirm("Continue processing " + s.Name() + "? (Y/n) ")
 
-	return strings.ToLower(runScript) == "y"
+	return err == nil && ok
 }
 
 // IsClearsigned returns true if the script and signature are attached,
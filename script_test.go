@@ -10,11 +10,15 @@ the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
 package main
 
 import (
+	"bytes"
+	"errors"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/suite"
+	"golang.org/x/crypto/openpgp"
 )
 
 type ScriptTest struct {
@@ -64,37 +68,231 @@ func providerTestAuthorInvalid() [][]string {
 	return [][]string{
 		[]string{"", ``},
 		[]string{"", `no author here yo`},
+		[]string{"", `PIPETHIS_AUTHOR bar`},
 		[]string{"", `
 stuff things
 more stuff
 # comments to ignore
-// reasons bar_STUFF_123 is my name but it should only pick up the first word
+// reasons PIPETHIS_AUTHOR bar_STUFF_123 is past the header
 # more comments
 things and stuff
 		`},
+		[]string{"", `
+// PIPETHIS_AUTHOR bar_STUFF_123
+// PIPETHIS_AUTHOR other_author makes it ambiguous
+		`},
 	}
 }
 func providerTestAuthorValid() [][]string {
 	return [][]string{
-		[]string{`bar`, `PIPETHIS_AUTHOR bar`},
+		[]string{`bar`, `# PIPETHIS_AUTHOR bar`},
 		[]string{`bar`, `// PIPETHIS_AUTHOR bar         `},
 		[]string{`bar`, `# PIPETHIS_AUTHOR bar         `},
 		[]string{`bar`, `# PIPETHIS_AUTHOR		bar				   `},
+		[]string{`alice@example.com`, "#!/bin/sh\n# PIPETHIS_AUTHOR alice@example.com\necho hi\n"},
+		[]string{`Jane Doe <jane@example.com>`, "#!/bin/sh\n# PIPETHIS_AUTHOR: Jane Doe <jane@example.com>\n"},
 		[]string{`bar_STUFF_123`, `
-stuff things
-more stuff
 # comments to ignore
-// reasons PIPETHIS_AUTHOR bar_STUFF_123 is my name but it should only pick up the first word
-# more comments
+// PIPETHIS_AUTHOR bar_STUFF_123
+// PIPETHIS_AUTHOR bar_STUFF_123
 things and stuff
 		`},
-		[]string{`bar_STUFF_123`, `
-// PIPETHIS_AUTHOR bar_STUFF_123 should take this one
-// PIPETHIS_AUTHOR other_author should ignore this one
-		`},
 	}
 }
 
+func (s *ScriptTest) TestEmbeddedSignatureVerifies() {
+	ringfile, err := os.Open("lookup/testdata/secrethome/pubring.gpg")
+	s.Require().NoError(err)
+	defer ringfile.Close()
+	ring, err := openpgp.ReadKeyRing(ringfile)
+	s.Require().NoError(err)
+
+	payload, err := ioutil.ReadFile("metadata/testdata/embedded.payload.sh")
+	s.Require().NoError(err)
+
+	script, err := NewScript("metadata/testdata/embedded.sh")
+	s.Require().NoError(err)
+	defer os.Remove(script.Name())
+	defer os.Remove(script.Name() + ".sig")
+
+	s.True(script.IsClearsigned())
+	contents, err := ioutil.ReadFile(script.Name())
+	s.NoError(err)
+	s.Equal(string(payload), string(contents))
+
+	signature := NewSignature(ring, script, "")
+	s.NoError(signature.Verify())
+
+	// anything changed outside the signature lines breaks it
+	original, err := ioutil.ReadFile("metadata/testdata/embedded.sh")
+	s.Require().NoError(err)
+	dir, err := ioutil.TempDir("", "pipethis-test-")
+	s.Require().NoError(err)
+	defer os.RemoveAll(dir)
+	tampered := filepath.Join(dir, "tampered.sh")
+	s.Require().NoError(ioutil.WriteFile(tampered, bytes.Replace(original, []byte("echo hello"), []byte("echo pwned"), 1), 0600))
+
+	script, err = NewScript(tampered)
+	s.Require().NoError(err)
+	defer os.Remove(script.Name())
+	defer os.Remove(script.Name() + ".sig")
+
+	s.True(script.IsClearsigned())
+	signature = NewSignature(ring, script, "")
+	s.Error(signature.Verify())
+}
+
+func (s *ScriptTest) TestInterpreterOverridesShebang() {
+	dir, err := ioutil.TempDir("", "pipethis-test-")
+	s.Require().NoError(err)
+	defer os.RemoveAll(dir)
+
+	// the shebang would fail; the override copies the script instead
+	contents := "#!/bin/false\necho hello\n"
+	script := &Script{filename: dir + "/install.sh", contents: []byte(contents)}
+
+	command, err := interpreterCommand("cp -p")
+	s.Require().NoError(err)
+	s.Equal("cp", filepath.Base(command[0]))
+	s.Equal("-p", command[1])
+
+	s.NoError(script.Run(command, []string{"/bin/false"}, "install.sh", dir+"/ran.sh"))
+
+	ran, err := ioutil.ReadFile(dir + "/ran.sh")
+	s.NoError(err)
+	s.Equal(contents, string(ran))
+}
+
+func (s *ScriptTest) TestRunUsesTheShebang() {
+	dir, err := ioutil.TempDir("", "pipethis-test-")
+	s.Require().NoError(err)
+	defer os.RemoveAll(dir)
+
+	ran := func(contents string, override, fallback []string) (string, error) {
+		os.Remove(dir + "/ran")
+		script := &Script{filename: dir + "/install.sh", contents: []byte(contents)}
+		err := script.Run(override, fallback, "install.sh")
+		marker, _ := ioutil.ReadFile(dir + "/ran")
+		return string(marker), err
+	}
+
+	shell, err := interpreterCommand("sh")
+	s.Require().NoError(err)
+	marker := "echo $0 > " + dir + "/ran\n"
+
+	// the shebang beats the fallback
+	out, err := ran("#!/bin/sh\n"+marker, nil, []string{"/bin/false"})
+	s.NoError(err)
+	s.NotEmpty(out)
+
+	// without a shebang, the fallback runs it
+	out, err = ran(marker, nil, shell)
+	s.NoError(err)
+	s.NotEmpty(out)
+
+	_, err = ran(marker, nil, []string{"/bin/false"})
+	s.Error(err)
+
+	// shebang arguments come along
+	command, err := (&Script{contents: []byte("#!/usr/bin/env sh -e\n")}).Command(nil, shell)
+	s.NoError(err)
+	s.Equal([]string{"/usr/bin/env", "sh", "-e"}, command)
+}
+
+func (s *ScriptTest) TestInterpreterMustBeExecutable() {
+	_, err := interpreterCommand("pipethis-no-such-interpreter -x")
+	s.Error(err)
+	s.Contains(err.Error(), "pipethis-no-such-interpreter")
+
+	_, err = interpreterCommand("  ")
+	s.Error(err)
+}
+
+// runInTempDir runs contents with /bin/sh, with the temporary directory
+// pointed at a fresh one, and returns whatever was left in the temporary
+// directory afterwards, and the error from Script.Run.
+func (s *ScriptTest) runInTempDir(contents string) ([]os.FileInfo, error) {
+	tmp, err := ioutil.TempDir("", "pipethis-test-")
+	s.Require().NoError(err)
+	defer os.RemoveAll(tmp)
+
+	defer os.Setenv("TMPDIR", os.Getenv("TMPDIR"))
+	os.Setenv("TMPDIR", tmp)
+
+	script := &Script{filename: tmp + "/install.sh", contents: []byte(contents)}
+	runErr := script.Run(nil, []string{"/bin/sh"}, "install.sh")
+
+	left, err := ioutil.ReadDir(tmp)
+	s.Require().NoError(err)
+
+	return left, runErr
+}
+
+func (s *ScriptTest) TestRunCleansUpAfterSuccess() {
+	left, err := s.runInTempDir("exit 0\n")
+
+	s.NoError(err)
+	s.Empty(left)
+}
+
+func (s *ScriptTest) TestRunCleansUpAfterFailure() {
+	left, err := s.runInTempDir("exit 3\n")
+
+	s.Error(err)
+	s.Empty(left)
+}
+
+func (s *ScriptTest) TestRunHidesTheFileFromTheScript() {
+	if !hasDevFD() {
+		s.T().Skip("no /dev/fd here")
+	}
+
+	// by the time the script runs, there's nothing left to find
+	_, err := s.runInTempDir(`[ "$0" = /dev/fd/3 ] && [ -z "$(ls -A "$TMPDIR")" ]` + "\n")
+
+	s.NoError(err)
+}
+
+func (s *ScriptTest) TestSignatureAsScriptIsCaught() {
+	tests := map[string]string{
+		"verify/testdata/script.sh.sig": "is a PGP signature, not a script",
+		"lookup/testdata/pubring.gpg":   "is a PGP public key, not a script",
+		"lookup/testdata/pubring.asc":   "is a PGP public key block, not a script",
+	}
+
+	for location, message := range tests {
+		_, err := NewScript(location)
+
+		s.True(errors.Is(err, ErrSwappedArguments), location)
+		s.Contains(err.Error(), location+" "+message, location)
+		s.Contains(err.Error(), "the script goes first", location)
+	}
+
+	// a clearsigned script is still a script
+	s.Empty(pgpKind([]byte("-----BEGIN PGP SIGNED MESSAGE-----\nHash: SHA256\n\necho hi\n")))
+
+	// and so is text that starts with a byte that could be a packet tag
+	s.Empty(pgpKind([]byte("\xef\xbb\xbf#!/bin/sh\necho hi\n")))
+	s.Empty(pgpKind([]byte("\xc2\xa0echo hi\n")))
+}
+
+func (s *ScriptTest) TestInspectAsksToContinue() {
+	script, err := NewScript("verify/testdata/script.sh")
+	s.Require().NoError(err)
+	defer os.Remove(script.Name())
+
+	prompter := &fakePrompter{answer: false}
+	s.False(script.Inspect(true, "true", prompter))
+	s.Equal([]string{"Continue processing " + script.Name() + "? (Y/n) "}, prompter.messages)
+
+	s.True(script.Inspect(true, "true", &fakePrompter{answer: true}))
+
+	// nothing is asked without an inspection
+	prompter = &fakePrompter{}
+	s.True(script.Inspect(false, "true", prompter))
+	s.Empty(prompter.messages)
+}
+
 func TestScriptTest(t *testing.T) {
 	suite.Run(t, new(ScriptTest))
 }
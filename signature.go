@@ -11,29 +11,41 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"io"
+	"log"
 	"os"
+	"strings"
 
+	"github.com/ellotheth/pipethis/verify"
 	"golang.org/x/crypto/openpgp"
 )
 
 // Signature represents the PGP signature to be verified against a key and
 // Script.
 type Signature struct {
-	key      openpgp.KeyRing
+	key      openpgp.EntityList
+	verifier *verify.Verifier
 	script   *Script
 	filename string
 	source   string
 }
 
 // NewSignature loads a key ring and Script into a new Signature.
-func NewSignature(key openpgp.KeyRing, script *Script, source string) *Signature {
+func NewSignature(key openpgp.EntityList, script *Script, source string) *Signature {
 	sig := &Signature{key: key, script: script, source: source}
+	sig.verifier = verify.NewVerifier(key)
 	sig.filename = script.Name() + ".sig"
 
 	return sig
 }
 
+// Verifier is what checks the signature, so the caller can add requirements
+// for the signing key.
+func (s *Signature) Verifier() *verify.Verifier {
+	return s.verifier
+}
+
 // Name is the name of the temporary file holding the signature.
 func (s Signature) Name() string {
 	return s.filename
@@ -51,20 +63,49 @@ func (s *Signature) Source() string {
 	return s.source
 }
 
-// Download saves the signature to a temporary file.
+// candidates are the places the signature might be: the source location if it
+// was given, or else <script source>.sig and then <script source>.asc.
+func (s *Signature) candidates() []string {
+	if s.source != "" || s.script == nil || s.script.IsClearsigned() || s.script.IsPiped() {
+		if s.source == "" {
+			return nil
+		}
+		return []string{s.source}
+	}
+
+	return []string{s.script.Source() + ".sig", s.script.Source() + ".asc"}
+}
+
+// Download saves the signature to a temporary file. Without a signature
+// source location, it tries <script source>.sig and then <script
+// source>.asc, and remembers whichever one it found. If none of them can be
+// opened, the error says why for each one, and wraps the first one's error.
 func (s *Signature) Download() error {
 	if s.script != nil && s.script.IsClearsigned() {
 		return nil
 	}
 
-	source := s.Source()
-	if source == "" {
+	candidates := s.candidates()
+	if len(candidates) == 0 {
 		return errors.New("The signature source location is missing")
 	}
 
-	body, err := getFile(source)
-	if err != nil {
-		return errors.New("Couldn't open the signature source file at " + source)
+	var body io.ReadCloser
+	failures := []error{}
+	for _, source := range candidates {
+		var err error
+		if body, err = resolveSource(source); err == nil {
+			s.source = source
+			break
+		}
+		failures = append(failures, err)
+	}
+	if body == nil {
+		rest := ""
+		for _, err := range failures[1:] {
+			rest += "; " + err.Error()
+		}
+		return fmt.Errorf("Couldn't open the signature source file at %s: %w%s", strings.Join(candidates, " or "), failures[0], rest)
 	}
 	defer body.Close()
 
@@ -76,7 +117,7 @@ func (s *Signature) Download() error {
 
 	_, err = io.Copy(file, body)
 	if err != nil {
-		return nil
+		return err
 	}
 
 	return nil
@@ -92,36 +133,82 @@ func (s *Signature) Body() (ReadSeekCloser, error) {
 	if os.IsNotExist(err) || info.Size() == 0 {
 		err := s.Download()
 		if err != nil {
-			return nil, errors.New(err.Error() + " (do you need to set -signature?)")
+			return nil, fmt.Errorf("%w (do you need to set -signature?)", err)
 		}
 	}
 
-	return os.Open(s.Name())
+	file, err := os.Open(s.Name())
+	if err != nil {
+		return nil, err
+	}
+
+	// catch a script passed as the signature, before it's reported as just
+	// a malformed signature
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(file, head)
+	if looksLikeScript(head[:n]) {
+		file.Close()
+		return nil, fmt.Errorf("%w: %s is a script, not a PGP signature; the script goes first, and its signature in -signature", ErrSwappedArguments, s.Source())
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return file, nil
 }
 
 // Verify checks Signature.Name() against the public key and script file, and
-// returns an error if the signature cannot be verified.
+// returns an error if the signature cannot be verified. The script is staged
+// (see Script.Stage) as it's verified, so what runs afterwards is exactly what
+// was verified.
 func (s *Signature) Verify() error {
-	signed, err := s.script.Body()
+	signature, err := s.Body()
 	if err != nil {
 		return err
 	}
-	defer signed.Close()
+	defer signature.Close()
+
+	report := s.check(signature)
+	if report.Err != nil {
+		return errors.New("Failed to verify signature: " + report.Err.Error())
+	}
+
+	for _, warning := range report.Result.Warnings {
+		log.Println("Warning:", warning)
+	}
 
+	return nil
+}
+
+// Check verifies Signature.Name() against the public key and script file like
+// Verify, but reports what it found instead of returning an error.
+func (s *Signature) Check() verify.Report {
 	signature, err := s.Body()
 	if err != nil {
-		return err
+		return verify.Report{Outcome: verify.Failed, Err: err}
 	}
 	defer signature.Close()
 
-	if _, err := openpgp.CheckDetachedSignature(s.key, signed, signature); err == nil {
-		return nil
-	}
+	return s.check(signature)
+}
 
-	signature.Seek(0, 0) // i'm sure there's a good reason i don't need to reset the script...
-	if _, err := openpgp.CheckArmoredDetachedSignature(s.key, signed, signature); err == nil {
-		return nil
+// check verifies signature against the script as the script is staged.
+func (s *Signature) check(signature io.Reader) verify.Report {
+	var report verify.Report
+	err := s.script.Stage(func(dst io.Writer, src io.Reader) error {
+		if s.Verifier().Cache != nil {
+			// the cache reads the whole script into memory to hash it
+			// anyway, so there's no stream to keep
+			report = s.Verifier().Check(io.TeeReader(src, dst), signature)
+		} else {
+			report = s.Verifier().CheckStream(dst, src, signature)
+		}
+		return report.Err
+	})
+	if err != nil && report.Err == nil {
+		report = verify.Report{Outcome: verify.Failed, Err: err}
 	}
 
-	return errors.New("Failed to verify signature")
+	return report
 }
@@ -10,6 +10,7 @@ the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
 package main
 
 import (
+	"errors"
 	"io/ioutil"
 	"os"
 	"testing"
@@ -41,6 +42,17 @@ func (s *SigTest) TestDownloadIsNoopWithClearsignedScript() {
 	s.NoError(sig.Download())
 }
 
+func (s *SigTest) TestCandidatesTrySigThenAsc() {
+	sig := Signature{script: &Script{source: "scriptsource"}}
+	s.Equal([]string{"scriptsource.sig", "scriptsource.asc"}, sig.candidates())
+
+	sig = Signature{source: "foosig", script: &Script{source: "scriptsource"}}
+	s.Equal([]string{"foosig"}, sig.candidates())
+
+	sig = Signature{script: &Script{}}
+	s.Empty(sig.candidates())
+}
+
 func (s *SigTest) TestDownloadFailsWithoutSource() {
 	sig := Signature{}
 	s.Error(sig.Download())
@@ -88,6 +100,22 @@ func (s *SigTest) TestBodyFailsWithoutFiles() {
 	s.Error(err)
 }
 
+func (s *SigTest) TestScriptAsSignatureIsCaught() {
+	script, err := NewScript("verify/testdata/script.sh")
+	s.Require().NoError(err)
+	defer os.Remove(script.Name())
+
+	signature := NewSignature(nil, script, "verify/testdata/script.sh")
+	defer os.Remove(signature.Name())
+
+	err = signature.Verify()
+	s.True(errors.Is(err, ErrSwappedArguments), err)
+	s.Contains(err.Error(), "verify/testdata/script.sh is a script, not a PGP signature")
+
+	report := signature.Check()
+	s.True(errors.Is(report.Err, ErrSwappedArguments), report.Err)
+}
+
 func TestSignatureTest(t *testing.T) {
 	suite.Run(t, new(SigTest))
 }
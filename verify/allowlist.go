@@ -0,0 +1,134 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package verify
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/ellotheth/pipethis/lookup"
+	"golang.org/x/crypto/openpgp"
+)
+
+// ErrNotAllowed means the signature is good, but the key that made it isn't
+// on the Verifier's Allowlist.
+var ErrNotAllowed = errors.New("Signer isn't on the allowlist")
+
+// Allowlist is the only authors a Verifier will accept, however good their
+// signatures are. Each entry is either the full fingerprint of a primary key
+// (spaced out or not) or an email address, which can have glob wildcards in
+// it like *@example.com.
+type Allowlist struct {
+	fingerprints map[string]bool
+	emails       []string
+}
+
+// NewAllowlist creates an Allowlist from entries. If any of them is neither a
+// full fingerprint nor an email address (or pattern), NewAllowlist bails.
+func NewAllowlist(entries []string) (*Allowlist, error) {
+	allowlist := &Allowlist{fingerprints: map[string]bool{}}
+
+	for _, entry := range entries {
+		if err := allowlist.add(entry); err != nil {
+			return nil, err
+		}
+	}
+
+	return allowlist, nil
+}
+
+// LoadAllowlist reads an Allowlist from filename, one entry per line.
+// Everything after a # is a comment, and blank lines are skipped.
+func LoadAllowlist(filename string) (*Allowlist, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	allowlist := &Allowlist{fingerprints: map[string]bool{}}
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(strings.SplitN(scanner.Text(), "#", 2)[0])
+		if entry == "" {
+			continue
+		}
+
+		if err := allowlist.add(entry); err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", filename, line, err)
+		}
+	}
+
+	return allowlist, scanner.Err()
+}
+
+func (a *Allowlist) add(entry string) error {
+	entry = strings.TrimSpace(entry)
+
+	if strings.Contains(entry, "@") {
+		pattern := strings.ToLower(entry)
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Bad email pattern in the allowlist: %s", entry)
+		}
+		a.emails = append(a.emails, pattern)
+		return nil
+	}
+
+	fingerprint := lookup.NormalizeFingerprint(entry)
+	if _, err := hex.DecodeString(fingerprint); err != nil || len(fingerprint) != 40 {
+		return fmt.Errorf("Allowlist entries have to be full fingerprints or email addresses: %s", entry)
+	}
+	a.fingerprints[fingerprint] = true
+
+	return nil
+}
+
+// Len is how many entries the Allowlist has.
+func (a *Allowlist) Len() int {
+	return len(a.fingerprints) + len(a.emails)
+}
+
+// Allows is true when signer's primary key fingerprint, or the email address
+// on one of its identities, is on the Allowlist.
+func (a *Allowlist) Allows(signer *openpgp.Entity) bool {
+	if a.fingerprints[fmt.Sprintf("%X", signer.PrimaryKey.Fingerprint)] {
+		return true
+	}
+
+	for _, identity := range signer.Identities {
+		if identity.UserId == nil || identity.UserId.Email == "" {
+			continue
+		}
+
+		email := strings.ToLower(strings.TrimSpace(identity.UserId.Email))
+		for _, pattern := range a.emails {
+			if matched, _ := path.Match(pattern, email); matched || lookup.SameEmail(pattern, email) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Check returns ErrNotAllowed (wrapped) unless the Allowlist Allows signer.
+func (a *Allowlist) Check(signer *openpgp.Entity) error {
+	if a.Allows(signer) {
+		return nil
+	}
+
+	return fmt.Errorf("%w: %X", ErrNotAllowed, signer.PrimaryKey.Fingerprint)
+}
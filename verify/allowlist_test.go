@@ -0,0 +1,131 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package verify
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/ellotheth/pipethis/lookup"
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/crypto/openpgp"
+)
+
+type AllowlistTest struct {
+	author *openpgp.Entity
+	other  *openpgp.Entity
+	suite.Suite
+}
+
+func (s *AllowlistTest) SetupSuite() {
+	s.author = newTestEntity(s.T(), "Author", "author@example.com")
+	s.other = newTestEntity(s.T(), "Other", "other@example.org")
+}
+
+// verify checks a good signature by signer against allowlist.
+func (s *AllowlistTest) verify(signer *openpgp.Entity, allowlist *Allowlist) error {
+	sig := detachSign(s.T(), signer, script)
+
+	verifier := NewVerifier(openpgp.EntityList{s.author, s.other})
+	verifier.Allowlist = allowlist
+
+	_, err := verifier.Verify(bytes.NewBufferString(script), bytes.NewReader(sig))
+	return err
+}
+
+func (s *AllowlistTest) TestRejectsSignersNotOnTheList() {
+	allowlist, err := NewAllowlist([]string{fmt.Sprintf("%X", s.author.PrimaryKey.Fingerprint)})
+	s.Require().NoError(err)
+
+	err = s.verify(s.other, allowlist)
+	s.True(errors.Is(err, ErrNotAllowed), err)
+
+	sig := detachSign(s.T(), s.other, script)
+	verifier := NewVerifier(openpgp.EntityList{s.other})
+	verifier.Allowlist = allowlist
+	report := verifier.Check(bytes.NewBufferString(script), bytes.NewReader(sig))
+	s.Equal(NotAllowed, report.Outcome)
+	s.Equal("not_allowed", report.Outcome.String())
+}
+
+func (s *AllowlistTest) TestAcceptsFingerprints() {
+	// spaced out the way GnuPG shows it, in lowercase
+	fingerprint := lookup.FormatFingerprint(fmt.Sprintf("%x", s.author.PrimaryKey.Fingerprint))
+	allowlist, err := NewAllowlist([]string{fingerprint})
+	s.Require().NoError(err)
+
+	s.NoError(s.verify(s.author, allowlist))
+}
+
+func (s *AllowlistTest) TestAcceptsEmailPatterns() {
+	allowlist, err := NewAllowlist([]string{"*@EXAMPLE.com"})
+	s.Require().NoError(err)
+
+	s.NoError(s.verify(s.author, allowlist))
+	s.True(errors.Is(s.verify(s.other, allowlist), ErrNotAllowed))
+
+	allowlist, err = NewAllowlist([]string{" Other@example.org "})
+	s.Require().NoError(err)
+
+	s.NoError(s.verify(s.other, allowlist))
+	s.True(errors.Is(s.verify(s.author, allowlist), ErrNotAllowed))
+}
+
+func (s *AllowlistTest) TestRejectsBadEntries() {
+	for _, entry := range []string{"DEADBEEF", "not a fingerprint", "[@example.com"} {
+		_, err := NewAllowlist([]string{entry})
+		s.Error(err, entry)
+	}
+}
+
+func (s *AllowlistTest) TestLoadAllowlist() {
+	contents := fmt.Sprintf(`# the release team
+%X  # release signing key
+
+*@example.org
+`, s.author.PrimaryKey.Fingerprint)
+	filename := s.writeAllowlist(contents)
+	defer os.Remove(filename)
+
+	allowlist, err := LoadAllowlist(filename)
+	s.Require().NoError(err)
+	s.Equal(2, allowlist.Len())
+
+	s.NoError(s.verify(s.author, allowlist))
+	s.NoError(s.verify(s.other, allowlist))
+
+	bad := s.writeAllowlist("# nobody\nnobody\n")
+	defer os.Remove(bad)
+
+	_, err = LoadAllowlist(bad)
+	s.EqualError(err, bad+" line 2: Allowlist entries have to be full fingerprints or email addresses: nobody")
+
+	_, err = LoadAllowlist(bad + ".missing")
+	s.True(os.IsNotExist(err))
+}
+
+func (s *AllowlistTest) writeAllowlist(contents string) string {
+	file, err := ioutil.TempFile("", "pipethis-allowlist-")
+	s.Require().NoError(err)
+	defer file.Close()
+
+	_, err = file.WriteString(contents)
+	s.Require().NoError(err)
+
+	return file.Name()
+}
+
+func TestAllowlistTest(t *testing.T) {
+	suite.Run(t, new(AllowlistTest))
+}
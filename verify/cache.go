@@ -0,0 +1,189 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package verify
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/ellotheth/pipethis/lookup"
+	"golang.org/x/crypto/openpgp"
+)
+
+// VerificationCache remembers the scripts that have been verified, by the
+// SHA-256 of their contents, the SHA-256 of the signature, and the fingerprint
+// of the key that signed them, so a Verifier doesn't have to check the same
+// signature on the same script over and over. Only the signature check itself
+// is skipped: everything else the Verifier requires of the signer is checked
+// every time. A signature that isn't byte for byte the one that was verified
+// never hits, so the details the Verifier's policies read from it (the hash
+// and the creation time) are always from a signature that's been checked.
+//
+// A cached verification only counts while the signing key is the same as it
+// was: if it's been revoked, or its expiry has changed, or anything else about
+// it has, the signature is checked again. It doesn't count once the key has
+// expired, either.
+type VerificationCache struct {
+	dir string
+
+	// now is the clock expiry is checked against. It's only replaced in
+	// tests.
+	now func() time.Time
+}
+
+// NewVerificationCache creates a VerificationCache that keeps its records in
+// dir. If dir is empty, the verified directory in lookup.DefaultCacheDir() is
+// used.
+func NewVerificationCache(dir string) *VerificationCache {
+	if dir == "" {
+		dir = path.Join(lookup.DefaultCacheDir(), "verified")
+	}
+
+	return &VerificationCache{dir: dir}
+}
+
+func (c *VerificationCache) clock() time.Time {
+	if c.now == nil {
+		return time.Now()
+	}
+
+	return c.now()
+}
+
+// verify works like the package-level Verify, except that a script that's
+// already been verified with the same signature and key isn't verified again.
+// The script is read into memory, so it's only hashed once, and what's
+// verified is exactly what's recorded.
+func (c *VerificationCache) verify(script io.Reader, signature io.Reader, ring openpgp.EntityList) (*VerificationResult, error) {
+	contents, err := ioutil.ReadAll(script)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(contents)
+	scriptHash := hex.EncodeToString(sum[:])
+
+	signature, err = dearmor(signature)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := ioutil.ReadAll(signature)
+	if err != nil {
+		return nil, err
+	}
+	sum = sha256.Sum256(raw)
+	sigHash := hex.EncodeToString(sum[:])
+
+	if details, err := signatureDetails(raw); err == nil {
+		for _, key := range ring.KeysById(details.issuer) {
+			if !c.hit(scriptHash, sigHash, key.Entity) {
+				continue
+			}
+			if result, err := newResult(key.Entity, raw); err == nil {
+				result.Cached = true
+				return result, nil
+			}
+		}
+	}
+
+	result, err := Verify(bytes.NewReader(contents), bytes.NewReader(raw), ring)
+	if err != nil {
+		return nil, err
+	}
+
+	// a cache that can't be written to just means verifying again next time
+	c.save(scriptHash, sigHash, result.Signer)
+
+	return result, nil
+}
+
+// filename is where the record for the script with scriptHash, signed by
+// signer with the signature with sigHash, is kept.
+func (c *VerificationCache) filename(scriptHash, sigHash string, signer *openpgp.Entity) string {
+	return path.Join(c.dir, scriptHash+"-"+sigHash+"-"+hex.EncodeToString(signer.PrimaryKey.Fingerprint[:]))
+}
+
+// hit is true when the script with scriptHash has been verified with the
+// signature with sigHash and signer, signer hasn't changed since, and it's
+// still good.
+func (c *VerificationCache) hit(scriptHash, sigHash string, signer *openpgp.Entity) bool {
+	if len(signer.Revocations) > 0 {
+		return false
+	}
+	if expiry := lookup.KeyExpiry(signer); !expiry.IsZero() && c.clock().After(expiry) {
+		return false
+	}
+
+	recorded, err := ioutil.ReadFile(c.filename(scriptHash, sigHash, signer))
+	if err != nil {
+		return false
+	}
+
+	state, err := keyState(signer)
+
+	return err == nil && string(recorded) == state
+}
+
+// save records that the script with scriptHash was verified with the
+// signature with sigHash and signer, as signer is now.
+func (c *VerificationCache) save(scriptHash, sigHash string, signer *openpgp.Entity) error {
+	state, err := keyState(signer)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		return err
+	}
+
+	// write someplace temporary first, so a half-written record never shows
+	// up in the cache
+	file, err := ioutil.TempFile(c.dir, "pipethis-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	if _, err := file.WriteString(state); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), c.filename(scriptHash, sigHash, signer))
+}
+
+// keyState is a digest of everything about key that could change whether it
+// should be trusted: its identities and their self-signatures (with the
+// expiry), its subkeys and their binding signatures (or revocations), and its
+// own revocations.
+func keyState(key *openpgp.Entity) (string, error) {
+	hash := sha256.New()
+
+	if err := key.Serialize(hash); err != nil {
+		return "", err
+	}
+
+	// Serialize leaves these out
+	for _, revocation := range key.Revocations {
+		if err := revocation.Serialize(hash); err != nil {
+			return "", err
+		}
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,175 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package verify
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+type CacheTest struct {
+	dir      string
+	author   *openpgp.Entity
+	verifier *Verifier
+	suite.Suite
+}
+
+func (s *CacheTest) SetupTest() {
+	s.dir, _ = ioutil.TempDir("", "pipethis-test-")
+	s.author = newTestEntity(s.T(), "Author", "author@example.com")
+
+	s.verifier = NewVerifier(openpgp.EntityList{s.author})
+	s.verifier.Cache = NewVerificationCache(s.dir)
+}
+
+func (s *CacheTest) TearDownTest() {
+	os.RemoveAll(s.dir)
+}
+
+func (s *CacheTest) verify(contents string, sig []byte) (*VerificationResult, error) {
+	return s.verifier.Verify(bytes.NewBufferString(contents), bytes.NewReader(sig))
+}
+
+// scriptHash is the hex SHA-256 of the test script.
+func (s *CacheTest) scriptHash() string {
+	sum := sha256.Sum256([]byte(script))
+	return hex.EncodeToString(sum[:])
+}
+
+// sigHash is the hex SHA-256 of a binary signature.
+func (s *CacheTest) sigHash(sig []byte) string {
+	sum := sha256.Sum256(sig)
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *CacheTest) TestHitSkipsVerification() {
+	sig := detachSign(s.T(), s.author, script)
+
+	result, err := s.verify(script, sig)
+	s.Require().NoError(err)
+	s.False(result.Cached)
+
+	result, err = s.verify(script, sig)
+	s.Require().NoError(err)
+	s.True(result.Cached)
+	s.Equal(s.author, result.Signer)
+	s.Equal(s.author.PrimaryKey.KeyIdString(), result.KeyID)
+
+	// an armored copy of the same signature is the same signature
+	result, err = s.verify(script, armorSignature(s.T(), sig))
+	s.Require().NoError(err)
+	s.True(result.Cached)
+}
+
+func (s *CacheTest) TestOtherSignaturesDontHit() {
+	sig := detachSign(s.T(), s.author, script)
+	_, err := s.verify(script, sig)
+	s.Require().NoError(err)
+
+	// same issuer, same script, but the signature itself is broken
+	mangled := append([]byte{}, sig...)
+	mangled[len(mangled)-1] ^= 0xff
+	_, err = s.verify(script, mangled)
+	s.Error(err)
+
+	// and a different good signature is checked, not taken from the cache
+	earlier := &bytes.Buffer{}
+	config := &packet.Config{Time: func() time.Time { return time.Now().Add(-time.Hour) }}
+	s.Require().NoError(openpgp.DetachSign(earlier, s.author, bytes.NewBufferString(script), config))
+	result, err := s.verify(script, earlier.Bytes())
+	s.Require().NoError(err)
+	s.False(result.Cached)
+}
+
+func (s *CacheTest) TestChangedScriptIsVerifiedAgain() {
+	sig := detachSign(s.T(), s.author, script)
+
+	_, err := s.verify(script, sig)
+	s.Require().NoError(err)
+
+	_, err = s.verify(script+"rm -rf ~\n", sig)
+	s.True(errors.Is(err, ErrBadSignature), err)
+
+	changed := script + "echo again\n"
+	result, err := s.verify(changed, detachSign(s.T(), s.author, changed))
+	s.Require().NoError(err)
+	s.False(result.Cached)
+}
+
+func (s *CacheTest) TestOtherSignersDontHit() {
+	sig := detachSign(s.T(), s.author, script)
+	_, err := s.verify(script, sig)
+	s.Require().NoError(err)
+
+	other := newTestEntity(s.T(), "Other", "other@example.com")
+	s.verifier.Ring = append(s.verifier.Ring, other)
+
+	result, err := s.verify(script, detachSign(s.T(), other, script))
+	s.Require().NoError(err)
+	s.False(result.Cached)
+	s.Equal(other, result.Signer)
+}
+
+func (s *CacheTest) TestKeyChangesInvalidate() {
+	sig := detachSign(s.T(), s.author, script)
+	_, err := s.verify(script, sig)
+	s.Require().NoError(err)
+
+	// a new expiry on the key
+	lifetime := uint32((48 * time.Hour).Seconds())
+	for _, identity := range s.author.Identities {
+		identity.SelfSignature.KeyLifetimeSecs = &lifetime
+		s.Require().NoError(identity.SelfSignature.SignUserId(identity.UserId.Id, s.author.PrimaryKey, s.author.PrivateKey, nil))
+	}
+
+	result, err := s.verify(script, sig)
+	s.Require().NoError(err)
+	s.False(result.Cached)
+
+	result, err = s.verify(script, sig)
+	s.Require().NoError(err)
+	s.True(result.Cached)
+
+	// and once it's run out, it's checked again (and openpgp won't use it)
+	s.verifier.Cache.now = func() time.Time { return s.author.PrimaryKey.CreationTime.Add(72 * time.Hour) }
+	s.False(s.verifier.Cache.hit(s.scriptHash(), s.sigHash(sig), s.author))
+	s.verifier.Cache.now = nil
+	s.True(s.verifier.Cache.hit(s.scriptHash(), s.sigHash(sig), s.author))
+
+	// a revocation, which openpgp won't use either
+	s.author.Revocations = append(s.author.Revocations, &packet.Signature{SigType: packet.SigTypeKeyRevocation})
+	s.False(s.verifier.Cache.hit(s.scriptHash(), s.sigHash(sig), s.author))
+	_, err = s.verify(script, sig)
+	s.True(errors.Is(err, ErrUnknownSigner), err)
+}
+
+func (s *CacheTest) TestPoliciesStillApply() {
+	sig := detachSign(s.T(), s.author, script)
+	_, err := s.verify(script, sig)
+	s.Require().NoError(err)
+
+	s.verifier.RequireEmail = "jane@example.com"
+	_, err = s.verify(script, sig)
+	s.True(errors.Is(err, ErrIdentityMismatch), err)
+}
+
+func TestCacheTest(t *testing.T) {
+	suite.Run(t, new(CacheTest))
+}
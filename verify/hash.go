@@ -0,0 +1,44 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package verify
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+)
+
+// ErrWeakHash means the signature is good, but it was made with a hash
+// algorithm the Verifier's HashPolicy doesn't allow.
+var ErrWeakHash = errors.New("Signature uses a weak hash algorithm")
+
+// HashPolicy sets the hash algorithms a Verifier won't accept signatures
+// made with, however good they are otherwise.
+type HashPolicy struct {
+	Rejected []crypto.Hash
+}
+
+// DefaultHashPolicy rejects MD5, which is long broken.
+var DefaultHashPolicy = HashPolicy{Rejected: []crypto.Hash{crypto.MD5}}
+
+// StrictHashPolicy rejects SHA-1 and RIPEMD-160 as well as MD5, leaving only
+// the SHA-2 family.
+var StrictHashPolicy = HashPolicy{Rejected: []crypto.Hash{crypto.MD5, crypto.SHA1, crypto.RIPEMD160}}
+
+// Check makes sure the signature in result wasn't made with a rejected hash.
+func (p HashPolicy) Check(result *VerificationResult) error {
+	for _, rejected := range p.Rejected {
+		if result.Hash == rejected {
+			return fmt.Errorf("%w: %s", ErrWeakHash, result.Hash)
+		}
+	}
+
+	return nil
+}
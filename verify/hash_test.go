@@ -0,0 +1,86 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package verify
+
+import (
+	"bytes"
+	"crypto"
+	_ "crypto/md5"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+type HashTest struct {
+	suite.Suite
+}
+
+// verify checks testdata/script.sh against testdata/script.sh.<hash>.sig,
+// which testdata/hashes.gpg signed with that hash, under policy.
+func (s *HashTest) verify(hash string, policy *HashPolicy) (*VerificationResult, error) {
+	script, _ := os.Open("testdata/script.sh")
+	defer script.Close()
+	sig, _ := os.Open("testdata/script.sh." + hash + ".sig")
+	defer sig.Close()
+
+	verifier := NewVerifier(readTestRing(s.T(), "testdata/hashes.gpg"))
+	verifier.HashPolicy = policy
+
+	return verifier.Verify(script, sig)
+}
+
+func (s *HashTest) TestPicksTheSignaturesHash() {
+	hashes := map[string]crypto.Hash{"sha1": crypto.SHA1, "sha256": crypto.SHA256, "sha512": crypto.SHA512}
+
+	for name, hash := range hashes {
+		result, err := s.verify(name, nil)
+		s.Require().NoError(err, name)
+		s.Equal(hash, result.Hash, name)
+	}
+}
+
+func (s *HashTest) TestDefaultPolicyAllowsSHA1() {
+	for _, name := range []string{"sha1", "sha256", "sha512"} {
+		_, err := s.verify(name, &DefaultHashPolicy)
+		s.NoError(err, name)
+	}
+}
+
+func (s *HashTest) TestStrictPolicyRejectsSHA1() {
+	_, err := s.verify("sha1", &StrictHashPolicy)
+	s.True(errors.Is(err, ErrWeakHash), err)
+	s.EqualError(err, "Signature uses a weak hash algorithm: SHA-1")
+
+	_, err = s.verify("sha256", &StrictHashPolicy)
+	s.NoError(err)
+}
+
+func (s *HashTest) TestDefaultPolicyRejectsMD5() {
+	author := newTestEntity(s.T(), "Author", "author@example.com")
+	sig := &bytes.Buffer{}
+	s.Require().NoError(openpgp.DetachSign(sig, author, bytes.NewBufferString(script), &packet.Config{DefaultHash: crypto.MD5}))
+
+	verifier := NewVerifier(openpgp.EntityList{author})
+	_, err := verifier.Verify(bytes.NewBufferString(script), bytes.NewReader(sig.Bytes()))
+	s.Require().NoError(err, "MD5 signatures should verify without a policy")
+
+	verifier.HashPolicy = &DefaultHashPolicy
+	report := verifier.Check(bytes.NewBufferString(script), bytes.NewReader(sig.Bytes()))
+	s.Equal(WeakHash, report.Outcome)
+	s.Equal("Signature uses a weak hash algorithm: MD5", report.String())
+}
+
+func TestHashTest(t *testing.T) {
+	suite.Run(t, new(HashTest))
+}
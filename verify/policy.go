@@ -0,0 +1,89 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package verify
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// ErrWeakKey means the signature is good, but the key that made it is weaker
+// than the Verifier's KeyPolicy allows.
+var ErrWeakKey = errors.New("Signing key is too weak")
+
+// KeyPolicy sets the weakest keys a Verifier will trust. It applies to the
+// signer's primary key and to the subkey that made the signature, if that's
+// not the primary key. Elliptic curve keys aren't limited.
+type KeyPolicy struct {
+	// MinRSABits is the shortest RSA (or ElGamal) key allowed.
+	MinRSABits int
+
+	// MinDSABits is the shortest DSA key allowed. Since nearly every DSA key
+	// out there is 1024 bits, setting this to 2048 or more just about rules
+	// DSA out.
+	MinDSABits int
+}
+
+// DefaultKeyPolicy rejects RSA and DSA keys shorter than 2048 bits.
+var DefaultKeyPolicy = KeyPolicy{MinRSABits: 2048, MinDSABits: 2048}
+
+// algorithmNames are the names used in ErrWeakKey errors.
+var algorithmNames = map[packet.PublicKeyAlgorithm]string{
+	packet.PubKeyAlgoRSA:            "RSA",
+	packet.PubKeyAlgoRSASignOnly:    "RSA",
+	packet.PubKeyAlgoRSAEncryptOnly: "RSA",
+	packet.PubKeyAlgoDSA:            "DSA",
+	packet.PubKeyAlgoElGamal:        "ElGamal",
+}
+
+// checkKey makes sure key is at least as strong as the policy. what says
+// which key it is, for the error.
+func (p KeyPolicy) checkKey(key *packet.PublicKey, what string) error {
+	var min int
+
+	switch key.PubKeyAlgo {
+	case packet.PubKeyAlgoRSA, packet.PubKeyAlgoRSASignOnly, packet.PubKeyAlgoRSAEncryptOnly, packet.PubKeyAlgoElGamal:
+		min = p.MinRSABits
+	case packet.PubKeyAlgoDSA:
+		min = p.MinDSABits
+	default:
+		return nil
+	}
+
+	bits, err := key.BitLength()
+	if err != nil {
+		return err
+	}
+
+	if int(bits) < min {
+		return fmt.Errorf("%w: %s %s is %s-%d, need at least %d bits", ErrWeakKey, what, key.KeyIdString(), algorithmNames[key.PubKeyAlgo], bits, min)
+	}
+
+	return nil
+}
+
+// Check makes sure the primary key of signer, and the subkey with keyID if
+// that's what made the signature, are at least as strong as the policy.
+func (p KeyPolicy) Check(signer *openpgp.Entity, keyID string) error {
+	if err := p.checkKey(signer.PrimaryKey, "primary key"); err != nil {
+		return err
+	}
+
+	for _, subkey := range signer.Subkeys {
+		if subkey.PublicKey.KeyIdString() == keyID {
+			return p.checkKey(subkey.PublicKey, "signing subkey")
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,79 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package verify
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/crypto/openpgp"
+)
+
+type PolicyTest struct {
+	suite.Suite
+}
+
+// verify checks testdata/script.sh against the signature made by the key
+// named name, with policy.
+func (s *PolicyTest) verify(name string, policy *KeyPolicy) error {
+	script, _ := os.Open("testdata/script.sh")
+	defer script.Close()
+	sig, _ := os.Open("testdata/script.sh." + name + ".sig")
+	defer sig.Close()
+
+	verifier := NewVerifier(readTestRing(s.T(), "testdata/"+name+".gpg"))
+	verifier.Policy = policy
+
+	_, err := verifier.Verify(script, sig)
+	return err
+}
+
+func (s *PolicyTest) TestDefaultPolicyAcceptsStrongKeys() {
+	s.NoError(s.verify("strong", &DefaultKeyPolicy))
+}
+
+func (s *PolicyTest) TestDefaultPolicyRejectsWeakKeys() {
+	err := s.verify("weak-rsa", &DefaultKeyPolicy)
+	s.True(errors.Is(err, ErrWeakKey), err)
+	s.EqualError(err, "Signing key is too weak: primary key D4724995DF8D9217 is RSA-1024, need at least 2048 bits")
+
+	err = s.verify("weak-dsa", &DefaultKeyPolicy)
+	s.True(errors.Is(err, ErrWeakKey), err)
+	s.EqualError(err, "Signing key is too weak: primary key 543D8B88AFB4B9E6 is DSA-1024, need at least 2048 bits")
+}
+
+func (s *PolicyTest) TestPolicyIsConfigurable() {
+	s.NoError(s.verify("weak-rsa", nil))
+	s.NoError(s.verify("weak-dsa", &KeyPolicy{MinRSABits: 2048, MinDSABits: 1024}))
+	s.Error(s.verify("weak-rsa", &KeyPolicy{MinRSABits: 2048, MinDSABits: 1024}))
+	s.Error(s.verify("strong", &KeyPolicy{MinRSABits: 4096}))
+}
+
+func (s *PolicyTest) TestPolicyChecksSigningSubkey() {
+	ring := readTestRing(s.T(), "testdata/subkey.gpg")
+	s.NoError(DefaultKeyPolicy.Check(ring[0], "6523F848D72D24A1"))
+
+	// a strong primary key doesn't make up for a weak signing subkey
+	strong := readTestRing(s.T(), "testdata/strong.gpg")[0]
+	weak := readTestRing(s.T(), "testdata/weak-rsa.gpg")[0]
+	signer := &openpgp.Entity{
+		PrimaryKey: strong.PrimaryKey,
+		Subkeys:    []openpgp.Subkey{{PublicKey: weak.PrimaryKey}},
+	}
+
+	s.NoError(DefaultKeyPolicy.Check(signer, strong.PrimaryKey.KeyIdString()))
+	s.EqualError(DefaultKeyPolicy.Check(signer, "D4724995DF8D9217"), "Signing key is too weak: signing subkey D4724995DF8D9217 is RSA-1024, need at least 2048 bits")
+}
+
+func TestPolicyTest(t *testing.T) {
+	suite.Run(t, new(PolicyTest))
+}
@@ -0,0 +1,152 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package verify
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// ErrQuorumNotMet means fewer of a script's signers checked out than the
+// Verifier needs.
+var ErrQuorumNotMet = errors.New("Not enough good signatures")
+
+// VerifyQuorum checks every signature in signatures against script, the same
+// way Verify does, and needs good signatures from at least threshold
+// different keys. Each reader in signatures can hold one signature or several
+// (concatenated binary signatures, or one armored block after another). It
+// returns the results for the good signatures; if there aren't enough of
+// them, the error (which wraps ErrQuorumNotMet) lists what was wrong with each
+// of the others, including the ids of signing keys that aren't in the ring.
+func (v *Verifier) VerifyQuorum(script []byte, signatures []io.Reader, threshold int) ([]*VerificationResult, error) {
+	if threshold < 1 {
+		return nil, errors.New("The signature threshold has to be at least 1")
+	}
+
+	sigs := [][]byte{}
+	for _, signature := range signatures {
+		split, err := splitSignatures(signature)
+		if err != nil {
+			return nil, err
+		}
+		sigs = append(sigs, split...)
+	}
+
+	results := []*VerificationResult{}
+	signers := map[string]bool{}
+	failures := []string{}
+
+	for idx, sig := range sigs {
+		result, err := v.verify(bytes.NewReader(script), bytes.NewReader(sig))
+		if err != nil {
+			if errors.Is(err, ErrUnknownSigner) {
+				if issuer, ierr := issuerKeyID(sig); ierr == nil {
+					err = fmt.Errorf("%w: %X isn't in the ring", ErrUnknownSigner, issuer)
+				}
+			}
+			failures = append(failures, fmt.Sprintf("signature %d: %v", idx+1, err))
+			continue
+		}
+
+		fingerprint := fmt.Sprintf("%X", result.Signer.PrimaryKey.Fingerprint)
+		if signers[fingerprint] {
+			failures = append(failures, fmt.Sprintf("signature %d: another signature by %s", idx+1, fingerprint))
+			continue
+		}
+		signers[fingerprint] = true
+		results = append(results, result)
+	}
+
+	v.logf("%d of %d signatures verified, %d needed", len(results), len(sigs), threshold)
+
+	if len(results) < threshold {
+		details := ""
+		for _, failure := range failures {
+			details += "\n  " + failure
+		}
+		return results, fmt.Errorf("%w: %d of %d needed%s", ErrQuorumNotMet, len(results), threshold, details)
+	}
+
+	return results, nil
+}
+
+// splitSignatures reads every signature in r, which can be binary or
+// armored, and returns each one on its own.
+func splitSignatures(r io.Reader) ([][]byte, error) {
+	buffered := bufio.NewReader(r)
+
+	head, _ := buffered.Peek(64)
+	if !bytes.HasPrefix(bytes.TrimSpace(head), []byte("-----BEGIN PGP")) {
+		return splitPackets(buffered)
+	}
+
+	sigs := [][]byte{}
+	for {
+		block, err := armor.Decode(buffered)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrMalformedSignature, err)
+		}
+
+		split, err := splitPackets(block.Body)
+		if err != nil {
+			return nil, err
+		}
+		sigs = append(sigs, split...)
+	}
+
+	return sigs, nil
+}
+
+// splitPackets reads the binary signature packets in r.
+func splitPackets(r io.Reader) ([][]byte, error) {
+	raw, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	sigs := [][]byte{}
+	packets := packet.NewReader(bytes.NewReader(raw))
+	for {
+		p, err := packets.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, classify(err)
+		}
+
+		sig, ok := p.(*packet.Signature)
+		if !ok {
+			return nil, fmt.Errorf("%w: expected a signature packet, found %T", ErrMalformedSignature, p)
+		}
+
+		var buf bytes.Buffer
+		if err := sig.Serialize(&buf); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrMalformedSignature, err)
+		}
+		sigs = append(sigs, buf.Bytes())
+	}
+
+	if len(sigs) == 0 {
+		return nil, fmt.Errorf("%w: no signatures found", ErrMalformedSignature)
+	}
+
+	return sigs, nil
+}
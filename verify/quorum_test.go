@@ -0,0 +1,117 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package verify
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/crypto/openpgp"
+)
+
+type QuorumTest struct {
+	first    *openpgp.Entity
+	second   *openpgp.Entity
+	outsider *openpgp.Entity
+	verifier *Verifier
+	suite.Suite
+}
+
+func (s *QuorumTest) SetupSuite() {
+	s.first = newTestEntity(s.T(), "First", "first@example.com")
+	s.second = newTestEntity(s.T(), "Second", "second@example.com")
+	s.outsider = newTestEntity(s.T(), "Outsider", "outsider@example.com")
+	s.verifier = NewVerifier(openpgp.EntityList{s.first, s.second})
+}
+
+func readers(sigs ...[]byte) []io.Reader {
+	r := []io.Reader{}
+	for _, sig := range sigs {
+		r = append(r, bytes.NewReader(sig))
+	}
+
+	return r
+}
+
+func (s *QuorumTest) TestThresholdWithOneBadSignature() {
+	good := detachSign(s.T(), s.first, script)
+	bad := detachSign(s.T(), s.second, script+"rm -rf ~\n")
+
+	results, err := s.verifier.VerifyQuorum([]byte(script), readers(good, bad), 1)
+	s.NoError(err)
+	s.Len(results, 1)
+	s.Equal(s.first, results[0].Signer)
+
+	results, err = s.verifier.VerifyQuorum([]byte(script), readers(good, bad), 2)
+	s.True(errors.Is(err, ErrQuorumNotMet), err)
+	s.Contains(err.Error(), "1 of 2 needed")
+	s.Contains(err.Error(), "signature 2: Bad signature")
+	s.Len(results, 1)
+}
+
+func (s *QuorumTest) TestThresholdMetByDifferentSigners() {
+	results, err := s.verifier.VerifyQuorum([]byte(script), readers(
+		detachSign(s.T(), s.first, script),
+		armorSignature(s.T(), detachSign(s.T(), s.second, script)),
+	), 2)
+
+	s.NoError(err)
+	s.Len(results, 2)
+}
+
+func (s *QuorumTest) TestSameSignerOnlyCountsOnce() {
+	_, err := s.verifier.VerifyQuorum([]byte(script), readers(
+		detachSign(s.T(), s.first, script),
+		detachSign(s.T(), s.first, script),
+	), 2)
+
+	s.True(errors.Is(err, ErrQuorumNotMet), err)
+	s.Contains(err.Error(), "signature 2: another signature by")
+}
+
+func (s *QuorumTest) TestListsSignersMissingFromRing() {
+	_, err := s.verifier.VerifyQuorum([]byte(script), readers(
+		detachSign(s.T(), s.first, script),
+		detachSign(s.T(), s.outsider, script),
+	), 2)
+
+	s.True(errors.Is(err, ErrQuorumNotMet), err)
+	s.Contains(err.Error(), fmt.Sprintf("signature 2: Signature made by an unknown key: %X isn't in the ring", s.outsider.PrimaryKey.KeyId))
+}
+
+func (s *QuorumTest) TestSplitsConcatenatedSignatures() {
+	first := detachSign(s.T(), s.first, script)
+	second := detachSign(s.T(), s.second, script)
+
+	binary := append(append([]byte{}, first...), second...)
+	armored := bytes.Join([][]byte{armorSignature(s.T(), first), armorSignature(s.T(), second)}, []byte("\n"))
+
+	for _, sigs := range [][]byte{binary, armored} {
+		results, err := s.verifier.VerifyQuorum([]byte(script), readers(sigs), 2)
+		s.NoError(err)
+		s.Len(results, 2)
+	}
+}
+
+func (s *QuorumTest) TestRejectsBadInput() {
+	_, err := s.verifier.VerifyQuorum([]byte(script), readers(detachSign(s.T(), s.first, script)), 0)
+	s.Error(err)
+
+	_, err = s.verifier.VerifyQuorum([]byte(script), readers([]byte("not a signature")), 1)
+	s.True(errors.Is(err, ErrMalformedSignature), err)
+}
+
+func TestQuorumTest(t *testing.T) {
+	suite.Run(t, new(QuorumTest))
+}
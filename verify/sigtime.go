@@ -0,0 +1,79 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package verify
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// ErrSignatureTime means the signature is dated when it can't have been
+// made: in the future, or before the key that made it existed.
+var ErrSignatureTime = errors.New("Signature has an impossible creation time")
+
+// TimePolicy is how a Verifier treats the creation time on a signature.
+type TimePolicy struct {
+	// ClockSkew is how far in the future a signature can be dated before
+	// it's suspicious, since not everybody's clock is right.
+	ClockSkew time.Duration
+
+	// WarnOnly makes the Verifier accept a signature with an impossible
+	// creation time, and add a warning to the VerificationResult (and log
+	// it) instead.
+	WarnOnly bool
+
+	// Now is the clock the signature is checked against. If it's nil,
+	// time.Now is used.
+	Now func() time.Time
+}
+
+// DefaultTimePolicy rejects signatures dated more than five minutes in the
+// future, or before their signing key was created.
+var DefaultTimePolicy = TimePolicy{ClockSkew: 5 * time.Minute}
+
+func (p TimePolicy) now() time.Time {
+	if p.Now == nil {
+		return time.Now()
+	}
+
+	return p.Now()
+}
+
+// Check makes sure the signature in result was made after the key that made
+// it, and isn't dated in the future (give or take ClockSkew).
+func (p TimePolicy) Check(result *VerificationResult) error {
+	if now := p.now(); result.Created.After(now.Add(p.ClockSkew)) {
+		return fmt.Errorf("%w: signed %s, %s from now", ErrSignatureTime, result.Created.UTC().Format(time.RFC3339), result.Created.Sub(now).Round(time.Second))
+	}
+
+	if key := signingKey(result); key != nil && result.Created.Before(key.CreationTime) {
+		return fmt.Errorf("%w: signed %s, but key %s was created %s", ErrSignatureTime, result.Created.UTC().Format(time.RFC3339), key.KeyIdString(), key.CreationTime.UTC().Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// signingKey is the primary key or subkey in result that made the signature.
+func signingKey(result *VerificationResult) *packet.PublicKey {
+	if !result.Subkey {
+		return result.Signer.PrimaryKey
+	}
+
+	for _, subkey := range result.Signer.Subkeys {
+		if subkey.PublicKey.KeyIdString() == result.KeyID {
+			return subkey.PublicKey
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,108 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package verify
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+type TimePolicyTest struct {
+	author *openpgp.Entity
+	now    time.Time
+	suite.Suite
+}
+
+func (s *TimePolicyTest) SetupSuite() {
+	s.author = newTestEntity(s.T(), "Author", "author@example.com")
+	s.now = s.author.PrimaryKey.CreationTime.Add(24 * time.Hour).Truncate(time.Second)
+}
+
+// signAt signs the test script with a signature dated at.
+func (s *TimePolicyTest) signAt(at time.Time) []byte {
+	sig := &bytes.Buffer{}
+	config := &packet.Config{Time: func() time.Time { return at }}
+	s.Require().NoError(openpgp.DetachSign(sig, s.author, bytes.NewBufferString(script), config))
+
+	return sig.Bytes()
+}
+
+func (s *TimePolicyTest) verify(sig []byte, policy TimePolicy) (*VerificationResult, error) {
+	policy.Now = func() time.Time { return s.now }
+
+	verifier := NewVerifier(openpgp.EntityList{s.author})
+	verifier.TimePolicy = &policy
+
+	return verifier.Verify(bytes.NewBufferString(script), bytes.NewReader(sig))
+}
+
+func (s *TimePolicyTest) TestAcceptsSignaturesFromThePast() {
+	signed := s.now.Add(-time.Hour).Truncate(time.Second)
+
+	result, err := s.verify(s.signAt(signed), DefaultTimePolicy)
+
+	s.Require().NoError(err)
+	s.True(signed.Equal(result.Created), result.Created)
+	s.Empty(result.Warnings)
+}
+
+func (s *TimePolicyTest) TestRejectsFutureSignatures() {
+	sig := s.signAt(s.now.Add(time.Hour))
+
+	_, err := s.verify(sig, DefaultTimePolicy)
+	s.True(errors.Is(err, ErrSignatureTime), err)
+	s.Contains(err.Error(), "1h0m0s from now")
+
+	report := NewVerifier(openpgp.EntityList{s.author})
+	report.TimePolicy = &TimePolicy{Now: func() time.Time { return s.now }}
+	s.Equal(BadTime, report.Check(bytes.NewBufferString(script), bytes.NewReader(sig)).Outcome)
+
+	// a clock that's a little off is fine
+	_, err = s.verify(s.signAt(s.now.Add(2*time.Minute)), DefaultTimePolicy)
+	s.NoError(err)
+
+	_, err = s.verify(sig, TimePolicy{ClockSkew: 2 * time.Hour})
+	s.NoError(err)
+}
+
+func (s *TimePolicyTest) TestRejectsSignaturesOlderThanTheKey() {
+	sig := s.signAt(s.author.PrimaryKey.CreationTime.Add(-time.Hour))
+
+	_, err := s.verify(sig, DefaultTimePolicy)
+	s.True(errors.Is(err, ErrSignatureTime), err)
+	s.Contains(err.Error(), "but key "+s.author.PrimaryKey.KeyIdString()+" was created")
+}
+
+func (s *TimePolicyTest) TestWarnOnly() {
+	var logged bytes.Buffer
+	policy := TimePolicy{WarnOnly: true, Now: func() time.Time { return s.now }}
+
+	verifier := NewVerifier(openpgp.EntityList{s.author})
+	verifier.TimePolicy = &policy
+	verifier.Logger = log.New(&logged, "", 0)
+
+	result, err := verifier.Verify(bytes.NewBufferString(script), bytes.NewReader(s.signAt(s.now.Add(time.Hour))))
+
+	s.Require().NoError(err)
+	s.Len(result.Warnings, 1)
+	s.Contains(result.Warnings[0], "Signature has an impossible creation time")
+	s.Contains(logged.String(), "warning: Signature has an impossible creation time")
+}
+
+func TestTimePolicyTest(t *testing.T) {
+	suite.Run(t, new(TimePolicyTest))
+}
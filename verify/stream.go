@@ -0,0 +1,50 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package verify
+
+import (
+	"io"
+)
+
+// VerifyStream checks the detached signature against script like Verify
+// does, and copies script to dst on the way through, so a big installer only
+// has to be read once and is never held in memory all at once.
+//
+// The memory it needs doesn't depend on the size of the script: script goes
+// through a small copy buffer (32KB) into the signature's hash and dst, one
+// chunk at a time. Only the signature, which is a few hundred bytes, is read
+// in whole.
+//
+// The signature can't be confirmed until the last byte of script has been
+// hashed, so nothing in dst can be trusted until VerifyStream returns without
+// an error. Don't hand dst to an interpreter as it's written; write it to a
+// private temp file, and run that file once VerifyStream says it's good. If
+// VerifyStream fails, dst may hold some or all of script, and it should be
+// thrown away.
+//
+// The Verifier's Cache isn't used: it needs the whole script in memory to
+// hash it before deciding whether to check the signature, and a streamed
+// script is hashed for the signature check on the way through anyway.
+func (v *Verifier) VerifyStream(dst io.Writer, script io.Reader, signature io.Reader) (*VerificationResult, error) {
+	uncached := *v
+	uncached.Cache = nil
+
+	return uncached.Verify(io.TeeReader(script, dst), signature)
+}
+
+// CheckStream verifies the detached signature against script like
+// VerifyStream, copying script to dst on the way through, but sums up the
+// outcome in a Report like Check.
+func (v *Verifier) CheckStream(dst io.Writer, script io.Reader, signature io.Reader) Report {
+	uncached := *v
+	uncached.Cache = nil
+
+	return uncached.Check(io.TeeReader(script, dst), signature)
+}
@@ -0,0 +1,140 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package verify
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/crypto/openpgp"
+)
+
+// bigScript is how big the generated installer is. It's a lot bigger than
+// the memory VerifyStream is allowed to use.
+const bigScript = 32 << 20
+
+type StreamTest struct {
+	author *openpgp.Entity
+	other  *openpgp.Entity
+	suite.Suite
+}
+
+func (s *StreamTest) SetupSuite() {
+	s.author = newTestEntity(s.T(), "Author", "author@example.com")
+	s.other = newTestEntity(s.T(), "Other", "other@example.com")
+}
+
+// patternReader makes up an endless script without keeping any of it around.
+type patternReader struct {
+	n byte
+}
+
+func (p *patternReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 'a' + p.n%26
+		p.n++
+	}
+	return len(b), nil
+}
+
+func newBigScript() io.Reader {
+	return io.LimitReader(&patternReader{}, bigScript)
+}
+
+func (s *StreamTest) signBigScript(signer *openpgp.Entity) []byte {
+	sig := &bytes.Buffer{}
+	s.Require().NoError(openpgp.DetachSign(sig, signer, newBigScript(), nil))
+	return sig.Bytes()
+}
+
+func (s *StreamTest) TestVerifyStreamCopiesTheScript() {
+	sig := s.signBigScript(s.author)
+
+	copied := sha256.New()
+	result, err := NewVerifier(openpgp.EntityList{s.author}).VerifyStream(copied, newBigScript(), bytes.NewReader(sig))
+
+	s.Require().NoError(err)
+	s.Equal(s.author.PrimaryKey.Fingerprint, result.Signer.PrimaryKey.Fingerprint)
+
+	expected := sha256.New()
+	io.Copy(expected, newBigScript())
+	s.Equal(expected.Sum(nil), copied.Sum(nil))
+}
+
+func (s *StreamTest) TestVerifyStreamMemoryIsBounded() {
+	sig := s.signBigScript(s.author)
+	verifier := NewVerifier(openpgp.EntityList{s.author})
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	_, err := verifier.VerifyStream(sha256.New(), newBigScript(), bytes.NewReader(sig))
+
+	runtime.ReadMemStats(&after)
+	s.Require().NoError(err)
+	s.Less(after.TotalAlloc-before.TotalAlloc, uint64(bigScript/8), "VerifyStream buffered the script")
+}
+
+func (s *StreamTest) TestVerifyStreamSkipsTheCache() {
+	dir, err := ioutil.TempDir("", "pipethis-test-")
+	s.Require().NoError(err)
+	defer os.RemoveAll(dir)
+
+	sig := s.signBigScript(s.author)
+	verifier := NewVerifier(openpgp.EntityList{s.author})
+	verifier.Cache = NewVerificationCache(dir)
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	result, err := verifier.VerifyStream(ioutil.Discard, newBigScript(), bytes.NewReader(sig))
+
+	runtime.ReadMemStats(&after)
+	s.Require().NoError(err)
+	s.False(result.Cached)
+	s.Less(after.TotalAlloc-before.TotalAlloc, uint64(bigScript/8), "VerifyStream buffered the script")
+
+	records, _ := ioutil.ReadDir(dir)
+	s.Empty(records)
+}
+
+func (s *StreamTest) TestVerifyStreamRejectsOtherSigners() {
+	sig := s.signBigScript(s.other)
+
+	_, err := NewVerifier(openpgp.EntityList{s.author}).VerifyStream(ioutil.Discard, newBigScript(), bytes.NewReader(sig))
+
+	s.True(errors.Is(err, ErrUnknownSigner))
+}
+
+func (s *StreamTest) TestCheckStreamReports() {
+	copied := sha256.New()
+	report := NewVerifier(openpgp.EntityList{s.author}).CheckStream(copied, newBigScript(), bytes.NewReader(s.signBigScript(s.author)))
+	s.Equal(Valid, report.Outcome, report.Err)
+
+	expected := sha256.New()
+	io.Copy(expected, newBigScript())
+	s.Equal(expected.Sum(nil), copied.Sum(nil))
+
+	report = NewVerifier(openpgp.EntityList{s.author}).CheckStream(ioutil.Discard, newBigScript(), bytes.NewReader(s.signBigScript(s.other)))
+	s.Equal(NoMatchingKey, report.Outcome)
+}
+
+func TestStreamTest(t *testing.T) {
+	suite.Run(t, new(StreamTest))
+}
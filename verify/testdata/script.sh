@@ -0,0 +1,3 @@
+#!/bin/sh
+# PIPETHIS_AUTHOR subkey@example.com
+echo hello from a subkey
@@ -0,0 +1,425 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package verify
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/ellotheth/pipethis/lookup"
+	"golang.org/x/crypto/openpgp"
+)
+
+// ErrIdentityMismatch means the signature is good, but the key that made it
+// doesn't have the identity the Verifier requires.
+var ErrIdentityMismatch = errors.New("Signing key doesn't have the required identity")
+
+// ErrSignerMismatch means the signature is good, but it was made by a
+// different key than the one the Verifier expects.
+var ErrSignerMismatch = errors.New("Signature wasn't made by the expected key")
+
+// ErrSigningKeyMismatch means the signature is good, but it was made by a
+// different primary key or subkey than the one the Verifier requires.
+var ErrSigningKeyMismatch = errors.New("Signature wasn't made by the required signing key")
+
+// Verifier checks scripts against the keys in Ring.
+type Verifier struct {
+	Ring openpgp.EntityList
+
+	// RequireEmail, if it's set, is an email address that has to be on one of
+	// the signing key's identities.
+	RequireEmail string
+
+	// RequireSigner, if it's set, is the full fingerprint of the primary key
+	// the signature has to be made by (with the primary key itself or any of
+	// its signing subkeys).
+	RequireSigner string
+
+	// RequireSigningKey, if it's set, is the full fingerprint of the one
+	// primary key or subkey allowed to make the signature. It's stricter than
+	// checking the signer's primary key, which any of its signing subkeys
+	// would pass.
+	RequireSigningKey string
+
+	// Policy, if it's set, is the weakest signing key the Verifier will
+	// trust.
+	Policy *KeyPolicy
+
+	// HashPolicy, if it's set, is the hash algorithms the Verifier won't
+	// accept signatures made with.
+	HashPolicy *HashPolicy
+
+	// Allowlist, if it's set, is the only signers the Verifier will trust.
+	Allowlist *Allowlist
+
+	// TimePolicy, if it's set, is how the Verifier treats signatures dated
+	// in the future or before their signing key was created.
+	TimePolicy *TimePolicy
+
+	// Cache, if it's set, saves checking the signature again on scripts
+	// that have already been verified with the same key.
+	Cache *VerificationCache
+
+	// Logger, if it's set, hears how each Verify turned out.
+	Logger lookup.Logger
+}
+
+// NewVerifier creates a Verifier for the keys in ring.
+func NewVerifier(ring openpgp.EntityList) *Verifier {
+	return &Verifier{Ring: ring}
+}
+
+// Verify checks the detached signature against script, the same way the
+// package-level Verify does, and then checks the signing key against the
+// Verifier's requirements.
+func (v *Verifier) Verify(script io.Reader, signature io.Reader) (*VerificationResult, error) {
+	result, err := v.verify(script, signature)
+	if err != nil {
+		v.logf("signature check failed: %v", err)
+		return nil, err
+	}
+
+	if result.Cached {
+		v.logf("signature already verified by %X (key %s)", result.Signer.PrimaryKey.Fingerprint, result.KeyID)
+	} else {
+		v.logf("signature verified by %X (key %s)", result.Signer.PrimaryKey.Fingerprint, result.KeyID)
+	}
+
+	return result, nil
+}
+
+func (v *Verifier) verify(script io.Reader, signature io.Reader) (*VerificationResult, error) {
+	v.logf("checking signature against %d keys", len(v.Ring))
+
+	verify := Verify
+	if v.Cache != nil {
+		verify = v.Cache.verify
+	}
+
+	result, err := verify(script, signature, v.Ring)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := v.checkIdentity(result.Signer); err != nil {
+		return nil, err
+	}
+
+	if err := v.checkSigner(result.Signer); err != nil {
+		return nil, err
+	}
+
+	if err := v.checkSigningKey(result); err != nil {
+		return nil, err
+	}
+
+	if v.Policy != nil {
+		if err := v.Policy.Check(result.Signer, result.KeyID); err != nil {
+			return nil, err
+		}
+	}
+
+	if v.HashPolicy != nil {
+		if err := v.HashPolicy.Check(result); err != nil {
+			return nil, err
+		}
+	}
+
+	if v.Allowlist != nil {
+		if err := v.Allowlist.Check(result.Signer); err != nil {
+			return nil, err
+		}
+	}
+
+	if v.TimePolicy != nil {
+		if err := v.TimePolicy.Check(result); err != nil && !v.TimePolicy.WarnOnly {
+			return nil, err
+		} else if err != nil {
+			v.logf("warning: %v", err)
+			result.Warnings = append(result.Warnings, err.Error())
+		}
+	}
+
+	return result, nil
+}
+
+// logf logs to the Verifier's Logger, if it has one.
+func (v *Verifier) logf(format string, args ...interface{}) {
+	if v.Logger != nil {
+		v.Logger.Printf(format, args...)
+	}
+}
+
+// checkIdentity makes sure signer has the RequireEmail address, if there is
+// one.
+func (v *Verifier) checkIdentity(signer *openpgp.Entity) error {
+	if v.RequireEmail == "" {
+		return nil
+	}
+
+	for _, identity := range signer.Identities {
+		if identity.UserId != nil && lookup.SameEmail(identity.UserId.Email, v.RequireEmail) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: %s", ErrIdentityMismatch, v.RequireEmail)
+}
+
+// checkSigner makes sure signer is the RequireSigner, if there is one.
+func (v *Verifier) checkSigner(signer *openpgp.Entity) error {
+	if v.RequireSigner == "" {
+		return nil
+	}
+
+	required := lookup.NormalizeFingerprint(v.RequireSigner)
+	actual := fmt.Sprintf("%X", signer.PrimaryKey.Fingerprint)
+	if actual != required {
+		return fmt.Errorf("%w: wanted %s, signed by %s", ErrSignerMismatch, required, actual)
+	}
+
+	return nil
+}
+
+// checkSigningKey makes sure the RequireSigningKey made the signature in
+// result, if there is one.
+func (v *Verifier) checkSigningKey(result *VerificationResult) error {
+	if v.RequireSigningKey == "" {
+		return nil
+	}
+
+	required := lookup.NormalizeFingerprint(v.RequireSigningKey)
+	actual := fmt.Sprintf("%X", result.SignedBy.PublicKey.Fingerprint)
+	if actual != required {
+		return fmt.Errorf("%w: wanted %s, signed by %s", ErrSigningKeyMismatch, required, actual)
+	}
+
+	return nil
+}
+
+// ParseSigningKey checks that raw is a full fingerprint, which is all
+// RequireSigningKey takes (key ids are too easy to collide), and returns it
+// in plain uppercase hex.
+func ParseSigningKey(raw string) (string, error) {
+	fingerprint := lookup.NormalizeFingerprint(raw)
+	if _, err := hex.DecodeString(fingerprint); err != nil || len(fingerprint) != 40 {
+		return "", fmt.Errorf("The required signing key has to be a full fingerprint: %s", raw)
+	}
+
+	return fingerprint, nil
+}
+
+// Outcome sums up what a Check found.
+type Outcome int
+
+const (
+	// Valid means the signature is good.
+	Valid Outcome = iota
+
+	// NoMatchingKey means the signature was made by a key that isn't in the
+	// ring.
+	NoMatchingKey
+
+	// BadSignature means the signature doesn't match the script.
+	BadSignature
+
+	// MalformedSignature means the signature couldn't be parsed.
+	MalformedSignature
+
+	// IdentityMismatch means the signature is good, but the signing key
+	// doesn't have the required identity.
+	IdentityMismatch
+
+	// SignerMismatch means the signature is good, but it was made by a
+	// different key than the expected one.
+	SignerMismatch
+
+	// SigningKeyMismatch means the signature is good, but it was made by a
+	// different primary key or subkey than the required one.
+	SigningKeyMismatch
+
+	// WeakKey means the signature is good, but the signing key is weaker
+	// than the policy allows.
+	WeakKey
+
+	// WeakHash means the signature is good, but it was made with a hash
+	// algorithm the policy doesn't allow.
+	WeakHash
+
+	// BadTime means the signature is good, but it's dated in the future or
+	// before the signing key was created.
+	BadTime
+
+	// NotAllowed means the signature is good, but the signing key isn't on
+	// the allowlist.
+	NotAllowed
+
+	// Failed means the check couldn't be finished, e.g. because the script
+	// couldn't be read.
+	Failed
+)
+
+// outcomeNames are the Outcomes' names in JSON.
+var outcomeNames = map[Outcome]string{
+	Valid:              "valid",
+	NoMatchingKey:      "no_matching_key",
+	BadSignature:       "bad_signature",
+	MalformedSignature: "malformed_signature",
+	IdentityMismatch:   "identity_mismatch",
+	SignerMismatch:     "signer_mismatch",
+	SigningKeyMismatch: "signing_key_mismatch",
+	WeakKey:            "weak_key",
+	WeakHash:           "weak_hash",
+	BadTime:            "bad_time",
+	NotAllowed:         "not_allowed",
+	Failed:             "failed",
+}
+
+// String is the Outcome's name, like "valid" or "bad_signature".
+func (o Outcome) String() string {
+	if name, ok := outcomeNames[o]; ok {
+		return name
+	}
+
+	return "unknown"
+}
+
+// Report is the result of a Check, for callers that want to show what
+// happened instead of just acting on it.
+type Report struct {
+	Outcome Outcome
+
+	// Result describes the signature when the Outcome is Valid, and is nil
+	// otherwise.
+	Result *VerificationResult
+
+	// Err is the reason the Outcome isn't Valid.
+	Err error
+}
+
+// Check verifies the detached signature against script like Verify, but
+// sums up the outcome in a Report instead of returning an error.
+func (v *Verifier) Check(script io.Reader, signature io.Reader) Report {
+	result, err := v.Verify(script, signature)
+
+	switch {
+	case err == nil:
+		return Report{Outcome: Valid, Result: result}
+	case errors.Is(err, ErrUnknownSigner):
+		return Report{Outcome: NoMatchingKey, Err: err}
+	case errors.Is(err, ErrBadSignature):
+		return Report{Outcome: BadSignature, Err: err}
+	case errors.Is(err, ErrMalformedSignature):
+		return Report{Outcome: MalformedSignature, Err: err}
+	case errors.Is(err, ErrIdentityMismatch):
+		return Report{Outcome: IdentityMismatch, Err: err}
+	case errors.Is(err, ErrSignerMismatch):
+		return Report{Outcome: SignerMismatch, Err: err}
+	case errors.Is(err, ErrSigningKeyMismatch):
+		return Report{Outcome: SigningKeyMismatch, Err: err}
+	case errors.Is(err, ErrWeakKey):
+		return Report{Outcome: WeakKey, Err: err}
+	case errors.Is(err, ErrWeakHash):
+		return Report{Outcome: WeakHash, Err: err}
+	case errors.Is(err, ErrSignatureTime):
+		return Report{Outcome: BadTime, Err: err}
+	case errors.Is(err, ErrNotAllowed):
+		return Report{Outcome: NotAllowed, Err: err}
+	}
+
+	return Report{Outcome: Failed, Err: err}
+}
+
+// OK is true when the signature is good.
+func (r Report) OK() bool {
+	return r.Outcome == Valid && r.Result != nil
+}
+
+// Fingerprint is the full fingerprint of the signing key, or empty if the
+// signature isn't good.
+func (r Report) Fingerprint() string {
+	if !r.OK() {
+		return ""
+	}
+
+	return fmt.Sprintf("%X", r.Result.Signer.PrimaryKey.Fingerprint)
+}
+
+// Identities lists the identities on the signing key, sorted, or nothing if
+// the signature isn't good.
+func (r Report) Identities() []string {
+	if !r.OK() {
+		return nil
+	}
+
+	identities := []string{}
+	for name := range r.Result.Signer.Identities {
+		identities = append(identities, name)
+	}
+	sort.Strings(identities)
+
+	return identities
+}
+
+// MarshalJSON encodes the Report for machines, as an object with valid,
+// outcome, signer (the fingerprint), signing_key (the id of the primary key or
+// subkey that signed), identities, and error.
+func (r Report) MarshalJSON() ([]byte, error) {
+	report := struct {
+		Valid      bool     `json:"valid"`
+		Outcome    string   `json:"outcome"`
+		Signer     string   `json:"signer"`
+		SigningKey string   `json:"signing_key"`
+		Identities []string `json:"identities"`
+		Error      string   `json:"error"`
+	}{
+		Valid:      r.OK(),
+		Outcome:    r.Outcome.String(),
+		Signer:     r.Fingerprint(),
+		Identities: r.Identities(),
+	}
+
+	if report.Identities == nil {
+		report.Identities = []string{}
+	}
+	if r.OK() {
+		report.SigningKey = r.Result.KeyID
+	}
+	if r.Err != nil {
+		report.Error = r.Err.Error()
+	}
+
+	return json.Marshal(report)
+}
+
+// String describes the Report for people: the signer and its identities for a
+// good signature, and the reason otherwise.
+func (r Report) String() string {
+	switch r.Outcome {
+	case Valid:
+		lines := []string{"Signature valid, signer " + r.Fingerprint()}
+		for _, identity := range r.Identities() {
+			lines = append(lines, "  "+identity)
+		}
+		return strings.Join(lines, "\n")
+	case NoMatchingKey:
+		return "No matching key: " + r.Err.Error()
+	case BadSignature, MalformedSignature, IdentityMismatch, SignerMismatch, SigningKeyMismatch, WeakKey, WeakHash:
+		// these errors already say what they are
+		return r.Err.Error()
+	}
+
+	return "Verification failed: " + r.Err.Error()
+}
@@ -0,0 +1,226 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package verify
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/crypto/openpgp"
+)
+
+type VerifierTest struct {
+	author *openpgp.Entity
+	other  *openpgp.Entity
+	suite.Suite
+}
+
+func (s *VerifierTest) SetupSuite() {
+	s.author = newTestEntity(s.T(), "Author", "author@example.com")
+	s.other = newTestEntity(s.T(), "Other", "other@example.com")
+}
+
+func (s *VerifierTest) TestCheckReportsValidSigner() {
+	sig := detachSign(s.T(), s.author, script)
+
+	report := NewVerifier(openpgp.EntityList{s.author}).Check(bytes.NewBufferString(script), bytes.NewReader(sig))
+
+	s.True(report.OK())
+	s.Equal(Valid, report.Outcome)
+	s.NoError(report.Err)
+	s.Equal(fmt.Sprintf("%X", s.author.PrimaryKey.Fingerprint), report.Fingerprint())
+	s.Equal([]string{"Author <author@example.com>"}, report.Identities())
+	s.Equal("Signature valid, signer "+report.Fingerprint()+"\n  Author <author@example.com>", report.String())
+}
+
+func (s *VerifierTest) TestCheckReportsFailures() {
+	verifier := NewVerifier(openpgp.EntityList{s.author})
+	good := detachSign(s.T(), s.author, script)
+
+	tests := []struct {
+		script    string
+		signature []byte
+		outcome   Outcome
+		prefix    string
+	}{
+		{script, detachSign(s.T(), s.other, script), NoMatchingKey, "No matching key: "},
+		{script + "rm -rf ~\n", good, BadSignature, "Bad signature: "},
+		{script, good[:len(good)/2], MalformedSignature, "Malformed signature: "},
+	}
+
+	for _, test := range tests {
+		report := verifier.Check(bytes.NewBufferString(test.script), bytes.NewReader(test.signature))
+
+		s.False(report.OK())
+		s.Equal(test.outcome, report.Outcome)
+		s.Error(report.Err)
+		s.Empty(report.Fingerprint())
+		s.Empty(report.Identities())
+		s.True(strings.HasPrefix(report.String(), test.prefix), report.String())
+	}
+}
+
+func (s *VerifierTest) TestVerifyRequiresEmail() {
+	sig := detachSign(s.T(), s.author, script)
+	verifier := NewVerifier(openpgp.EntityList{s.author})
+
+	verifier.RequireEmail = " AUTHOR@example.com"
+	result, err := verifier.Verify(bytes.NewBufferString(script), bytes.NewReader(sig))
+	s.NoError(err)
+	s.NotNil(result)
+
+	// a good signature, but not from the author anyone was expecting
+	verifier.RequireEmail = "other@example.com"
+	_, err = verifier.Verify(bytes.NewBufferString(script), bytes.NewReader(sig))
+	s.True(errors.Is(err, ErrIdentityMismatch), err)
+
+	report := verifier.Check(bytes.NewBufferString(script), bytes.NewReader(sig))
+	s.False(report.OK())
+	s.Equal(IdentityMismatch, report.Outcome)
+	s.Equal("Signing key doesn't have the required identity: other@example.com", report.String())
+}
+
+func (s *VerifierTest) TestVerifyLogsOutcome() {
+	var buf bytes.Buffer
+	sig := detachSign(s.T(), s.author, script)
+	verifier := NewVerifier(openpgp.EntityList{s.author})
+	verifier.Logger = log.New(&buf, "", 0)
+
+	_, err := verifier.Verify(bytes.NewBufferString(script), bytes.NewReader(sig))
+	s.NoError(err)
+	s.Contains(buf.String(), "checking signature against 1 keys")
+	s.Contains(buf.String(), fmt.Sprintf("signature verified by %X", s.author.PrimaryKey.Fingerprint))
+
+	buf.Reset()
+	_, err = verifier.Verify(bytes.NewBufferString(script+"echo extra\n"), bytes.NewReader(sig))
+	s.Error(err)
+	s.Contains(buf.String(), "signature check failed: Bad signature")
+}
+
+func (s *VerifierTest) TestRequiredSignerRejectsOtherKeys() {
+	verifier := NewVerifier(openpgp.EntityList{s.author, s.other})
+	verifier.RequireSigner = strings.ToLower(fmt.Sprintf("%X", s.author.PrimaryKey.Fingerprint))
+
+	report := verifier.Check(bytes.NewBufferString(script), bytes.NewReader(detachSign(s.T(), s.author, script)))
+	s.True(report.OK(), report.String())
+
+	report = verifier.Check(bytes.NewBufferString(script), bytes.NewReader(detachSign(s.T(), s.other, script)))
+	s.Equal(SignerMismatch, report.Outcome)
+	s.True(errors.Is(report.Err, ErrSignerMismatch), report.Err)
+	s.Empty(report.Fingerprint())
+}
+
+// testdata/rotated.gpg has a certify-only primary key and two signing
+// subkeys, and testdata/script.sh.first-subkey.sig and
+// testdata/script.sh.second-subkey.sig are signed by each of them
+const (
+	rotatedPrimary = "0207E8E47AB7AB59C711BE6F9B5368D3BCE5CA3C"
+	rotatedFirst   = "DC572196A54FF5E45DD657827C91929BB6E200E7"
+	rotatedSecond  = "8E3E33CA853CA5635C4FEE5524C6DD727060CED4"
+)
+
+func (s *VerifierTest) checkRotated(subkey, required string) Report {
+	script, _ := os.Open("testdata/script.sh")
+	defer script.Close()
+	sig, _ := os.Open("testdata/script.sh." + subkey + "-subkey.sig")
+	defer sig.Close()
+
+	verifier := NewVerifier(readTestRing(s.T(), "testdata/rotated.gpg"))
+	verifier.RequireSigningKey = required
+
+	return verifier.Check(script, sig)
+}
+
+func (s *VerifierTest) TestRequiredSigningKeyAccepts() {
+	report := s.checkRotated("first", rotatedFirst)
+	s.Require().True(report.OK(), report.String())
+	s.Equal(rotatedPrimary, report.Fingerprint())
+	s.Equal(rotatedFirst, fmt.Sprintf("%X", report.Result.SignedBy.PublicKey.Fingerprint))
+
+	// spaced out and lowercase, the way people copy them
+	report = s.checkRotated("second", "8e3e 33ca 853c a563 5c4f  ee55 24c6 dd72 7060 ced4")
+	s.True(report.OK(), report.String())
+}
+
+func (s *VerifierTest) TestRequiredSigningKeyRejectsOtherKeys() {
+	// both signatures are good without the requirement
+	s.True(s.checkRotated("first", "").OK())
+	s.True(s.checkRotated("second", "").OK())
+
+	for _, test := range []struct{ subkey, required string }{
+		{"first", rotatedSecond},
+		{"second", rotatedFirst},
+		{"first", rotatedPrimary},
+	} {
+		report := s.checkRotated(test.subkey, test.required)
+
+		s.Equal(SigningKeyMismatch, report.Outcome, test.subkey)
+		s.True(errors.Is(report.Err, ErrSigningKeyMismatch), report.Err)
+		s.Contains(report.String(), "wanted "+test.required)
+	}
+}
+
+func (s *VerifierTest) TestParseSigningKey() {
+	fingerprint, err := ParseSigningKey("0x" + strings.ToLower(rotatedFirst))
+	s.NoError(err)
+	s.Equal(rotatedFirst, fingerprint)
+
+	for _, bad := range []string{"7C91929BB6E200E7", "not a fingerprint", rotatedFirst + "00"} {
+		_, err := ParseSigningKey(bad)
+		s.Error(err, bad)
+	}
+}
+
+func (s *VerifierTest) TestReportDescribesOtherFailures() {
+	report := Report{Outcome: Failed, Err: errors.New("Disk on fire")}
+
+	s.False(report.OK())
+	s.Equal("Verification failed: Disk on fire", report.String())
+}
+
+func (s *VerifierTest) TestReportMarshalsToGoldenJSON() {
+	ring := readTestRing(s.T(), "testdata/subkey.gpg")
+	script, _ := os.Open("testdata/script.sh")
+	defer script.Close()
+	sig, _ := os.Open("testdata/script.sh.sig")
+	defer sig.Close()
+
+	report := NewVerifier(ring).Check(script, sig)
+	actual, err := json.MarshalIndent(report, "", "  ")
+	s.Require().NoError(err)
+
+	expected, err := ioutil.ReadFile("testdata/report.golden.json")
+	s.Require().NoError(err)
+	s.JSONEq(string(expected), string(actual))
+}
+
+func (s *VerifierTest) TestReportMarshalsFailures() {
+	report := Report{Outcome: BadSignature, Err: errors.New("Bad signature: nope")}
+
+	actual, err := json.Marshal(report)
+
+	s.NoError(err)
+	s.JSONEq(`{
+		"valid": false, "outcome": "bad_signature", "signer": "",
+		"signing_key": "", "identities": [], "error": "Bad signature: nope"
+	}`, string(actual))
+}
+
+func TestVerifierTest(t *testing.T) {
+	suite.Run(t, new(VerifierTest))
+}
@@ -0,0 +1,290 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+// Package verify checks scripts against their authors' PGP signatures.
+package verify
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/ellotheth/pipethis/lookup"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/clearsign"
+	pgperrors "golang.org/x/crypto/openpgp/errors"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+var (
+	// ErrBadSignature means the signature doesn't match the script (or the
+	// key it claims to be from).
+	ErrBadSignature = errors.New("Bad signature")
+
+	// ErrUnknownSigner means the signature was made by a key that isn't in
+	// the key ring.
+	ErrUnknownSigner = errors.New("Signature made by an unknown key")
+
+	// ErrMalformedSignature means the signature couldn't be parsed at all.
+	ErrMalformedSignature = errors.New("Malformed signature")
+)
+
+// VerificationResult describes a good signature: the key that made it, and
+// which part of that key did the signing.
+type VerificationResult struct {
+	// Signer is the whole key (primary key, identities, and subkeys) that
+	// made the signature.
+	Signer *openpgp.Entity
+
+	// KeyID is the id of the primary key or subkey that made the signature.
+	KeyID string
+
+	// SignedBy is the primary key or subkey that made the signature, like
+	// openpgp.MessageDetails.SignedBy.
+	SignedBy *openpgp.Key
+
+	// Subkey is true when the signature was made by one of Signer's subkeys
+	// instead of the primary key.
+	Subkey bool
+
+	// Created is when the signature says it was made.
+	Created time.Time
+
+	// Hash is the hash algorithm the signature was made with.
+	Hash crypto.Hash
+
+	// Cached is true when the signature wasn't checked again, because the
+	// Verifier's VerificationCache already had the script verified with the
+	// same key.
+	Cached bool
+
+	// Warnings are the problems the Verifier was told to let slide, like a
+	// signature dated in the future under a TimePolicy with WarnOnly set.
+	Warnings []string
+}
+
+// Verify checks the detached signature against script and the keys in ring,
+// and returns the key that made the signature, so the caller can make sure
+// it's the author they were expecting. The signature can be binary or
+// ASCII-armored. The errors wrap ErrBadSignature, ErrUnknownSigner, or
+// ErrMalformedSignature, depending on what went wrong.
+func Verify(script io.Reader, signature io.Reader, ring openpgp.EntityList) (*VerificationResult, error) {
+	signature, err := dearmor(signature)
+	if err != nil {
+		return nil, err
+	}
+
+	// hang on to the signature, so we can dig the issuer out of it later
+	raw, err := ioutil.ReadAll(signature)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := openpgp.CheckDetachedSignature(ring, script, bytes.NewReader(raw))
+	if err != nil {
+		return nil, classify(err)
+	}
+
+	return newResult(signer, raw)
+}
+
+// VerifyWithUser checks the detached signature against script like Verify,
+// but only with user's own key, fetched from service. Whatever other keys
+// service hands back along with it (Keybase, say, gives every key the user has)
+// don't count, so the signature has to be made by exactly the key that was
+// chosen, not just one that happened to be in the same ring. If it wasn't,
+// the error wraps ErrUnknownSigner.
+func VerifyWithUser(ctx context.Context, script io.Reader, signature io.Reader, service lookup.KeyService, user lookup.User) (*VerificationResult, error) {
+	ring, err := service.Key(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	fingerprint := lookup.NormalizeFingerprint(user.Fingerprint)
+	var key *openpgp.Entity
+	for _, candidate := range ring {
+		if fmt.Sprintf("%X", candidate.PrimaryKey.Fingerprint) == fingerprint {
+			key = candidate
+			break
+		}
+	}
+	if key == nil {
+		return nil, fmt.Errorf("%w: wanted %s", lookup.ErrFingerprintMismatch, user.Fingerprint)
+	}
+
+	return Verify(script, signature, openpgp.EntityList{key})
+}
+
+// issuerKeyID is the id of the key that made the first signature in raw.
+func issuerKeyID(raw []byte) (uint64, error) {
+	details, err := signatureDetails(raw)
+
+	return details.issuer, err
+}
+
+// sigDetails is what newResult needs from the signature packet itself.
+type sigDetails struct {
+	issuer  uint64
+	created time.Time
+	hash    crypto.Hash
+}
+
+// signatureDetails is the id of the key that made the first signature in raw,
+// when the signature says it was made, and the hash it was made with.
+func signatureDetails(raw []byte) (sigDetails, error) {
+	packets := packet.NewReader(bytes.NewReader(raw))
+	for {
+		p, err := packets.Next()
+		if err != nil {
+			return sigDetails{}, classify(err)
+		}
+
+		if sig, ok := p.(*packet.Signature); ok && sig.IssuerKeyId != nil {
+			return sigDetails{issuer: *sig.IssuerKeyId, created: sig.CreationTime, hash: sig.Hash}, nil
+		}
+		if sig, ok := p.(*packet.SignatureV3); ok {
+			return sigDetails{issuer: sig.IssuerKeyId, created: sig.CreationTime, hash: sig.Hash}, nil
+		}
+	}
+}
+
+// newResult figures out which of signer's keys made the signature in raw.
+func newResult(signer *openpgp.Entity, raw []byte) (*VerificationResult, error) {
+	details, err := signatureDetails(raw)
+	if err != nil {
+		return nil, err
+	}
+	issuer := details.issuer
+
+	result := &VerificationResult{Signer: signer, Created: details.created, Hash: details.hash}
+
+	if signer.PrimaryKey.KeyId == issuer {
+		if !primaryCanSign(signer) {
+			return nil, fmt.Errorf("%w: key %X isn't allowed to make signatures", ErrUnknownSigner, issuer)
+		}
+		result.KeyID = signer.PrimaryKey.KeyIdString()
+		result.SignedBy = &openpgp.Key{Entity: signer, PublicKey: signer.PrimaryKey, PrivateKey: signer.PrivateKey}
+		for _, identity := range signer.Identities {
+			if allowsSigning(identity.SelfSignature) {
+				result.SignedBy.SelfSignature = identity.SelfSignature
+				break
+			}
+		}
+		return result, nil
+	}
+
+	for _, subkey := range signer.Subkeys {
+		if subkey.PublicKey.KeyId == issuer {
+			if !allowsSigning(subkey.Sig) {
+				return nil, fmt.Errorf("%w: key %X isn't allowed to make signatures", ErrUnknownSigner, issuer)
+			}
+			result.KeyID = subkey.PublicKey.KeyIdString()
+			result.SignedBy = &openpgp.Key{Entity: signer, PublicKey: subkey.PublicKey, PrivateKey: subkey.PrivateKey, SelfSignature: subkey.Sig}
+			result.Subkey = true
+			return result, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: can't find key %X in the signing key", ErrUnknownSigner, issuer)
+}
+
+// allowsSigning is true unless sig has key flags that leave out signing.
+// openpgp.CheckDetachedSignature checks this too, but the result shouldn't
+// depend on that.
+func allowsSigning(sig *packet.Signature) bool {
+	return sig != nil && (!sig.FlagsValid || sig.FlagSign)
+}
+
+// primaryCanSign is true when one of key's identities lets the primary key
+// make signatures.
+func primaryCanSign(key *openpgp.Entity) bool {
+	for _, identity := range key.Identities {
+		if allowsSigning(identity.SelfSignature) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// dearmor strips the ASCII armor off signature, if it's there. Anything else
+// is assumed to be a binary signature.
+func dearmor(signature io.Reader) (io.Reader, error) {
+	buffered := bufio.NewReader(signature)
+
+	head, _ := buffered.Peek(64)
+	if !bytes.HasPrefix(bytes.TrimSpace(head), []byte("-----BEGIN PGP")) {
+		return buffered, nil
+	}
+
+	block, err := armor.Decode(buffered)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedSignature, err)
+	}
+	if block.Type != openpgp.SignatureType {
+		return nil, fmt.Errorf("%w: expected a %s block, found %s", ErrMalformedSignature, openpgp.SignatureType, block.Type)
+	}
+
+	return block.Body, nil
+}
+
+// VerifyClearsigned splits a clearsigned script into the script and its
+// signature, and checks the signature against the script and the keys in ring.
+// It returns the script exactly as it was signed (so that's what gets run) and
+// the details of the key that signed it. If there's anything but whitespace
+// after the signed block, VerifyClearsigned fails, since that's text nobody
+// signed.
+func VerifyClearsigned(r io.Reader, ring openpgp.EntityList) ([]byte, *VerificationResult, error) {
+	contents, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	block, rest := clearsign.Decode(contents)
+	if block == nil {
+		return nil, nil, fmt.Errorf("%w: no clearsigned block found", ErrMalformedSignature)
+	}
+	if len(bytes.TrimSpace(rest)) > 0 {
+		return nil, nil, errors.New("Found unsigned data after the clearsigned block")
+	}
+
+	result, err := Verify(bytes.NewReader(block.Bytes), block.ArmoredSignature.Body, ring)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return block.Plaintext, result, nil
+}
+
+// classify wraps an openpgp error with the matching verify error.
+func classify(err error) error {
+	switch err.(type) {
+	case pgperrors.SignatureError:
+		return fmt.Errorf("%w: %v", ErrBadSignature, err)
+	case pgperrors.StructuralError, pgperrors.UnsupportedError:
+		return fmt.Errorf("%w: %v", ErrMalformedSignature, err)
+	}
+
+	if err == pgperrors.ErrUnknownIssuer {
+		return fmt.Errorf("%w: %v", ErrUnknownSigner, err)
+	}
+
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%w: %v", ErrMalformedSignature, err)
+	}
+
+	return err
+}
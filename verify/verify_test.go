@@ -0,0 +1,292 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package verify
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/ellotheth/pipethis/lookup"
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/clearsign"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+const script = "#!/bin/sh\n# PIPETHIS_AUTHOR test\necho hello\n"
+
+type VerifyTest struct {
+	author *openpgp.Entity
+	other  *openpgp.Entity
+	suite.Suite
+}
+
+func (s *VerifyTest) SetupSuite() {
+	s.author = newTestEntity(s.T(), "Author", "author@example.com")
+	s.other = newTestEntity(s.T(), "Other", "other@example.com")
+}
+
+func (s *VerifyTest) TestVerifyReturnsSigner() {
+	sig := detachSign(s.T(), s.author, script)
+
+	result, err := Verify(bytes.NewBufferString(script), bytes.NewReader(sig), openpgp.EntityList{s.other, s.author})
+
+	s.NoError(err)
+	s.Equal(s.author.PrimaryKey.Fingerprint, result.Signer.PrimaryKey.Fingerprint)
+	s.Equal(s.author.PrimaryKey.KeyIdString(), result.KeyID)
+	s.False(result.Subkey)
+}
+
+func (s *VerifyTest) TestVerifyReportsSigningSubkey() {
+	ring := readTestRing(s.T(), "testdata/subkey.gpg")
+	script, _ := os.Open("testdata/script.sh")
+	defer script.Close()
+	sig, _ := os.Open("testdata/script.sh.sig")
+	defer sig.Close()
+
+	result, err := Verify(script, sig, ring)
+
+	s.NoError(err)
+	s.Equal("FB5834CFAE27B7CF", result.Signer.PrimaryKey.KeyIdString())
+	s.Equal("6523F848D72D24A1", result.KeyID)
+	s.True(result.Subkey)
+}
+
+func (s *VerifyTest) TestVerifyFailsWhenKeyCannotSign() {
+	encryptOnly := newTestEntity(s.T(), "Encrypt Only", "encrypt@example.com")
+	sig := detachSign(s.T(), encryptOnly, script)
+
+	// take the signing flag away after the fact
+	for _, identity := range encryptOnly.Identities {
+		identity.SelfSignature.FlagSign = false
+	}
+
+	_, err := Verify(bytes.NewBufferString(script), bytes.NewReader(sig), openpgp.EntityList{encryptOnly})
+	s.True(errors.Is(err, ErrUnknownSigner), err)
+
+	_, err = newResult(encryptOnly, sig)
+	s.True(errors.Is(err, ErrUnknownSigner), err)
+}
+
+func (s *VerifyTest) TestVerifyFailsWithTamperedScript() {
+	sig := detachSign(s.T(), s.author, script)
+
+	_, err := Verify(bytes.NewBufferString(script+"rm -rf ~\n"), bytes.NewReader(sig), openpgp.EntityList{s.author})
+
+	s.True(errors.Is(err, ErrBadSignature), err.Error())
+}
+
+func (s *VerifyTest) TestVerifyFailsWithUnknownSigner() {
+	sig := detachSign(s.T(), s.other, script)
+
+	_, err := Verify(bytes.NewBufferString(script), bytes.NewReader(sig), openpgp.EntityList{s.author})
+
+	s.True(errors.Is(err, ErrUnknownSigner), err.Error())
+}
+
+func (s *VerifyTest) TestVerifyFailsWithMalformedSignature() {
+	sig := detachSign(s.T(), s.author, script)
+
+	_, err := Verify(bytes.NewBufferString(script), bytes.NewReader(sig[:len(sig)/2]), openpgp.EntityList{s.author})
+	s.True(errors.Is(err, ErrMalformedSignature), err.Error())
+
+	_, err = Verify(bytes.NewBufferString(script), bytes.NewBufferString("definitely not a signature"), openpgp.EntityList{s.author})
+	s.True(errors.Is(err, ErrMalformedSignature), err.Error())
+}
+
+func (s *VerifyTest) TestVerifyAcceptsBinaryAndArmoredSignatures() {
+	sig := detachSign(s.T(), s.author, script)
+
+	for _, signature := range [][]byte{sig, armorSignature(s.T(), sig)} {
+		result, err := Verify(bytes.NewBufferString(script), bytes.NewReader(signature), openpgp.EntityList{s.author})
+
+		s.NoError(err)
+		s.Equal(s.author.PrimaryKey.Fingerprint, result.Signer.PrimaryKey.Fingerprint)
+	}
+}
+
+func (s *VerifyTest) TestVerifyFailsWithTamperedScriptAndArmoredSignature() {
+	sig := armorSignature(s.T(), detachSign(s.T(), s.author, script))
+
+	_, err := Verify(bytes.NewBufferString(script+"rm -rf ~\n"), bytes.NewReader(sig), openpgp.EntityList{s.author})
+
+	s.True(errors.Is(err, ErrBadSignature), err.Error())
+}
+
+func (s *VerifyTest) TestVerifyRejectsOtherArmoredBlocks() {
+	key := &bytes.Buffer{}
+	w, _ := armor.Encode(key, openpgp.PublicKeyType, nil)
+	s.author.Serialize(w)
+	w.Close()
+
+	_, err := Verify(bytes.NewBufferString(script), key, openpgp.EntityList{s.author})
+
+	s.True(errors.Is(err, ErrMalformedSignature), err.Error())
+	s.Contains(err.Error(), openpgp.PublicKeyType)
+}
+
+func (s *VerifyTest) TestVerifyClearsignedReturnsScriptAndSigner() {
+	signed := clearSign(s.T(), s.author, script)
+
+	body, result, err := VerifyClearsigned(bytes.NewReader(signed), openpgp.EntityList{s.author})
+
+	s.NoError(err)
+	s.Equal(script, string(body))
+	s.Equal(s.author.PrimaryKey.Fingerprint, result.Signer.PrimaryKey.Fingerprint)
+}
+
+func (s *VerifyTest) TestVerifyClearsignedFailsWithEditedScript() {
+	signed := clearSign(s.T(), s.author, script)
+	edited := bytes.Replace(signed, []byte("echo hello"), []byte("echo pwned"), 1)
+
+	_, _, err := VerifyClearsigned(bytes.NewReader(edited), openpgp.EntityList{s.author})
+
+	s.True(errors.Is(err, ErrBadSignature), err.Error())
+}
+
+func (s *VerifyTest) TestVerifyClearsignedFailsWithTrailingData() {
+	signed := clearSign(s.T(), s.author, script)
+
+	_, _, err := VerifyClearsigned(bytes.NewReader(append(signed, []byte("\n\nrm -rf ~\n")...)), openpgp.EntityList{s.author})
+	s.Error(err)
+
+	// whitespace is fine
+	_, _, err = VerifyClearsigned(bytes.NewReader(append(signed, []byte("\n\n")...)), openpgp.EntityList{s.author})
+	s.NoError(err)
+}
+
+func (s *VerifyTest) TestVerifyClearsignedFailsWithoutSignature() {
+	_, _, err := VerifyClearsigned(bytes.NewBufferString(script), openpgp.EntityList{s.author})
+
+	s.True(errors.Is(err, ErrMalformedSignature))
+}
+
+// wholeRingService hands back its whole ring for every user, like Keybase
+// does with all of a user's keys.
+type wholeRingService struct {
+	ring openpgp.EntityList
+}
+
+func (w wholeRingService) Matches(ctx context.Context, query string) ([]lookup.User, error) {
+	return nil, lookup.ErrNoMatches
+}
+
+func (w wholeRingService) Key(ctx context.Context, user lookup.User) (openpgp.EntityList, error) {
+	return w.ring, nil
+}
+
+func (s *VerifyTest) TestVerifyWithUserBindsToTheChosenKey() {
+	impostor := newTestEntity(s.T(), "Author", "author@example.com")
+	service := wholeRingService{ring: openpgp.EntityList{impostor, s.author}}
+	user := lookup.User{Fingerprint: fmt.Sprintf("%x", s.author.PrimaryKey.Fingerprint)}
+
+	result, err := VerifyWithUser(context.Background(), bytes.NewBufferString(script), bytes.NewReader(detachSign(s.T(), s.author, script)), service, user)
+	s.Require().NoError(err)
+	s.Equal(s.author, result.Signer)
+
+	// the whole ring would take the impostor's word for it, but the chosen
+	// user doesn't
+	forged := detachSign(s.T(), impostor, script)
+	_, err = Verify(bytes.NewBufferString(script), bytes.NewReader(forged), service.ring)
+	s.Require().NoError(err)
+
+	_, err = VerifyWithUser(context.Background(), bytes.NewBufferString(script), bytes.NewReader(forged), service, user)
+	s.True(errors.Is(err, ErrUnknownSigner), err)
+}
+
+func (s *VerifyTest) TestVerifyWithUserNeedsTheUsersKey() {
+	service := wholeRingService{ring: openpgp.EntityList{s.other}}
+	user := lookup.User{Fingerprint: fmt.Sprintf("%X", s.author.PrimaryKey.Fingerprint)}
+
+	_, err := VerifyWithUser(context.Background(), bytes.NewBufferString(script), bytes.NewReader(detachSign(s.T(), s.author, script)), service, user)
+	s.True(errors.Is(err, lookup.ErrFingerprintMismatch), err)
+}
+
+func (s *VerifyTest) TestVerifyWithUserRefusesRevokedKeys() {
+	revoked := newTestEntity(s.T(), "Revoked", "revoked@example.com")
+	revoked.Revocations = append(revoked.Revocations, &packet.Signature{SigType: packet.SigTypeKeyRevocation})
+	user := lookup.User{Fingerprint: fmt.Sprintf("%X", revoked.PrimaryKey.Fingerprint)}
+
+	_, err := VerifyWithUser(context.Background(), bytes.NewBufferString(script), bytes.NewReader(detachSign(s.T(), revoked, script)), lookup.NewMemoryService(openpgp.EntityList{revoked}), user)
+	s.True(errors.Is(err, lookup.ErrKeyRevoked), err)
+}
+
+func TestVerifyTest(t *testing.T) {
+	suite.Run(t, new(VerifyTest))
+}
+
+// newTestEntity generates a small throwaway key for a single identity.
+func newTestEntity(t *testing.T, name, email string) *openpgp.Entity {
+	entity, err := openpgp.NewEntity(name, "", email, &packet.Config{RSABits: 1024})
+	if err != nil {
+		t.Fatal("Failed generating the test key:", err)
+	}
+
+	return entity
+}
+
+// readTestRing loads a binary keyring fixture.
+func readTestRing(t *testing.T, filename string) openpgp.EntityList {
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal("Failed opening the test keyring:", err)
+	}
+	defer f.Close()
+
+	ring, err := openpgp.ReadKeyRing(f)
+	if err != nil {
+		t.Fatal("Failed reading the test keyring:", err)
+	}
+
+	return ring
+}
+
+// detachSign makes a binary detached signature for contents.
+func detachSign(t *testing.T, signer *openpgp.Entity, contents string) []byte {
+	sig := &bytes.Buffer{}
+	if err := openpgp.DetachSign(sig, signer, bytes.NewBufferString(contents), nil); err != nil {
+		t.Fatal("Failed signing the test script:", err)
+	}
+
+	return sig.Bytes()
+}
+
+// armorSignature wraps a binary signature in ASCII armor.
+func armorSignature(t *testing.T, sig []byte) []byte {
+	armored := &bytes.Buffer{}
+
+	w, err := armor.Encode(armored, openpgp.SignatureType, nil)
+	if err != nil {
+		t.Fatal("Failed armoring the test signature:", err)
+	}
+	w.Write(sig)
+	w.Close()
+
+	return armored.Bytes()
+}
+
+// clearSign wraps contents in a clearsigned block.
+func clearSign(t *testing.T, signer *openpgp.Entity, contents string) []byte {
+	signed := &bytes.Buffer{}
+
+	w, err := clearsign.Encode(signed, signer.PrivateKey, nil)
+	if err != nil {
+		t.Fatal("Failed signing the test script:", err)
+	}
+	w.Write([]byte(contents))
+	w.Close()
+
+	return signed.Bytes()
+}